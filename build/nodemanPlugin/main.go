@@ -24,6 +24,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	sfs "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/sf-share"
 	"github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/version"
@@ -38,6 +39,7 @@ import (
 	"github.com/TencentBlueKing/bscp-go/internal/config"
 	"github.com/TencentBlueKing/bscp-go/pkg/logger"
 	"github.com/TencentBlueKing/bscp-go/pkg/metrics"
+	"github.com/TencentBlueKing/bscp-go/pkg/source"
 )
 
 const (
@@ -153,14 +155,45 @@ func Watch(cmd *cobra.Command, args []string) error {
 		client.WithLabels(conf.Labels),
 		client.WithUID(conf.UID),
 		client.WithP2PDownload(conf.EnableP2PDownload),
+		client.WithP2PDownloadSettings(client.P2PDownloadSettings{
+			Threshold:    conf.P2PDownload.Threshold,
+			PollInterval: time.Duration(conf.P2PDownload.PollIntervalSeconds) * time.Second,
+			Timeout:      time.Duration(conf.P2PDownload.TimeoutSeconds) * time.Second,
+			StagingDir:   conf.P2PDownload.StagingDir,
+		}),
 		client.WithBkAgentID(conf.BkAgentID),
 		client.WithFileCache(client.FileCache{
-			Enabled:     conf.FileCache.Enabled,
-			CacheDir:    conf.FileCache.CacheDir,
-			ThresholdGB: conf.FileCache.ThresholdGB,
+			Enabled:        conf.FileCache.Enabled,
+			CacheDir:       conf.FileCache.CacheDir,
+			ThresholdGB:    conf.FileCache.ThresholdGB,
+			EvictionPolicy: conf.FileCache.EvictionPolicy,
+			Scrub:          fileCacheScrub(conf.FileCache.Scrub),
+			Prewarm:        fileCachePrewarm(conf.FileCache.Prewarm),
 		}),
 		client.WithEnableMonitorResourceUsage(conf.EnableMonitorResourceUsage),
 		client.WithTextLineBreak(conf.TextLineBreak),
+		client.WithVersionedDir(client.VersionedDir{
+			Enabled:        conf.VersionedDir.Enabled,
+			RetainReleases: conf.VersionedDir.RetainReleases,
+		}),
+		client.WithFileDeletion(client.FileDeletion{
+			NeverDelete: conf.FileDeletion.NeverDelete,
+			Ignore:      conf.FileDeletion.Ignore,
+		}),
+		client.WithAutoRollback(conf.AutoRollback),
+		client.WithBandwidthLimit(conf.Download.BandwidthLimit),
+		client.WithDownloadPriority(client.DownloadPriority{
+			Enabled:       conf.Download.PriorityEnabled,
+			SmallFileSize: conf.Download.SmallFileSize,
+		}),
+		client.WithSources(contentSources(conf.Sources)...),
+		client.WithSharedStore(client.SharedStore{
+			Enabled: conf.SharedStore.Enabled,
+			Dir:     conf.SharedStore.Dir,
+		}),
+		client.WithHTTPTransport(httpTransport(conf.HTTPTransport)),
+		client.WithFileDownloadTimeout(time.Duration(conf.Download.FileTimeoutSeconds)*time.Second),
+		client.WithRangePartSize(conf.Download.RangePartSize),
 	)
 	if err != nil {
 		logger.Error("init client", logger.ErrAttr(err))
@@ -169,15 +202,18 @@ func Watch(cmd *cobra.Command, args []string) error {
 
 	for _, subscriber := range conf.Apps {
 		handler := &WatchHandler{
-			Biz:           conf.Biz,
-			App:           subscriber.Name,
-			Labels:        subscriber.Labels,
-			UID:           subscriber.UID,
-			ConfigMatches: subscriber.ConfigMatches,
-			Lock:          sync.Mutex{},
-			TempDir:       conf.TempDir,
-			AppTempDir:    filepath.Join(conf.TempDir, strconv.Itoa(int(conf.Biz)), subscriber.Name),
-			bscp:          bscp,
+			Biz:            conf.Biz,
+			App:            subscriber.Name,
+			Labels:         subscriber.Labels,
+			UID:            subscriber.UID,
+			ConfigMatches:  subscriber.ConfigMatches,
+			AutoRollback:   subscriber.AutoRollback,
+			PathMappings:   subscriber.PathMappings,
+			BandwidthLimit: subscriber.BandwidthLimit,
+			Lock:           sync.Mutex{},
+			TempDir:        conf.TempDir,
+			AppTempDir:     filepath.Join(conf.TempDir, strconv.Itoa(int(conf.Biz)), subscriber.Name),
+			bscp:           bscp,
 		}
 		if e := bscp.AddWatcher(
 			handler.watchCallback, handler.App, handler.getSubscribeOptions()...); e != nil {
@@ -280,6 +316,12 @@ type WatchHandler struct {
 	UID string
 	// ConfigMatches app config item's match conditions
 	ConfigMatches []string
+	// AutoRollback overwrites the global auto rollback config for the app if set
+	AutoRollback *bool
+	// PathMappings rules to map the config items to the target paths on the host
+	PathMappings []*config.PathMappingConfig
+	// BandwidthLimit download bandwidth limit of the app in bytes per second
+	BandwidthLimit int64
 	// TempDir bscp temporary directory
 	TempDir string
 	// AppTempDir app temporary directory
@@ -311,9 +353,83 @@ func (w *WatchHandler) getSubscribeOptions() []client.AppOption {
 	options = append(options, client.WithAppLabels(w.Labels))
 	options = append(options, client.WithAppUID(w.UID))
 	options = append(options, client.WithAppConfigMatch(w.ConfigMatches))
+	if w.AutoRollback != nil {
+		options = append(options, client.WithAppAutoRollback(*w.AutoRollback))
+	}
+	if len(w.PathMappings) > 0 {
+		options = append(options, client.WithAppPathMappings(pathMappings(w.PathMappings)))
+	}
+	if w.BandwidthLimit > 0 {
+		options = append(options, client.WithAppBandwidthLimit(w.BandwidthLimit))
+	}
 	return options
 }
 
+// pathMappings converts the path mapping configs to the client path mappings
+func pathMappings(cfgs []*config.PathMappingConfig) []client.PathMapping {
+	mappings := make([]client.PathMapping, 0, len(cfgs))
+	for _, c := range cfgs {
+		mappings = append(mappings, client.PathMapping{
+			Match:     c.Match,
+			Target:    c.Target,
+			User:      c.User,
+			UserGroup: c.UserGroup,
+			Privilege: c.Privilege,
+		})
+	}
+	return mappings
+}
+
+// contentSources converts the source configs to the content sources
+func contentSources(cfgs []*config.SourceConfig) []source.Source {
+	sources := make([]source.Source, 0, len(cfgs))
+	for _, c := range cfgs {
+		switch c.Type {
+		case config.SourceTypeLocal:
+			sources = append(sources, source.NewLocalDir(c.Path))
+		case config.SourceTypeHTTP:
+			sources = append(sources, source.NewHTTP(c.URL,
+				&http.Client{Timeout: time.Duration(c.TimeoutSeconds) * time.Second}))
+		}
+	}
+	return sources
+}
+
+// httpTransport converts the http transport config to the client http transport option
+func httpTransport(c *config.HTTPTransportConfig) client.HTTPTransport {
+	return client.HTTPTransport{
+		DialTimeout:           time.Duration(c.DialTimeoutSeconds) * time.Second,
+		TLSHandshakeTimeout:   time.Duration(c.TLSHandshakeTimeoutSeconds) * time.Second,
+		ResponseHeaderTimeout: time.Duration(c.ResponseHeaderTimeoutSeconds) * time.Second,
+		IdleConnTimeout:       time.Duration(c.IdleConnTimeoutSeconds) * time.Second,
+		MaxIdleConns:          c.MaxIdleConns,
+		MaxIdleConnsPerHost:   c.MaxIdleConnsPerHost,
+		ProxyURL:              c.ProxyURL,
+		EnableHTTP2:           c.EnableHTTP2,
+		CAFile:                c.CAFile,
+	}
+}
+
+// fileCacheScrub converts the file cache scrub config to the client file cache scrub option
+func fileCacheScrub(c *config.FileCacheScrubConfig) client.FileCacheScrub {
+	return client.FileCacheScrub{
+		Enabled:     c.Enabled,
+		Interval:    time.Duration(c.IntervalSeconds) * time.Second,
+		Rate:        c.Rate,
+		VerifiedTTL: time.Duration(c.VerifiedTTLSeconds) * time.Second,
+		Quarantine:  c.Quarantine,
+	}
+}
+
+// fileCachePrewarm converts the file cache prewarm config to the client file cache prewarm option
+func fileCachePrewarm(c *config.FileCachePrewarmConfig) client.FileCachePrewarm {
+	return client.FileCachePrewarm{
+		Enabled:      c.Enabled,
+		DelayApply:   c.DelayApply,
+		DelayTimeout: time.Duration(c.DelayTimeoutSeconds) * time.Second,
+	}
+}
+
 func init() {
 	cobra.OnInitialize(func() {
 		cobra.CheckErr(initConf(watchViper))
@@ -34,9 +34,11 @@ import (
 
 	"github.com/TencentBlueKing/bscp-go/internal/cache"
 	"github.com/TencentBlueKing/bscp-go/internal/downloader"
+	"github.com/TencentBlueKing/bscp-go/internal/tracing"
 	"github.com/TencentBlueKing/bscp-go/internal/upstream"
 	"github.com/TencentBlueKing/bscp-go/internal/util"
 	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+	"github.com/TencentBlueKing/bscp-go/pkg/metrics"
 )
 
 // Client bscp client method
@@ -45,10 +47,15 @@ type Client interface {
 	ListApps(match []string) ([]*pbfs.App, error)
 	// PullFiles pull files from remote
 	PullFiles(app string, opts ...AppOption) (*Release, error)
+	// NewRelease returns a release of the app without pulling from remote, which is used to operate the
+	// releases applied locally, eg: rollback
+	NewRelease(app string, opts ...AppOption) *Release
 	// PullKvs pull KV release from remote
 	PullKvs(app string, match []string, opts ...AppOption) (*Release, error)
 	// Get gets Key Value from remote
 	Get(app string, key string, opts ...AppOption) (string, error)
+	// GetWithMeta gets Key Value with its release, source and staleness from remote, or from the cache if allowed
+	GetWithMeta(app string, key string, opts ...AppOption) (*KvValue, error)
 	// AddWatcher add a watcher to client
 	AddWatcher(callback Callback, app string, opts ...AppOption) error
 	// StartWatch start watch
@@ -132,12 +139,44 @@ func New(opts ...Option) (Client, error) {
 	if err != nil {
 		return nil, fmt.Errorf("decode handshake payload failed, err: %s, rid: %s", err.Error(), vas.Rid)
 	}
+	if clientOpt.tracerProvider != nil {
+		tracing.SetTracerProvider(clientOpt.tracerProvider)
+	} else if clientOpt.traceExporter != nil {
+		tracing.SetExporter(clientOpt.traceExporter)
+	}
+	downloader.SetHTTPOptions(downloader.HTTPOptions{
+		DialTimeout:           clientOpt.httpTransport.DialTimeout,
+		TLSHandshakeTimeout:   clientOpt.httpTransport.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: clientOpt.httpTransport.ResponseHeaderTimeout,
+		IdleConnTimeout:       clientOpt.httpTransport.IdleConnTimeout,
+		MaxIdleConns:          clientOpt.httpTransport.MaxIdleConns,
+		MaxIdleConnsPerHost:   clientOpt.httpTransport.MaxIdleConnsPerHost,
+		ProxyURL:              clientOpt.httpTransport.ProxyURL,
+		EnableHTTP2:           clientOpt.httpTransport.EnableHTTP2,
+		CAFile:                clientOpt.httpTransport.CAFile,
+		FileTimeout:           clientOpt.fileDownloadTimeout,
+		RangePartSize:         clientOpt.rangePartSize,
+	})
+	downloader.SetAsyncOptions(downloader.AsyncOptions{
+		Threshold:    clientOpt.p2pDownloadSettings.Threshold,
+		PollInterval: clientOpt.p2pDownloadSettings.PollInterval,
+		Timeout:      clientOpt.p2pDownloadSettings.Timeout,
+		StagingDir:   clientOpt.p2pDownloadSettings.StagingDir,
+	})
 	err = downloader.Init(vas, clientOpt.bizID, clientOpt.token, u, pl.RuntimeOption.RepositoryTLS,
 		pl.RuntimeOption.EnableAsyncDownload, clientOpt.enableP2PDownload, clientOpt.bkAgentID, clientOpt.clusterID,
 		clientOpt.podID, clientOpt.containerName)
 	if err != nil {
 		return nil, fmt.Errorf("init downloader failed, err: %s", err.Error())
 	}
+	downloader.SetBandwidthLimit(clientOpt.bandwidthLimit)
+	downloader.SetSources(clientOpt.sources)
+	if clientOpt.sharedStore.Enabled {
+		logger.Info("enable shared store", slog.String("dir", clientOpt.sharedStore.Dir))
+		if err = downloader.SetSharedStore(clientOpt.sharedStore.Dir); err != nil {
+			return nil, fmt.Errorf("init shared store failed, err: %s", err.Error())
+		}
+	}
 
 	if err = initFileCache(clientOpt); err != nil {
 		return nil, err
@@ -158,9 +197,22 @@ func New(opts ...Option) (Client, error) {
 func initFileCache(opts *options) error {
 	if opts.fileCache.Enabled {
 		logger.Info("enable file cache")
-		if err := cache.Init(opts.fileCache.CacheDir, opts.fileCache.ThresholdGB); err != nil {
+		policy := opts.fileCache.EvictionPolicy
+		if policy == "" {
+			policy = cache.EvictionPolicyLRU
+		}
+		scrub := cache.ScrubOptions{
+			Interval:    opts.fileCache.Scrub.Interval,
+			Rate:        opts.fileCache.Scrub.Rate,
+			VerifiedTTL: opts.fileCache.Scrub.VerifiedTTL,
+			Quarantine:  opts.fileCache.Scrub.Quarantine,
+		}
+		if err := cache.Init(opts.fileCache.CacheDir, opts.fileCache.ThresholdGB, policy, scrub); err != nil {
 			return fmt.Errorf("init file cache failed, err: %s", err.Error())
 		}
+		if opts.fileCache.Scrub.Enabled {
+			go cache.AutoScrubFileCache()
+		}
 		go cache.AutoCleanupFileCache(opts.fileCache.CacheDir, DefaultCleanupIntervalSeconds,
 			opts.fileCache.ThresholdGB, DefaultCacheRetentionRate)
 	}
@@ -174,24 +226,49 @@ func initKvCache(opts *options) error {
 		if err := cache.InitMemCache(opts.kvCache.ThresholdMB); err != nil {
 			return fmt.Errorf("init kv cache failed, err: %s", err.Error())
 		}
-
-		go func() {
-			mc := cache.GetMemCache()
-			for {
-				hit, miss, kvCnt := mc.Stats().Hits, mc.Stats().Misses, mc.Len()
-				var hitRatio float64
-				if hit+miss > 0 {
-					hitRatio = float64(hit) / float64(hit+miss)
-				}
-				logger.Debug("kv cache statistics", slog.Int64("hit", hit), slog.Int64("miss", miss),
-					slog.String("hit-ratio", fmt.Sprintf("%.3f", hitRatio)), slog.Int("kv-count", kvCnt))
-				time.Sleep(time.Second * 15)
-			}
-		}()
+		if err := initKvSnapshot(opts); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// initKvSnapshot loads the kv snapshots on disk into the kv cache if the kv snapshot is enabled
+func initKvSnapshot(opts *options) error {
+	if !opts.kvCache.Snapshot.Enabled {
+		return nil
+	}
+	if err := cache.InitKvSnapshot(cache.KvSnapshotOptions{
+		Dir:           opts.kvCache.Snapshot.Dir,
+		MaxSize:       opts.kvCache.Snapshot.MaxSize,
+		EncryptionKey: opts.kvCache.Snapshot.EncryptionKey,
+	}); err != nil {
+		return fmt.Errorf("init kv snapshot failed, err: %s", err.Error())
+	}
+	var loaded int
+	cache.GetKvSnapshot().Range(func(bizID uint32, app, key string, e cache.KvEntry) {
+		if err := cache.SetKvEntry(kvCacheKey(bizID, app, key), &e); err != nil {
+			logger.Warn("load kv snapshot into kv cache failed", slog.String("key", kvCacheKey(bizID, app, key)),
+				logger.ErrAttr(err))
+			return
+		}
+		loaded++
+	})
+	logger.Info("loaded kv snapshot into kv cache", slog.String("dir", opts.kvCache.Snapshot.Dir),
+		slog.Int("kvs", loaded))
+	go cache.AutoFlushKvSnapshot()
+	return nil
+}
+
+// syncKvSnapshot syncs the kv snapshot of the app with the kvs of the release if the kv snapshot is enabled, it is
+// persisted by the auto flush, so that it is not written on the path of Get
+func syncKvSnapshot(bizID uint32, app string, kvs []*sfs.KvMetaV1) {
+	if !cache.EnableKvSnapshot {
+		return
+	}
+	cache.GetKvSnapshot().Sync(bizID, app, kvs)
+}
+
 // AddWatcher add a watcher to client
 func (c *client) AddWatcher(callback Callback, app string, opts ...AppOption) error {
 	_ = c.watcher.Subscribe(callback, app, opts...)
@@ -215,7 +292,7 @@ func (c *client) ResetLabels(labels map[string]string) {
 		subscriber.ResetLabels(labels)
 	}
 
-	c.watcher.NotifyReconnect(reconnectSignal{Reason: "reset labels"})
+	c.watcher.NotifyReconnect(reconnectSignal{Kind: reconnectKindResetLabels, Reason: "reset labels"})
 }
 
 // PullFiles pull files from remote
@@ -253,8 +330,11 @@ func (c *client) PullFiles(app string, opts ...AppOption) (*Release, error) { //
 	var err error
 	var resp *pbfs.PullAppFileMetaResp
 	r := &Release{
-		upstream: c.upstream,
-		vas:      vas,
+		upstream:     c.upstream,
+		vas:          vas,
+		versionedDir: c.opts.versionedDir,
+		autoRollback: option.autoRollbackEnabled(c.opts.autoRollback),
+		fileDeletion: c.opts.fileDeletion,
 		AppMate: &sfs.SideAppMeta{
 			App:       app,
 			Labels:    req.AppMeta.Labels,
@@ -324,6 +404,8 @@ func (c *client) PullFiles(app string, opts ...AppOption) (*Release, error) { //
 			},
 		}
 	}
+	applyPathMappings(files, option.PathMappings)
+	prioritizeFiles(files, c.opts.downloadPriority, downloader.NewLimiter(option.BandwidthLimit))
 
 	r.ReleaseID = resp.ReleaseId
 	r.ReleaseName = resp.ReleaseName
@@ -337,6 +419,34 @@ func (c *client) PullFiles(app string, opts ...AppOption) (*Release, error) { //
 	return r, nil
 }
 
+// NewRelease returns a release of the app without pulling from remote
+func (c *client) NewRelease(app string, opts ...AppOption) *Release {
+	option := &AppOptions{}
+	for _, opt := range opts {
+		opt(option)
+	}
+	vas, _ := c.buildVas()
+	uid := c.opts.uid
+	if option.UID != "" {
+		uid = option.UID
+	}
+	if uid == "" {
+		uid = c.opts.fingerprint
+	}
+	return &Release{
+		upstream:     c.upstream,
+		vas:          vas,
+		versionedDir: c.opts.versionedDir,
+		fileDeletion: c.opts.fileDeletion,
+		AppMate: &sfs.SideAppMeta{
+			App:    app,
+			Labels: util.MergeLabels(c.opts.labels, option.Labels),
+			Uid:    uid,
+			Match:  option.Match,
+		},
+	}
+}
+
 // PullKvs get release from remote
 func (c *client) PullKvs(app string, match []string, opts ...AppOption) (*Release, error) {
 	option := &AppOptions{}
@@ -375,6 +485,8 @@ func (c *client) PullKvs(app string, match []string, opts ...AppOption) (*Releas
 		})
 	}
 
+	syncKvSnapshot(c.opts.bizID, app, kvs)
+
 	r := &Release{
 		ReleaseID: resp.ReleaseId,
 		FileItems: []*ConfigItemFile{},
@@ -387,26 +499,43 @@ func (c *client) PullKvs(app string, match []string, opts ...AppOption) (*Releas
 
 // Get 读取 Key 的值
 // 先从feed-server服务端拉取最新版本元数据，优先从缓存中获取该最新版本value，缓存中没有再调用feed-server获取value并缓存起来
-// 在feed-server服务端连接不可用时则降级从缓存中获取（如果有缓存过），此时存在从缓存获取到的value值不是最新发布版本的风险
+// 在feed-server服务端连接不可用时则按过期策略降级从缓存中获取（如果有缓存过），此时存在从缓存获取到的value值不是最新发布版本的风险，
+// 需要感知是否降级时使用 GetWithMeta
 func (c *client) Get(app string, key string, opts ...AppOption) (string, error) {
+	v, err := c.GetWithMeta(app, key, opts...)
+	if err != nil {
+		return "", err
+	}
+	return v.Value, nil
+}
+
+// GetWithMeta 读取 Key 的值及其元数据，包括版本、来源、获取时间以及是否可能过期
+func (c *client) GetWithMeta(app string, key string, opts ...AppOption) (*KvValue, error) {
+	option := &AppOptions{}
+	for _, opt := range opts {
+		opt(option)
+	}
+	policy := c.opts.stalePolicy
+	if option.StalePolicy != nil {
+		policy = *option.StalePolicy
+	}
+
 	// get kv value from cache
-	var val, md5 string
-	var err error
 	cacheKey := kvCacheKey(c.opts.bizID, app, key)
+	var releaseID uint32
+	var meta *sfs.KvMetaV1
 	if cache.EnableMemCache {
-		val, md5, err = c.getKvValueFromCache(app, key, opts...)
+		var v *KvValue
+		var err error
+		v, releaseID, meta, err = c.getKvValueFromCache(app, key, opts...)
 		if err == nil {
-			return val, nil
+			return v, nil
 		} else if err != bigcache.ErrEntryNotFound {
 			logger.Error("get kv value from cache failed", slog.String("key", cacheKey), logger.ErrAttr(err))
 		}
 	}
 
 	// get kv value from feed-server
-	option := &AppOptions{}
-	for _, opt := range opts {
-		opt(option)
-	}
 	vas, _ := c.buildVas()
 	req := &pbfs.GetKvValueReq{
 		BizId: c.opts.bizID,
@@ -430,68 +559,122 @@ func (c *client) Get(app string, key string, opts ...AppOption) (string, error)
 		case codes.Unavailable, codes.DeadlineExceeded, codes.Internal:
 			logger.Error("feed-server is unavailable", logger.ErrAttr(err))
 			// 降级从缓存中获取
-			if cache.EnableMemCache {
-				v, cErr := cache.GetMemCache().Get(cacheKey)
-				if cErr != nil {
-					logger.Error("get kv value from cache failed", slog.String("key", cacheKey), logger.ErrAttr(cErr))
-					return "", err
-				}
-				logger.Warn("feed-server is unavailable but get kv value from cache successfully",
-					slog.String("key", cacheKey))
-				return string(v[32:]), nil
-			}
+			return c.getStaleKvValue(cacheKey, policy, err)
 		default:
-			return "", err
+			return nil, err
 		}
 	}
-	val = resp.Value
+
+	v := &KvValue{
+		Value:     resp.Value,
+		KvType:    resp.KvType,
+		ReleaseID: releaseID,
+		Source:    KvSourceServer,
+		FetchedAt: time.Now(),
+	}
+	if meta != nil {
+		v.Md5 = meta.ContentSpec.GetMd5()
+		v.Revision = meta.Revision
+	}
 
 	// set kv md5 and value for cache
 	if cache.EnableMemCache {
-		if md5 == "" {
+		if v.Md5 == "" {
 			logger.Error("set kv cache failed", slog.String("key", cacheKey), logger.ErrAttr(ErrNotFoundKvMD5))
 		} else {
-			if err := cache.GetMemCache().Set(cacheKey, append([]byte(md5), []byte(val)...)); err != nil {
+			e := cache.KvEntry{Md5: v.Md5, Value: v.Value, ReleaseID: v.ReleaseID, Revision: v.Revision,
+				FetchedAt: v.FetchedAt}
+			if err := cache.SetKvEntry(cacheKey, &e); err != nil {
 				logger.Error("set kv cache failed", slog.String("key", cacheKey), logger.ErrAttr(err))
 			}
+			if cache.EnableKvSnapshot {
+				cache.GetKvSnapshot().Set(c.opts.bizID, app, key, resp.KvType, e)
+			}
 		}
 	}
 
-	return val, nil
+	return v, nil
 }
 
-// getKvValueWithCache get kv value from the cache
-func (c *client) getKvValueFromCache(app string, key string, opts ...AppOption) (string, string, error) {
+// getKvValueFromCache get the kv value of the latest release from the cache, the release id and the kv meta of the
+// latest release are returned to fetch the value from feed-server if it is not cached
+func (c *client) getKvValueFromCache(app string, key string, opts ...AppOption) (
+	*KvValue, uint32, *sfs.KvMetaV1, error) {
 	release, err := c.PullKvs(app, []string{}, opts...)
 	if err != nil {
-		return "", "", err
+		return nil, 0, nil, err
 	}
 
-	var md5 string
+	var meta *sfs.KvMetaV1
 	for _, k := range release.KvItems {
 		if k.Key == key {
-			md5 = k.ContentSpec.Md5
+			meta = k
 			break
 		}
 	}
-	if md5 == "" {
-		return "", "", ErrNotFoundKvMD5
+	if meta == nil || meta.ContentSpec.GetMd5() == "" {
+		return nil, release.ReleaseID, nil, ErrNotFoundKvMD5
 	}
 
-	var val []byte
-	val, err = cache.GetMemCache().Get(kvCacheKey(c.opts.bizID, app, key))
+	e, err := cache.GetKvEntry(kvCacheKey(c.opts.bizID, app, key))
 	if err != nil {
-		return "", md5, err
+		return nil, release.ReleaseID, meta, err
 	}
 	// 判断是否为最新版本缓存，不是最新则仍从服务端获取value
-	if string(val[:32]) != md5 {
-		return "", md5, bigcache.ErrEntryNotFound
+	if e.Md5 != meta.ContentSpec.GetMd5() {
+		return nil, release.ReleaseID, meta, bigcache.ErrEntryNotFound
+	}
+
+	return &KvValue{
+		Value:     e.Value,
+		KvType:    meta.KvType,
+		ReleaseID: release.ReleaseID,
+		Revision:  meta.Revision,
+		Md5:       e.Md5,
+		Source:    kvSourceOf(e),
+		FetchedAt: e.FetchedAt,
+	}, release.ReleaseID, meta, nil
+}
+
+// getStaleKvValue gets the possibly stale kv value from the cache when feed-server is unavailable, it returns the
+// upstream error if the value is not cached or the fallback is not allowed by the stale policy
+func (c *client) getStaleKvValue(cacheKey string, policy StalePolicy, upstreamErr error) (*KvValue, error) {
+	if !cache.EnableMemCache {
+		return nil, upstreamErr
 	}
+	e, err := cache.GetKvEntry(cacheKey)
+	if err != nil {
+		logger.Error("get kv value from cache failed", slog.String("key", cacheKey), logger.ErrAttr(err))
+		return nil, upstreamErr
+	}
+	if err := policy.check(e.FetchedAt); err != nil {
+		logger.Warn("feed-server is unavailable and the cached kv value is not allowed by the stale policy",
+			slog.String("key", cacheKey), logger.ErrAttr(err))
+		return nil, fmt.Errorf("%w, %w", err, upstreamErr)
+	}
+	logger.Warn("feed-server is unavailable but get kv value from cache successfully",
+		slog.String("key", cacheKey), slog.Time("fetched_at", e.FetchedAt))
+	metrics.KvCacheFallbackCounter.WithLabelValues(string(kvSourceOf(e))).Inc()
+	return &KvValue{
+		Value:     e.Value,
+		ReleaseID: e.ReleaseID,
+		Revision:  e.Revision,
+		Md5:       e.Md5,
+		Source:    kvSourceOf(e),
+		FetchedAt: e.FetchedAt,
+		Stale:     true,
+	}, nil
+}
 
-	return string(val[32:]), md5, nil
+// kvSourceOf returns the source of the cached kv value
+func kvSourceOf(e *cache.KvEntry) KvSource {
+	if e.FromSnapshot {
+		return KvSourceSnapshot
+	}
+	return KvSourceCache
 }
 
-// kvCacheKey is cache key for kv md5 and value, the cached data's first 32 character is md5, other is value
+// kvCacheKey is cache key for kv md5 and value, the cached data is the encoded cache.KvEntry
 func kvCacheKey(bizID uint32, app, key string) string {
 	return fmt.Sprintf("%d_%s_%s", bizID, app, key)
 }
@@ -511,7 +694,7 @@ func (c *client) ListApps(match []string) ([]*pbfs.App, error) {
 	return resp.Apps, nil
 }
 
-func (c *client) buildVas() (*kit.Vas, context.CancelFunc) { // nolint
+func (c *client) buildVas() (*kit.Vas, context.CancelFunc) {
 	vas := kit.OutgoingVas(c.pairs)
 	ctx, cancel := context.WithCancel(vas.Ctx)
 	vas.Ctx = ctx
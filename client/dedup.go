@@ -0,0 +1,145 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/TencentBlueKing/bscp-go/internal/util"
+	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+	"github.com/TencentBlueKing/bscp-go/pkg/metrics"
+)
+
+// contentDedup downloads the identical content shared by several files of a release only once, the other files
+// are hardlinked or copied from the downloaded content.
+type contentDedup struct {
+	dir    string
+	counts map[string]int
+	lock   sync.Mutex
+	shared map[string]*sharedContent
+	// savedBytes the bytes not downloaded since the content is shared
+	savedBytes uint64
+}
+
+// sharedContent is the content downloaded once for the files with the same signature
+type sharedContent struct {
+	once sync.Once
+	// path the downloaded content, which is a temp file in the files dir
+	path string
+	// file the file which downloads the content
+	file *ConfigItemFile
+	err  error
+}
+
+// newContentDedup creates the dedup of the files, the shared content is downloaded into the dir
+func newContentDedup(dir string, files []*ConfigItemFile) *contentDedup {
+	d := &contentDedup{
+		dir:    dir,
+		counts: make(map[string]int),
+		shared: make(map[string]*sharedContent),
+	}
+	for _, file := range files {
+		if sig := file.FileMeta.ContentSpec.Signature; sig != "" {
+			d.counts[sig]++
+		}
+	}
+	return d
+}
+
+// saveToFile saves the content of the file to dst, the content shared by other files is downloaded only once
+func (d *contentDedup) saveToFile(file *ConfigItemFile, dst string) error {
+	sig := file.FileMeta.ContentSpec.Signature
+	if sig == "" || d.counts[sig] < 2 {
+		return file.SaveToFile(dst)
+	}
+
+	d.lock.Lock()
+	content, ok := d.shared[sig]
+	if !ok {
+		content = &sharedContent{path: util.TempFilePath(filepath.Join(d.dir, sig))}
+		d.shared[sig] = content
+	}
+	d.lock.Unlock()
+
+	downloaded := false
+	content.once.Do(func() {
+		downloaded = true
+		content.file = file
+		content.err = file.SaveToFile(content.path)
+	})
+	if content.err != nil {
+		return content.err
+	}
+
+	if err := linkOrCopy(content, file, dst); err != nil {
+		return err
+	}
+	if !downloaded {
+		atomic.AddUint64(&d.savedBytes, file.FileMeta.ContentSpec.ByteSize)
+		metrics.DedupSavedBytesCounter.WithLabelValues("release").Add(float64(file.FileMeta.ContentSpec.ByteSize))
+		file.progress.complete()
+	}
+	return nil
+}
+
+// linkOrCopy hardlinks the shared content to dst if the file is read-only and has the same permission with the file
+// which downloads the content, otherwise the content is copied. The hardlinks share the content, the mode and the
+// owner, so a chmod or an in-place edit of one file would change the others, which never happens to the read-only
+// files written by bscp, the line break conversion and the next release replace the files instead of editing them.
+func linkOrCopy(content *sharedContent, file *ConfigItemFile, dst string) error {
+	if samePermission(content.file, file) && readOnly(file) {
+		if err := os.Link(content.path, dst); err == nil {
+			return nil
+		}
+		// e.g. the file system does not support hardlink, fallback to copy
+	}
+	return copyFile(content.path, dst)
+}
+
+// samePermission returns whether the two files have the same permission
+func samePermission(a, b *ConfigItemFile) bool {
+	pa, pb := a.FileMeta.ConfigItemSpec.Permission, b.FileMeta.ConfigItemSpec.Permission
+	if pa == nil || pb == nil {
+		return pa == pb
+	}
+	return pa.User == pb.User && pa.UserGroup == pb.UserGroup && pa.Privilege == pb.Privilege
+}
+
+// readOnly returns whether the privilege of the file is not writable by anyone
+func readOnly(file *ConfigItemFile) bool {
+	pm := file.FileMeta.ConfigItemSpec.Permission
+	if pm == nil {
+		return false
+	}
+	mode, err := strconv.ParseInt("0"+pm.Privilege, 8, 64)
+	return err == nil && os.FileMode(mode)&0222 == 0
+}
+
+// cleanup removes the shared content and reports the saved bytes
+func (d *contentDedup) cleanup() {
+	for _, content := range d.shared {
+		if err := os.Remove(content.path); err != nil && !os.IsNotExist(err) {
+			logger.Warn("remove shared content failed", slog.String("file", content.path), logger.ErrAttr(err))
+		}
+	}
+	if saved := atomic.LoadUint64(&d.savedBytes); saved > 0 {
+		logger.Info("the identical content is downloaded only once", slog.Int("contents", len(d.shared)),
+			slog.Uint64("saved_bytes", saved))
+	}
+}
@@ -0,0 +1,88 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestContentDedup(t *testing.T) {
+	initTestCache(t, "shared")
+	// newFile returns the file of the shared content with the privilege
+	newFile := func(name, privilege string) *ConfigItemFile {
+		file := newTestFile(t, "/", name, "shared")
+		file.FileMeta.ConfigItemSpec.Permission = testPermission(t, privilege)
+		return file
+	}
+	files := []*ConfigItemFile{
+		newFile("a.conf", "444"),
+		newFile("b.conf", "444"),
+		newFile("writable.conf", "644"),
+		newFile("other.conf", "400"),
+	}
+	filesDir := t.TempDir()
+	d := newContentDedup(filesDir, files)
+	for _, file := range files {
+		if err := d.saveToFile(file, filepath.Join(filesDir, file.Name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d.cleanup()
+
+	infos := make(map[string]os.FileInfo)
+	for _, file := range files {
+		filePath := filepath.Join(filesDir, file.Name)
+		if got := readTestFile(t, filePath); got != "shared" {
+			t.Errorf("content of %s = %q, want shared", file.Name, got)
+		}
+		info, err := os.Stat(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		infos[file.Name] = info
+	}
+	// the read-only files with the same permission share the inode
+	if !os.SameFile(infos["a.conf"], infos["b.conf"]) {
+		t.Error("the read-only files with the same permission are not hardlinked")
+	}
+	// the writable file and the file with another permission are copied, so that a chmod or an edit of them never
+	// changes the others
+	for _, name := range []string{"writable.conf", "other.conf"} {
+		if os.SameFile(infos["a.conf"], infos[name]) {
+			t.Errorf("%s is hardlinked to the shared content", name)
+		}
+	}
+	if d.savedBytes != 3*uint64(len("shared")) {
+		t.Errorf("saved bytes = %d, want %d", d.savedBytes, 3*len("shared"))
+	}
+	entries, err := os.ReadDir(filesDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(files) {
+		t.Errorf("the shared content is not cleaned up, entries: %v", entries)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	for privilege, want := range map[string]bool{"444": true, "400": true, "644": false, "440": true, "442": false,
+		"invalid": false} {
+		file := newTestFile(t, "/", "app.conf", "content")
+		file.FileMeta.ConfigItemSpec.Permission = testPermission(t, privilege)
+		if got := readOnly(file); got != want {
+			t.Errorf("readOnly(%s) = %v, want %v", privilege, got, want)
+		}
+	}
+}
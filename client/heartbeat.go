@@ -24,6 +24,7 @@ import (
 	"github.com/TencentBlueKing/bscp-go/internal/util"
 	"github.com/TencentBlueKing/bscp-go/internal/util/process_collect"
 	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+	"github.com/TencentBlueKing/bscp-go/pkg/metrics"
 )
 
 const (
@@ -101,7 +102,7 @@ func (w *watcher) loopHeartbeat() error { // nolint
 					logger.Warn("stream heartbeat failed, notify reconnect upstream",
 						logger.ErrAttr(err), slog.String("rid", w.vas.Rid))
 
-					w.NotifyReconnect(reconnectSignal{Reason: "stream heartbeat failed"})
+					w.NotifyReconnect(reconnectSignal{Kind: reconnectKindHeartbeatFailed, Reason: "stream heartbeat failed"})
 					return
 				}
 				logger.Debug("stream heartbeat successfully", slog.String("rid", w.vas.Rid))
@@ -131,6 +132,7 @@ func (w *watcher) heartbeatOnce(vas *kit.Vas, msgType sfs.MessagingType, payload
 		if err := w.sendHeartbeatMessaging(vas, msgType, payload); err != nil {
 			logger.Error("send heartbeat message failed",
 				slog.Any("retry_count", retry.RetryCount()), logger.ErrAttr(err), slog.String("rid", vas.Rid))
+			metrics.HeartbeatFailureCounter.Inc()
 			lastErr = err
 			retry.Sleep()
 			continue
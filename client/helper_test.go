@@ -0,0 +1,154 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/kit"
+	pbci "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/core/config-item"
+	pbcontent "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/core/content"
+	pbfs "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/feed-server"
+	sfs "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/sf-share"
+
+	"github.com/TencentBlueKing/bscp-go/internal/cache"
+	"github.com/TencentBlueKing/bscp-go/internal/upstream"
+	"github.com/TencentBlueKing/bscp-go/internal/util/eventmeta"
+)
+
+// fakeUpstream is the upstream which accepts all the messages, the other calls are not expected in the tests
+type fakeUpstream struct {
+	upstream.Upstream
+	messages int32
+	// payload the payload of the last message
+	payload atomic.Value
+}
+
+// Messaging counts the messages sent and records the last payload
+func (u *fakeUpstream) Messaging(vas *kit.Vas, typ sfs.MessagingType, payload []byte) (*pbfs.MessagingResp, error) {
+	atomic.AddInt32(&u.messages, 1)
+	u.payload.Store(payload)
+	return &pbfs.MessagingResp{}, nil
+}
+
+// newTestRelease returns a watch mode release of the app dir under a temp dir
+func newTestRelease(t *testing.T, releaseID uint32, files ...*ConfigItemFile) *Release {
+	t.Helper()
+	tempDir := t.TempDir()
+	return &Release{
+		ReleaseID:   releaseID,
+		ReleaseName: "release",
+		FileItems:   files,
+		SemaphoreCh: make(chan struct{}, 100),
+		upstream:    &fakeUpstream{},
+		vas:         kit.NewVas(),
+		AppDir:      filepath.Join(tempDir, "1", "app"),
+		TempDir:     tempDir,
+		BizID:       1,
+		ClientMode:  sfs.Watch,
+		AppMate:     &sfs.SideAppMeta{App: "app"},
+	}
+}
+
+// testPermission returns the file permission owned by the current user
+func testPermission(t *testing.T, privilege string) *pbci.FilePermission {
+	t.Helper()
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := user.LookupGroupId(u.Gid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &pbci.FilePermission{User: u.Username, UserGroup: g.Name, Privilege: privilege}
+}
+
+// newTestFile returns the binary config item file of the content
+func newTestFile(t *testing.T, dir, name, content string) *ConfigItemFile {
+	t.Helper()
+	sum := sha256.Sum256([]byte(content))
+	pm := testPermission(t, "644")
+	return &ConfigItemFile{
+		Name:       name,
+		Path:       dir,
+		Permission: pm,
+		FileMeta: &sfs.ConfigItemMetaV1{
+			ContentSpec: &pbcontent.ContentSpec{
+				Signature: hex.EncodeToString(sum[:]),
+				ByteSize:  uint64(len(content)),
+			},
+			ConfigItemSpec: &pbci.ConfigItemSpec{
+				Name:       name,
+				Path:       dir,
+				FileType:   "binary",
+				Permission: pm,
+			},
+		},
+	}
+}
+
+// writeTestFile writes the content of the file under the files dir
+func writeTestFile(t *testing.T, filesDir string, file *ConfigItemFile, content string) {
+	t.Helper()
+	fileDir := filepath.Join(filesDir, file.Path)
+	if err := os.MkdirAll(fileDir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(fileDir, file.Name), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readTestFile returns the content of the file, or empty string if not exists
+func readTestFile(t *testing.T, filePath string) string {
+	t.Helper()
+	b, err := os.ReadFile(filePath)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+// appendTestMetadata records the release as applied successfully
+func appendTestMetadata(t *testing.T, appDir string, meta *eventmeta.EventMeta) {
+	t.Helper()
+	if meta.Status == "" {
+		meta.Status = eventmeta.EventStatusSuccess
+	}
+	if err := eventmeta.AppendMetadataToFile(appDir, meta); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// initTestCache enables the file cache of a temp dir which the contents are cached in
+func initTestCache(t *testing.T, contents ...string) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := cache.Init(dir, 1, cache.EvictionPolicyLRU, cache.ScrubOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cache.Enable = false })
+	for _, content := range contents {
+		sum := sha256.Sum256([]byte(content))
+		if err := os.WriteFile(filepath.Join(dir, hex.EncodeToString(sum[:])), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,162 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/kit"
+	pbcontent "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/core/content"
+	pbfs "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/feed-server"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/TencentBlueKing/bscp-go/internal/cache"
+	"github.com/TencentBlueKing/bscp-go/internal/upstream"
+)
+
+// kvUpstream is the upstream which serves a kv, or fails all the kv calls with the err
+type kvUpstream struct {
+	upstream.Upstream
+	md5   string
+	value string
+	err   error
+}
+
+// PullKvMeta returns the meta of the kv
+func (u *kvUpstream) PullKvMeta(vas *kit.Vas, req *pbfs.PullKvMetaReq) (*pbfs.PullKvMetaResp, error) {
+	if u.err != nil {
+		return nil, u.err
+	}
+	return &pbfs.PullKvMetaResp{ReleaseId: 2, KvMetas: []*pbfs.KvMeta{
+		{Key: "key", KvType: "string", ContentSpec: &pbcontent.ContentSpec{Md5: u.md5}},
+	}}, nil
+}
+
+// GetKvValue returns the value of the kv
+func (u *kvUpstream) GetKvValue(vas *kit.Vas, req *pbfs.GetKvValueReq) (*pbfs.GetKvValueResp, error) {
+	if u.err != nil {
+		return nil, u.err
+	}
+	return &pbfs.GetKvValueResp{KvType: "string", Value: u.value}, nil
+}
+
+// initTestKvCache enables the kv cache which the value of the key is cached in if fetchedAt is not zero
+func initTestKvCache(t *testing.T, fetchedAt time.Time) {
+	t.Helper()
+	if err := cache.InitMemCache(1); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cache.EnableMemCache = false })
+	if fetchedAt.IsZero() {
+		return
+	}
+	e := &cache.KvEntry{Md5: "md5-v1", Value: "v1", ReleaseID: 1, FetchedAt: fetchedAt}
+	if err := cache.SetKvEntry(kvCacheKey(1, "app", "key"), e); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGetWithMeta(t *testing.T) {
+	initTestKvCache(t, time.Now().Add(-time.Hour))
+	c := &client{opts: options{bizID: 1}, upstream: &kvUpstream{md5: "md5-v2", value: "v2"}}
+
+	// the value of the latest release is not cached, it is got from feed-server and cached
+	v, err := c.GetWithMeta("app", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Value != "v2" || v.Source != KvSourceServer || v.Stale || v.ReleaseID != 2 || v.Md5 != "md5-v2" {
+		t.Errorf("unexpected value got from feed-server: %+v", v)
+	}
+
+	// the value of the latest release is got from the cache
+	v, err = c.GetWithMeta("app", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Value != "v2" || v.Source != KvSourceCache || v.Stale || v.ReleaseID != 2 {
+		t.Errorf("unexpected value got from the cache: %+v", v)
+	}
+	if s, err := c.Get("app", "key"); err != nil || s != "v2" {
+		t.Errorf("Get() = %s, err: %v, want v2", s, err)
+	}
+}
+
+func TestGetWithMetaStalePolicy(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "feed-server is down")
+	tests := []struct {
+		name       string
+		cached     bool
+		err        error
+		policy     StalePolicy
+		appPolicy  *StalePolicy
+		wantStale  bool
+		wantErrIs  error
+		wantStatus codes.Code
+	}{
+		{name: "allow stale", cached: true, err: unavailable, policy: StalePolicyAllowStale, wantStale: true},
+		{name: "strict", cached: true, err: unavailable, policy: StalePolicyStrict, wantErrIs: ErrStaleKvValue,
+			wantStatus: codes.Unavailable},
+		{name: "within max age", cached: true, err: unavailable, policy: StalePolicyAllowStaleUpTo(2 * time.Hour),
+			wantStale: true},
+		{name: "older than max age", cached: true, err: unavailable, policy: StalePolicyAllowStaleUpTo(time.Minute),
+			wantErrIs: ErrStaleKvValue, wantStatus: codes.Unavailable},
+		{name: "overwritten by the app option", cached: true, err: unavailable, policy: StalePolicyStrict,
+			appPolicy: &StalePolicyAllowStale, wantStale: true},
+		{name: "not cached", err: unavailable, policy: StalePolicyAllowStale, wantErrIs: unavailable,
+			wantStatus: codes.Unavailable},
+		{name: "deadline exceeded", cached: true, err: status.Error(codes.DeadlineExceeded, "timeout"),
+			policy: StalePolicyAllowStale, wantStale: true},
+		{name: "not a fallback error", cached: true, err: status.Error(codes.PermissionDenied, "denied"),
+			policy: StalePolicyAllowStale, wantStatus: codes.PermissionDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fetchedAt time.Time
+			if tt.cached {
+				fetchedAt = time.Now().Add(-time.Hour)
+			}
+			initTestKvCache(t, fetchedAt)
+			c := &client{opts: options{bizID: 1, stalePolicy: tt.policy}, upstream: &kvUpstream{err: tt.err}}
+			var opts []AppOption
+			if tt.appPolicy != nil {
+				opts = append(opts, WithAppStalePolicy(*tt.appPolicy))
+			}
+
+			v, err := c.GetWithMeta("app", "key", opts...)
+			if tt.wantStale {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if v.Value != "v1" || !v.Stale || v.Source != KvSourceCache || v.ReleaseID != 1 ||
+					!v.FetchedAt.Equal(fetchedAt) {
+					t.Errorf("unexpected stale value: %+v", v)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected an error, got value %+v", v)
+			}
+			if tt.wantErrIs != nil && !errors.Is(err, tt.wantErrIs) {
+				t.Errorf("expected the error is %v, got %v", tt.wantErrIs, err)
+			}
+			// the upstream error is wrapped, so that its gRPC status is kept
+			if code := status.Code(err); code != tt.wantStatus {
+				t.Errorf("expected the status code %s, got %s, err: %v", tt.wantStatus, code, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,393 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	sfs "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/sf-share"
+	"golang.org/x/exp/slog"
+
+	"github.com/TencentBlueKing/bscp-go/internal/util/eventmeta"
+	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+)
+
+// versioned release directory layout:
+//
+//	<app>/releases/<releaseID>/   retained release dirs, each holds the full file set of a release
+//	<app>/current -> releases/<releaseID>
+//	<app>/files -> current
+//
+// files are downloaded into a staging dir under releases, verified, and then the current symlink is
+// switched atomically, so that readers of <app>/files never observe a half-updated mix of two releases.
+const (
+	// filesDirName is the dir name of the app config files
+	filesDirName = "files"
+	// releasesDirName is the dir name which holds all the retained release dirs
+	releasesDirName = "releases"
+	// currentLinkName is the symlink name which points to the current release dir
+	currentLinkName = "current"
+	// stagingDirPrefix is the prefix of the staging release dir
+	stagingDirPrefix = ".staging-"
+	// legacyDirMark is the mark in the name of the legacy files dir which is moved aside
+	legacyDirMark = ".legacy."
+)
+
+// releaseIDFromDirName returns the release id that the release dir belongs to.
+// release dir is named as <releaseID> or <releaseID>_<suffix> when the release is re-applied.
+func releaseIDFromDirName(name string) (uint32, bool) {
+	id, err := strconv.ParseUint(strings.SplitN(name, "_", 2)[0], 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(id), true
+}
+
+// currentReleaseDir returns the release dir name which the current symlink points to,
+// returns empty string if the current symlink not exists.
+func currentReleaseDir(appDir string) (string, error) {
+	target, err := os.Readlink(filepath.Join(appDir, currentLinkName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	return filepath.Base(target), nil
+}
+
+// findReleaseDir returns the name of the retained release dir of the release, the hint dir name recorded in
+// metadata is preferred, otherwise the newest dir of the release is returned.
+// returns empty string if no release dir is retained.
+func findReleaseDir(appDir string, releaseID uint32, hint string) (string, error) {
+	releasesDir := filepath.Join(appDir, releasesDirName)
+	if hint != "" {
+		if id, ok := releaseIDFromDirName(hint); ok && id == releaseID {
+			if info, err := os.Stat(filepath.Join(releasesDir, hint)); err == nil && info.IsDir() {
+				return hint, nil
+			}
+		}
+	}
+
+	entries, err := os.ReadDir(releasesDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	var name string
+	ranks := releaseDirRanks(appDir)
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if id, ok := releaseIDFromDirName(entry.Name()); !ok || id != releaseID {
+			continue
+		}
+		if name == "" || newerReleaseDir(ranks, entry.Name(), name) {
+			name = entry.Name()
+		}
+	}
+	return name, nil
+}
+
+// releaseDirRanks returns the order of the release dirs applied, which is recorded by the metadata history, the dir
+// applied later has a larger rank. The modification time of the dir is not used, since the reused staging dir keeps
+// the modification time when it is created.
+func releaseDirRanks(appDir string) map[string]int {
+	ranks := make(map[string]int)
+	history, err := eventmeta.GetMetadataHistoryFromFile(appDir)
+	if err != nil {
+		logger.Warn("get metadata history failed, the release dirs are ordered by release id", logger.ErrAttr(err))
+		return ranks
+	}
+	for i, meta := range history {
+		if meta.ReleaseDir != "" {
+			ranks[meta.ReleaseDir] = i + 1
+		}
+	}
+	return ranks
+}
+
+// newerReleaseDir returns whether the release dir a is applied later than b, the dirs not recorded in the metadata
+// history are older than the recorded ones, and ordered by the release id and then the re-applied suffix.
+func newerReleaseDir(ranks map[string]int, a, b string) bool {
+	if ranks[a] != ranks[b] {
+		return ranks[a] > ranks[b]
+	}
+	idA, _ := releaseIDFromDirName(a)
+	idB, _ := releaseIDFromDirName(b)
+	if idA != idB {
+		return idA > idB
+	}
+	// <releaseID>_<unix nano> is re-applied after <releaseID>, and the suffixes are in the same length
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return a > b
+}
+
+// prepareStagingDir prepares the staging dir for the release, the staging dir left by the previous
+// failed attempt of the same release would be reused, its verified files do not need to download again.
+func prepareStagingDir(appDir string, releaseID uint32) (string, error) {
+	stagingDir := filepath.Join(appDir, releasesDirName, fmt.Sprintf("%s%d", stagingDirPrefix, releaseID))
+	if err := os.MkdirAll(stagingDir, os.ModePerm); err != nil {
+		return "", err
+	}
+	return stagingDir, nil
+}
+
+// seedReleaseDir copies the unchanged files from the current release dir to the staging dir,
+// so that only the changed files need to be downloaded.
+func seedReleaseDir(srcDir, stagingDir string, files []*ConfigItemFile) {
+	for _, file := range files {
+		srcFileDir := filepath.Join(srcDir, file.Path)
+		exists, err := checkFileExists(srcFileDir, file.FileMeta)
+		if err != nil || !exists {
+			continue
+		}
+		dstFileDir := filepath.Join(stagingDir, file.Path)
+		if exists, _ = checkFileExists(dstFileDir, file.FileMeta); exists {
+			continue
+		}
+		if err = os.MkdirAll(dstFileDir, os.ModePerm); err != nil {
+			logger.Warn("seed release dir failed", slog.String("dir", dstFileDir), logger.ErrAttr(err))
+			continue
+		}
+		if err = copyFile(filepath.Join(srcFileDir, file.Name), filepath.Join(dstFileDir, file.Name)); err != nil {
+			logger.Warn("seed release file failed", slog.String("file", filepath.Join(file.Path, file.Name)),
+				logger.ErrAttr(err))
+		}
+	}
+}
+
+// verifyReleaseDir verifies all the files of the release exist in the release dir and the SHA256 is match.
+func verifyReleaseDir(dir string, files []*ConfigItemFile) error {
+	for _, file := range files {
+		fileDir := filepath.Join(dir, file.Path)
+		// the content of text file has been changed if its line break is converted, only check existence
+		if file.FileMeta.ConfigItemSpec.FileType == "text" && file.TextLineBreak != "" {
+			if _, err := os.Stat(filepath.Join(fileDir, file.Name)); err != nil {
+				return sfs.WrapPrimaryError(sfs.DownloadFailed,
+					sfs.SecondaryError{SpecificFailedReason: sfs.ValidateDownloadFailed, Err: err})
+			}
+			continue
+		}
+		exists, err := checkFileExists(fileDir, file.FileMeta)
+		if err != nil {
+			return sfs.WrapPrimaryError(sfs.DownloadFailed,
+				sfs.SecondaryError{SpecificFailedReason: sfs.CheckFileExistsFailed, Err: err})
+		}
+		if !exists {
+			return sfs.WrapPrimaryError(sfs.DownloadFailed,
+				sfs.SecondaryError{SpecificFailedReason: sfs.ValidateDownloadFailed,
+					Err: fmt.Errorf("verify file %s failed, file not exists or SHA256 not match",
+						filepath.Join(file.Path, file.Name))})
+		}
+	}
+	return nil
+}
+
+// commitReleaseDir renames the verified staging dir to the release dir and switches the current symlink to it.
+// it returns the name of the release dir.
+func commitReleaseDir(appDir, stagingDir string, releaseID uint32, current string) (string, error) {
+	name := strconv.FormatUint(uint64(releaseID), 10)
+	// re-apply the current release, use another dir name so that the current dir is kept until switched
+	if name == current {
+		name = fmt.Sprintf("%s_%d", name, time.Now().UnixNano())
+	}
+	releaseDir := filepath.Join(appDir, releasesDirName, name)
+	if err := os.RemoveAll(releaseDir); err != nil {
+		return "", err
+	}
+	if err := os.Rename(stagingDir, releaseDir); err != nil {
+		return "", err
+	}
+	if err := switchCurrentRelease(appDir, name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// switchCurrentRelease atomically points the current symlink to the release dir.
+func switchCurrentRelease(appDir, name string) error {
+	tmpLink := filepath.Join(appDir, fmt.Sprintf(".%s.%d", currentLinkName, time.Now().UnixNano()))
+	if err := os.Symlink(filepath.Join(releasesDirName, name), tmpLink); err != nil {
+		return err
+	}
+	// rename is atomic, readers always see either the old or the new release
+	if err := os.Rename(tmpLink, filepath.Join(appDir, currentLinkName)); err != nil {
+		_ = os.Remove(tmpLink)
+		return err
+	}
+	logger.Info("switch current release dir success", slog.String("app_dir", appDir), slog.String("release", name))
+	return ensureFilesLink(appDir)
+}
+
+// ensureFilesLink makes sure the files dir is a symlink to the current symlink, so that the hooks and
+// the users who read <app>/files are compatible with the versioned layout.
+func ensureFilesLink(appDir string) error {
+	filesDir := filepath.Join(appDir, filesDirName)
+	info, err := os.Lstat(filesDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	// the legacy files dir moved aside is left over if the process is killed during the last migration
+	clearLegacyFilesDirs(appDir)
+
+	tmpLink := filepath.Join(appDir, fmt.Sprintf(".%s.%d", filesDirName, time.Now().UnixNano()))
+	if e := os.Symlink(currentLinkName, tmpLink); e != nil {
+		return e
+	}
+	if err == nil {
+		// files dir is a real dir created by the legacy layout, exchange it with the symlink atomically, so that
+		// the files path always exists. the tmp link path holds the legacy dir after exchanged.
+		logger.Info("migrate legacy files dir to versioned layout", slog.String("dir", filesDir))
+		e := exchangePaths(tmpLink, filesDir)
+		if e == nil {
+			if e = os.RemoveAll(tmpLink); e != nil {
+				logger.Warn("delete legacy files dir failed", slog.String("dir", tmpLink), logger.ErrAttr(e))
+			}
+			return nil
+		}
+		logger.Debug("exchange legacy files dir failed, move it aside instead", logger.ErrAttr(e))
+		// the files path does not exist between the two renames, it is recovered by the next switch if the
+		// process is killed in between
+		legacyDir := filepath.Join(appDir, fmt.Sprintf(".%s%s%d", filesDirName, legacyDirMark, time.Now().UnixNano()))
+		if e = os.Rename(filesDir, legacyDir); e != nil {
+			_ = os.Remove(tmpLink)
+			return e
+		}
+		defer os.RemoveAll(legacyDir)
+	}
+	if e := os.Rename(tmpLink, filesDir); e != nil {
+		_ = os.Remove(tmpLink)
+		return e
+	}
+	return nil
+}
+
+// clearLegacyFilesDirs deletes the legacy files dirs which are moved aside but not deleted
+func clearLegacyFilesDirs(appDir string) {
+	dirs, err := filepath.Glob(filepath.Join(appDir, "."+filesDirName+legacyDirMark+"*"))
+	if err != nil {
+		return
+	}
+	for _, dir := range dirs {
+		if err := os.RemoveAll(dir); err != nil {
+			logger.Warn("delete legacy files dir failed", slog.String("dir", dir), logger.ErrAttr(err))
+			continue
+		}
+		logger.Info("delete legacy files dir left over success", slog.String("dir", dir))
+	}
+}
+
+// ensureLegacyFilesDir makes sure the files dir is a real dir, the symlink left by the versioned layout
+// would be removed so that the legacy layout does not write into the retained release dirs.
+func ensureLegacyFilesDir(appDir string) error {
+	filesDir := filepath.Join(appDir, filesDirName)
+	info, err := os.Lstat(filesDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		return nil
+	}
+	logger.Info("versioned layout is disabled, remove the files symlink", slog.String("dir", filesDir))
+	return os.Remove(filesDir)
+}
+
+// pruneReleases removes the stale staging dirs and the old release dirs, only the latest retain release dirs
+// are kept, the current release dir is always kept.
+func pruneReleases(appDir string, retain int) error {
+	current, err := currentReleaseDir(appDir)
+	if err != nil {
+		return err
+	}
+	releasesDir := filepath.Join(appDir, releasesDirName)
+	entries, err := os.ReadDir(releasesDir)
+	if err != nil {
+		return err
+	}
+
+	releases := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() || entry.Name() == current {
+			continue
+		}
+		if strings.HasPrefix(entry.Name(), stagingDirPrefix) {
+			// all the staging dirs left now are stale since the release has been committed
+			if e := os.RemoveAll(filepath.Join(releasesDir, entry.Name())); e != nil {
+				return e
+			}
+			continue
+		}
+		if _, ok := releaseIDFromDirName(entry.Name()); !ok {
+			continue
+		}
+		releases = append(releases, entry.Name())
+	}
+
+	// the latest applied release dir first
+	ranks := releaseDirRanks(appDir)
+	sort.Slice(releases, func(i, j int) bool {
+		return newerReleaseDir(ranks, releases[i], releases[j])
+	})
+	// current release dir takes one of the retained place
+	keep := retain - 1
+	if keep < 0 {
+		keep = 0
+	}
+	for i := keep; i < len(releases); i++ {
+		dir := filepath.Join(releasesDir, releases[i])
+		if e := os.RemoveAll(dir); e != nil {
+			return e
+		}
+		logger.Info("delete old release dir success", slog.String("dir", dir))
+	}
+	return nil
+}
+
+// copyFile copies the src file to the dst file.
+func copyFile(src, dst string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	dstFile, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer dstFile.Close()
+
+	if _, err = io.Copy(dstFile, srcFile); err != nil {
+		return err
+	}
+	return dstFile.Sync()
+}
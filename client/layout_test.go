@@ -0,0 +1,234 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TencentBlueKing/bscp-go/internal/util/eventmeta"
+)
+
+// writeReleaseDir writes the app.conf of the content into the release dir
+func writeReleaseDir(t *testing.T, appDir, name, content string) {
+	t.Helper()
+	writeTestFile(t, filepath.Join(appDir, releasesDirName, name), &ConfigItemFile{Path: "/", Name: "app.conf"},
+		content)
+}
+
+// listAppDir returns the names under the app dir and the releases dir
+func listAppDir(t *testing.T, appDir string) []string {
+	t.Helper()
+	var names []string
+	for _, dir := range []string{appDir, filepath.Join(appDir, releasesDirName)} {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, entry := range entries {
+			rel, _ := filepath.Rel(appDir, filepath.Join(dir, entry.Name()))
+			names = append(names, filepath.ToSlash(rel))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestCommitReleaseDir(t *testing.T) {
+	appDir := t.TempDir()
+	stagingDir, err := prepareStagingDir(appDir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, stagingDir, &ConfigItemFile{Path: "/", Name: "app.conf"}, "v1")
+	name, err := commitReleaseDir(appDir, stagingDir, 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "1" {
+		t.Errorf("release dir = %s, want 1", name)
+	}
+	if got := readTestFile(t, filepath.Join(appDir, filesDirName, "app.conf")); got != "v1" {
+		t.Errorf("files/app.conf = %q, want v1", got)
+	}
+
+	// re-apply the current release, the current release dir is kept until switched
+	if stagingDir, err = prepareStagingDir(appDir, 1); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, stagingDir, &ConfigItemFile{Path: "/", Name: "app.conf"}, "v1-reapplied")
+	if name, err = commitReleaseDir(appDir, stagingDir, 1, name); err != nil {
+		t.Fatal(err)
+	}
+	if id, ok := releaseIDFromDirName(name); !ok || id != 1 || name == "1" {
+		t.Errorf("release dir of the re-applied release = %s", name)
+	}
+	if got := readTestFile(t, filepath.Join(appDir, filesDirName, "app.conf")); got != "v1-reapplied" {
+		t.Errorf("files/app.conf = %q, want v1-reapplied", got)
+	}
+	if current, _ := currentReleaseDir(appDir); current != name {
+		t.Errorf("current release dir = %s, want %s", current, name)
+	}
+}
+
+func TestSwitchCurrentRelease(t *testing.T) {
+	appDir := t.TempDir()
+	writeReleaseDir(t, appDir, "1", "v1")
+	writeReleaseDir(t, appDir, "2", "v2")
+
+	for _, name := range []string{"1", "2", "1"} {
+		if err := switchCurrentRelease(appDir, name); err != nil {
+			t.Fatal(err)
+		}
+		if got := readTestFile(t, filepath.Join(appDir, filesDirName, "app.conf")); got != "v"+name {
+			t.Errorf("files/app.conf = %q after switched to %s", got, name)
+		}
+	}
+	want := []string{"current", "files", "releases", "releases/1", "releases/2"}
+	if got := listAppDir(t, appDir); !reflect.DeepEqual(got, want) {
+		t.Errorf("app dir = %v, want %v", got, want)
+	}
+}
+
+func TestEnsureFilesLinkMigration(t *testing.T) {
+	tests := []struct {
+		name    string
+		prepare func(t *testing.T, appDir string)
+	}{
+		{
+			name: "legacy files dir",
+			prepare: func(t *testing.T, appDir string) {
+				writeTestFile(t, filepath.Join(appDir, filesDirName), &ConfigItemFile{Path: "/", Name: "app.conf"},
+					"legacy")
+			},
+		},
+		{
+			name: "legacy files dir moved aside but not deleted",
+			prepare: func(t *testing.T, appDir string) {
+				writeTestFile(t, filepath.Join(appDir, ".files.legacy.1"), &ConfigItemFile{Path: "/", Name: "app.conf"},
+					"legacy")
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			appDir := t.TempDir()
+			tt.prepare(t, appDir)
+			writeReleaseDir(t, appDir, "1", "v1")
+
+			if err := switchCurrentRelease(appDir, "1"); err != nil {
+				t.Fatal(err)
+			}
+			info, err := os.Lstat(filepath.Join(appDir, filesDirName))
+			if err != nil || info.Mode()&os.ModeSymlink == 0 {
+				t.Fatalf("files is not migrated to a symlink, err: %v", err)
+			}
+			if got := readTestFile(t, filepath.Join(appDir, filesDirName, "app.conf")); got != "v1" {
+				t.Errorf("files/app.conf = %q, want v1", got)
+			}
+			for _, name := range listAppDir(t, appDir) {
+				if strings.HasPrefix(name, ".") {
+					t.Errorf("%s is left over by the migration", name)
+				}
+			}
+		})
+	}
+}
+
+func TestPruneReleases(t *testing.T) {
+	tests := []struct {
+		name   string
+		retain int
+		want   []string
+	}{
+		{name: "retain current only", retain: 1, want: []string{"4"}},
+		{name: "retain the latest applied", retain: 2, want: []string{"1", "4"}},
+		{name: "retain more", retain: 3, want: []string{"1", "3", "4"}},
+		{name: "retain all", retain: 10, want: []string{"1", "2", "3", "4"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			appDir := t.TempDir()
+			for _, name := range []string{"1", "2", "3", "4", ".staging-5"} {
+				writeReleaseDir(t, appDir, name, "v"+name)
+			}
+			// release 1 is rolled back to after release 3, while its dir is the oldest modified one
+			for i, name := range []string{"2", "3", "1", "4"} {
+				appendTestMetadata(t, appDir, &eventmeta.EventMeta{ReleaseDir: name})
+				modTime := time.Now().Add(time.Duration(i-10) * time.Hour)
+				if name == "1" {
+					modTime = time.Now().Add(-100 * time.Hour)
+				}
+				if err := os.Chtimes(filepath.Join(appDir, releasesDirName, name), modTime, modTime); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := switchCurrentRelease(appDir, "4"); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := pruneReleases(appDir, tt.retain); err != nil {
+				t.Fatal(err)
+			}
+			entries, err := os.ReadDir(filepath.Join(appDir, releasesDirName))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]string, 0, len(entries))
+			for _, entry := range entries {
+				got = append(got, entry.Name())
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("release dirs = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindReleaseDir(t *testing.T) {
+	appDir := t.TempDir()
+	for _, name := range []string{"1", "1_1700000000000000000", "2"} {
+		writeReleaseDir(t, appDir, name, "v"+name)
+	}
+	appendTestMetadata(t, appDir, &eventmeta.EventMeta{ReleaseID: 1, ReleaseDir: "1_1700000000000000000"})
+	appendTestMetadata(t, appDir, &eventmeta.EventMeta{ReleaseID: 2, ReleaseDir: "2"})
+	appendTestMetadata(t, appDir, &eventmeta.EventMeta{ReleaseID: 1, ReleaseDir: "1"})
+
+	tests := []struct {
+		name      string
+		releaseID uint32
+		hint      string
+		want      string
+	}{
+		{name: "hint", releaseID: 1, hint: "1_1700000000000000000", want: "1_1700000000000000000"},
+		{name: "latest applied", releaseID: 1, want: "1"},
+		{name: "hint of another release", releaseID: 1, hint: "2", want: "1"},
+		{name: "not retained", releaseID: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := findReleaseDir(appDir, tt.releaseID, tt.hint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("findReleaseDir() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
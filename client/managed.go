@@ -0,0 +1,310 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	sfs "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/sf-share"
+	"golang.org/x/exp/slog"
+
+	"github.com/TencentBlueKing/bscp-go/internal/util"
+	"github.com/TencentBlueKing/bscp-go/internal/util/eventmeta"
+	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+)
+
+const (
+	// maxReportDeletedFiles is the max count of deleted files in the report annotations
+	maxReportDeletedFiles = 100
+	// maxReportP2PTasks is the max count of p2p download tasks in the report annotations
+	maxReportP2PTasks = 100
+)
+
+// managedPath returns the slash separated path of the file relative to the files dir
+func managedPath(file *ConfigItemFile) string {
+	return strings.TrimPrefix(filepath.ToSlash(filepath.Join(file.Path, file.Name)), "/")
+}
+
+// releaseManagedPaths returns the managed paths of the release files
+func releaseManagedPaths(files []*ConfigItemFile) map[string]bool {
+	paths := make(map[string]bool, len(files))
+	for _, file := range files {
+		paths[managedPath(file)] = true
+	}
+	return paths
+}
+
+// protected returns whether the managed file is protected from being deleted by the file deletion option
+func (d FileDeletion) protected(p string) bool {
+	if d.NeverDelete {
+		return true
+	}
+	for _, pattern := range d.Ignore {
+		// the file is protected if itself or any of its parent dirs is matched
+		for dir := p; dir != "." && dir != "/" && dir != ""; dir = path.Dir(dir) {
+			if ok, _ := path.Match(pattern, dir); ok {
+				return true
+			}
+		}
+		if !strings.Contains(pattern, "/") {
+			if ok, _ := path.Match(pattern, path.Base(p)); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// staleManagedFiles returns the managed files under the files dir which are not in the release, the deletes can
+// be deleted, the protected are kept by the file deletion option.
+func (r *Release) staleManagedFiles(filesDir string) (deletes []string, protected []string, err error) {
+	managed, err := r.managedFiles(filesDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	current := releaseManagedPaths(r.FileItems)
+	for _, p := range managed.Files {
+		if current[p] {
+			continue
+		}
+		if r.fileDeletion.protected(p) {
+			protected = append(protected, p)
+			continue
+		}
+		deletes = append(deletes, p)
+	}
+	return deletes, protected, nil
+}
+
+// clearStaleFiles deletes the managed files which are not in the release under the files dir and the target
+// paths, the files not created by bscp, eg: logs or files written by hooks, are never deleted.
+func (r *Release) clearStaleFiles(filesDir string) error {
+	deletes, protected, err := r.staleManagedFiles(filesDir)
+	if err != nil {
+		return err
+	}
+	keptTargets, err := r.clearStaleTargets()
+	if err != nil {
+		return err
+	}
+	for _, p := range deletes {
+		filePath := filepath.Join(filesDir, filepath.FromSlash(p))
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			return sfs.WrapPrimaryError(sfs.DeleteOldFilesFailed,
+				sfs.SecondaryError{SpecificFailedReason: sfs.DeleteFolderFailed, Err: err})
+		}
+		logger.Info("delete file success", slog.String("file", filePath))
+		r.deletedFiles = append(r.deletedFiles, p)
+		removeEmptyParentDirs(filesDir, filepath.Dir(filePath))
+	}
+	for _, p := range protected {
+		logger.Info("file is not in the release but protected, skip delete", slog.String("file", p))
+	}
+	if err := clearTempFiles(filesDir); err != nil {
+		logger.Warn("clear the temp files left over failed", slog.String("dir", filesDir), logger.ErrAttr(err))
+	}
+	return r.writeManagedFiles(protected, keptTargets)
+}
+
+// clearTempFiles deletes the temp files left over by the writes interrupted, eg: the process is killed
+func clearTempFiles(filesDir string) error {
+	err := filepath.Walk(filesDir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !util.IsTempFile(info.Name()) {
+			return nil
+		}
+		if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		logger.Info("delete temp file left over success", slog.String("file", filePath))
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// managedFiles returns the managed files manifest. Without the manifest, which means the files dir is written by
+// the old version of bscp that deletes all the files not in the release, all the files under the files dir are
+// regarded as managed, and the manifest is written after the release is applied, so the dir is listed only once.
+func (r *Release) managedFiles(filesDir string) (*eventmeta.ManagedFiles, error) {
+	managed, exists, err := getManagedFiles(r.AppDir)
+	if err != nil || exists || filesDir == "" {
+		return managed, err
+	}
+	// the files dir is a symlink in versioned layout, walk the dir it points to
+	dir, err := filepath.EvalSymlinks(filesDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return managed, nil
+		}
+		return nil, err
+	}
+	err = filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || util.IsTempFile(info.Name()) {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, filePath)
+		if err != nil {
+			return err
+		}
+		managed.Files = append(managed.Files, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("managed files manifest not exists, regard all the files as managed", slog.String("dir", filesDir),
+		slog.Int("count", len(managed.Files)))
+	return managed, nil
+}
+
+// getManagedFiles gets the managed files manifest, an empty one is returned if not exists
+func getManagedFiles(appDir string) (*eventmeta.ManagedFiles, bool, error) {
+	managed, exists, err := eventmeta.GetManagedFiles(appDir)
+	if err != nil {
+		return nil, false, err
+	}
+	if !exists {
+		return &eventmeta.ManagedFiles{}, false, nil
+	}
+	return managed, true, nil
+}
+
+// writeManagedFiles writes the release files and the still kept managed files as the managed files
+func (r *Release) writeManagedFiles(kept, keptTargets []string) error {
+	managed := &eventmeta.ManagedFiles{
+		Files:   append([]string{}, kept...),
+		Targets: append([]string{}, keptTargets...),
+	}
+	for p := range releaseManagedPaths(r.FileItems) {
+		managed.Files = append(managed.Files, p)
+	}
+	for p := range releaseTargetPaths(r.FileItems) {
+		managed.Targets = append(managed.Targets, p)
+	}
+	return eventmeta.WriteManagedFiles(r.AppDir, managed)
+}
+
+// mergeManagedFiles adds the release files to the managed files, used when the old files are not deleted
+func (r *Release) mergeManagedFiles() error {
+	managed, _, err := getManagedFiles(r.AppDir)
+	if err != nil {
+		return err
+	}
+	current := releaseManagedPaths(r.FileItems)
+	kept := make([]string, 0, len(managed.Files))
+	for _, p := range managed.Files {
+		if !current[p] {
+			kept = append(kept, p)
+		}
+	}
+	currentTargets := releaseTargetPaths(r.FileItems)
+	keptTargets := make([]string, 0, len(managed.Targets))
+	for _, target := range managed.Targets {
+		if !currentTargets[target] {
+			keptTargets = append(keptTargets, target)
+		}
+	}
+	return r.writeManagedFiles(kept, keptTargets)
+}
+
+// carryOverFiles copies the files which should be kept from the current release dir to the staging dir in
+// versioned layout, including the files not created by bscp and the protected managed files.
+// it returns the protected managed files which are carried over.
+func (r *Release) carryOverFiles(currentDir, stagingDir string) ([]string, error) {
+	managed, err := r.managedFiles(currentDir)
+	if err != nil {
+		return nil, err
+	}
+	managedSet := make(map[string]bool, len(managed.Files))
+	for _, p := range managed.Files {
+		managedSet[p] = true
+	}
+	current := releaseManagedPaths(r.FileItems)
+
+	kept := make([]string, 0)
+	err = filepath.Walk(currentDir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// the temp files left over by the interrupted writes are not carried over
+		if info.IsDir() || util.IsTempFile(info.Name()) {
+			return nil
+		}
+		rel, err := filepath.Rel(currentDir, filePath)
+		if err != nil {
+			return err
+		}
+		p := filepath.ToSlash(rel)
+		if current[p] || (managedSet[p] && !r.fileDeletion.protected(p)) {
+			return nil
+		}
+		if !info.Mode().IsRegular() {
+			logger.Warn("unmanaged file is not a regular file, skip carry over to the new release dir",
+				slog.String("file", filePath))
+			return nil
+		}
+		dst := filepath.Join(stagingDir, rel)
+		if err := os.MkdirAll(filepath.Dir(dst), os.ModePerm); err != nil {
+			return err
+		}
+		if err := copyFile(filePath, dst); err != nil {
+			return err
+		}
+		if err := os.Chmod(dst, info.Mode().Perm()); err != nil {
+			return err
+		}
+		if managedSet[p] {
+			kept = append(kept, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return kept, nil
+}
+
+// removeEmptyParentDirs removes the dir and its parents if they are empty, until the root dir
+func removeEmptyParentDirs(root, dir string) {
+	for dir != root && strings.HasPrefix(dir, root) {
+		// remove fails if the dir is not empty
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// deletedFilesAnnotations returns the report annotations of the deleted files
+func (r *Release) deletedFilesAnnotations(annotations map[string]interface{}) {
+	if len(r.deletedFiles) == 0 {
+		return
+	}
+	files := r.deletedFiles
+	if len(files) > maxReportDeletedFiles {
+		files = files[:maxReportDeletedFiles]
+	}
+	annotations["deleted_files"] = files
+	annotations["deleted_files_count"] = len(r.deletedFiles)
+}
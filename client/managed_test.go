@@ -0,0 +1,156 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/TencentBlueKing/bscp-go/internal/util/eventmeta"
+)
+
+func TestFileDeletionProtected(t *testing.T) {
+	tests := []struct {
+		name     string
+		deletion FileDeletion
+		path     string
+		want     bool
+	}{
+		{name: "no option", path: "app.conf", want: false},
+		{name: "never delete", deletion: FileDeletion{NeverDelete: true}, path: "app.conf", want: true},
+		{name: "base name glob", deletion: FileDeletion{Ignore: []string{"*.log"}}, path: "logs/app.log", want: true},
+		{name: "base name glob not match", deletion: FileDeletion{Ignore: []string{"*.log"}}, path: "app.conf"},
+		{name: "parent dir", deletion: FileDeletion{Ignore: []string{"data"}}, path: "data/db/app.db", want: true},
+		{name: "parent dir glob", deletion: FileDeletion{Ignore: []string{"data/*"}}, path: "data/db/app.db",
+			want: true},
+		{name: "path glob", deletion: FileDeletion{Ignore: []string{"conf/*.bak"}}, path: "conf/app.bak", want: true},
+		{name: "path glob only matches from the root", deletion: FileDeletion{Ignore: []string{"conf/*.bak"}},
+			path: "backup/conf/app.bak"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.deletion.protected(tt.path); got != tt.want {
+				t.Errorf("protected(%s) = %v, want %v", tt.path, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStaleManagedFiles(t *testing.T) {
+	tests := []struct {
+		name          string
+		managed       []string
+		deletion      FileDeletion
+		wantDeletes   []string
+		wantProtected []string
+	}{
+		{
+			name:        "only the managed files are deleted",
+			managed:     []string{"app.conf", "old.conf"},
+			wantDeletes: []string{"old.conf"},
+		},
+		{
+			name:          "ignored files are protected",
+			managed:       []string{"app.conf", "old.conf", "logs/app.log"},
+			deletion:      FileDeletion{Ignore: []string{"*.log"}},
+			wantDeletes:   []string{"old.conf"},
+			wantProtected: []string{"logs/app.log"},
+		},
+		{
+			name:          "never delete",
+			managed:       []string{"app.conf", "old.conf"},
+			deletion:      FileDeletion{NeverDelete: true},
+			wantProtected: []string{"old.conf"},
+		},
+		{
+			name:        "all the files are managed without the manifest",
+			wantDeletes: []string{"logs/app.log", "old.conf", "unmanaged.txt"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRelease(t, 1, newTestFile(t, "/", "app.conf", "app"))
+			r.fileDeletion = tt.deletion
+			filesDir := filepath.Join(r.AppDir, filesDirName)
+			for _, name := range []string{"app.conf", "old.conf", "unmanaged.txt", "logs/app.log",
+				".old.conf.bscp-tmp-1"} {
+				writeTestFile(t, filesDir, &ConfigItemFile{Path: filepath.Dir(name), Name: filepath.Base(name)}, "")
+			}
+			if tt.managed != nil {
+				if err := eventmeta.WriteManagedFiles(r.AppDir, &eventmeta.ManagedFiles{Files: tt.managed}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			deletes, protected, err := r.staleManagedFiles(filesDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Strings(deletes)
+			if !reflect.DeepEqual(deletes, tt.wantDeletes) {
+				t.Errorf("deletes = %v, want %v", deletes, tt.wantDeletes)
+			}
+			if !reflect.DeepEqual(protected, tt.wantProtected) {
+				t.Errorf("protected = %v, want %v", protected, tt.wantProtected)
+			}
+		})
+	}
+}
+
+func TestClearStaleFiles(t *testing.T) {
+	file := newTestFile(t, "/conf", "app.conf", "app")
+	r := newTestRelease(t, 1, file)
+	r.fileDeletion = FileDeletion{Ignore: []string{"*.log"}}
+	filesDir := filepath.Join(r.AppDir, filesDirName)
+	writeTestFile(t, filesDir, file, "app")
+	for _, name := range []string{"conf/old.conf", "old/old.conf", "logs/app.log", "conf/.app.conf.bscp-tmp-1"} {
+		writeTestFile(t, filesDir, &ConfigItemFile{Path: filepath.Dir(name), Name: filepath.Base(name)}, "old")
+	}
+
+	// the files dir written by the old version of bscp, the files not in the release are deleted
+	if err := r.clearStaleFiles(filesDir); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range map[string]string{"conf/app.conf": "app", "conf/old.conf": "", "old/old.conf": "",
+		"logs/app.log": "old", "conf/.app.conf.bscp-tmp-1": ""} {
+		if got := readTestFile(t, filepath.Join(filesDir, name)); got != want {
+			t.Errorf("content of %s = %q, want %q", name, got, want)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(filesDir, "old")); !os.IsNotExist(err) {
+		t.Errorf("the empty dir is not removed, err: %v", err)
+	}
+	managed, _, err := eventmeta.GetManagedFiles(r.AppDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"conf/app.conf", "logs/app.log"}; !reflect.DeepEqual(managed.Files, want) {
+		t.Errorf("managed files = %v, want %v", managed.Files, want)
+	}
+
+	// the files written by others after the manifest is written are never deleted
+	writeTestFile(t, filesDir, &ConfigItemFile{Path: "/", Name: "hook.out"}, "out")
+	r.FileItems = nil
+	if err = r.clearStaleFiles(filesDir); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, filepath.Join(filesDir, "hook.out")); got != "out" {
+		t.Errorf("the file not created by bscp is deleted")
+	}
+	if got := readTestFile(t, filepath.Join(filesDir, "conf", "app.conf")); got != "" {
+		t.Errorf("the managed file not in the release is not deleted")
+	}
+}
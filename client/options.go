@@ -12,6 +12,21 @@
 
 package client
 
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/TencentBlueKing/bscp-go/pkg/source"
+)
+
 // options options for bscp sdk client
 type options struct {
 	// FeedAddr BSCP feed_server address
@@ -42,10 +57,69 @@ type options struct {
 	fileCache FileCache
 	// kvCache kv cache option
 	kvCache KvCache
+	// stalePolicy decides whether Get falls back to the cached kv value when feed-server is unavailable
+	stalePolicy StalePolicy
 	// EnableMonitorResourceUsage 是否采集/监控资源使用率
 	enableMonitorResourceUsage bool
 	// textLineBreak is the text file line break character, default as LF
 	textLineBreak string
+	// versionedDir versioned release directory layout option
+	versionedDir VersionedDir
+	// autoRollback is whether restore the previous release when the post hook of a new release failed
+	autoRollback bool
+	// fileDeletion option for deleting the files which are not in the release
+	fileDeletion FileDeletion
+	// bandwidthLimit is the global download bandwidth limit in bytes per second, 0 means no limit
+	bandwidthLimit int64
+	// downloadPriority is the option for prioritizing the downloads
+	downloadPriority DownloadPriority
+	// sources the content sources tried in order before the feed server
+	sources []source.Source
+	// sharedStore node local shared store option
+	sharedStore SharedStore
+	// httpTransport http transport option for downloading from the repository
+	httpTransport HTTPTransport
+	// p2pDownloadSettings the threshold, polling and staging dir of the p2p download
+	p2pDownloadSettings P2PDownloadSettings
+	// fileDownloadTimeout the total timeout of downloading a file, 0 means no limit
+	fileDownloadTimeout time.Duration
+	// rangePartSize the byte size of each part of the range download
+	rangePartSize uint64
+	// tracerProvider the tracer provider which traces the release applications, nil means not traced
+	tracerProvider trace.TracerProvider
+	// traceExporter the exporter which the spans of the release applications are exported to
+	traceExporter sdktrace.SpanExporter
+}
+
+// HTTPTransport option for the http transport shared by all the downloads from the repository,
+// the zero values mean the defaults
+type HTTPTransport struct {
+	// DialTimeout timeout of dialing the repository, default is 5s
+	DialTimeout time.Duration
+	// TLSHandshakeTimeout timeout of the tls handshake, default is 5s
+	TLSHandshakeTimeout time.Duration
+	// ResponseHeaderTimeout timeout of waiting for the response header, default is 15m
+	ResponseHeaderTimeout time.Duration
+	// IdleConnTimeout timeout of the idle connections kept in the pool, default is 90s
+	IdleConnTimeout time.Duration
+	// MaxIdleConns max idle connections of all the hosts, default is 100
+	MaxIdleConns int
+	// MaxIdleConnsPerHost max idle connections of each host, default is 10
+	MaxIdleConnsPerHost int
+	// ProxyURL the proxy of the requests, the proxy from the environment is used if it is empty
+	ProxyURL string
+	// EnableHTTP2 is whether try http/2 with the repository
+	EnableHTTP2 bool
+	// CAFile the ca file trusted besides the system ca, used to verify the repository
+	CAFile string
+}
+
+// SharedStore option for the node local content store shared by the clients on the same node
+type SharedStore struct {
+	// Enabled is whether enable the shared store
+	Enabled bool
+	// Dir is the shared store dir, e.g. a hostPath dir mounted by all the sidecars on the node
+	Dir string
 }
 
 // FileCache option for file cache
@@ -56,12 +130,42 @@ type FileCache struct {
 	CacheDir string
 	// ThresholdGB is threshold gigabyte of cleanup
 	ThresholdGB float64
+	// EvictionPolicy is the policy of evicting the cached contents on cleanup, lru or lfu, default is lru
+	EvictionPolicy string
+	// Scrub is the option of verifying the cached contents in background
+	Scrub FileCacheScrub
+	// Prewarm is the option of pre-warming the cache when a release is announced by watch
+	Prewarm FileCachePrewarm
 	// CleanupIntervalSeconds is interval seconds of cleanup, not exposed for configuration now, use default value
 	// CleanupIntervalSeconds int64
 	// RetentionRate is retention rate of cleanup, not exposed for configuration now, use default value
 	// RetentionRate float64
 }
 
+// FileCacheScrub option for verifying the cached contents in background, the zero values mean the default settings
+type FileCacheScrub struct {
+	// Enabled is whether verify the cached contents in background
+	Enabled bool
+	// Interval is the interval of the scrub rounds, default is 1h
+	Interval time.Duration
+	// Rate is the bytes hashed per second, 0 means no limit
+	Rate int64
+	// VerifiedTTL is the duration in which a verified content is not hashed again on lookup, default is 24h
+	VerifiedTTL time.Duration
+	// Quarantine is whether move the corrupt contents into the quarantine dir instead of deleting them
+	Quarantine bool
+}
+
+// FileCachePrewarm option for downloading the missing contents of an announced release into the cache in background
+type FileCachePrewarm struct {
+	// Enabled is whether pre-warm the cache when a release is announced
+	Enabled bool
+	// DelayApply is whether delay applying the release until the pre-warm completes, so that it is a local copy
+	DelayApply bool
+	// DelayTimeout is the max duration of delaying the apply, default is 10m
+	DelayTimeout time.Duration
+}
+
 // P2PDownload option for p2p download file
 type P2PDownload struct {
 	// Enabled is whether enable p2p download file
@@ -76,19 +180,83 @@ type P2PDownload struct {
 	ContainerName string
 }
 
+// P2PDownloadSettings settings of the p2p download, the zero values mean the default settings
+type P2PDownloadSettings struct {
+	// Threshold is the min byte size of the file downloaded by p2p, default is 2MB
+	Threshold uint64
+	// PollInterval is the interval of polling the p2p download task status, default is 5s
+	PollInterval time.Duration
+	// Timeout is the timeout of waiting for the p2p download task, default is 10m
+	Timeout time.Duration
+	// StagingDir is the dir which gse downloads the files into, default is the os temp dir
+	StagingDir string
+}
+
 // KvCache option for kv cache
 type KvCache struct {
 	// Enabled is whether enable kv cache
 	Enabled bool
 	// ThresholdMB is threshold megabyte of kv cache
 	ThresholdMB float64
+	// Snapshot is the option of persisting the kv cache on disk
+	Snapshot KvSnapshot
+}
+
+// KvSnapshot option for persisting the last known good kv values on disk, which are loaded into the kv cache on
+// start, so that Get can fall back to them after a restart while the feed server is unavailable
+type KvSnapshot struct {
+	// Enabled is whether persist the kv values on disk, it takes effect only if the kv cache is enabled
+	Enabled bool
+	// Dir is the dir of the kv snapshots
+	Dir string
+	// MaxSize is the max byte size of the snapshot of each app, default is 10MB
+	MaxSize uint64
+	// EncryptionKey is the AES key of 16, 24 or 32 bytes to encrypt the secret values at rest, the secret values are
+	// stored in plain text if it is empty
+	EncryptionKey []byte
+}
+
+// VersionedDir option for versioned release directory layout
+type VersionedDir struct {
+	// Enabled is whether download files into releases/<releaseID> and switch the current symlink atomically
+	Enabled bool
+	// RetainReleases is the count of release dirs to retain, including the current one
+	RetainReleases int
+}
+
+// FileDeletion option for deleting the files which are not in the release, only the files created by bscp
+// can be deleted, the files created by others under the files dir, eg: logs or files written by hooks, are kept.
+type FileDeletion struct {
+	// NeverDelete is whether never delete any file which is not in the release
+	NeverDelete bool
+	// Ignore is the glob patterns of the files which are never deleted, matched against the slash separated path
+	// relative to the files dir and its parent dirs, a pattern without '/' is also matched against the file name
+	Ignore []string
+}
+
+// DownloadPriority option for prioritizing the downloads, the small text files are downloaded first and the large
+// files are downloaded last, so that the configs which the app needs first are ready as soon as possible.
+type DownloadPriority struct {
+	// Enabled is whether prioritize the downloads
+	Enabled bool
+	// SmallFileSize is the max byte size of the small files, the text files not larger than it are downloaded
+	// first, and the files larger than it are downloaded last
+	SmallFileSize uint64
 }
 
 const (
+	// DefaultSmallFileSize is the default max byte size of the small files for download priority, which is 1MB
+	DefaultSmallFileSize = 1024 * 1024
+	// DefaultRetainReleases is the default count of release dirs to retain in versioned layout
+	DefaultRetainReleases = 3
 	// DefaultCleanupIntervalSeconds is the bscp cli default file cache cleanup interval.
 	DefaultCleanupIntervalSeconds = 300
 	// DefaultCacheRetentionRate is the bscp cli default file cache retention rate, which is 90%
 	DefaultCacheRetentionRate = 0.9
+	// DefaultPrewarmDelayTimeout is the default max duration of delaying the apply until the cache pre-warm completes
+	DefaultPrewarmDelayTimeout = 10 * time.Minute
+	// MinRangePartSize is the min byte size of each part of the range download, which is 1MB
+	MinRangePartSize = 1024 * 1024
 )
 
 // Option setter for bscp sdk options
@@ -144,6 +312,20 @@ func WithP2PDownload(enabled bool) Option {
 	}
 }
 
+// WithP2PDownloadSettings set the settings of the p2p download
+func WithP2PDownloadSettings(s P2PDownloadSettings) Option {
+	return func(o *options) error {
+		if s.PollInterval < 0 || s.Timeout < 0 {
+			return errors.New("p2p download poll interval and timeout should not be negative")
+		}
+		if s.StagingDir != "" && !filepath.IsAbs(s.StagingDir) {
+			return fmt.Errorf("p2p download staging dir %s should be an absolute path", s.StagingDir)
+		}
+		o.p2pDownloadSettings = s
+		return nil
+	}
+}
+
 // WithToken set sdk token
 func WithToken(token string) Option {
 	return func(o *options) error {
@@ -200,6 +382,15 @@ func WithKvCache(c KvCache) Option {
 	}
 }
 
+// WithKvStalePolicy sets the default stale policy of Get, which decides whether it falls back to the cached kv value
+// when feed-server is unavailable, default is StalePolicyAllowStale
+func WithKvStalePolicy(p StalePolicy) Option {
+	return func(o *options) error {
+		o.stalePolicy = p
+		return nil
+	}
+}
+
 // WithEnableMonitorResourceUsage 是否采集/监控资源使用率
 func WithEnableMonitorResourceUsage(enable bool) Option {
 	return func(o *options) error {
@@ -216,6 +407,151 @@ func WithTextLineBreak(lineBreak string) Option {
 	}
 }
 
+// WithVersionedDir set versioned release directory layout
+func WithVersionedDir(v VersionedDir) Option {
+	return func(o *options) error {
+		if v.Enabled && runtime.GOOS == "windows" {
+			return errors.New("versioned dir layout is not supported on windows")
+		}
+		if v.RetainReleases <= 0 {
+			v.RetainReleases = DefaultRetainReleases
+		}
+		o.versionedDir = v
+		return nil
+	}
+}
+
+// WithAutoRollback set whether restore the previous applied release when the post hook of a new release failed
+func WithAutoRollback(enabled bool) Option {
+	return func(o *options) error {
+		o.autoRollback = enabled
+		return nil
+	}
+}
+
+// WithFileDeletion set the option for deleting the files which are not in the release
+func WithFileDeletion(d FileDeletion) Option {
+	return func(o *options) error {
+		for _, pattern := range d.Ignore {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid file deletion ignore pattern %s, err: %s", pattern, err.Error())
+			}
+		}
+		o.fileDeletion = d
+		return nil
+	}
+}
+
+// WithBandwidthLimit set the global download bandwidth limit in bytes per second, 0 means no limit
+func WithBandwidthLimit(bytesPerSecond int64) Option {
+	return func(o *options) error {
+		if bytesPerSecond < 0 {
+			return fmt.Errorf("invalid bandwidth limit %d, it should not be negative", bytesPerSecond)
+		}
+		o.bandwidthLimit = bytesPerSecond
+		return nil
+	}
+}
+
+// WithDownloadPriority set the download priority option
+func WithDownloadPriority(p DownloadPriority) Option {
+	return func(o *options) error {
+		if p.SmallFileSize == 0 {
+			p.SmallFileSize = DefaultSmallFileSize
+		}
+		o.downloadPriority = p
+		return nil
+	}
+}
+
+// WithSources set the content sources, e.g. a local mirror directory or an on-prem http cache, which are tried in
+// order before downloading from the feed server. The content from any source is verified by the SHA256 signature,
+// and the next source is tried on a miss.
+func WithSources(sources ...source.Source) Option {
+	return func(o *options) error {
+		for _, s := range sources {
+			if s == nil {
+				return fmt.Errorf("invalid source, it should not be nil")
+			}
+		}
+		o.sources = sources
+		return nil
+	}
+}
+
+// WithSharedStore set the node local shared store, the first client on the node downloads the content and the
+// others reuse the verified content in the store
+func WithSharedStore(s SharedStore) Option {
+	return func(o *options) error {
+		if s.Enabled && s.Dir == "" {
+			return errors.New("shared store dir should not be empty when it is enabled")
+		}
+		o.sharedStore = s
+		return nil
+	}
+}
+
+// WithHTTPTransport set the http transport option for downloading from the repository
+func WithHTTPTransport(t HTTPTransport) Option {
+	return func(o *options) error {
+		if t.DialTimeout < 0 || t.TLSHandshakeTimeout < 0 || t.ResponseHeaderTimeout < 0 || t.IdleConnTimeout < 0 {
+			return errors.New("http transport timeouts should not be negative")
+		}
+		if t.MaxIdleConns < 0 || t.MaxIdleConnsPerHost < 0 {
+			return errors.New("http transport max idle conns should not be negative")
+		}
+		if t.ProxyURL != "" {
+			if _, err := url.Parse(t.ProxyURL); err != nil {
+				return fmt.Errorf("invalid proxy url %s, err: %s", t.ProxyURL, err.Error())
+			}
+		}
+		o.httpTransport = t
+		return nil
+	}
+}
+
+// WithFileDownloadTimeout set the total timeout of downloading a file, 0 means no limit
+func WithFileDownloadTimeout(timeout time.Duration) Option {
+	return func(o *options) error {
+		if timeout < 0 {
+			return fmt.Errorf("invalid file download timeout %s, it should not be negative", timeout)
+		}
+		o.fileDownloadTimeout = timeout
+		return nil
+	}
+}
+
+// WithRangePartSize set the byte size of each part of the range download, the file larger than half of it is
+// downloaded with range policy, 0 means the default 20MB
+func WithRangePartSize(size uint64) Option {
+	return func(o *options) error {
+		if size != 0 && size < MinRangePartSize {
+			return fmt.Errorf("invalid range part size %d, it should not be less than %d", size, MinRangePartSize)
+		}
+		o.rangePartSize = size
+		return nil
+	}
+}
+
+// WithTracerProvider traces the release applications by the tracer provider, which is flushed and shutdown by
+// the caller
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(o *options) error {
+		o.tracerProvider = tp
+		return nil
+	}
+}
+
+// WithTraceExporter traces the release applications and exports the spans to the exporter, the spans of a release
+// application are flushed when it is done, eg: an in-memory exporter can be used in tests and a stdout exporter
+// for local debugging. It is ignored if WithTracerProvider is set.
+func WithTraceExporter(exporter sdktrace.SpanExporter) Option {
+	return func(o *options) error {
+		o.traceExporter = exporter
+		return nil
+	}
+}
+
 // AppOptions options for app pull and watch
 type AppOptions struct {
 	// Match matches config items
@@ -224,6 +560,31 @@ type AppOptions struct {
 	Labels map[string]string
 	// UID instance unique uid
 	UID string
+	// AutoRollback overwrites the client auto rollback option for the app if set
+	AutoRollback *bool
+	// PathMappings rules to map the config items to the target paths on the host
+	PathMappings []PathMapping
+	// BandwidthLimit the download bandwidth limit of the app in bytes per second, 0 means no limit
+	BandwidthLimit int64
+	// StalePolicy overwrites the client stale policy of Get if set
+	StalePolicy *StalePolicy
+}
+
+// PathMapping maps the config items to the target path on the host, the files are still written to the files dir
+// and then copied to the target path.
+type PathMapping struct {
+	// Match is the config item path prefix, eg: /etc/nginx, or glob pattern matched against the full config
+	// item path, eg: /etc/nginx/*.conf
+	Match string
+	// Target is the destination root, the config item path under the prefix is kept for prefix rule, and the
+	// config item is written under the destination root with its name for glob rule
+	Target string
+	// User overwrites the owner of the target file if set
+	User string
+	// UserGroup overwrites the owner group of the target file if set
+	UserGroup string
+	// Privilege overwrites the mode of the target file if set, eg: 644
+	Privilege string
 }
 
 // AppOption setter for app options
@@ -249,3 +610,78 @@ func WithAppUID(uid string) AppOption {
 		o.UID = uid
 	}
 }
+
+// WithAppAutoRollback set whether restore the previous applied release when the post hook of a new release
+// of the app failed, overwrites the client option
+func WithAppAutoRollback(enabled bool) AppOption {
+	return func(o *AppOptions) {
+		o.AutoRollback = &enabled
+	}
+}
+
+// autoRollbackEnabled returns whether auto rollback is enabled for the app
+func (o *AppOptions) autoRollbackEnabled(global bool) bool {
+	if o.AutoRollback != nil {
+		return *o.AutoRollback
+	}
+	return global
+}
+
+// WithAppPathMappings set the rules to map the config items to the target paths on the host
+func WithAppPathMappings(mappings []PathMapping) AppOption {
+	return func(o *AppOptions) {
+		o.PathMappings = mappings
+	}
+}
+
+// WithAppBandwidthLimit set the download bandwidth limit of the app in bytes per second, which is shared by all the
+// downloads of the app and applied besides the global bandwidth limit, 0 means no limit
+func WithAppBandwidthLimit(bytesPerSecond int64) AppOption {
+	return func(o *AppOptions) {
+		o.BandwidthLimit = bytesPerSecond
+	}
+}
+
+// WithAppStalePolicy overwrites the client stale policy for the Get call
+func WithAppStalePolicy(p StalePolicy) AppOption {
+	return func(o *AppOptions) {
+		o.StalePolicy = &p
+	}
+}
+
+// ErrStaleKvValue is returned by Get when feed-server is unavailable and the cached kv value is not allowed by the
+// stale policy
+var ErrStaleKvValue = errors.New("the cached kv value is not allowed by the stale policy")
+
+// StalePolicy decides whether Get falls back to the cached kv value when feed-server is unavailable, the zero value
+// allows the fallback without limit
+type StalePolicy struct {
+	// Strict disallows the fallback
+	Strict bool
+	// MaxAge limits the age of the cached value since it is fetched from feed-server, 0 means no limit
+	MaxAge time.Duration
+}
+
+var (
+	// StalePolicyStrict never returns the cached value when feed-server is unavailable
+	StalePolicyStrict = StalePolicy{Strict: true}
+	// StalePolicyAllowStale returns the cached value when feed-server is unavailable however old it is
+	StalePolicyAllowStale = StalePolicy{}
+)
+
+// StalePolicyAllowStaleUpTo returns the cached value when feed-server is unavailable if it is fetched within maxAge
+func StalePolicyAllowStaleUpTo(maxAge time.Duration) StalePolicy {
+	return StalePolicy{MaxAge: maxAge}
+}
+
+// check returns ErrStaleKvValue if the cached value fetched at the time is not allowed
+func (p StalePolicy) check(fetchedAt time.Time) error {
+	if p.Strict {
+		return fmt.Errorf("%w, the policy is strict", ErrStaleKvValue)
+	}
+	if p.MaxAge > 0 && time.Since(fetchedAt) > p.MaxAge {
+		return fmt.Errorf("%w, the value is fetched at %s, older than %s", ErrStaleKvValue,
+			fetchedAt.Format(time.RFC3339), p.MaxAge)
+	}
+	return nil
+}
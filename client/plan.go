@@ -0,0 +1,299 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/dal/table"
+	pbhook "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/core/hook"
+	sfs "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/sf-share"
+	"github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/tools"
+
+	"github.com/TencentBlueKing/bscp-go/internal/util"
+)
+
+// PlanAction is the action which would be taken on the file when the release is applied
+type PlanAction string
+
+const (
+	// PlanActionCreate the file does not exist and would be created
+	PlanActionCreate PlanAction = "create"
+	// PlanActionUpdate the content of the file is changed and would be updated
+	PlanActionUpdate PlanAction = "update"
+	// PlanActionDelete the file is not in the release and would be deleted
+	PlanActionDelete PlanAction = "delete"
+	// PlanActionPermission the content of the file is unchanged but its permission would be changed
+	PlanActionPermission PlanAction = "permission"
+)
+
+// ErrDryRun is returned by the watch callback which only plans the release instead of applying it, the release is
+// not reported as a version change, so the status, the current release and the kv snapshot of the app are kept
+var ErrDryRun = errors.New("the release is planned by the dry run and not applied")
+
+// ReleasePlan is what would change when the release is applied
+type ReleasePlan struct {
+	// App app name
+	App string `json:"app"`
+	// ReleaseID release id
+	ReleaseID uint32 `json:"release_id"`
+	// ReleaseName release name
+	ReleaseName string `json:"release_name"`
+	// Files the files which would be changed
+	Files []*FilePlan `json:"files"`
+	// Unchanged the count of files which would not be changed
+	Unchanged int `json:"unchanged"`
+	// Hooks the hooks which would be executed, in order
+	Hooks []*HookPlan `json:"hooks"`
+}
+
+// FilePlan is the change of a file
+type FilePlan struct {
+	// Action the action which would be taken on the file
+	Action PlanAction `json:"action"`
+	// Path the local path of the file
+	Path string `json:"path"`
+	// Signature the SHA256 of the file content in the release
+	Signature string `json:"signature,omitempty"`
+	// ByteSize the size of the file content in the release
+	ByteSize uint64 `json:"byte_size,omitempty"`
+	// Privilege the file privilege in the release
+	Privilege string `json:"privilege,omitempty"`
+	// User the file owner in the release
+	User string `json:"user,omitempty"`
+	// UserGroup the file owner group in the release
+	UserGroup string `json:"user_group,omitempty"`
+}
+
+// HookPlan is a hook which would be executed
+type HookPlan struct {
+	// Type hook type, pre_hook or post_hook
+	Type table.HookType `json:"type"`
+	// Name hook name
+	Name string `json:"name"`
+	// ScriptType hook script type, eg: shell, python
+	ScriptType string `json:"script_type"`
+	// RevisionName hook revision name
+	RevisionName string `json:"revision_name"`
+}
+
+// Plan computes what would change when the release is applied, without writing anything to disk
+// and reporting anything to the server.
+func (r *Release) Plan() (*ReleasePlan, error) {
+	plan := &ReleasePlan{
+		ReleaseID:   r.ReleaseID,
+		ReleaseName: r.ReleaseName,
+		Files:       make([]*FilePlan, 0),
+		Hooks:       make([]*HookPlan, 0),
+	}
+	if r.AppMate != nil {
+		plan.App = r.AppMate.App
+	}
+
+	filesDir := filepath.Join(r.AppDir, filesDirName)
+	for _, file := range r.FileItems {
+		action, err := planFile(filesDir, file)
+		if err != nil {
+			return nil, err
+		}
+		if action == "" {
+			plan.Unchanged++
+			continue
+		}
+		fp := &FilePlan{
+			Action:    action,
+			Path:      filepath.Join(filesDir, file.Path, file.Name),
+			Signature: file.FileMeta.ContentSpec.Signature,
+			ByteSize:  file.FileMeta.ContentSpec.ByteSize,
+		}
+		if pm := file.FileMeta.ConfigItemSpec.Permission; pm != nil {
+			fp.Privilege, fp.User, fp.UserGroup = pm.Privilege, pm.User, pm.UserGroup
+		}
+		plan.Files = append(plan.Files, fp)
+	}
+	plan.Files = append(plan.Files, planTargets(r.FileItems)...)
+
+	// old files and targets are deleted in watch mode, or gone with the old release dir in versioned layout,
+	// they are kept and still managed in legacy pull mode
+	if r.ClientMode == sfs.Watch || r.versionedDir.Enabled {
+		deletes, err := r.planDeletes(filesDir)
+		if err != nil {
+			return nil, err
+		}
+		plan.Files = append(plan.Files, deletes...)
+	}
+
+	if hp := newHookPlan(table.PreHook, r.PreHook); hp != nil {
+		plan.Hooks = append(plan.Hooks, hp)
+	}
+	if hp := newHookPlan(table.PostHook, r.PostHook); hp != nil {
+		plan.Hooks = append(plan.Hooks, hp)
+	}
+	return plan, nil
+}
+
+// planFile returns the action which would be taken on the file, empty if the file is unchanged
+func planFile(filesDir string, file *ConfigItemFile) (PlanAction, error) {
+	fileDir := filepath.Join(filesDir, file.Path)
+	filePath := filepath.Join(fileDir, file.Name)
+	if _, err := os.Stat(filePath); err != nil {
+		if os.IsNotExist(err) {
+			return PlanActionCreate, nil
+		}
+		return "", err
+	}
+	var exists bool
+	var err error
+	if file.FileMeta.ConfigItemSpec.FileType == "text" && file.TextLineBreak != "" {
+		exists, err = checkTextFileExists(filePath, file)
+	} else {
+		exists, err = checkFileExists(fileDir, file.FileMeta)
+	}
+	if err != nil {
+		return "", err
+	}
+	if !exists {
+		return PlanActionUpdate, nil
+	}
+	pm := file.FileMeta.ConfigItemSpec.Permission
+	if runtime.GOOS == "windows" || pm == nil {
+		return "", nil
+	}
+	same, err := util.CheckFilePermission(filePath, pm)
+	if err != nil || !same {
+		// the permission would be set again if it can not be checked
+		return PlanActionPermission, nil
+	}
+	return "", nil
+}
+
+// checkTextFileExists checks the content of the text file whose line break is converted is the converted content
+// of the release. The local file is unchanged if it is converted already, and converting it back to the line break
+// of the release content matches the SHA256. The release content with mixed line breaks is always reported changed.
+func checkTextFileExists(filePath string, file *ConfigItemFile) (bool, error) {
+	content, err := os.ReadFile(filePath)
+	if err != nil {
+		return false, err
+	}
+	converted, err := util.ConvertLineBreak(content, file.TextLineBreak)
+	if err != nil {
+		return false, err
+	}
+	if !bytes.Equal(converted, content) {
+		return false, nil
+	}
+	for _, lineBreak := range []string{"LF", "CRLF", "CR"} {
+		origin, err := util.ConvertLineBreak(content, lineBreak)
+		if err != nil {
+			return false, err
+		}
+		sum := sha256.Sum256(origin)
+		if hex.EncodeToString(sum[:]) == file.FileMeta.ContentSpec.Signature {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// planTargets returns the mapped target files which would be written
+func planTargets(files []*ConfigItemFile) []*FilePlan {
+	plans := make([]*FilePlan, 0)
+	for _, file := range files {
+		if file.TargetPath == "" {
+			continue
+		}
+		var action PlanAction
+		same, err := checkTargetExists(file)
+		switch {
+		case os.IsNotExist(err):
+			action = PlanActionCreate
+		case err != nil || !same:
+			action = PlanActionUpdate
+		default:
+			continue
+		}
+		fp := &FilePlan{
+			Action:    action,
+			Path:      file.TargetPath,
+			Signature: file.FileMeta.ContentSpec.Signature,
+			ByteSize:  file.FileMeta.ContentSpec.ByteSize,
+		}
+		if pm := file.TargetPermission; pm != nil {
+			fp.Privilege, fp.User, fp.UserGroup = pm.Privilege, pm.User, pm.UserGroup
+		}
+		plans = append(plans, fp)
+	}
+	return plans
+}
+
+// planDeletes returns the managed files and the mapped targets which would be deleted, the files not created by
+// bscp and the protected ones are kept
+func (r *Release) planDeletes(filesDir string) ([]*FilePlan, error) {
+	deletes, _, err := r.staleManagedFiles(filesDir)
+	if err != nil {
+		return nil, err
+	}
+	targets, _, err := r.staleTargets()
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(deletes)+len(targets))
+	for _, p := range deletes {
+		paths = append(paths, filepath.Join(filesDir, filepath.FromSlash(p)))
+	}
+	paths = append(paths, targets...)
+
+	plans := make([]*FilePlan, 0, len(paths))
+	for _, filePath := range paths {
+		if _, err := os.Stat(filePath); err != nil {
+			// already deleted by others
+			continue
+		}
+		plans = append(plans, &FilePlan{
+			Action: PlanActionDelete,
+			Path:   filePath,
+		})
+	}
+	return plans, nil
+}
+
+// checkTargetExists checks the content of the mapped target file is the content of the release
+func checkTargetExists(file *ConfigItemFile) (bool, error) {
+	if file.FileMeta.ConfigItemSpec.FileType == "text" && file.TextLineBreak != "" {
+		return checkTextFileExists(file.TargetPath, file)
+	}
+	sha, err := tools.FileSHA256(file.TargetPath)
+	if err != nil {
+		return false, err
+	}
+	return sha == file.FileMeta.ContentSpec.Signature, nil
+}
+
+// newHookPlan returns the hook plan, nil if the hook is not set
+func newHookPlan(hookType table.HookType, hook *pbhook.HookSpec) *HookPlan {
+	if hook == nil {
+		return nil
+	}
+	return &HookPlan{
+		Type:         hookType,
+		Name:         hook.Name,
+		ScriptType:   hook.Type,
+		RevisionName: hook.RevisionName,
+	}
+}
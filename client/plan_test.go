@@ -0,0 +1,160 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/TencentBlueKing/bscp-go/internal/util/eventmeta"
+)
+
+// newTestTextFile returns the text config item file of the content, whose line break is converted
+func newTestTextFile(t *testing.T, name, content, lineBreak string) *ConfigItemFile {
+	t.Helper()
+	file := newTestFile(t, "/", name, content)
+	file.FileMeta.ConfigItemSpec.FileType = "text"
+	file.TextLineBreak = lineBreak
+	return file
+}
+
+func TestPlan(t *testing.T) {
+	created := newTestFile(t, "/", "created.conf", "created")
+	updated := newTestFile(t, "/", "updated.conf", "updated")
+	unchanged := newTestFile(t, "/", "unchanged.conf", "unchanged")
+	permission := newTestFile(t, "/", "permission.conf", "permission")
+	mapped := newTestFile(t, "/", "mapped.conf", "mapped")
+	r := newTestRelease(t, 2, created, updated, unchanged, permission, mapped)
+	mapped.TargetPath = filepath.Join(t.TempDir(), "etc", "mapped.conf")
+	filesDir := filepath.Join(r.AppDir, filesDirName)
+
+	writeTestFile(t, filesDir, updated, "old")
+	writeTestFile(t, filesDir, unchanged, "unchanged")
+	writeTestFile(t, filesDir, permission, "permission")
+	if err := os.Chmod(filepath.Join(filesDir, "permission.conf"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filesDir, mapped, "mapped")
+	writeTestFile(t, filesDir, &ConfigItemFile{Path: "/", Name: "old.conf"}, "old")
+	writeTestFile(t, filesDir, &ConfigItemFile{Path: "/", Name: "unmanaged.conf"}, "unmanaged")
+	// the target mapped by the previous release is not in the release
+	staleTarget := filepath.Join(t.TempDir(), "stale.conf")
+	if err := os.WriteFile(staleTarget, []byte("stale"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := eventmeta.WriteManagedFiles(r.AppDir, &eventmeta.ManagedFiles{
+		Files:   []string{"mapped.conf", "old.conf", "permission.conf", "unchanged.conf", "updated.conf"},
+		Targets: []string{staleTarget}}); err != nil {
+		t.Fatal(err)
+	}
+	before := listTestDir(t, r.AppDir)
+
+	plan, err := r.Plan()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]PlanAction)
+	for _, f := range plan.Files {
+		got[f.Path] = f.Action
+	}
+	want := map[string]PlanAction{
+		filepath.Join(filesDir, "created.conf"):    PlanActionCreate,
+		filepath.Join(filesDir, "updated.conf"):    PlanActionUpdate,
+		filepath.Join(filesDir, "permission.conf"): PlanActionPermission,
+		mapped.TargetPath:                          PlanActionCreate,
+		filepath.Join(filesDir, "old.conf"):        PlanActionDelete,
+		staleTarget:                                PlanActionDelete,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("plan files = %v, want %v", got, want)
+	}
+	if plan.Unchanged != 2 {
+		t.Errorf("unchanged files = %d, want 2", plan.Unchanged)
+	}
+
+	// nothing is written by the plan
+	if after := listTestDir(t, r.AppDir); !reflect.DeepEqual(after, before) {
+		t.Errorf("app dir is changed by the plan, before: %v, after: %v", before, after)
+	}
+	if _, err := os.Stat(mapped.TargetPath); !os.IsNotExist(err) {
+		t.Errorf("the target file is written by the plan, err: %v", err)
+	}
+	if _, err := os.Stat(staleTarget); err != nil {
+		t.Errorf("the stale target file is deleted by the plan, err: %v", err)
+	}
+}
+
+func TestPlanTextLineBreak(t *testing.T) {
+	tests := []struct {
+		name      string
+		content   string
+		lineBreak string
+		local     string
+		want      PlanAction
+	}{
+		{name: "converted to CRLF", content: "a\nb\n", lineBreak: "CRLF", local: "a\r\nb\r\n"},
+		{name: "converted to CR", content: "a\r\nb\r\n", lineBreak: "CR", local: "a\rb\r"},
+		{name: "converted to LF", content: "a\r\nb\r\n", lineBreak: "LF", local: "a\nb\n"},
+		{name: "not converted", content: "a\nb\n", lineBreak: "CRLF", local: "a\nb\n", want: PlanActionUpdate},
+		{name: "content changed", content: "a\nb\n", lineBreak: "CRLF", local: "a\r\nc\r\n", want: PlanActionUpdate},
+		{name: "mixed line breaks", content: "a\nb\r\n", lineBreak: "CRLF", local: "a\r\nb\r\n",
+			want: PlanActionUpdate},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := newTestTextFile(t, "app.conf", tt.content, tt.lineBreak)
+			file.TargetPath = filepath.Join(t.TempDir(), "app.conf")
+			r := newTestRelease(t, 1, file)
+			filesDir := filepath.Join(r.AppDir, filesDirName)
+			writeTestFile(t, filesDir, file, tt.local)
+			if err := os.WriteFile(file.TargetPath, []byte(tt.local), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			action, err := planFile(filesDir, file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if action != tt.want {
+				t.Errorf("planFile() = %q, want %q", action, tt.want)
+			}
+			var targetAction PlanAction
+			if plans := planTargets([]*ConfigItemFile{file}); len(plans) != 0 {
+				targetAction = plans[0].Action
+			}
+			if targetAction != tt.want {
+				t.Errorf("action of the target file = %q, want %q", targetAction, tt.want)
+			}
+		})
+	}
+}
+
+// listTestDir returns the relative paths of all the files and dirs under the dir
+func listTestDir(t *testing.T, dir string) []string {
+	t.Helper()
+	var paths []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(dir, path)
+		paths = append(paths, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return paths
+}
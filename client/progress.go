@@ -0,0 +1,168 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"path"
+	"sync"
+	"time"
+)
+
+const (
+	// progressInterval is the min interval of reporting the bytes progress, the file completion is always reported
+	progressInterval = 200 * time.Millisecond
+)
+
+// FileProgress is the download progress of a config item file
+type FileProgress struct {
+	// Path the absolute path of the config item, e.g. /etc/app.conf
+	Path string
+	// DoneBytes the downloaded byte size
+	DoneBytes uint64
+	// TotalBytes the byte size of the file
+	TotalBytes uint64
+	// Completed is whether the file has been downloaded or is already up to date
+	Completed bool
+}
+
+// FileProgressFunc is called when the download progress of the file changes
+type FileProgressFunc func(progress FileProgress)
+
+// ReleaseProgress is the overall download progress of a release
+type ReleaseProgress struct {
+	ReleaseID uint32
+	// File the progress of the file which triggers the report
+	File FileProgress
+	// DoneFiles the count of the completed files
+	DoneFiles int
+	// TotalFiles the count of all the files
+	TotalFiles int
+	// DoneBytes the downloaded byte size of all the files
+	DoneBytes uint64
+	// TotalBytes the byte size of all the files
+	TotalBytes uint64
+	// Throughput the average download speed in bytes per second since the first report
+	Throughput float64
+	// ETA the estimated remaining time, zero if unknown
+	ETA time.Duration
+}
+
+// ProgressFunc is called when the download progress of the release changes, the calls are serialized,
+// so it needs not to be goroutine safe.
+type ProgressFunc func(progress ReleaseProgress)
+
+// fileProgress tracks the download progress of a config item file
+type fileProgress struct {
+	lock sync.Mutex
+	FileProgress
+	fn FileProgressFunc
+}
+
+// newFileProgress creates the progress of the file
+func newFileProgress(file *ConfigItemFile, fn FileProgressFunc) *fileProgress {
+	return &fileProgress{
+		FileProgress: FileProgress{
+			Path:       path.Join(file.Path, file.Name),
+			TotalBytes: file.FileMeta.ContentSpec.ByteSize,
+		},
+		fn: fn,
+	}
+}
+
+// add adds the downloaded bytes, the bytes of the retried download are capped by the file size
+func (p *fileProgress) add(n uint64) {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.Completed {
+		return
+	}
+	p.DoneBytes += n
+	if p.DoneBytes > p.TotalBytes {
+		p.DoneBytes = p.TotalBytes
+	}
+	p.fn(p.FileProgress)
+}
+
+// complete marks the file completed, it is reported only once
+func (p *fileProgress) complete() {
+	if p == nil {
+		return
+	}
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.Completed {
+		return
+	}
+	p.DoneBytes = p.TotalBytes
+	p.Completed = true
+	p.fn(p.FileProgress)
+}
+
+// releaseProgress aggregates the progress of the files of a release
+type releaseProgress struct {
+	lock       sync.Mutex
+	progress   ReleaseProgress
+	files      map[string]uint64
+	start      time.Time
+	lastReport time.Time
+	fn         ProgressFunc
+}
+
+// TrackProgress reports the download progress of the release files to fn, including the per-file bytes,
+// the overall bytes and files, the throughput and the ETA. It should be called before the files are updated.
+func (r *Release) TrackProgress(fn ProgressFunc) {
+	if fn == nil {
+		return
+	}
+	rp := &releaseProgress{
+		progress: ReleaseProgress{ReleaseID: r.ReleaseID, TotalFiles: len(r.FileItems)},
+		files:    make(map[string]uint64, len(r.FileItems)),
+		fn:       fn,
+	}
+	for _, file := range r.FileItems {
+		rp.progress.TotalBytes += file.FileMeta.ContentSpec.ByteSize
+		file.SetProgress(rp.update)
+	}
+}
+
+// update updates the overall progress by the file progress
+func (rp *releaseProgress) update(fp FileProgress) {
+	rp.lock.Lock()
+	defer rp.lock.Unlock()
+	now := time.Now()
+	if rp.start.IsZero() {
+		rp.start = now
+	}
+	rp.progress.DoneBytes += fp.DoneBytes - rp.files[fp.Path]
+	rp.files[fp.Path] = fp.DoneBytes
+	if fp.Completed {
+		rp.progress.DoneFiles++
+	} else if now.Sub(rp.lastReport) < progressInterval {
+		// the bytes progress is throttled, the completion is always reported
+		return
+	}
+	rp.lastReport = now
+	rp.progress.File = fp
+	rp.progress.Throughput, rp.progress.ETA = 0, 0
+	if elapsed := now.Sub(rp.start).Seconds(); elapsed > 0 {
+		rp.progress.Throughput = float64(rp.progress.DoneBytes) / elapsed
+	}
+	if rp.progress.Throughput > 0 && rp.progress.TotalBytes > rp.progress.DoneBytes {
+		rp.progress.ETA = time.Duration(float64(rp.progress.TotalBytes-rp.progress.DoneBytes) /
+			rp.progress.Throughput * float64(time.Second))
+	}
+	rp.fn(rp.progress)
+}
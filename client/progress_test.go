@@ -0,0 +1,83 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFileProgress(t *testing.T) {
+	var reports []FileProgress
+	file := newTestFile(t, "/etc", "app.conf", "0123456789")
+	file.SetProgress(func(p FileProgress) { reports = append(reports, p) })
+	p := file.progress
+
+	p.add(6)
+	// the download is retried, its bytes are reported again
+	p.add(6)
+	if last := reports[len(reports)-1]; last.DoneBytes != 10 || last.TotalBytes != 10 || last.Completed {
+		t.Errorf("the retried bytes are not capped by the file size: %+v", last)
+	}
+	p.complete()
+	p.complete()
+	p.add(1)
+	if len(reports) != 3 {
+		t.Fatalf("expected 3 reports, got %+v", reports)
+	}
+	if last := reports[2]; last.Path != "/etc/app.conf" || last.DoneBytes != 10 || !last.Completed {
+		t.Errorf("unexpected completion report: %+v", last)
+	}
+
+	// the untracked file reports nothing
+	file.SetProgress(nil)
+	file.progress.add(1)
+	file.progress.complete()
+}
+
+func TestTrackProgress(t *testing.T) {
+	a := newTestFile(t, "/etc", "a.conf", "0123456789")
+	b := newTestFile(t, "/etc", "b.conf", "01234")
+	r := newTestRelease(t, 1, a, b)
+	var reports []ReleaseProgress
+	r.TrackProgress(func(p ReleaseProgress) { reports = append(reports, p) })
+
+	a.progress.add(4)
+	// the bytes progress within the interval is throttled
+	a.progress.add(4)
+	if len(reports) != 1 || reports[0].DoneBytes != 4 || reports[0].TotalBytes != 15 || reports[0].TotalFiles != 2 {
+		t.Fatalf("unexpected reports: %+v", reports)
+	}
+	time.Sleep(progressInterval)
+	// the retried download of a reports its bytes again
+	a.progress.add(10)
+	if last := reports[len(reports)-1]; last.DoneBytes != 10 || last.File.DoneBytes != 10 {
+		t.Errorf("the retried bytes are not capped by the file size: %+v", last)
+	}
+	if last := reports[len(reports)-1]; last.Throughput <= 0 || last.ETA <= 0 {
+		t.Errorf("expected the throughput and the ETA are estimated: %+v", last)
+	}
+
+	// the completion is always reported
+	a.progress.complete()
+	b.progress.complete()
+	last := reports[len(reports)-1]
+	if last.DoneFiles != 2 || last.DoneBytes != 15 || last.File.Path != "/etc/b.conf" || last.ETA != 0 {
+		t.Errorf("unexpected final report: %+v", last)
+	}
+	for _, p := range reports {
+		if p.DoneBytes > p.TotalBytes {
+			t.Errorf("the done bytes are larger than the total bytes: %+v", p)
+		}
+	}
+}
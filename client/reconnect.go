@@ -20,6 +20,7 @@ import (
 	"golang.org/x/exp/slog"
 
 	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+	"github.com/TencentBlueKing/bscp-go/pkg/metrics"
 )
 
 // NotifyReconnect notify the watcher to reconnect the upstream server.
@@ -38,6 +39,7 @@ func (w *watcher) waitForReconnectSignal() {
 			return
 		case signal := <-w.reconnectChan:
 			logger.Info("received reconnect signal", slog.String("reason", signal.String()), slog.String("rid", w.vas.Rid))
+			metrics.StreamReconnectCounter.WithLabelValues(signal.Kind).Inc()
 
 			// stop the previous watch stream before close conn.
 			w.StopWatch()
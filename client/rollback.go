@@ -0,0 +1,387 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	sfs "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/sf-share"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slog"
+
+	"github.com/TencentBlueKing/bscp-go/internal/cache"
+	"github.com/TencentBlueKing/bscp-go/internal/tracing"
+	"github.com/TencentBlueKing/bscp-go/internal/util/eventmeta"
+	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+)
+
+// Rollback restores the files of a previously applied release locally, re-runs its post hook, appends a rollback
+// entry to metadata.json and reports the version change. If toReleaseID is 0, rollback to the previous successfully
+// applied release. The files are restored from the retained release dir of the versioned layout, or from the
+// local file cache.
+func (r *Release) Rollback(toReleaseID uint32) error {
+	r.AppMate.CursorID = r.CursorID
+	r.AppMate.StartTime = time.Now().UTC()
+	r.AppMate.ReleaseChangeStatus = sfs.Processing
+
+	current, exist, err := eventmeta.GetLatestMetadataFromFile(r.AppDir)
+	if err != nil {
+		return err
+	}
+	if !exist {
+		return fmt.Errorf("can not find metadata file of app %s, no release has been applied", r.AppMate.App)
+	}
+	target, err := r.rollbackTarget(current.ReleaseID, toReleaseID)
+	if err != nil {
+		return err
+	}
+
+	r.ReleaseID = target.ReleaseID
+	r.AppMate.CurrentReleaseID = current.ReleaseID
+	r.AppMate.TargetReleaseID = target.ReleaseID
+	bd := r.handleBasicData(r.ClientMode, map[string]interface{}{"rollback_from": current.ReleaseID})
+
+	defer func() {
+		r.reportReleaseChangeResult(bd, err)
+	}()
+
+	var span trace.Span
+	r.traceCtx, span = tracing.Start(r.vas.Ctx, "release rollback",
+		attribute.Int64("biz_id", int64(r.BizID)), attribute.String("app", r.AppMate.App),
+		attribute.Int64("from_release_id", int64(current.ReleaseID)), attribute.Int64("release_id", int64(r.ReleaseID)))
+	defer func() {
+		tracing.End(span, err)
+		tracing.Flush()
+	}()
+
+	if err = r.sendVersionChangeMessaging(bd); err != nil {
+		logger.Error("failed to send the rollback status event", slog.Uint64("biz", uint64(r.BizID)),
+			slog.String("app", r.AppMate.App), logger.ErrAttr(err))
+	}
+
+	if err = r.restoreRelease(target); err != nil {
+		return err
+	}
+	if err = r.ExecuteHook(&PostScriptStrategy{})(); err != nil {
+		return err
+	}
+
+	if err = r.appendRollbackMetadata(current.ReleaseID, current.ConfigMatches,
+		fmt.Sprintf("rollback from release %d", current.ReleaseID)); err != nil {
+		return err
+	}
+
+	// the files are unknown if the release is restored from the retained dir without manifest, keep the pins
+	if len(r.FileItems) != 0 {
+		r.pinCachedFiles()
+	}
+	r.reportApplyMetrics()
+	logger.Info("rollback release success", slog.String("app", r.AppMate.App),
+		slog.Any("from", current.ReleaseID), slog.Any("to", r.ReleaseID))
+	return nil
+}
+
+// isPostHookFailed returns whether the error is caused by the failure of post hook
+func isPostHookFailed(err error) bool {
+	var e sfs.PrimaryError
+	return errors.As(err, &e) && e.FailedReason == sfs.PostHookFailed
+}
+
+// rollbackOnPostHookFailed restores the previous applied release when the post hook of the release failed, and
+// executes the post hook of the previous release again. It returns the post hook error attached with the rollback
+// result, so that the report tells which release the instance rolled back to.
+func (r *Release) rollbackOnPostHookFailed(bd *sfs.BasicData, hookErr error) error {
+	var e sfs.PrimaryError
+	if !errors.As(hookErr, &e) {
+		return hookErr
+	}
+	wrapErr := func(format string, args ...interface{}) error {
+		return sfs.WrapPrimaryError(e.FailedReason, sfs.SecondaryError{
+			SpecificFailedReason: e.SpecificFailedReason,
+			Err:                  fmt.Errorf("%s, %s", e.Err.Error(), fmt.Sprintf(format, args...))})
+	}
+
+	target, err := r.rollbackTarget(r.ReleaseID, 0)
+	if err != nil {
+		logger.Error("auto rollback failed", slog.String("app", r.AppMate.App), logger.ErrAttr(err))
+		return wrapErr("auto rollback failed, err: %s", err.Error())
+	}
+
+	ctx, span := tracing.Start(r.traceCtx, "auto rollback", attribute.Int64("release_id", int64(target.ReleaseID)))
+	defer func() { tracing.End(span, err) }()
+
+	// use another release to restore, so that the report still describes the failed release
+	appMate := *r.AppMate
+	previous := &Release{
+		ReleaseID:    target.ReleaseID,
+		AppDir:       r.AppDir,
+		TempDir:      r.TempDir,
+		BizID:        r.BizID,
+		ClientMode:   r.ClientMode,
+		AppMate:      &appMate,
+		upstream:     r.upstream,
+		vas:          r.vas,
+		versionedDir: r.versionedDir,
+		fileDeletion: r.fileDeletion,
+		traceCtx:     ctx,
+	}
+	err = previous.restoreRelease(target)
+	if err == nil {
+		err = previous.ExecuteHook(&PostScriptStrategy{})()
+	}
+	if err == nil {
+		err = previous.appendRollbackMetadata(r.ReleaseID, r.AppMate.Match,
+			fmt.Sprintf("auto rollback since the post hook of release %d failed", r.ReleaseID))
+	}
+	if err != nil {
+		logger.Error("auto rollback failed", slog.String("app", r.AppMate.App),
+			slog.Any("to", target.ReleaseID), logger.ErrAttr(err))
+		return wrapErr("auto rollback to release %d failed, err: %s", target.ReleaseID, err.Error())
+	}
+
+	if bd.Annotations == nil {
+		bd.Annotations = make(map[string]interface{})
+	}
+	bd.Annotations["auto_rollback_to"] = target.ReleaseID
+	r.AppMate.CurrentReleaseID = target.ReleaseID
+	r.rolledBack = true
+	if len(previous.FileItems) != 0 {
+		previous.pinCachedFiles()
+	}
+	previous.reportApplyMetrics()
+	logger.Info("auto rollback success", slog.String("app", r.AppMate.App),
+		slog.Any("from", r.ReleaseID), slog.Any("to", target.ReleaseID))
+	return wrapErr("rolled back to release %d", target.ReleaseID)
+}
+
+// appendRollbackMetadata appends the metadata of the release which is rolled back to
+func (r *Release) appendRollbackMetadata(from uint32, match []string, message string) error {
+	if match == nil {
+		match = []string{}
+	}
+	err := eventmeta.AppendMetadataToFile(r.AppDir, &eventmeta.EventMeta{
+		ReleaseID:     r.ReleaseID,
+		Status:        eventmeta.EventStatusSuccess,
+		Message:       message,
+		ConfigMatches: match,
+		EventTime:     time.Now().Format(time.RFC3339),
+		ReleaseDir:    r.releaseDir,
+		RollbackFrom:  from,
+	})
+	if err != nil {
+		logger.Error("append metadata to file failed", logger.ErrAttr(err))
+		return err
+	}
+	return nil
+}
+
+// rollbackTarget returns the metadata of the release to rollback to
+func (r *Release) rollbackTarget(currentID, toReleaseID uint32) (*eventmeta.EventMeta, error) {
+	if toReleaseID != 0 && toReleaseID == currentID {
+		return nil, fmt.Errorf("release %d is already the current release", toReleaseID)
+	}
+	history, err := eventmeta.GetMetadataHistoryFromFile(r.AppDir)
+	if err != nil {
+		return nil, err
+	}
+	// the latest applied one first
+	for i := len(history) - 1; i >= 0; i-- {
+		meta := history[i]
+		if meta.Status != eventmeta.EventStatusSuccess || meta.ReleaseID == currentID {
+			continue
+		}
+		if toReleaseID == 0 || meta.ReleaseID == toReleaseID {
+			return meta, nil
+		}
+	}
+	if toReleaseID == 0 {
+		return nil, errors.New("can not find a previous successfully applied release to rollback to")
+	}
+	// the release is not recorded in metadata, try to restore it by the retained release dir or manifest
+	return &eventmeta.EventMeta{ReleaseID: toReleaseID, Status: eventmeta.EventStatusSuccess}, nil
+}
+
+// CheckRollback checks the app files can be restored to a previously applied release locally without changing
+// anything, and returns the release id to rollback to. If toReleaseID is 0, the previous successfully applied
+// release is checked. The file cache should be initialized before if the contents can be restored from it.
+func CheckRollback(appDir string, toReleaseID uint32, versionedDir VersionedDir) (uint32, error) {
+	current, exist, err := eventmeta.GetLatestMetadataFromFile(appDir)
+	if err != nil {
+		return 0, err
+	}
+	if !exist {
+		return 0, errors.New("can not find metadata file, no release has been applied")
+	}
+	r := &Release{AppDir: appDir, versionedDir: versionedDir}
+	target, err := r.rollbackTarget(current.ReleaseID, toReleaseID)
+	if err != nil {
+		return 0, err
+	}
+	manifest, exist, err := eventmeta.GetReleaseManifest(appDir, target.ReleaseID)
+	if err != nil {
+		return 0, err
+	}
+	var files []*ConfigItemFile
+	if exist {
+		files = manifestFiles(manifest)
+	}
+
+	if versionedDir.Enabled {
+		name, e := findReleaseDir(appDir, target.ReleaseID, target.ReleaseDir)
+		if e != nil {
+			return 0, e
+		}
+		if name != "" && (!exist || verifyReleaseDir(filepath.Join(appDir, releasesDirName, name), files) == nil) {
+			return target.ReleaseID, nil
+		}
+	}
+	if !exist {
+		return 0, fmt.Errorf("release %d is neither retained nor has a manifest", target.ReleaseID)
+	}
+	// the files symlink points to the current release dir in versioned layout
+	if err = checkRestorable(filepath.Join(appDir, filesDirName), files); err != nil {
+		return 0, err
+	}
+	return target.ReleaseID, nil
+}
+
+// manifestFiles returns the config item files of the release manifest
+func manifestFiles(manifest *eventmeta.ReleaseManifest) []*ConfigItemFile {
+	files := make([]*ConfigItemFile, 0, len(manifest.Files))
+	for _, f := range manifest.Files {
+		files = append(files, &ConfigItemFile{
+			Name:             f.Name,
+			Path:             f.Path,
+			TextLineBreak:    f.TextLineBreak,
+			Permission:       f.FileMeta.ConfigItemSpec.Permission,
+			FileMeta:         f.FileMeta,
+			TargetPath:       f.TargetPath,
+			TargetPermission: f.TargetPermission,
+		})
+	}
+	return files
+}
+
+// restoreRelease restores the files of the target release
+func (r *Release) restoreRelease(target *eventmeta.EventMeta) error {
+	manifest, exist, err := eventmeta.GetReleaseManifest(r.AppDir, target.ReleaseID)
+	if err != nil {
+		return err
+	}
+	if exist {
+		r.ReleaseName = manifest.ReleaseName
+		r.PostHook = manifest.PostHook
+		r.FileItems = manifestFiles(manifest)
+		r.AppMate.TotalFileNum = len(r.FileItems)
+	}
+	if r.SemaphoreCh == nil {
+		// nobody receives the download progress of rollback, use a buffered channel so that it never blocks
+		r.SemaphoreCh = make(chan struct{}, len(r.FileItems))
+	}
+
+	if r.versionedDir.Enabled {
+		name, e := findReleaseDir(r.AppDir, target.ReleaseID, target.ReleaseDir)
+		if e != nil {
+			return sfs.WrapPrimaryError(sfs.DownloadFailed,
+				sfs.SecondaryError{SpecificFailedReason: sfs.TraverseFolderFailed, Err: e})
+		}
+		// the retained release dir is verified by the manifest if exists, otherwise it is trusted
+		if name != "" && exist {
+			if e = verifyReleaseDir(filepath.Join(r.AppDir, releasesDirName, name), r.FileItems); e != nil {
+				logger.Warn("retained release dir is broken, try to restore from file cache",
+					slog.String("dir", name), logger.ErrAttr(e))
+				name = ""
+			}
+		}
+		if name != "" {
+			if e = switchCurrentRelease(r.AppDir, name); e != nil {
+				return sfs.WrapPrimaryError(sfs.DownloadFailed,
+					sfs.SecondaryError{SpecificFailedReason: sfs.WriteFileFailed, Err: e})
+			}
+			r.releaseDir = name
+			if !exist {
+				return nil
+			}
+			if e = r.syncTargets(filepath.Join(r.AppDir, releasesDirName, name)); e != nil {
+				return e
+			}
+			keptTargets, e := r.clearStaleTargets()
+			if e != nil {
+				return e
+			}
+			return r.writeManagedFiles(nil, keptTargets)
+		}
+	}
+
+	if !exist {
+		return sfs.WrapPrimaryError(sfs.DownloadFailed, sfs.SecondaryError{
+			SpecificFailedReason: sfs.FilePathNotFound,
+			Err:                  fmt.Errorf("release %d is neither retained nor has a manifest", target.ReleaseID)})
+	}
+
+	if r.versionedDir.Enabled {
+		currentDir, e := currentReleaseDir(r.AppDir)
+		if e != nil {
+			return sfs.WrapPrimaryError(sfs.DownloadFailed,
+				sfs.SecondaryError{SpecificFailedReason: sfs.ReadFileFailed, Err: e})
+		}
+		if e = checkRestorable(filepath.Join(r.AppDir, releasesDirName, currentDir), r.FileItems); e != nil {
+			return e
+		}
+		return r.updateVersionedFiles()
+	}
+
+	if err = ensureLegacyFilesDir(r.AppDir); err != nil {
+		return sfs.WrapPrimaryError(sfs.DownloadFailed,
+			sfs.SecondaryError{SpecificFailedReason: sfs.DeleteFolderFailed, Err: err})
+	}
+	filesDir := filepath.Join(r.AppDir, filesDirName)
+	if err = checkRestorable(filesDir, r.FileItems); err != nil {
+		return err
+	}
+	if err = updateFiles(r.traceCtx, filesDir, filesDir, r.FileItems, &r.AppMate.DownloadFileNum,
+		&r.AppMate.DownloadFileSize, &r.changes, r.SemaphoreCh); err != nil {
+		logger.Error("restore files failed", logger.ErrAttr(err))
+		return err
+	}
+	if err = r.syncTargets(filesDir); err != nil {
+		return err
+	}
+	if err = r.clearStaleFiles(filesDir); err != nil {
+		logger.Error("clear old files failed", logger.ErrAttr(err))
+		return err
+	}
+	return nil
+}
+
+// checkRestorable checks all the files can be restored locally, either from the dir or the file cache,
+// so that rollback never depends on the remote repository.
+func checkRestorable(dir string, files []*ConfigItemFile) error {
+	for _, file := range files {
+		if exists, _ := checkFileExists(filepath.Join(dir, file.Path), file.FileMeta); exists {
+			continue
+		}
+		if cache.Enable && cache.GetCache().Exists(file.FileMeta) {
+			continue
+		}
+		return sfs.WrapPrimaryError(sfs.DownloadFailed, sfs.SecondaryError{
+			SpecificFailedReason: sfs.FilePathNotFound,
+			Err: fmt.Errorf("file %s is neither retained nor in the file cache",
+				filepath.Join(file.Path, file.Name))})
+	}
+	return nil
+}
@@ -0,0 +1,355 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	pbhook "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/core/hook"
+	sfs "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/sf-share"
+
+	"github.com/TencentBlueKing/bscp-go/internal/util/eventmeta"
+)
+
+func TestRollbackTarget(t *testing.T) {
+	r := newTestRelease(t, 3)
+	appendTestMetadata(t, r.AppDir, &eventmeta.EventMeta{ReleaseID: 1})
+	appendTestMetadata(t, r.AppDir, &eventmeta.EventMeta{ReleaseID: 2, Status: eventmeta.EventStatusFailed})
+	appendTestMetadata(t, r.AppDir, &eventmeta.EventMeta{ReleaseID: 3})
+
+	tests := []struct {
+		name      string
+		currentID uint32
+		toID      uint32
+		want      uint32
+		wantErr   bool
+	}{
+		{name: "previous successfully applied", currentID: 3, want: 1},
+		{name: "latest one other than current", currentID: 1, want: 3},
+		{name: "specified release", currentID: 3, toID: 1, want: 1},
+		{name: "specified release not recorded", currentID: 3, toID: 9, want: 9},
+		{name: "specified release is current", currentID: 3, toID: 3, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := r.rollbackTarget(tt.currentID, tt.toID)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("rollbackTarget() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got.ReleaseID != tt.want {
+				t.Errorf("rollbackTarget() = %d, want %d", got.ReleaseID, tt.want)
+			}
+		})
+	}
+
+	only := newTestRelease(t, 1)
+	appendTestMetadata(t, only.AppDir, &eventmeta.EventMeta{ReleaseID: 1})
+	if _, err := only.rollbackTarget(1, 0); err == nil {
+		t.Error("expected error when there is no previous release")
+	}
+}
+
+func TestCheckRestorable(t *testing.T) {
+	file := newTestFile(t, "/conf", "app.yaml", "v1")
+
+	tests := []struct {
+		name    string
+		content string
+		cached  bool
+		wantErr bool
+	}{
+		{name: "file retained", content: "v1"},
+		{name: "file in cache", content: "v2", cached: true},
+		{name: "file modified", content: "v2", wantErr: true},
+		{name: "file not exists", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.content != "" {
+				writeTestFile(t, dir, file, tt.content)
+			}
+			if tt.cached {
+				initTestCache(t, "v1")
+			}
+			err := checkRestorable(dir, []*ConfigItemFile{file})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkRestorable() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var e sfs.PrimaryError
+			if err != nil && (!errors.As(err, &e) || e.SpecificFailedReason != sfs.FilePathNotFound) {
+				t.Errorf("expected file path not found error, got %v", err)
+			}
+		})
+	}
+}
+
+// rollbackLayout prepares the app dir which release 1 (a.conf=a1) and then release 2 (a.conf=a2, b.conf=b2) are
+// applied, the release dir of release 1 is pruned if not retained in the versioned layout.
+func rollbackLayout(t *testing.T, r *Release, retained bool) {
+	t.Helper()
+	v1 := []*ConfigItemFile{newTestFile(t, "/", "a.conf", "a1")}
+	v2 := []*ConfigItemFile{newTestFile(t, "/", "a.conf", "a2"), newTestFile(t, "/", "b.conf", "b2")}
+	for id, files := range map[uint32][]*ConfigItemFile{1: v1, 2: v2} {
+		applied := &Release{ReleaseID: id, ReleaseName: "release", FileItems: files}
+		if err := eventmeta.WriteReleaseManifest(r.AppDir, applied.manifest()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	filesDir := filepath.Join(r.AppDir, filesDirName)
+	if r.versionedDir.Enabled {
+		if retained {
+			writeTestFile(t, filepath.Join(r.AppDir, releasesDirName, "1"), v1[0], "a1")
+		}
+		filesDir = filepath.Join(r.AppDir, releasesDirName, "2")
+	}
+	writeTestFile(t, filesDir, v2[0], "a2")
+	writeTestFile(t, filesDir, v2[1], "b2")
+	if r.versionedDir.Enabled {
+		if err := switchCurrentRelease(r.AppDir, "2"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	managed := &eventmeta.ManagedFiles{Files: []string{"a.conf", "b.conf"}}
+	if err := eventmeta.WriteManagedFiles(r.AppDir, managed); err != nil {
+		t.Fatal(err)
+	}
+	appendTestMetadata(t, r.AppDir, &eventmeta.EventMeta{ReleaseID: 1, ReleaseDir: "1"})
+	appendTestMetadata(t, r.AppDir, &eventmeta.EventMeta{ReleaseID: 2, ReleaseDir: "2"})
+}
+
+func TestRollback(t *testing.T) {
+	tests := []struct {
+		name      string
+		versioned bool
+		retained  bool
+		cached    bool
+		wantErr   bool
+	}{
+		{name: "versioned layout with release dir retained", versioned: true, retained: true},
+		{name: "versioned layout with release dir pruned but content in cache", versioned: true, cached: true},
+		{name: "versioned layout with neither release dir nor cache", versioned: true, wantErr: true},
+		{name: "legacy layout with content in cache", cached: true},
+		{name: "legacy layout without cache", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRelease(t, 0)
+			r.versionedDir = VersionedDir{Enabled: tt.versioned, RetainReleases: 3}
+			rollbackLayout(t, r, tt.retained)
+			if tt.cached {
+				initTestCache(t, "a1")
+			}
+
+			err := r.Rollback(0)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Rollback() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			filesDir := filepath.Join(r.AppDir, filesDirName)
+			event, e := eventmeta.GetLatestChangeEventFromFile(r.AppDir)
+			if e != nil {
+				t.Fatal(e)
+			}
+			if tt.wantErr {
+				if got := readTestFile(t, filepath.Join(filesDir, "a.conf")); got != "a2" {
+					t.Errorf("files are changed by the failed rollback, a.conf = %q", got)
+				}
+				if event == nil || event.ReleaseID != 1 || event.Status != eventmeta.EventStatusFailed {
+					t.Errorf("expected the failed rollback is recorded, got %+v", event)
+				}
+				return
+			}
+
+			if got := readTestFile(t, filepath.Join(filesDir, "a.conf")); got != "a1" {
+				t.Errorf("a.conf = %q, want a1", got)
+			}
+			if got := readTestFile(t, filepath.Join(filesDir, "b.conf")); got != "" {
+				t.Errorf("b.conf which is not in release 1 is not deleted, got %q", got)
+			}
+			meta, _, e := eventmeta.GetLatestMetadataFromFile(r.AppDir)
+			if e != nil {
+				t.Fatal(e)
+			}
+			if meta.ReleaseID != 1 || meta.RollbackFrom != 2 {
+				t.Errorf("expected the rollback metadata is appended, got %+v", meta)
+			}
+			if event == nil || event.ReleaseID != 1 || event.Status != eventmeta.EventStatusSuccess {
+				t.Errorf("expected the rollback is recorded as success, got %+v", event)
+			}
+			if n := r.upstream.(*fakeUpstream).messages; n != 2 {
+				t.Errorf("expected the processing and the result of rollback are reported, got %d messages", n)
+			}
+		})
+	}
+}
+
+func TestCheckRollback(t *testing.T) {
+	tests := []struct {
+		name      string
+		versioned bool
+		retained  bool
+		cached    bool
+		previous  bool
+		wantErr   bool
+	}{
+		{name: "no previous release", versioned: true, retained: true, wantErr: true},
+		{name: "release dir retained", versioned: true, retained: true, previous: true},
+		{name: "release dir pruned but content in cache", versioned: true, cached: true, previous: true},
+		{name: "neither release dir nor content in cache", versioned: true, previous: true, wantErr: true},
+		{name: "legacy layout with content in cache", cached: true, previous: true},
+		{name: "legacy layout without cache", previous: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestRelease(t, 0)
+			r.versionedDir = VersionedDir{Enabled: tt.versioned, RetainReleases: 3}
+			if tt.previous {
+				rollbackLayout(t, r, tt.retained)
+			} else {
+				appendTestMetadata(t, r.AppDir, &eventmeta.EventMeta{ReleaseID: 2})
+			}
+			if tt.cached {
+				initTestCache(t, "a1")
+			}
+
+			got, err := CheckRollback(r.AppDir, 0, r.versionedDir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("CheckRollback() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got != 1 {
+				t.Errorf("CheckRollback() = %d, want 1", got)
+			}
+			if tt.previous {
+				if content := readTestFile(t, filepath.Join(r.AppDir, filesDirName, "a.conf")); content != "a2" {
+					t.Errorf("files are changed by the check, a.conf = %q", content)
+				}
+			}
+		})
+	}
+}
+
+func TestRollbackNoPreviousRelease(t *testing.T) {
+	r := newTestRelease(t, 0)
+	appendTestMetadata(t, r.AppDir, &eventmeta.EventMeta{ReleaseID: 2})
+	if err := r.Rollback(0); err == nil {
+		t.Error("expected error when there is no previous release")
+	}
+	if n := r.upstream.(*fakeUpstream).messages; n != 0 {
+		t.Errorf("expected nothing is reported without a rollback target, got %d messages", n)
+	}
+}
+
+func TestAutoRollbackOnPostHookFailed(t *testing.T) {
+	first := newTestRelease(t, 0)
+	first.versionedDir = VersionedDir{Enabled: true, RetainReleases: 3}
+	rollbackLayout(t, first, true)
+	appDir := first.AppDir
+	newRelease := func(releaseID uint32) *Release {
+		r := newTestRelease(t, releaseID)
+		r.AppDir, r.TempDir = appDir, first.TempDir
+		r.versionedDir = first.versionedDir
+		r.autoRollback = true
+		return r
+	}
+
+	// the post hook of release 2 is executed again after rolled back to it
+	manifest, _, err := eventmeta.GetReleaseManifest(appDir, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest.PostHook = &pbhook.HookSpec{Type: "shell", Content: "echo done > post_hook_2"}
+	if err = eventmeta.WriteReleaseManifest(appDir, manifest); err != nil {
+		t.Fatal(err)
+	}
+	// the release 3 is downloaded into its release dir, but its post hook failed
+	r := newRelease(3)
+	r.PostHook = &pbhook.HookSpec{Type: "shell", Content: "exit 1"}
+	applied := func() error {
+		writeTestFile(t, filepath.Join(appDir, releasesDirName, "3"), newTestFile(t, "/", "a.conf", "a3"), "a3")
+		return switchCurrentRelease(appDir, "3")
+	}
+	err = r.Execute(applied, r.ExecuteHook(&PostScriptStrategy{}), r.UpdateMetadata())
+
+	var e sfs.PrimaryError
+	if !errors.As(err, &e) || e.FailedReason != sfs.PostHookFailed ||
+		!strings.Contains(e.Err.Error(), "rolled back to release 2") {
+		t.Fatalf("expected the post hook failure with the rollback result, got %v", err)
+	}
+	if got := readTestFile(t, filepath.Join(appDir, filesDirName, "a.conf")); got != "a2" {
+		t.Errorf("a.conf = %q, want a2 of the previous release", got)
+	}
+	if got := readTestFile(t, filepath.Join(appDir, "post_hook_2")); got != "done\n" {
+		t.Errorf("the post hook of the previous release is not executed, got %q", got)
+	}
+	if r.AppMate.CurrentReleaseID != 2 {
+		t.Errorf("current release id = %d, want 2", r.AppMate.CurrentReleaseID)
+	}
+	event, err := eventmeta.GetLatestChangeEventFromFile(appDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event == nil || event.ReleaseID != 3 || event.Status != eventmeta.EventStatusRolledBack {
+		t.Errorf("expected release 3 is recorded as rolled back, got %+v", event)
+	}
+
+	// the release rolled back is not applied again when it is delivered again
+	again := newRelease(3)
+	err = again.Execute(func() error {
+		t.Error("the release rolled back is applied again")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.AppMate.CurrentReleaseID != 2 {
+		t.Errorf("current release id = %d, want 2", again.AppMate.CurrentReleaseID)
+	}
+	if event, _ = eventmeta.GetLatestChangeEventFromFile(appDir); event.Status != eventmeta.EventStatusRolledBack {
+		t.Errorf("expected release 3 is still recorded as rolled back, got %+v", event)
+	}
+
+	// a newer release is applied
+	newer := newRelease(4)
+	applied4 := false
+	if err = newer.Execute(func() error { applied4 = true; return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if !applied4 {
+		t.Error("the newer release is not applied")
+	}
+}
+
+func TestAutoRollbackWithoutPreviousRelease(t *testing.T) {
+	r := newTestRelease(t, 1)
+	r.autoRollback = true
+	hookErr := sfs.WrapPrimaryError(sfs.PostHookFailed,
+		sfs.SecondaryError{SpecificFailedReason: sfs.ScriptExecutionFailed, Err: errors.New("exit status 1")})
+	err := r.rollbackOnPostHookFailed(&sfs.BasicData{}, hookErr)
+
+	var e sfs.PrimaryError
+	if !errors.As(err, &e) || e.FailedReason != sfs.PostHookFailed ||
+		!strings.Contains(e.Err.Error(), "auto rollback failed") {
+		t.Errorf("expected the post hook failure with the rollback failure, got %v", err)
+	}
+	if r.rolledBack {
+		t.Error("the release is marked as rolled back while the rollback failed")
+	}
+	if _, err = os.Stat(filepath.Join(r.AppDir, releasesDirName)); !os.IsNotExist(err) {
+		t.Errorf("expected nothing is restored, got %v", err)
+	}
+}
@@ -0,0 +1,241 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	pbci "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/core/config-item"
+	sfs "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/sf-share"
+	"github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/tools"
+	"golang.org/x/exp/slog"
+
+	"github.com/TencentBlueKing/bscp-go/internal/util"
+	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+)
+
+// applyPathMappings sets the target path and permission of the files by the path mappings, the first matched
+// mapping wins.
+func applyPathMappings(files []*ConfigItemFile, mappings []PathMapping) {
+	if len(mappings) == 0 {
+		return
+	}
+	for _, file := range files {
+		for _, m := range mappings {
+			target, ok := m.mapPath(file)
+			if !ok {
+				continue
+			}
+			file.TargetPath = target
+			file.TargetPermission = m.permission(file.Permission)
+			break
+		}
+	}
+}
+
+// mapPath returns the target path of the file if it is matched by the mapping.
+// For the prefix rule, the config item path under the prefix is kept under the target root,
+// and the target is the file path itself if the prefix is the config item path exactly.
+// For the glob rule, the config item is written under the target root with its name.
+func (m PathMapping) mapPath(file *ConfigItemFile) (string, bool) {
+	if m.Match == "" || m.Target == "" {
+		return "", false
+	}
+	ciPath := path.Join("/", filepath.ToSlash(file.Path), file.Name)
+	if strings.ContainsAny(m.Match, "*?[") {
+		if ok, _ := path.Match(m.Match, ciPath); !ok {
+			return "", false
+		}
+		return filepath.Join(m.Target, file.Name), true
+	}
+
+	prefix := path.Join("/", m.Match)
+	switch {
+	case ciPath == prefix:
+		return filepath.Clean(m.Target), true
+	case prefix == "/":
+		return filepath.Join(m.Target, filepath.FromSlash(ciPath)), true
+	case strings.HasPrefix(ciPath, prefix+"/"):
+		return filepath.Join(m.Target, filepath.FromSlash(strings.TrimPrefix(ciPath, prefix))), true
+	default:
+		return "", false
+	}
+}
+
+// permission returns the permission of the target file, the config item permission overwritten by the mapping
+func (m PathMapping) permission(pm *pbci.FilePermission) *pbci.FilePermission {
+	target := &pbci.FilePermission{}
+	if pm != nil {
+		target.User, target.UserGroup, target.Privilege = pm.User, pm.UserGroup, pm.Privilege
+	}
+	if m.User != "" {
+		target.User = m.User
+	}
+	if m.UserGroup != "" {
+		target.UserGroup = m.UserGroup
+	}
+	if m.Privilege != "" {
+		target.Privilege = m.Privilege
+	}
+	return target
+}
+
+// releaseTargetPaths returns the target paths of the release files
+func releaseTargetPaths(files []*ConfigItemFile) map[string]bool {
+	paths := make(map[string]bool)
+	for _, file := range files {
+		if file.TargetPath != "" {
+			paths[file.TargetPath] = true
+		}
+	}
+	return paths
+}
+
+// syncTargets writes the files from the files dir to their mapped target paths, each target is written to a temp
+// file in the same dir, verified by SHA256 and then renamed to the target path, so that the readers never see
+// a partially written file.
+func (r *Release) syncTargets(filesDir string) error {
+	for _, file := range r.FileItems {
+		if file.TargetPath == "" {
+			continue
+		}
+		src := filepath.Join(filesDir, file.Path, file.Name)
+		if err := syncTarget(src, file); err != nil {
+			logger.Error("write target file failed", slog.String("file", src),
+				slog.String("target", file.TargetPath), logger.ErrAttr(err))
+			return err
+		}
+	}
+	return nil
+}
+
+// syncTarget writes the src file to the target path of the file
+func syncTarget(src string, file *ConfigItemFile) error {
+	// the file content is changed if the line break is converted, use the SHA256 of the written file instead
+	expected := file.FileMeta.ContentSpec.Signature
+	if file.FileMeta.ConfigItemSpec.FileType == "text" && file.TextLineBreak != "" {
+		sha, err := tools.FileSHA256(src)
+		if err != nil {
+			return sfs.WrapPrimaryError(sfs.DownloadFailed,
+				sfs.SecondaryError{SpecificFailedReason: sfs.ReadFileFailed, Err: err})
+		}
+		expected = sha
+	}
+
+	target := file.TargetPath
+	if sha, err := tools.FileSHA256(target); err == nil && sha == expected {
+		logger.Debug("target file is already exists and has not been modified, skip write",
+			slog.String("target", target))
+		setTargetPermission(target, file.TargetPermission)
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(target), os.ModePerm); err != nil {
+		return sfs.WrapPrimaryError(sfs.DownloadFailed,
+			sfs.SecondaryError{SpecificFailedReason: sfs.NewFolderFailed,
+				Err: fmt.Errorf("create dir %s failed, err: %s", filepath.Dir(target), err.Error())})
+	}
+	if err := writeTarget(src, file, expected); err != nil {
+		return sfs.WrapPrimaryError(sfs.DownloadFailed,
+			sfs.SecondaryError{SpecificFailedReason: sfs.WriteFileFailed, Err: err})
+	}
+	logger.Info("write target file success", slog.String("target", target))
+	return nil
+}
+
+// writeTarget copies the src file to a temp file in the dir of the target, verifies its SHA256, sets the
+// permission and then renames it to the target.
+func writeTarget(src string, file *ConfigItemFile, expected string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	tmpFile, err := util.CreateAtomicFile(file.TargetPath, 0644)
+	if err != nil {
+		return err
+	}
+	defer tmpFile.Abort()
+	hash := sha256.New()
+	if _, err = io.Copy(io.MultiWriter(tmpFile, hash), srcFile); err != nil {
+		return err
+	}
+	if sha := hex.EncodeToString(hash.Sum(nil)); sha != expected {
+		return fmt.Errorf("SHA256 of %s is %s, but expected %s", file.TargetPath, sha, expected)
+	}
+	setTargetPermission(tmpFile.Name(), file.TargetPermission)
+	return tmpFile.Commit()
+}
+
+// setTargetPermission sets the permission of the target file, same as the files dir, failing to set the
+// permission does not fail the release change
+func setTargetPermission(filePath string, pm *pbci.FilePermission) {
+	if runtime.GOOS == "windows" || pm == nil || pm.Privilege == "" {
+		return
+	}
+	if err := util.SetFilePermission(filePath, pm); err != nil {
+		logger.Warn("set target file permission failed", slog.String("file", filePath), logger.ErrAttr(err))
+	}
+}
+
+// staleTargets returns the managed target files which are not in the release and would be deleted, and the
+// protected ones which are kept.
+func (r *Release) staleTargets() ([]string, []string, error) {
+	managed, _, err := getManagedFiles(r.AppDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	current := releaseTargetPaths(r.FileItems)
+	deletes, kept := make([]string, 0), make([]string, 0)
+	for _, target := range managed.Targets {
+		if current[target] {
+			continue
+		}
+		if r.fileDeletion.protected(filepath.ToSlash(target)) {
+			kept = append(kept, target)
+			continue
+		}
+		deletes = append(deletes, target)
+	}
+	return deletes, kept, nil
+}
+
+// clearStaleTargets deletes the managed target files which are not in the release, the protected ones are kept
+// and returned.
+func (r *Release) clearStaleTargets() ([]string, error) {
+	deletes, kept, err := r.staleTargets()
+	if err != nil {
+		return nil, err
+	}
+	for _, target := range kept {
+		logger.Info("target file is not in the release but protected, skip delete", slog.String("target", target))
+	}
+	for _, target := range deletes {
+		if err := os.Remove(target); err != nil && !os.IsNotExist(err) {
+			return nil, sfs.WrapPrimaryError(sfs.DeleteOldFilesFailed,
+				sfs.SecondaryError{SpecificFailedReason: sfs.DeleteFolderFailed, Err: err})
+		}
+		logger.Info("delete target file success", slog.String("target", target))
+		r.deletedFiles = append(r.deletedFiles, target)
+	}
+	return kept, nil
+}
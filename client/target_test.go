@@ -0,0 +1,223 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	pbci "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/core/config-item"
+
+	"github.com/TencentBlueKing/bscp-go/internal/util/eventmeta"
+)
+
+func TestMapPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		mapping PathMapping
+		path    string
+		want    string
+		wantOk  bool
+	}{
+		{name: "prefix", mapping: PathMapping{Match: "/etc/nginx", Target: "/opt/nginx"},
+			path: "/etc/nginx/conf.d/app.conf", want: "/opt/nginx/conf.d/app.conf", wantOk: true},
+		{name: "prefix with trailing slash", mapping: PathMapping{Match: "/etc/nginx/", Target: "/opt/nginx"},
+			path: "/etc/nginx/nginx.conf", want: "/opt/nginx/nginx.conf", wantOk: true},
+		{name: "prefix is the file path", mapping: PathMapping{Match: "/etc/nginx/nginx.conf", Target: "/opt/n.conf"},
+			path: "/etc/nginx/nginx.conf", want: "/opt/n.conf", wantOk: true},
+		{name: "prefix matches the whole path segment", mapping: PathMapping{Match: "/etc/nginx", Target: "/opt"},
+			path: "/etc/nginx2/nginx.conf"},
+		{name: "root prefix", mapping: PathMapping{Match: "/", Target: "/opt"},
+			path: "/etc/app.conf", want: "/opt/etc/app.conf", wantOk: true},
+		{name: "glob", mapping: PathMapping{Match: "/etc/nginx/*.conf", Target: "/opt/nginx"},
+			path: "/etc/nginx/nginx.conf", want: "/opt/nginx/nginx.conf", wantOk: true},
+		{name: "glob does not match sub dirs", mapping: PathMapping{Match: "/etc/nginx/*.conf", Target: "/opt/nginx"},
+			path: "/etc/nginx/conf.d/app.conf"},
+		{name: "empty target", mapping: PathMapping{Match: "/etc"}, path: "/etc/app.conf"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := &ConfigItemFile{Path: filepath.Dir(tt.path), Name: filepath.Base(tt.path)}
+			got, ok := tt.mapping.mapPath(file)
+			if ok != tt.wantOk || got != filepath.FromSlash(tt.want) {
+				t.Errorf("mapPath(%s) = %s, %v, want %s, %v", tt.path, got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestApplyPathMappings(t *testing.T) {
+	mappings := []PathMapping{
+		{Match: "/etc/nginx/*.conf", Target: "/opt/glob", Privilege: "600"},
+		{Match: "/etc/nginx", Target: "/opt/prefix", User: "nginx"},
+		{Match: "/", Target: "/opt/root"},
+	}
+	pm := &pbci.FilePermission{User: "root", UserGroup: "root", Privilege: "644"}
+	tests := []struct {
+		path       string
+		want       string
+		permission *pbci.FilePermission
+	}{
+		{path: "/etc/nginx/nginx.conf", want: "/opt/glob/nginx.conf",
+			permission: &pbci.FilePermission{User: "root", UserGroup: "root", Privilege: "600"}},
+		{path: "/etc/nginx/conf.d/app.conf", want: "/opt/prefix/conf.d/app.conf",
+			permission: &pbci.FilePermission{User: "nginx", UserGroup: "root", Privilege: "644"}},
+		{path: "/etc/app.conf", want: "/opt/root/etc/app.conf",
+			permission: &pbci.FilePermission{User: "root", UserGroup: "root", Privilege: "644"}},
+	}
+	files := make([]*ConfigItemFile, 0, len(tests))
+	for _, tt := range tests {
+		files = append(files, &ConfigItemFile{Path: filepath.Dir(tt.path), Name: filepath.Base(tt.path), Permission: pm})
+	}
+
+	// the first matched mapping wins
+	applyPathMappings(files, mappings)
+	for i, tt := range tests {
+		if files[i].TargetPath != filepath.FromSlash(tt.want) {
+			t.Errorf("target path of %s = %s, want %s", tt.path, files[i].TargetPath, tt.want)
+		}
+		if !reflect.DeepEqual(files[i].TargetPermission, tt.permission) {
+			t.Errorf("target permission of %s = %v, want %v", tt.path, files[i].TargetPermission, tt.permission)
+		}
+	}
+}
+
+func TestSyncTarget(t *testing.T) {
+	file := newTestFile(t, "/", "app.conf", "v1")
+	file.TargetPath = filepath.Join(t.TempDir(), "etc", "app.conf")
+	src := filepath.Join(t.TempDir(), "app.conf")
+	writeTestFile(t, filepath.Dir(src), &ConfigItemFile{Path: "/", Name: "app.conf"}, "v1")
+
+	// the target is created with its parent dirs, and then overwritten if modified
+	for _, existing := range []string{"", "modified"} {
+		if existing != "" {
+			writeTestFile(t, filepath.Dir(file.TargetPath), &ConfigItemFile{Path: "/", Name: "app.conf"}, existing)
+		}
+		if err := syncTarget(src, file); err != nil {
+			t.Fatal(err)
+		}
+		if got := readTestFile(t, file.TargetPath); got != "v1" {
+			t.Errorf("target content = %q, want v1", got)
+		}
+	}
+
+	// the src file is not the content of the release
+	writeTestFile(t, filepath.Dir(src), &ConfigItemFile{Path: "/", Name: "app.conf"}, "corrupted")
+	writeTestFile(t, filepath.Dir(file.TargetPath), &ConfigItemFile{Path: "/", Name: "app.conf"}, "modified")
+	if err := syncTarget(src, file); err == nil {
+		t.Error("the content which SHA256 is not match is written to the target")
+	}
+	if got := readTestFile(t, file.TargetPath); got != "modified" {
+		t.Errorf("target content = %q, the target is changed by the failed write", got)
+	}
+
+	// the text file whose line break is converted is verified by the SHA256 of the src file
+	text := newTestTextFile(t, "app.conf", "a\nb\n", "CRLF")
+	text.TargetPath = file.TargetPath
+	writeTestFile(t, filepath.Dir(src), &ConfigItemFile{Path: "/", Name: "app.conf"}, "a\r\nb\r\n")
+	if err := syncTarget(src, text); err != nil {
+		t.Fatal(err)
+	}
+	if got := readTestFile(t, text.TargetPath); got != "a\r\nb\r\n" {
+		t.Errorf("target content = %q, want the converted content", got)
+	}
+}
+
+func TestClearStaleTargets(t *testing.T) {
+	targetDir := t.TempDir()
+	mappings := []PathMapping{
+		{Match: "/etc/keep.conf", Target: filepath.Join(targetDir, "keep.conf")},
+		{Match: "/etc/app.log", Target: filepath.Join(targetDir, "app.log")},
+		{Match: "/etc", Target: filepath.Join(targetDir, "etc")},
+	}
+	apply := func(r *Release) {
+		t.Helper()
+		filesDir := filepath.Join(r.AppDir, filesDirName)
+		for _, file := range r.FileItems {
+			writeTestFile(t, filesDir, file, "v"+file.Name)
+		}
+		if err := r.syncTargets(filesDir); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.clearStaleFiles(filesDir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// release 1 maps all the files
+	r := newTestRelease(t, 1, newTestFile(t, "/etc", "keep.conf", "vkeep.conf"),
+		newTestFile(t, "/etc", "app.log", "vapp.log"), newTestFile(t, "/etc", "old.conf", "vold.conf"),
+		newTestFile(t, "/etc", "unmapped.conf", "vunmapped.conf"))
+	r.fileDeletion = FileDeletion{Ignore: []string{"*.log"}}
+	applyPathMappings(r.FileItems, mappings)
+	apply(r)
+	// the file is not written by bscp
+	writeTestFile(t, targetDir, &ConfigItemFile{Path: "etc", Name: "other.conf"}, "other")
+
+	// release 2 removes old.conf and app.log, and unmapped.conf is not mapped any more
+	files := []*ConfigItemFile{newTestFile(t, "/etc", "keep.conf", "vkeep.conf"),
+		newTestFile(t, "/etc", "unmapped.conf", "vunmapped.conf")}
+	applyPathMappings(files[:1], mappings)
+	r2 := newTestRelease(t, 2, files...)
+	r2.AppDir, r2.TempDir = r.AppDir, r.TempDir
+	r2.fileDeletion = r.fileDeletion
+	apply(r2)
+
+	for name, want := range map[string]string{
+		"keep.conf":         "vkeep.conf",
+		"app.log":           "vapp.log",
+		"etc/old.conf":      "",
+		"etc/unmapped.conf": "",
+		"etc/other.conf":    "other",
+	} {
+		if got := readTestFile(t, filepath.Join(targetDir, filepath.FromSlash(name))); got != want {
+			t.Errorf("content of target %s = %q, want %q", name, got, want)
+		}
+	}
+	managed, _, err := eventmeta.GetManagedFiles(r.AppDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{filepath.Join(targetDir, "app.log"), filepath.Join(targetDir, "keep.conf")}
+	sort.Strings(want)
+	if !reflect.DeepEqual(managed.Targets, want) {
+		t.Errorf("managed targets = %v, want %v", managed.Targets, want)
+	}
+	deleted := append([]string{}, r2.deletedFiles...)
+	sort.Strings(deleted)
+	wantDeleted := []string{filepath.Join(targetDir, "etc", "old.conf"), filepath.Join(targetDir, "etc", "unmapped.conf"),
+		"etc/old.conf"}
+	if !reflect.DeepEqual(deleted, wantDeleted) {
+		t.Errorf("deleted files = %v, want %v", deleted, wantDeleted)
+	}
+
+	// the target not listed in the managed files is never deleted, even if its mapping is removed
+	managed = &eventmeta.ManagedFiles{Files: []string{"etc/keep.conf"}}
+	if err = eventmeta.WriteManagedFiles(r.AppDir, managed); err != nil {
+		t.Fatal(err)
+	}
+	r3 := newTestRelease(t, 3)
+	r3.AppDir = r.AppDir
+	kept, err := r3.clearStaleTargets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(kept) != 0 || len(r3.deletedFiles) != 0 {
+		t.Errorf("kept targets = %v, deleted files = %v, want none", kept, r3.deletedFiles)
+	}
+	if got := readTestFile(t, filepath.Join(targetDir, "keep.conf")); got != "vkeep.conf" {
+		t.Errorf("the target not listed in the managed files is deleted")
+	}
+}
@@ -16,30 +16,37 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
-	"strings"
+	"sort"
 	"sync/atomic"
 	"time"
 
 	"github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/dal/table"
 	"github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/kit"
+	pbbase "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/core/base"
 	pbci "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/core/config-item"
 	pbhook "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/core/hook"
 	sfs "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/sf-share"
 	"github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/tools"
 	"github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/version"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/exp/slog"
 	"golang.org/x/sync/errgroup"
 
 	"github.com/TencentBlueKing/bscp-go/internal/cache"
 	"github.com/TencentBlueKing/bscp-go/internal/downloader"
+	"github.com/TencentBlueKing/bscp-go/internal/tracing"
 	"github.com/TencentBlueKing/bscp-go/internal/upstream"
 	"github.com/TencentBlueKing/bscp-go/internal/util"
 	"github.com/TencentBlueKing/bscp-go/internal/util/eventmeta"
 	"github.com/TencentBlueKing/bscp-go/internal/util/process_collect"
 	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+	"github.com/TencentBlueKing/bscp-go/pkg/metrics"
 )
 
 const (
@@ -47,6 +54,38 @@ const (
 	updateFileConcurrentLimit = 10
 )
 
+// KvSource is where the kv value is got from
+type KvSource string
+
+const (
+	// KvSourceServer the value is fetched from feed-server
+	KvSourceServer KvSource = "server"
+	// KvSourceCache the value is got from the in-memory kv cache
+	KvSourceCache KvSource = "cache"
+	// KvSourceSnapshot the value is got from the kv snapshot loaded on start
+	KvSourceSnapshot KvSource = "snapshot"
+)
+
+// KvValue is a kv value with its metadata
+type KvValue struct {
+	// Value the kv value
+	Value string `json:"value"`
+	// KvType the kv type, empty if the value is got from the cache when feed-server is unavailable
+	KvType string `json:"kv_type,omitempty"`
+	// ReleaseID the release id which the value belongs to, 0 if unknown
+	ReleaseID uint32 `json:"release_id"`
+	// Revision the revision of the kv, nil if unknown
+	Revision *pbbase.Revision `json:"revision,omitempty"`
+	// Md5 the md5 of the value, empty if unknown
+	Md5 string `json:"md5"`
+	// Source where the value is got from
+	Source KvSource `json:"source"`
+	// FetchedAt the time the value is fetched from feed-server
+	FetchedAt time.Time `json:"fetched_at"`
+	// Stale whether the value is got from the cache when feed-server is unavailable, which may not be the latest
+	Stale bool `json:"stale"`
+}
+
 // Release bscp 服务版本
 type Release struct {
 	ReleaseID   uint32            `json:"release_id"`
@@ -64,6 +103,28 @@ type Release struct {
 	BizID       uint32
 	ClientMode  sfs.ClientMode
 	AppMate     *sfs.SideAppMeta
+	// versionedDir versioned release directory layout option
+	versionedDir VersionedDir
+	// releaseDir the release dir name which the files are updated into in versioned layout
+	releaseDir string
+	// autoRollback is whether restore the previous applied release when the post hook failed
+	autoRollback bool
+	// fileDeletion option for deleting the files which are not in the release
+	fileDeletion FileDeletion
+	// deletedFiles the managed files deleted since they are not in the release
+	deletedFiles []string
+	// changes the count of the files created and updated by applying the release
+	changes fileChanges
+	// traceCtx carries the root span of applying the release, nil if the release is not being applied
+	traceCtx context.Context
+	// rolledBack is whether the previous release is restored since the post hook of the release failed
+	rolledBack bool
+}
+
+// fileChanges is the count of the files changed by applying a release
+type fileChanges struct {
+	created int32
+	updated int32
 }
 
 // ConfigItemFile defines config item file
@@ -78,6 +139,42 @@ type ConfigItemFile struct {
 	Permission *pbci.FilePermission `json:"permission"`
 	// FileMeta data
 	FileMeta *sfs.ConfigItemMetaV1 `json:"fileMeta"`
+	// TargetPath the target path on the host mapped by the path mappings, the file is also written to it if set
+	TargetPath string `json:"targetPath,omitempty"`
+	// TargetPermission the permission of the target file, the file permission overwritten by the path mappings
+	TargetPermission *pbci.FilePermission `json:"targetPermission,omitempty"`
+	// priority the download priority of the file
+	priority downloader.Priority
+	// limiter the bandwidth limiter of the app which the file belongs to
+	limiter *downloader.Limiter
+	// progress the download progress of the file, nil if not tracked
+	progress *fileProgress
+	// asyncResult the result of the p2p download, nil if the file is not downloaded by p2p
+	asyncResult *downloader.AsyncResult
+	// traceCtx carries the span of downloading the file, nil if not traced
+	traceCtx context.Context
+}
+
+// SetProgress reports the download progress of the file to fn when it is downloaded by GetContent or SaveToFile
+func (c *ConfigItemFile) SetProgress(fn FileProgressFunc) {
+	if fn == nil {
+		c.progress = nil
+		return
+	}
+	c.progress = newFileProgress(c, fn)
+}
+
+// downloadOptions returns the download options of the file
+func (c *ConfigItemFile) downloadOptions() []downloader.DownloadOption {
+	opts := []downloader.DownloadOption{downloader.WithLimiter(c.limiter), downloader.WithPriority(c.priority),
+		downloader.WithAsyncReport(func(result downloader.AsyncResult) { c.asyncResult = &result })}
+	if c.progress != nil {
+		opts = append(opts, downloader.WithProgress(c.progress.add))
+	}
+	if c.traceCtx != nil {
+		opts = append(opts, downloader.WithTraceContext(c.traceCtx))
+	}
+	return opts
 }
 
 // GetContent Get file binary content from cache or download from remote
@@ -85,33 +182,91 @@ func (c *ConfigItemFile) GetContent() ([]byte, error) {
 	if cache.Enable {
 		if hit, bytes := cache.GetCache().GetFileContent(c.FileMeta); hit {
 			logger.Debug("get file content from cache success", slog.String("file", filepath.Join(c.Path, c.Name)))
+			c.progress.complete()
 			return bytes, nil
 		}
 	}
 	bytes := make([]byte, c.FileMeta.ContentSpec.ByteSize)
 
 	if err := downloader.GetDownloader().Download(c.FileMeta.PbFileMeta(), c.FileMeta.RepositoryPath,
-		c.FileMeta.ContentSpec.ByteSize, downloader.DownloadToBytes, bytes, ""); err != nil {
+		c.FileMeta.ContentSpec.ByteSize, downloader.DownloadToBytes, bytes, "", c.downloadOptions()...); err != nil {
 		logger.Error("download file failed", logger.ErrAttr(err))
 		return nil, err
 	}
+	c.progress.complete()
 	logger.Debug("get file content by downloading from repo success", slog.String("file", filepath.Join(c.Path, c.Name)))
 	return bytes, nil
 }
 
+// Open opens the file content as a stream from cache or from remote, the content is verified by the SHA256 while
+// it is read, and the last Read returns an error instead of io.EOF if it does not match. The caller must close it.
+// Unlike GetContent, the content is never loaded into memory as a whole.
+func (c *ConfigItemFile) Open() (io.ReadCloser, error) {
+	if cache.Enable {
+		if r, hit := cache.GetCache().Open(c.FileMeta); hit {
+			logger.Debug("open file content from cache success", slog.String("file", filepath.Join(c.Path, c.Name)))
+			return &contentStream{ReadCloser: r, file: c}, nil
+		}
+	}
+	r, err := downloader.GetDownloader().Open(c.FileMeta.PbFileMeta(), c.FileMeta.RepositoryPath,
+		c.FileMeta.ContentSpec.ByteSize, c.downloadOptions()...)
+	if err != nil {
+		logger.Error("open file content stream failed", logger.ErrAttr(err))
+		return nil, err
+	}
+	return &contentStream{ReadCloser: r, file: c}, nil
+}
+
+// WriteTo writes the verified file content to w as a stream, it returns an error if the content does not match
+// the SHA256 signature, in which case the content written to w should be discarded.
+func (c *ConfigItemFile) WriteTo(w io.Writer) (int64, error) {
+	r, err := c.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	return io.Copy(w, r)
+}
+
+// contentStream is the file content stream which completes the file progress at the end
+type contentStream struct {
+	io.ReadCloser
+	file *ConfigItemFile
+}
+
+// Read reads the file content
+func (s *contentStream) Read(p []byte) (int, error) {
+	n, err := s.ReadCloser.Read(p)
+	if err == io.EOF {
+		s.file.progress.complete()
+	}
+	return n, err
+}
+
+// copyFromCache copies the file content from the cache to dst, the content is added to the cache first if not cached
+func (c *ConfigItemFile) copyFromCache(dst string) bool {
+	ctx, span := tracing.Start(c.traceCtx, "cache copy")
+	defer span.End()
+	opts := append(c.downloadOptions(), downloader.WithTraceContext(ctx))
+	copied := cache.GetCache().CopyToFile(c.FileMeta, dst, opts...)
+	span.SetAttributes(attribute.Bool("copied", copied))
+	return copied
+}
+
 // SaveToFile save file content and write to local file
 func (c *ConfigItemFile) SaveToFile(dst string) error {
 	// 1. check if cache hit, copy from cache
-	if cache.Enable && cache.GetCache().CopyToFile(c.FileMeta, dst) {
+	if cache.Enable && c.copyFromCache(dst) {
 		logger.Debug("copy file from cache success", slog.String("dst", dst))
 	} else {
 		// 2. if cache not hit, download file from remote
 		if err := downloader.GetDownloader().Download(c.FileMeta.PbFileMeta(), c.FileMeta.RepositoryPath,
-			c.FileMeta.ContentSpec.ByteSize, downloader.DownloadToFile, nil, dst); err != nil {
+			c.FileMeta.ContentSpec.ByteSize, downloader.DownloadToFile, nil, dst, c.downloadOptions()...); err != nil {
 			logger.Error("download file failed", logger.ErrAttr(err))
 			return err
 		}
 	}
+	c.progress.complete()
 
 	return nil
 }
@@ -154,6 +309,13 @@ func (r *Release) compareRelease() (bool, error) {
 		return true, nil
 	}
 	r.AppMate.CurrentReleaseID = lastMetadata.ReleaseID
+	// the release has been rolled back automatically, it is not applied again until a newer release arrives
+	if lastChangeEventData.ReleaseID == r.ReleaseID && lastChangeEventData.Status == eventmeta.EventStatusRolledBack {
+		r.rolledBack = true
+		logger.Info("the received release has been rolled back, skip", slog.Any("releaseID", r.ReleaseID),
+			slog.Any("currentReleaseID", lastMetadata.ReleaseID))
+		return true, nil
+	}
 	return false, nil
 }
 
@@ -170,7 +332,9 @@ func (p *PreScriptStrategy) executeScript(r *Release) error {
 	if r.PreHook == nil {
 		return nil
 	}
+	_, span := tracing.Start(r.traceCtx, "pre-hook")
 	err := util.ExecuteHook(r.PreHook, table.PreHook, r.TempDir, r.BizID, r.AppMate.App, r.ReleaseName)
+	tracing.End(span, err)
 	if err != nil {
 		logger.Error("execute pre hook", logger.ErrAttr(err))
 		// 断言错误
@@ -195,7 +359,9 @@ func (p *PostScriptStrategy) executeScript(r *Release) error {
 	if r.PostHook == nil {
 		return nil
 	}
+	_, span := tracing.Start(r.traceCtx, "post-hook")
 	err := util.ExecuteHook(r.PostHook, table.PostHook, r.TempDir, r.BizID, r.AppMate.App, r.ReleaseName)
+	tracing.End(span, err)
 	if err != nil {
 		logger.Error("execute post hook", logger.ErrAttr(err))
 		// 断言错误
@@ -223,36 +389,116 @@ func (r *Release) ExecuteHook(hook ScriptStrategy) Function {
 // UpdateFiles 2.下载文件方法
 func (r *Release) UpdateFiles() Function {
 	return func() error {
-		filesDir := filepath.Join(r.AppDir, "files")
-		if err := updateFiles(filesDir, r.FileItems, &r.AppMate.DownloadFileNum, &r.AppMate.DownloadFileSize,
-			r.SemaphoreCh); err != nil {
+		if r.versionedDir.Enabled {
+			return r.updateVersionedFiles()
+		}
+		if err := ensureLegacyFilesDir(r.AppDir); err != nil {
+			return sfs.WrapPrimaryError(sfs.DownloadFailed,
+				sfs.SecondaryError{SpecificFailedReason: sfs.DeleteFolderFailed, Err: err})
+		}
+		filesDir := filepath.Join(r.AppDir, filesDirName)
+		if err := updateFiles(r.traceCtx, filesDir, filesDir, r.FileItems, &r.AppMate.DownloadFileNum,
+			&r.AppMate.DownloadFileSize, &r.changes, r.SemaphoreCh); err != nil {
 			logger.Error("update file failed", logger.ErrAttr(err))
 			return err
 		}
+		if err := r.syncTargets(filesDir); err != nil {
+			return err
+		}
 		if r.ClientMode == sfs.Pull {
+			// old files are not deleted in pull mode, they are still managed
+			if err := r.mergeManagedFiles(); err != nil {
+				logger.Error("update managed files failed", logger.ErrAttr(err))
+				return err
+			}
 			return nil
 		}
-		if err := clearOldFiles(filesDir, r.FileItems); err != nil {
+		if err := r.clearStaleFiles(filesDir); err != nil {
 			logger.Error("clear old files failed", logger.ErrAttr(err))
-			// 断言错误，可能是遍历文件错误
-			var smallErr sfs.SecondaryError
-			if errors.As(err, &smallErr) {
-				return sfs.WrapPrimaryError(sfs.DeleteOldFilesFailed, smallErr)
-			}
-			// 删除错误
-			return sfs.WrapPrimaryError(sfs.DeleteOldFilesFailed,
-				sfs.SecondaryError{
-					SpecificFailedReason: sfs.DeleteFolderFailed,
-					Err:                  err,
-				})
+			return err
 		}
 		return nil
 	}
 }
 
+// updateVersionedFiles downloads the files into the staging release dir, verifies them and then switches
+// the current symlink to the release dir atomically.
+func (r *Release) updateVersionedFiles() error {
+	current, err := currentReleaseDir(r.AppDir)
+	if err != nil {
+		return sfs.WrapPrimaryError(sfs.DownloadFailed,
+			sfs.SecondaryError{SpecificFailedReason: sfs.ReadFileFailed, Err: err})
+	}
+	stagingDir, err := prepareStagingDir(r.AppDir, r.ReleaseID)
+	if err != nil {
+		return sfs.WrapPrimaryError(sfs.DownloadFailed,
+			sfs.SecondaryError{SpecificFailedReason: sfs.NewFolderFailed, Err: err})
+	}
+	// the files of the current release dir, or the legacy files dir when migrating to versioned layout
+	var srcDir string
+	if current != "" {
+		srcDir = filepath.Join(r.AppDir, releasesDirName, current)
+	} else if info, e := os.Lstat(filepath.Join(r.AppDir, filesDirName)); e == nil && info.IsDir() {
+		srcDir = filepath.Join(r.AppDir, filesDirName)
+	}
+	var kept, deletes []string
+	if srcDir != "" {
+		seedReleaseDir(srcDir, stagingDir, r.FileItems)
+		if kept, err = r.carryOverFiles(srcDir, stagingDir); err != nil {
+			return sfs.WrapPrimaryError(sfs.DownloadFailed,
+				sfs.SecondaryError{SpecificFailedReason: sfs.WriteFileFailed, Err: err})
+		}
+		// the stale managed files which are not carried over are gone with the old release dir
+		if deletes, _, err = r.staleManagedFiles(srcDir); err != nil {
+			logger.Warn("get stale managed files failed", logger.ErrAttr(err))
+		}
+	}
+
+	if err = updateFiles(r.traceCtx, stagingDir, srcDir, r.FileItems, &r.AppMate.DownloadFileNum,
+		&r.AppMate.DownloadFileSize, &r.changes, r.SemaphoreCh); err != nil {
+		logger.Error("update file failed", logger.ErrAttr(err))
+		return err
+	}
+	if err = verifyReleaseDir(stagingDir, r.FileItems); err != nil {
+		logger.Error("verify release dir failed", slog.String("dir", stagingDir), logger.ErrAttr(err))
+		return err
+	}
+
+	r.releaseDir, err = commitReleaseDir(r.AppDir, stagingDir, r.ReleaseID, current)
+	if err != nil {
+		logger.Error("switch current release dir failed", logger.ErrAttr(err))
+		return sfs.WrapPrimaryError(sfs.DownloadFailed,
+			sfs.SecondaryError{SpecificFailedReason: sfs.WriteFileFailed, Err: err})
+	}
+	r.deletedFiles = deletes
+
+	if err = r.syncTargets(filepath.Join(r.AppDir, releasesDirName, r.releaseDir)); err != nil {
+		return err
+	}
+
+	keptTargets, err := r.clearStaleTargets()
+	if err != nil {
+		logger.Error("clear old target files failed", logger.ErrAttr(err))
+		return err
+	}
+	if err = r.writeManagedFiles(kept, keptTargets); err != nil {
+		logger.Error("update managed files failed", logger.ErrAttr(err))
+		return err
+	}
+
+	// the release has been switched, failing to delete old release dirs does not fail the release change
+	if err = pruneReleases(r.AppDir, r.versionedDir.RetainReleases); err != nil {
+		logger.Warn("delete old release dirs failed", slog.String("app_dir", r.AppDir), logger.ErrAttr(err))
+	}
+	return nil
+}
+
 // UpdateMetadata 4.更新meatdata数据方法
 func (r *Release) UpdateMetadata() Function {
-	return func() error {
+	return func() (err error) {
+		_, span := tracing.Start(r.traceCtx, "update metadata")
+		defer func() { tracing.End(span, err) }()
+
 		match := r.AppMate.Match
 		if match == nil {
 			match = []string{}
@@ -262,16 +508,42 @@ func (r *Release) UpdateMetadata() Function {
 			Status:        eventmeta.EventStatusSuccess,
 			ConfigMatches: match,
 			EventTime:     time.Now().Format(time.RFC3339),
+			ReleaseDir:    r.releaseDir,
 		}
-		err := eventmeta.AppendMetadataToFile(r.AppDir, metadata)
+		err = eventmeta.AppendMetadataToFile(r.AppDir, metadata)
 		if err != nil {
 			logger.Error("append metadata to file failed", logger.ErrAttr(err))
 			return err
 		}
+		// the manifest is only used for local rollback, failing to write it does not fail the release change
+		if err := eventmeta.WriteReleaseManifest(r.AppDir, r.manifest()); err != nil {
+			logger.Warn("write release manifest failed", logger.ErrAttr(err))
+		}
 		return nil
 	}
 }
 
+// manifest returns the manifest of the release
+func (r *Release) manifest() *eventmeta.ReleaseManifest {
+	files := make([]*eventmeta.ManifestFile, 0, len(r.FileItems))
+	for _, file := range r.FileItems {
+		files = append(files, &eventmeta.ManifestFile{
+			Name:             file.Name,
+			Path:             file.Path,
+			TextLineBreak:    file.TextLineBreak,
+			FileMeta:         file.FileMeta,
+			TargetPath:       file.TargetPath,
+			TargetPermission: file.TargetPermission,
+		})
+	}
+	return &eventmeta.ReleaseManifest{
+		ReleaseID:   r.ReleaseID,
+		ReleaseName: r.ReleaseName,
+		Files:       files,
+		PostHook:    r.PostHook,
+	}
+}
+
 // checkFileExists checks the file exists and the SHA256 is match.
 func checkFileExists(absPath string, ci *sfs.ConfigItemMetaV1) (bool, error) {
 	filePath := filepath.Join(absPath, ci.ConfigItemSpec.Name)
@@ -299,53 +571,6 @@ func checkFileExists(absPath string, ci *sfs.ConfigItemMetaV1) (bool, error) {
 	return true, nil
 }
 
-// clearOldFiles 删除旧文件
-func clearOldFiles(dir string, files []*ConfigItemFile) error {
-	if _, err := os.Stat(dir); err != nil {
-		// 根目录dir不存在，则之前没有拉取到任何匹配的文件，不用清理，直接退出
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return err
-	}
-
-	err := filepath.Walk(dir, func(filePath string, info os.FileInfo, err error) error {
-		if err != nil {
-			return sfs.WrapPrimaryError(sfs.DeleteOldFilesFailed,
-				sfs.SecondaryError{SpecificFailedReason: sfs.TraverseFolderFailed,
-					Err: err})
-		}
-
-		if info.IsDir() {
-			for _, file := range files {
-				absFileDir := filepath.Join(dir, file.Path)
-				if strings.HasPrefix(absFileDir, filePath) {
-					return nil
-				}
-			}
-			if err := os.RemoveAll(filePath); err != nil {
-				return err
-			}
-			logger.Info("delete folder success", slog.String("folder", filePath))
-			return filepath.SkipDir
-		}
-
-		for _, file := range files {
-			absFile := filepath.Join(dir, file.Path, file.Name)
-			if absFile == filePath {
-				return nil
-			}
-		}
-		if err := os.Remove(filePath); err != nil {
-			return err
-		}
-		logger.Info("delete file success", slog.String("file", filePath))
-		return nil
-	})
-
-	return err
-}
-
 // Execute 统一执行入口
 func (r *Release) Execute(steps ...Function) error {
 	var err error
@@ -358,29 +583,16 @@ func (r *Release) Execute(steps ...Function) error {
 
 	// 发送变更事件
 	defer func() {
-		r.AppMate.EndTime = time.Now().UTC()
-		r.AppMate.TotalSeconds = r.AppMate.EndTime.Sub(r.AppMate.StartTime).Seconds()
-		r.AppMate.ReleaseChangeStatus = sfs.Success
-		if err != nil {
-			// 默认为未知错误
-			r.AppMate.ReleaseChangeStatus = sfs.Failed
-			r.AppMate.FailedReason = sfs.UnknownFailed
-			r.AppMate.SpecificFailedReason = sfs.UnknownSpecificFailed
-			r.AppMate.FailedDetailReason = err.Error()
-			var e sfs.PrimaryError
-			if errors.As(err, &e) {
-				r.AppMate.FailedReason = e.FailedReason
-				r.AppMate.SpecificFailedReason = e.SpecificFailedReason
-				r.AppMate.FailedDetailReason = e.Err.Error()
-			}
-		}
-
-		if err = r.sendVersionChangeMessaging(bd); err != nil {
-			logger.Error("description failed to report the client change event",
-				slog.String("client_mode", r.ClientMode.String()), slog.Uint64("biz", uint64(r.BizID)),
-				slog.String("app", r.AppMate.App), logger.ErrAttr(err))
-		}
+		r.reportReleaseChangeResult(bd, err)
+	}()
 
+	var span trace.Span
+	r.traceCtx, span = tracing.Start(r.vas.Ctx, "release change",
+		attribute.Int64("biz_id", int64(r.BizID)), attribute.String("app", r.AppMate.App),
+		attribute.Int64("release_id", int64(r.ReleaseID)), attribute.String("release_name", r.ReleaseName))
+	defer func() {
+		tracing.End(span, err)
+		tracing.Flush()
 	}()
 
 	// 一定要在该位置
@@ -405,18 +617,109 @@ func (r *Release) Execute(steps ...Function) error {
 	}
 
 	if skip {
+		span.SetAttributes(attribute.Bool("skipped", true))
+		metrics.CurrentReleaseID.WithLabelValues(r.AppMate.App).Set(float64(r.AppMate.CurrentReleaseID))
 		return nil
 	}
 
 	for _, step := range steps {
 		if err = step(); err != nil {
+			if r.autoRollback && isPostHookFailed(err) {
+				err = r.rollbackOnPostHookFailed(bd, err)
+			}
 			return err
 		}
 	}
+	r.pinCachedFiles()
+	r.reportApplyMetrics()
 
 	return nil
 }
 
+// reportApplyMetrics reports the files changed by applying the release and the release id currently applied
+func (r *Release) reportApplyMetrics() {
+	app := r.AppMate.App
+	metrics.ApplyFileChangeCounter.WithLabelValues(app, "created").Add(float64(atomic.LoadInt32(&r.changes.created)))
+	metrics.ApplyFileChangeCounter.WithLabelValues(app, "updated").Add(float64(atomic.LoadInt32(&r.changes.updated)))
+	metrics.ApplyFileChangeCounter.WithLabelValues(app, "deleted").Add(float64(len(r.deletedFiles)))
+	metrics.CurrentReleaseID.WithLabelValues(app).Set(float64(r.ReleaseID))
+}
+
+// pinCachedFiles pins the cached contents of the applied release, so that they are not evicted from the file cache
+func (r *Release) pinCachedFiles() {
+	if !cache.Enable {
+		return
+	}
+	signatures := make([]string, 0, len(r.FileItems))
+	for _, file := range r.FileItems {
+		signatures = append(signatures, file.FileMeta.ContentSpec.Signature)
+	}
+	cache.GetCache().Pin(r.BizID, r.AppMate.App, r.ReleaseID, signatures)
+}
+
+// reportReleaseChangeResult 上报版本变更结果
+func (r *Release) reportReleaseChangeResult(bd *sfs.BasicData, err error) {
+	r.AppMate.EndTime = time.Now().UTC()
+	r.AppMate.TotalSeconds = r.AppMate.EndTime.Sub(r.AppMate.StartTime).Seconds()
+	r.AppMate.ReleaseChangeStatus = sfs.Success
+	if bd.Annotations == nil {
+		bd.Annotations = make(map[string]interface{})
+	}
+	r.deletedFilesAnnotations(bd.Annotations)
+	r.p2pDownloadAnnotations(bd.Annotations)
+	if err != nil {
+		// 默认为未知错误
+		r.AppMate.ReleaseChangeStatus = sfs.Failed
+		r.AppMate.FailedReason = sfs.UnknownFailed
+		r.AppMate.SpecificFailedReason = sfs.UnknownSpecificFailed
+		r.AppMate.FailedDetailReason = err.Error()
+		var e sfs.PrimaryError
+		if errors.As(err, &e) {
+			r.AppMate.FailedReason = e.FailedReason
+			r.AppMate.SpecificFailedReason = e.SpecificFailedReason
+			r.AppMate.FailedDetailReason = e.Err.Error()
+		}
+	}
+
+	if err = r.sendVersionChangeMessaging(bd); err != nil {
+		logger.Error("description failed to report the client change event",
+			slog.String("client_mode", r.ClientMode.String()), slog.Uint64("biz", uint64(r.BizID)),
+			slog.String("app", r.AppMate.App), logger.ErrAttr(err))
+	}
+}
+
+// p2pDownloadAnnotations adds the p2p download tasks of the files and the reasons of falling back to http download
+// to the report annotations
+func (r *Release) p2pDownloadAnnotations(annotations map[string]interface{}) {
+	tasks := make([]map[string]interface{}, 0)
+	fallbacks := 0
+	for _, file := range r.FileItems {
+		result := file.asyncResult
+		if result == nil {
+			continue
+		}
+		if result.Fallback {
+			fallbacks++
+		}
+		if len(tasks) >= maxReportP2PTasks {
+			continue
+		}
+		task := map[string]interface{}{
+			"file":    path.Join(file.Path, file.Name),
+			"task_id": result.TaskID,
+		}
+		if result.Fallback {
+			task["fallback_reason"] = util.TruncateString(result.FallbackReason, 256)
+		}
+		tasks = append(tasks, task)
+	}
+	if len(tasks) == 0 {
+		return
+	}
+	annotations["p2p_download_tasks"] = tasks
+	annotations["p2p_download_fallback_count"] = fallbacks
+}
+
 // sendVersionChangeMessaging 发送客户端版本变更信息
 func (r *Release) sendVersionChangeMessaging(bd *sfs.BasicData) (err error) {
 	r.AppMate.FailedDetailReason = util.TruncateString(r.AppMate.FailedDetailReason, 1024)
@@ -433,8 +736,9 @@ func (r *Release) sendVersionChangeMessaging(bd *sfs.BasicData) (err error) {
 		return err
 	}
 
-	if r.ClientMode != sfs.Pull {
-		if changeEvent != nil && changeEvent.ReleaseID > 0 {
+	// the release rolled back is not the current release, the current one is set by the rollback or the comparison
+	if r.ClientMode != sfs.Pull && !r.rolledBack {
+		if changeEvent != nil && changeEvent.ReleaseID > 0 && changeEvent.Status != eventmeta.EventStatusRolledBack {
 			r.AppMate.CurrentReleaseID = changeEvent.ReleaseID
 		}
 	}
@@ -450,7 +754,9 @@ func (r *Release) sendVersionChangeMessaging(bd *sfs.BasicData) (err error) {
 		return err
 	}
 
-	_, err = r.upstream.Messaging(r.vas, pullPayload.MessagingType(), encode)
+	// the trace context of applying the release is propagated to upstream server by the grpc metadata
+	vas := &kit.Vas{Rid: r.vas.Rid, Ctx: tracing.Propagate(r.vas.Ctx, r.traceCtx)}
+	_, err = r.upstream.Messaging(vas, pullPayload.MessagingType(), encode)
 	if err != nil {
 		return err
 	}
@@ -540,6 +846,7 @@ func (r *Release) heartbeatOnce(msgType sfs.MessagingType, payload []byte) error
 		if err := r.sendHeartbeatMessaging(r.vas, msgType, payload); err != nil {
 			logger.Error("send heartbeat message failed",
 				slog.Any("retry_count", retry.RetryCount()), logger.ErrAttr(err), slog.String("rid", r.vas.Rid))
+			metrics.HeartbeatFailureCounter.Inc()
 			lastErr = err
 			retry.Sleep()
 			continue
@@ -561,23 +868,34 @@ func (r *Release) sendHeartbeatMessaging(vas *kit.Vas, msgType sfs.MessagingType
 	return nil
 }
 
-// updateFiles updates the files to the target directory.
-func updateFiles(filesDir string, files []*ConfigItemFile, successDownloads *int32, successFileSize *uint64,
-	semaphoreCh chan struct{}) error {
+// updateFiles updates the files to the target directory, the files written are counted as updated if they exist
+// in the previous directory, otherwise as created.
+func updateFiles(ctx context.Context, filesDir, prevDir string, files []*ConfigItemFile, successDownloads *int32,
+	successFileSize *uint64, changes *fileChanges, semaphoreCh chan struct{}) error {
 	start := time.Now()
 	// Initialize the successDownloads and successFileSize to zero at the beginning of the function.
 	atomic.StoreInt32(successDownloads, 0)
 	atomic.StoreUint64(successFileSize, 0)
 	var success, failed, skip int32
+	// the identical content of the files is downloaded only once
+	dedup := newContentDedup(filesDir, files)
+	defer dedup.cleanup()
 	g, _ := errgroup.WithContext(context.Background())
 	g.SetLimit(updateFileConcurrentLimit)
-	for _, f := range files {
+	// the files with higher priority are started first
+	for _, f := range sortByPriority(files) {
 		file := f
-		g.Go(func() error {
+		g.Go(func() (err error) {
+			var span trace.Span
+			file.traceCtx, span = tracing.Start(ctx, "download file",
+				attribute.String("file", path.Join(file.Path, file.Name)),
+				attribute.Int64("size", int64(file.FileMeta.ContentSpec.ByteSize)))
+			defer func() { tracing.End(span, err) }()
+
 			// 1. prapare file path
 			fileDir := filepath.Join(filesDir, file.Path)
 			filePath := filepath.Join(fileDir, file.Name)
-			err := os.MkdirAll(fileDir, os.ModePerm)
+			err = os.MkdirAll(fileDir, os.ModePerm)
 			if err != nil {
 				atomic.AddInt32(&failed, 1)
 				return sfs.WrapPrimaryError(sfs.DownloadFailed,
@@ -593,30 +911,46 @@ func updateFiles(filesDir string, files []*ConfigItemFile, successDownloads *int
 						Err: fmt.Errorf("check file exists failed, err: %s", err.Error())})
 			}
 			if !exists {
-				err := file.SaveToFile(filePath)
-				if err != nil {
+				existed := false
+				if prevDir != "" {
+					_, e := os.Lstat(filepath.Join(prevDir, file.Path, file.Name))
+					existed = e == nil
+				}
+				// 3. download to a temp file, convert line break and set permission on it, and then rename it to
+				// the file, so that the file is never truncated, partially written or with wrong permission
+				tmpPath := util.TempFilePath(filePath)
+				if err := dedup.saveToFile(file, tmpPath); err != nil {
+					atomic.AddInt32(&failed, 1)
+					_ = os.Remove(tmpPath)
+					return err
+				}
+				if err := finishFile(tmpPath, file); err != nil {
 					atomic.AddInt32(&failed, 1)
+					_ = os.Remove(tmpPath)
 					return err
 				}
+				if err := os.Rename(tmpPath, filePath); err != nil {
+					atomic.AddInt32(&failed, 1)
+					_ = os.Remove(tmpPath)
+					return sfs.WrapPrimaryError(sfs.DownloadFailed,
+						sfs.SecondaryError{SpecificFailedReason: sfs.WriteFileFailed,
+							Err: fmt.Errorf("rename %s to %s failed, err: %s", tmpPath, filePath, err.Error())})
+				}
 				atomic.AddInt32(&success, 1)
+				if existed {
+					atomic.AddInt32(&changes.updated, 1)
+				} else {
+					atomic.AddInt32(&changes.created, 1)
+				}
 				logger.Info("update file success", slog.String("file", filePath))
 			} else {
 				atomic.AddInt32(&skip, 1)
 				logger.Debug("file is already exists and has not been modified, skip download",
 					slog.String("file", filePath))
-			}
-			// 4. check whether need to convert line break
-			if file.FileMeta.ConfigItemSpec.FileType == "text" && file.TextLineBreak != "" {
-				if err := util.ConvertTextLineBreak(filePath, file.TextLineBreak); err != nil {
-					logger.Error("convert text file line break failed", slog.String("file", filePath), logger.ErrAttr(err))
+				if err := finishFile(filePath, file); err != nil {
 					return err
 				}
-			}
-			// 5. set file permission
-			if runtime.GOOS != "windows" {
-				if err := util.SetFilePermission(filePath, file.FileMeta.ConfigItemSpec.Permission); err != nil {
-					logger.Warn("set file permission failed", slog.String("file", filePath), logger.ErrAttr(err))
-				}
+				file.progress.complete()
 			}
 			atomic.AddInt32(successDownloads, 1)
 			atomic.AddUint64(successFileSize, file.FileMeta.ContentSpec.ByteSize)
@@ -626,6 +960,17 @@ func updateFiles(filesDir string, files []*ConfigItemFile, successDownloads *int
 	}
 	err := g.Wait()
 
+	// the partial downloaded files which are not resumed for a long time are useless
+	cleanupDirs := make(map[string]bool)
+	for _, file := range files {
+		dir := filepath.Join(filesDir, file.Path)
+		if !cleanupDirs[dir] {
+			cleanupDirs[dir] = true
+			downloader.CleanupPartFiles(dir, downloader.DefaultPartFileExpiration)
+		}
+	}
+	downloader.CleanupSharedStore(downloader.DefaultSharedStoreExpiration)
+
 	logger.Info("update files done", slog.Int("success", int(success)), slog.Int("skip", int(skip)),
 		slog.Int("failed", int(failed)), slog.Int("total", len(files)),
 		slog.String("duration", time.Since(start).String()))
@@ -643,12 +988,87 @@ func updateFiles(filesDir string, files []*ConfigItemFile, successDownloads *int
 	return nil
 }
 
+// WarmCache adds the contents of the release files to the file cache without applying the release, so that the
+// release is applied from the local cache later
+func (r *Release) WarmCache() error {
+	if !cache.Enable {
+		return errors.New("file cache is not enabled")
+	}
+	start := time.Now()
+	var warmed int32
+	g, _ := errgroup.WithContext(context.Background())
+	g.SetLimit(updateFileConcurrentLimit)
+	for _, f := range sortByPriority(r.FileItems) {
+		file := f
+		g.Go(func() error {
+			if err := cache.GetCache().Warm(file.FileMeta, file.downloadOptions()...); err != nil {
+				return fmt.Errorf("warm file %s failed, err: %s", filepath.Join(file.Path, file.Name), err.Error())
+			}
+			file.progress.complete()
+			atomic.AddInt32(&warmed, 1)
+			return nil
+		})
+	}
+	err := g.Wait()
+	logger.Info("warm file cache done", slog.String("app", r.AppMate.App), slog.Uint64("release", uint64(r.ReleaseID)),
+		slog.Int("warmed", int(warmed)), slog.Int("total", len(r.FileItems)),
+		slog.String("duration", time.Since(start).String()))
+	return err
+}
+
+// prioritizeFiles sets the download priority and the app bandwidth limiter of the files
+func prioritizeFiles(files []*ConfigItemFile, priority DownloadPriority, limiter *downloader.Limiter) {
+	for _, file := range files {
+		file.limiter = limiter
+		if !priority.Enabled {
+			continue
+		}
+		switch {
+		case file.FileMeta.ContentSpec.ByteSize > priority.SmallFileSize:
+			file.priority = downloader.PriorityLow
+		case file.FileMeta.ConfigItemSpec.FileType == "text":
+			file.priority = downloader.PriorityHigh
+		}
+	}
+}
+
+// sortByPriority returns the files sorted by the download priority, the order of the files with the same priority
+// is kept
+func sortByPriority(files []*ConfigItemFile) []*ConfigItemFile {
+	sorted := append([]*ConfigItemFile{}, files...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].priority.Higher(sorted[j].priority)
+	})
+	return sorted
+}
+
+// finishFile converts the line break and sets the permission of the downloaded file
+func finishFile(filePath string, file *ConfigItemFile) error {
+	// 1. check whether need to convert line break
+	if file.FileMeta.ConfigItemSpec.FileType == "text" && file.TextLineBreak != "" {
+		if err := util.ConvertTextLineBreak(filePath, file.TextLineBreak); err != nil {
+			logger.Error("convert text file line break failed", slog.String("file", filePath), logger.ErrAttr(err))
+			return err
+		}
+	}
+	// 2. set file permission
+	if runtime.GOOS != "windows" {
+		if err := util.SetFilePermission(filePath, file.FileMeta.ConfigItemSpec.Permission); err != nil {
+			logger.Warn("set file permission failed", slog.String("file", filePath), logger.ErrAttr(err))
+		}
+	}
+	return nil
+}
+
 // recordChangeEvent 记录变更事件
 func (r *Release) recordChangeEvent() error {
 	var eventStatus eventmeta.EventStatus
-	if r.AppMate.ReleaseChangeStatus == sfs.Success {
+	switch {
+	case r.rolledBack:
+		eventStatus = eventmeta.EventStatusRolledBack
+	case r.AppMate.ReleaseChangeStatus == sfs.Success:
 		eventStatus = eventmeta.EventStatusSuccess
-	} else {
+	default:
 		eventStatus = eventmeta.EventStatusFailed
 	}
 	metadata := &eventmeta.ChangeEvent{
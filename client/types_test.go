@@ -0,0 +1,63 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/TencentBlueKing/bscp-go/internal/downloader"
+)
+
+func TestP2PDownloadAnnotations(t *testing.T) {
+	p2p := newTestFile(t, "/etc", "p2p.conf", "p2p")
+	p2p.asyncResult = &downloader.AsyncResult{TaskID: "task-1"}
+	fallback := newTestFile(t, "/etc", "fallback.conf", "fallback")
+	fallback.asyncResult = &downloader.AsyncResult{TaskID: "task-2", Fallback: true, FallbackReason: "timed out"}
+	direct := newTestFile(t, "/etc", "http.conf", "http")
+	r := newTestRelease(t, 1, p2p, fallback, direct)
+
+	// the p2p download tasks are reported with the release change result
+	r.reportReleaseChangeResult(r.handleBasicData(r.ClientMode, map[string]interface{}{}), nil)
+	payload, ok := r.upstream.(*fakeUpstream).payload.Load().([]byte)
+	if !ok {
+		t.Fatal("the release change result is not reported")
+	}
+	var got struct {
+		BasicData struct {
+			Annotations struct {
+				Tasks     []map[string]interface{} `json:"p2p_download_tasks"`
+				Fallbacks int                      `json:"p2p_download_fallback_count"`
+			} `json:"annotations"`
+		} `json:"basicData"`
+	}
+	if err := json.Unmarshal(payload, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []map[string]interface{}{
+		{"file": "/etc/p2p.conf", "task_id": "task-1"},
+		{"file": "/etc/fallback.conf", "task_id": "task-2", "fallback_reason": "timed out"},
+	}
+	annotations := got.BasicData.Annotations
+	if !reflect.DeepEqual(annotations.Tasks, want) || annotations.Fallbacks != 1 {
+		t.Errorf("p2p download annotations = %+v, want tasks %v with 1 fallback", annotations, want)
+	}
+
+	// nothing is reported if no file is downloaded by p2p
+	empty := make(map[string]interface{})
+	newTestRelease(t, 1, direct).p2pDownloadAnnotations(empty)
+	if len(empty) != 0 {
+		t.Errorf("unexpected p2p download annotations: %v", empty)
+	}
+}
@@ -32,6 +32,8 @@ import (
 	"golang.org/x/exp/slog"
 	"google.golang.org/grpc"
 
+	"github.com/TencentBlueKing/bscp-go/internal/cache"
+	"github.com/TencentBlueKing/bscp-go/internal/downloader"
 	"github.com/TencentBlueKing/bscp-go/internal/upstream"
 	"github.com/TencentBlueKing/bscp-go/internal/util"
 	"github.com/TencentBlueKing/bscp-go/internal/util/process_collect"
@@ -42,9 +44,19 @@ import (
 // ReconnectSignal defines the signal information to tell the
 // watcher to reconnect the remote upstream server.
 type reconnectSignal struct {
+	// Kind is the bounded kind of the reason, which is used as the metrics label
+	Kind   string
 	Reason string
 }
 
+const (
+	reconnectKindResetLabels     = "reset_labels"
+	reconnectKindHeartbeatFailed = "heartbeat_failed"
+	reconnectKindStreamClosed    = "stream_closed"
+	reconnectKindStreamCorrupted = "stream_corrupted"
+	reconnectKindBounce          = "bounce"
+)
+
 // String format the reconnect signal to a string.
 func (rs reconnectSignal) String() string {
 	return rs.Reason
@@ -203,7 +215,7 @@ func (w *watcher) loopReceiveWatchedEvent(wStream pbfs.Upstream_WatchClient) {
 			if err != nil {
 				if errors.Is(err, io.EOF) {
 					logger.Error("watch stream has been closed by remote upstream stream server, need to re-connect again")
-					w.NotifyReconnect(reconnectSignal{Reason: "connection is closed " +
+					w.NotifyReconnect(reconnectSignal{Kind: reconnectKindStreamClosed, Reason: "connection is closed " +
 						"by remote upstream server"})
 					return
 				}
@@ -211,7 +223,7 @@ func (w *watcher) loopReceiveWatchedEvent(wStream pbfs.Upstream_WatchClient) {
 				logger.Error("watch stream is corrupted", logger.ErrAttr(err), slog.String("rid", w.vas.Rid))
 				// 权限不足或者删除等会一直错误，限制重连频率
 				time.Sleep(time.Second * 5)
-				w.NotifyReconnect(reconnectSignal{Reason: "watch stream corrupted"})
+				w.NotifyReconnect(reconnectSignal{Kind: reconnectKindStreamCorrupted, Reason: "watch stream corrupted"})
 				return
 			}
 
@@ -232,7 +244,8 @@ func (w *watcher) loopReceiveWatchedEvent(wStream pbfs.Upstream_WatchClient) {
 			switch sfs.FeedMessageType(event.Type) {
 			case sfs.Bounce:
 				logger.Info("received upstream bounce request, need to reconnect upstream server", slog.String("rid", event.Rid))
-				w.NotifyReconnect(reconnectSignal{Reason: "received bounce request"})
+				metrics.BounceCounter.Inc()
+				w.NotifyReconnect(reconnectSignal{Kind: reconnectKindBounce, Reason: "received bounce request"})
 				return
 
 			case sfs.PublishRelease:
@@ -278,6 +291,11 @@ func (w *watcher) OnReleaseChange(event *sfs.ReleaseChangeEvent) { // nolint
 			subscriber.UID == pl.Instance.Uid &&
 			reflect.DeepEqual(subscriber.Labels, pl.Instance.Labels) {
 
+			// the state reported by the heartbeats, which is restored if the release is only planned by the dry run
+			prevCursorID, prevStatus := subscriber.CursorID, subscriber.ReleaseChangeStatus
+			prevConfigItems := subscriber.currentConfigItems
+			prevDownloadNum, prevDownloadSize := subscriber.DownloadFileNum, subscriber.DownloadFileSize
+
 			// 更新心跳数据需要cursorID
 			subscriber.CursorID = cursorID
 
@@ -299,20 +317,27 @@ func (w *watcher) OnReleaseChange(event *sfs.ReleaseChangeEvent) { // nolint
 				})
 				totalFileSize += ci.ContentSpec.ContentSpec().ByteSize
 			}
+			applyPathMappings(configItemFiles, subscriber.Opts.PathMappings)
+			prioritizeFiles(configItemFiles, w.opts.downloadPriority, subscriber.limiter)
+
+			prewarmed := w.prewarmCache(event, subscriber)
 
 			release := &Release{
-				ReleaseID:   pl.ReleaseMeta.ReleaseID,
-				ReleaseName: pl.ReleaseMeta.ReleaseName,
-				FileItems:   configItemFiles,
-				KvItems:     pl.ReleaseMeta.KvMetas,
-				PreHook:     pl.ReleaseMeta.PreHook,
-				PostHook:    pl.ReleaseMeta.PostHook,
-				vas:         w.vas,
-				upstream:    w.upstream,
-				BizID:       w.opts.bizID,
-				CursorID:    cursorID,
-				ClientMode:  sfs.Watch,
-				SemaphoreCh: make(chan struct{}),
+				ReleaseID:    pl.ReleaseMeta.ReleaseID,
+				ReleaseName:  pl.ReleaseMeta.ReleaseName,
+				FileItems:    configItemFiles,
+				KvItems:      pl.ReleaseMeta.KvMetas,
+				PreHook:      pl.ReleaseMeta.PreHook,
+				PostHook:     pl.ReleaseMeta.PostHook,
+				vas:          w.vas,
+				upstream:     w.upstream,
+				BizID:        w.opts.bizID,
+				CursorID:     cursorID,
+				ClientMode:   sfs.Watch,
+				SemaphoreCh:  make(chan struct{}),
+				versionedDir: w.opts.versionedDir,
+				autoRollback: subscriber.Opts.autoRollbackEnabled(w.opts.autoRollback),
+				fileDeletion: w.opts.fileDeletion,
 				AppMate: &sfs.SideAppMeta{
 					App:              subscriber.App,
 					Uid:              subscriber.UID,
@@ -343,15 +368,24 @@ func (w *watcher) OnReleaseChange(event *sfs.ReleaseChangeEvent) { // nolint
 			}(ctx)
 
 			subscriber.ReleaseChangeStatus = sfs.Processing
-			if err := subscriber.Callback(release); err != nil {
-				cancel()
+			w.awaitPrewarm(prewarmed, subscriber.App)
+			err := subscriber.Callback(release)
+			cancel()
+			switch {
+			case errors.Is(err, ErrDryRun):
+				subscriber.CursorID, subscriber.ReleaseChangeStatus = prevCursorID, prevStatus
+				subscriber.currentConfigItems = prevConfigItems
+				subscriber.DownloadFileNum, subscriber.DownloadFileSize = prevDownloadNum, prevDownloadSize
+				logger.Info("the release is planned by the dry run, skip reporting the release change",
+					slog.String("app", subscriber.App), slog.Uint64("releaseID", uint64(release.ReleaseID)))
+			case err != nil:
 				subscriber.ReleaseChangeStatus = sfs.Failed
 				logger.Error("execute watch callback failed", slog.String("app", subscriber.App), logger.ErrAttr(err))
 				subscriber.reportReleaseChangeCallbackMetrics("failed", start)
-			} else {
-				cancel()
+			default:
 				subscriber.ReleaseChangeStatus = sfs.Success
 				subscriber.reportReleaseChangeCallbackMetrics("success", start)
+				syncKvSnapshot(w.opts.bizID, subscriber.App, release.KvItems)
 
 				subscriber.CurrentReleaseID = pl.ReleaseMeta.ReleaseID
 			}
@@ -359,6 +393,35 @@ func (w *watcher) OnReleaseChange(event *sfs.ReleaseChangeEvent) { // nolint
 	}
 }
 
+// prewarmCache starts pre-warming the file cache with the contents of the release if it is enabled, the contents
+// are downloaded with the bandwidth limit of the subscriber app. It returns nil if the cache is not pre-warmed.
+func (w *watcher) prewarmCache(event *sfs.ReleaseChangeEvent, subscriber *subscriber) <-chan struct{} {
+	if !w.opts.fileCache.Enabled || !w.opts.fileCache.Prewarm.Enabled || !cache.Enable {
+		return nil
+	}
+	return cache.GetCache().OnReleaseChange(event, downloader.WithLimiter(subscriber.limiter))
+}
+
+// awaitPrewarm delays applying the release until the cache pre-warm completes or the delay times out if it is
+// enabled, the release is applied with the contents not cached yet downloaded from remote repo after the timeout.
+func (w *watcher) awaitPrewarm(prewarmed <-chan struct{}, app string) {
+	if prewarmed == nil || !w.opts.fileCache.Prewarm.DelayApply {
+		return
+	}
+	timeout := w.opts.fileCache.Prewarm.DelayTimeout
+	if timeout <= 0 {
+		timeout = DefaultPrewarmDelayTimeout
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-prewarmed:
+	case <-timer.C:
+		logger.Warn("the file cache pre-warm is not completed in time, apply the release anyway",
+			slog.String("app", app), slog.String("timeout", timeout.String()))
+	}
+}
+
 // Subscribe subscribe the instance release change event
 func (w *watcher) Subscribe(callback Callback, app string, opts ...AppOption) *subscriber {
 	options := &AppOptions{}
@@ -377,6 +440,7 @@ func (w *watcher) Subscribe(callback Callback, app string, opts ...AppOption) *s
 		Match:            options.Match,
 		Callback:         callback,
 		CurrentReleaseID: 0,
+		limiter:          downloader.NewLimiter(options.BandwidthLimit),
 	}
 	w.subscribers = append(w.subscribers, subscriber)
 	return subscriber
@@ -411,6 +475,8 @@ type subscriber struct {
 	ReleaseChangeStatus sfs.Status
 	DownloadFileNum     int32
 	DownloadFileSize    uint64
+	// limiter limits the download bandwidth of the subscriber app
+	limiter *downloader.Limiter
 }
 
 // CheckConfigItemsChanged check if the subscriber watched config items are changed
@@ -451,10 +517,12 @@ func (s *subscriber) ResetLabels(labels map[string]string) {
 }
 
 func (s *subscriber) reportReleaseChangeCallbackMetrics(status string, start time.Time) {
-	releaseID := strconv.Itoa(int(s.TargetReleaseID))
-	metrics.ReleaseChangeCallbackCounter.WithLabelValues(s.App, status, releaseID).Inc()
+	metrics.ReleaseChangeCallbackCounter.WithLabelValues(s.App, status).Inc()
 	seconds := time.Since(start).Seconds()
-	metrics.ReleaseChangeCallbackHandingSecond.WithLabelValues(s.App, status, releaseID).Observe(seconds)
+	metrics.ReleaseChangeCallbackHandingSecond.WithLabelValues(s.App, status).Observe(seconds)
+	if status == "success" {
+		metrics.CurrentReleaseID.WithLabelValues(s.App).Set(float64(s.TargetReleaseID))
+	}
 }
 
 // sendClientMessaging 发送客户端连接信息
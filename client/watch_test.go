@@ -0,0 +1,62 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package client
+
+import (
+	"encoding/json"
+	"testing"
+
+	sfs "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/sf-share"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/TencentBlueKing/bscp-go/pkg/metrics"
+)
+
+func TestOnReleaseChangeDryRun(t *testing.T) {
+	w := &watcher{opts: &options{bizID: 1}, upstream: &fakeUpstream{}}
+	var callbackErr error
+	s := w.Subscribe(func(release *Release) error { return callbackErr }, "dry-run-app", WithAppUID("uid"))
+	onReleaseChange := func(releaseID, cursorID uint32) {
+		t.Helper()
+		payload, err := json.Marshal(&sfs.ReleaseChangePayload{
+			ReleaseMeta: &sfs.ReleaseEventMetaV1{App: s.App, ReleaseID: releaseID, ReleaseName: "release"},
+			Instance:    &sfs.InstanceSpec{BizID: 1, App: s.App, Uid: s.UID, Labels: s.Labels},
+			CursorID:    cursorID,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.OnReleaseChange(&sfs.ReleaseChangeEvent{Rid: "rid", Payload: payload})
+	}
+
+	// release 1 is applied
+	onReleaseChange(1, 10)
+	if s.CurrentReleaseID != 1 || s.ReleaseChangeStatus != sfs.Success || s.CursorID != "10" {
+		t.Fatalf("unexpected subscriber state after the release is applied: %+v", s)
+	}
+	success := testutil.ToFloat64(metrics.ReleaseChangeCallbackCounter.WithLabelValues(s.App, "success"))
+
+	// release 2 is only planned by the dry run, nothing is reported as a version change
+	callbackErr = ErrDryRun
+	onReleaseChange(2, 20)
+	if s.CurrentReleaseID != 1 || s.ReleaseChangeStatus != sfs.Success || s.CursorID != "10" {
+		t.Errorf("the subscriber state is changed by the dry run: %+v", s)
+	}
+	if got := testutil.ToFloat64(metrics.ReleaseChangeCallbackCounter.WithLabelValues(s.App, "success")); got !=
+		success {
+		t.Errorf("the release change callback metrics are reported by the dry run")
+	}
+	if got := testutil.ToFloat64(metrics.ReleaseChangeCallbackCounter.WithLabelValues(s.App, "failed")); got != 0 {
+		t.Errorf("the dry run is reported as a failed release change")
+	}
+}
@@ -0,0 +1,335 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+
+	"github.com/TencentBlueKing/bscp-go/client"
+	"github.com/TencentBlueKing/bscp-go/internal/cache"
+	"github.com/TencentBlueKing/bscp-go/internal/config"
+	"github.com/TencentBlueKing/bscp-go/internal/constant"
+)
+
+var (
+	// cacheCmd is parent cmd for the file cache management sub cmds
+	cacheCmd = &cobra.Command{
+		Use:   "cache",
+		Short: "Manage the local file cache",
+		Long:  `Manage the local file cache used by pull and watch`,
+	}
+
+	// cacheLsCmd is cache cmd for listing the cached contents
+	cacheLsCmd = &cobra.Command{
+		Use:   "ls",
+		Short: "List the cached contents",
+		Long:  `List the cached contents with the size, the last use and the applied releases which reference them`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runCacheLs()
+		},
+	}
+
+	// cacheStatsCmd is cache cmd for showing the statistics
+	cacheStatsCmd = &cobra.Command{
+		Use:   "stats",
+		Short: "Show the statistics of the file cache",
+		Long:  `Show the statistics of the file cache`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runCacheStats()
+		},
+	}
+
+	// cachePruneCmd is cache cmd for removing the cached contents
+	cachePruneCmd = &cobra.Command{
+		Use:   "prune",
+		Short: "Remove the cached contents by size or by last use",
+		Long: `Remove the cached contents not used within --older-than, then evict the contents by the eviction
+policy until the cache size is not larger than --max-size. The contents referenced by the applied releases are
+never removed`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runCachePrune()
+		},
+	}
+
+	// cacheVerifyCmd is cache cmd for verifying the cached contents
+	cacheVerifyCmd = &cobra.Command{
+		Use:   "verify",
+		Short: "Verify the cached contents by SHA256",
+		Long: `Verify all the cached contents by SHA256, the corrupt contents are moved into the quarantine dir
+if quarantine is enabled, otherwise they are deleted`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runCacheVerify()
+		},
+	}
+
+	// cacheWarmCmd is cache cmd for pre-populating the cache
+	cacheWarmCmd = &cobra.Command{
+		Use:   "warm",
+		Short: "Pre-populate the file cache for the latest release of an app",
+		Long: `Download the files of the latest release of an app into the file cache without applying it,
+so that the release is applied from the local cache later`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runCacheWarm()
+		},
+	}
+)
+
+var (
+	// cacheOutputFormat the output format of cache ls
+	cacheOutputFormat string
+	// pruneMaxSize the max size of the cache after prune, e.g. 1GiB
+	pruneMaxSize string
+	// pruneOlderThan remove the contents not used within the duration
+	pruneOlderThan time.Duration
+)
+
+// cacheEntryOutput is a cached content in the json output of cache ls
+type cacheEntryOutput struct {
+	Signature  string    `json:"signature"`
+	Size       uint64    `json:"size"`
+	LastAccess time.Time `json:"last_access"`
+	Hits       uint64    `json:"hits"`
+	VerifiedAt time.Time `json:"verified_at"`
+	References []string  `json:"references"`
+}
+
+// openFileCache opens the file cache of the cache dir in the config
+func openFileCache() (*cache.Cache, error) {
+	if err := initConf(cacheViper); err != nil {
+		return nil, err
+	}
+	if conf.FileCache == nil {
+		conf.FileCache = new(config.FileCacheConfig)
+	}
+	if err := conf.FileCache.Validate(); err != nil {
+		return nil, err
+	}
+	return cache.New(conf.FileCache.CacheDir, conf.FileCache.ThresholdGB, conf.FileCache.EvictionPolicy,
+		cache.ScrubOptions{Quarantine: conf.FileCache.Scrub.Quarantine})
+}
+
+// runCacheLs executes the cache ls command
+func runCacheLs() error {
+	c, err := openFileCache()
+	if err != nil {
+		return err
+	}
+	entries := c.Entries()
+	outputs := make([]cacheEntryOutput, 0, len(entries))
+	for _, e := range entries {
+		refs := make([]string, 0, len(e.References))
+		for _, r := range e.References {
+			refs = append(refs, fmt.Sprintf("%s@%d", r.App, r.ReleaseID))
+		}
+		outputs = append(outputs, cacheEntryOutput{
+			Signature:  e.Signature,
+			Size:       e.Size,
+			LastAccess: e.LastAccess,
+			Hits:       e.Hits,
+			VerifiedAt: e.VerifiedAt,
+			References: refs,
+		})
+	}
+
+	switch cacheOutputFormat {
+	case outputFormatJson:
+		return jsonOutput(outputs)
+	case outputFormatTable:
+		table := newTable()
+		table.SetHeader([]string{"SHA256", "Size", "LastUse", "Hits", "References"})
+		for _, o := range outputs {
+			table.Append([]string{
+				o.Signature,
+				humanize.IBytes(o.Size),
+				humanize.Time(o.LastAccess),
+				fmt.Sprint(o.Hits),
+				strings.Join(o.References, ","),
+			})
+		}
+		table.Render()
+		return nil
+	default:
+		return fmt.Errorf(
+			`unable to match a printer suitable for the output format "%s", allowed formats are: json`,
+			cacheOutputFormat)
+	}
+}
+
+// runCacheStats executes the cache stats command
+func runCacheStats() error {
+	c, err := openFileCache()
+	if err != nil {
+		return err
+	}
+	stats := c.Stats()
+	table := newTable()
+	table.AppendBulk([][]string{
+		{"Dir:", conf.FileCache.CacheDir},
+		{"Entries:", fmt.Sprint(stats.Entries)},
+		{"Size:", humanize.IBytes(stats.Size)},
+		{"Threshold:", humanize.IBytes(stats.ThresholdSize)},
+		{"Pinned Entries:", fmt.Sprint(stats.PinnedEntries)},
+		{"Pinned Size:", humanize.IBytes(stats.PinnedSize)},
+		{"Hits:", fmt.Sprint(stats.Hits)},
+		{"Quarantined:", fmt.Sprint(stats.Quarantined)},
+		{"Eviction Policy:", stats.Policy},
+	})
+	table.Render()
+	return nil
+}
+
+// runCachePrune executes the cache prune command
+func runCachePrune() error {
+	var maxSize uint64
+	if pruneMaxSize != "" {
+		size, err := humanize.ParseBytes(pruneMaxSize)
+		if err != nil {
+			return fmt.Errorf("invalid max size %s, err: %s", pruneMaxSize, err.Error())
+		}
+		maxSize = size
+	}
+	if maxSize == 0 && pruneOlderThan <= 0 {
+		return fmt.Errorf("either --max-size or --older-than must be set")
+	}
+	c, err := openFileCache()
+	if err != nil {
+		return err
+	}
+	count, freed := c.Prune(maxSize, pruneOlderThan)
+	fmt.Printf("removed %d contents, freed %s\n", count, humanize.IBytes(freed))
+	return nil
+}
+
+// runCacheVerify executes the cache verify command
+func runCacheVerify() error {
+	c, err := openFileCache()
+	if err != nil {
+		return err
+	}
+	result, err := c.Verify(context.Background())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("checked %d contents, %s\n", result.Checked, humanize.IBytes(result.CheckedBytes))
+	for _, sig := range result.Corrupt {
+		fmt.Printf("corrupt: %s\n", sig)
+	}
+	if len(result.Corrupt) > 0 {
+		return fmt.Errorf("%d corrupt contents found", len(result.Corrupt))
+	}
+	return nil
+}
+
+// runCacheWarm executes the cache warm command
+func runCacheWarm() error {
+	if err := initConf(cacheViper); err != nil {
+		return err
+	}
+	if err := conf.ValidateBase(); err != nil {
+		return err
+	}
+	if len(conf.Apps) == 0 {
+		return fmt.Errorf("app must not be empty")
+	}
+
+	bscp, err := client.New(
+		client.WithFeedAddrs(conf.FeedAddrs),
+		client.WithBizID(conf.Biz),
+		client.WithToken(conf.Token),
+		client.WithLabels(conf.Labels),
+		client.WithUID(conf.UID),
+		client.WithFileCache(client.FileCache{
+			Enabled:        true,
+			CacheDir:       conf.FileCache.CacheDir,
+			ThresholdGB:    conf.FileCache.ThresholdGB,
+			EvictionPolicy: conf.FileCache.EvictionPolicy,
+			Scrub:          client.FileCacheScrub{Quarantine: conf.FileCache.Scrub.Quarantine},
+		}),
+		client.WithBandwidthLimit(conf.Download.BandwidthLimit),
+		client.WithSources(contentSources(conf.Sources)...),
+		client.WithSharedStore(client.SharedStore{
+			Enabled: conf.SharedStore.Enabled,
+			Dir:     conf.SharedStore.Dir,
+		}),
+		client.WithHTTPTransport(httpTransport(conf.HTTPTransport)),
+		client.WithFileDownloadTimeout(time.Duration(conf.Download.FileTimeoutSeconds)*time.Second),
+		client.WithRangePartSize(conf.Download.RangePartSize),
+	)
+	if err != nil {
+		return err
+	}
+
+	for _, app := range conf.Apps {
+		release, err := bscp.PullFiles(app.Name, client.WithAppConfigMatch(app.ConfigMatches),
+			client.WithAppLabels(app.Labels), client.WithAppUID(app.UID))
+		if err != nil {
+			return err
+		}
+		// show the download progress when attached to a terminal
+		bar := newProgressBar(app.Name)
+		if bar != nil {
+			release.TrackProgress(bar.update)
+		}
+		err = release.WarmCache()
+		bar.finish()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("warmed %d files of app %s release %d\n", len(release.FileItems), app.Name, release.ReleaseID)
+	}
+	return nil
+}
+
+func init() {
+	cacheCmd.PersistentFlags().StringP("file-cache-dir", "", constant.DefaultFileCacheDir, "bscp file cache dir")
+	mustBindPFlag(cacheViper, "file_cache.cache_dir", cacheCmd.PersistentFlags().Lookup("file-cache-dir"))
+
+	cacheLsCmd.Flags().StringVarP(&cacheOutputFormat, "output", "o", outputFormatTable, "output format, One of: json")
+
+	cachePruneCmd.Flags().StringVarP(&pruneMaxSize, "max-size", "", "",
+		"evict the contents until the cache size is not larger than it, eg: 1GiB")
+	cachePruneCmd.Flags().DurationVarP(&pruneOlderThan, "older-than", "", 0,
+		"remove the contents not used within the duration, eg: 168h")
+
+	cacheVerifyCmd.Flags().BoolP("quarantine", "", false,
+		"move the corrupt contents into the quarantine dir instead of deleting them")
+	mustBindPFlag(cacheViper, "file_cache.scrub.quarantine", cacheVerifyCmd.Flags().Lookup("quarantine"))
+
+	cacheWarmCmd.Flags().StringP("feed-addrs", "f", "", "feed server address, eg: 'bscp-feed.example.com:9510'")
+	mustBindPFlag(cacheViper, "feed_addrs", cacheWarmCmd.Flags().Lookup("feed-addrs"))
+	cacheWarmCmd.Flags().IntP("biz", "b", 0, "biz id")
+	mustBindPFlag(cacheViper, "biz", cacheWarmCmd.Flags().Lookup("biz"))
+	cacheWarmCmd.Flags().StringP("app", "a", "", "app name")
+	mustBindPFlag(cacheViper, "app", cacheWarmCmd.Flags().Lookup("app"))
+	cacheWarmCmd.Flags().StringP("token", "t", "", "sdk token")
+	mustBindPFlag(cacheViper, "token", cacheWarmCmd.Flags().Lookup("token"))
+	cacheWarmCmd.Flags().StringP("labels", "l", "", "labels")
+	mustBindPFlag(cacheViper, "labels_str", cacheWarmCmd.Flags().Lookup("labels"))
+
+	for key, envName := range commonEnvs {
+		// bind env variable with viper
+		if err := cacheViper.BindEnv(key, envName); err != nil {
+			panic(err)
+		}
+		// add env info for cmdline flags
+		if f := cacheWarmCmd.Flags().Lookup(strings.ReplaceAll(key, "_", "-")); f != nil {
+			f.Usage = fmt.Sprintf("%v [env %v]", f.Usage, envName)
+		}
+	}
+}
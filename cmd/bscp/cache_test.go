@@ -0,0 +1,142 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/TencentBlueKing/bscp-go/internal/cache"
+	"github.com/TencentBlueKing/bscp-go/internal/config"
+	"github.com/TencentBlueKing/bscp-go/internal/constant"
+)
+
+// runCacheCmd runs the cache sub cmd with the args and returns what is written to stdout
+func runCacheCmd(t *testing.T, dir string, args ...string) (string, error) {
+	t.Helper()
+	rootCmd.SetArgs(append([]string{"cache"}, append(args, "--file-cache-dir", dir)...))
+	var err error
+	out := captureStdout(t, func() { err = rootCmd.Execute() })
+	return out, err
+}
+
+// cachedSignatures returns the signatures of the contents in the cache dir
+func cachedSignatures(t *testing.T, dir string) []string {
+	t.Helper()
+	c, err := cache.New(dir, 1, cache.EvictionPolicyLRU, cache.ScrubOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigs := make([]string, 0)
+	for _, e := range c.Entries() {
+		sigs = append(sigs, e.Signature)
+	}
+	return sigs
+}
+
+func TestCacheCmds(t *testing.T) {
+	t.Cleanup(func() {
+		conf = new(config.ClientConfig)
+		rootCmd.SetArgs(nil)
+		cacheOutputFormat, pruneMaxSize, pruneOlderThan = outputFormatTable, "", 0
+		_ = cacheCmd.PersistentFlags().Set("file-cache-dir", constant.DefaultFileCacheDir)
+	})
+
+	// pinned is referenced by the applied release, pinned and unused are not used within a day
+	dir := t.TempDir()
+	contents := map[string]time.Duration{"pinned": 48 * time.Hour, "unused": 48 * time.Hour, "recent": time.Hour}
+	for content, age := range contents {
+		filePath := filepath.Join(dir, signature(content))
+		writeFile(t, filePath, content)
+		mtime := time.Now().Add(-age)
+		if err := os.Chtimes(filePath, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pinned, unused, recent := signature("pinned"), signature("unused"), signature("recent")
+	c, err := cache.New(dir, 1, cache.EvictionPolicyLRU, cache.ScrubOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Pin(1, "app", 3, []string{pinned})
+
+	// ls lists the contents with the applied releases which reference them, the least recently used first
+	out, err := runCacheCmd(t, dir, "ls", "-o", "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var entries []cacheEntryOutput
+	if err = json.Unmarshal([]byte(out), &entries); err != nil {
+		t.Fatalf("decode the output %q failed, err: %v", out, err)
+	}
+	if len(entries) != 3 || entries[2].Signature != recent {
+		t.Fatalf("unexpected entries: %s", out)
+	}
+	for _, e := range entries {
+		want := []string{}
+		if e.Signature == pinned {
+			want = []string{"1/app@3"}
+		}
+		if !reflect.DeepEqual(e.References, want) || e.Size != 6 {
+			t.Errorf("unexpected entry: %+v", e)
+		}
+	}
+
+	// stats shows the pinned contents
+	out, err = runCacheCmd(t, dir, "stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{dir, "18 B", "Pinned Size:", "6 B", "lru"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("the stats output %q does not contain %q", out, want)
+		}
+	}
+
+	// prune needs a limit
+	if _, err = runCacheCmd(t, dir, "prune"); err == nil {
+		t.Error("expected prune fails without --max-size and --older-than")
+	}
+	if _, err = runCacheCmd(t, dir, "prune", "--max-size", "invalid"); err == nil {
+		t.Error("expected prune fails with the invalid --max-size")
+	}
+
+	// prune removes the contents not used within --older-than except the pinned ones
+	out, err = runCacheCmd(t, dir, "prune", "--max-size", "", "--older-than", "24h")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "removed 1 contents, freed 6 B\n"; !strings.HasSuffix(out, want) {
+		t.Errorf("prune output = %q, want %q", out, want)
+	}
+	if got := cachedSignatures(t, dir); len(got) != 2 || got[0] == unused || got[1] == unused {
+		t.Errorf("expected the unused content is removed, got %v", got)
+	}
+
+	// prune evicts the contents until the size is not larger than --max-size except the pinned ones
+	out, err = runCacheCmd(t, dir, "prune", "--max-size", "1B", "--older-than", "0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "removed 1 contents, freed 6 B\n"; !strings.HasSuffix(out, want) {
+		t.Errorf("prune output = %q, want %q", out, want)
+	}
+	if got := cachedSignatures(t, dir); !reflect.DeepEqual(got, []string{pinned}) {
+		t.Errorf("expected only the pinned content is kept, got %v", got)
+	}
+}
@@ -14,11 +14,14 @@ package main
 
 import (
 	"context"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"time"
 
 	"github.com/dustin/go-humanize"
@@ -28,10 +31,12 @@ import (
 	"github.com/spf13/viper"
 	"golang.org/x/exp/slog"
 
+	"github.com/TencentBlueKing/bscp-go/client"
 	"github.com/TencentBlueKing/bscp-go/internal/config"
 	"github.com/TencentBlueKing/bscp-go/internal/constant"
 	"github.com/TencentBlueKing/bscp-go/pkg/env"
 	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+	"github.com/TencentBlueKing/bscp-go/pkg/source"
 )
 
 var (
@@ -39,15 +44,18 @@ var (
 )
 
 var (
-	rootViper    = viper.New()
-	pullViper    = viper.New()
-	watchViper   = viper.New()
-	getViper     = viper.New()
-	getAppViper  = viper.New()
-	getFileViper = viper.New()
-	getKvViper   = viper.New()
-
-	allVipers = []*viper.Viper{rootViper, pullViper, watchViper, getViper, getAppViper, getFileViper, getKvViper}
+	rootViper     = viper.New()
+	pullViper     = viper.New()
+	watchViper    = viper.New()
+	getViper      = viper.New()
+	getAppViper   = viper.New()
+	getFileViper  = viper.New()
+	getKvViper    = viper.New()
+	rollbackViper = viper.New()
+	cacheViper    = viper.New()
+
+	allVipers = []*viper.Viper{rootViper, pullViper, watchViper, getViper, getAppViper, getFileViper, getKvViper,
+		rollbackViper, cacheViper}
 	getVipers = []*viper.Viper{getViper, getAppViper, getFileViper, getKvViper}
 )
 
@@ -263,3 +271,91 @@ func refineOutputTime(timeStr string) string {
 
 	return durStr
 }
+
+// pathMappings converts the path mapping configs to the client path mappings
+func pathMappings(cfgs []*config.PathMappingConfig) []client.PathMapping {
+	mappings := make([]client.PathMapping, 0, len(cfgs))
+	for _, c := range cfgs {
+		mappings = append(mappings, client.PathMapping{
+			Match:     c.Match,
+			Target:    c.Target,
+			User:      c.User,
+			UserGroup: c.UserGroup,
+			Privilege: c.Privilege,
+		})
+	}
+	return mappings
+}
+
+// contentSources converts the source configs to the content sources
+func contentSources(cfgs []*config.SourceConfig) []source.Source {
+	sources := make([]source.Source, 0, len(cfgs))
+	for _, c := range cfgs {
+		switch c.Type {
+		case config.SourceTypeLocal:
+			sources = append(sources, source.NewLocalDir(c.Path))
+		case config.SourceTypeHTTP:
+			sources = append(sources, source.NewHTTP(c.URL,
+				&http.Client{Timeout: time.Duration(c.TimeoutSeconds) * time.Second}))
+		}
+	}
+	return sources
+}
+
+// httpTransport converts the http transport config to the client http transport option
+func httpTransport(c *config.HTTPTransportConfig) client.HTTPTransport {
+	return client.HTTPTransport{
+		DialTimeout:           time.Duration(c.DialTimeoutSeconds) * time.Second,
+		TLSHandshakeTimeout:   time.Duration(c.TLSHandshakeTimeoutSeconds) * time.Second,
+		ResponseHeaderTimeout: time.Duration(c.ResponseHeaderTimeoutSeconds) * time.Second,
+		IdleConnTimeout:       time.Duration(c.IdleConnTimeoutSeconds) * time.Second,
+		MaxIdleConns:          c.MaxIdleConns,
+		MaxIdleConnsPerHost:   c.MaxIdleConnsPerHost,
+		ProxyURL:              c.ProxyURL,
+		EnableHTTP2:           c.EnableHTTP2,
+		CAFile:                c.CAFile,
+	}
+}
+
+// fileCacheScrub converts the file cache scrub config to the client file cache scrub option
+func fileCacheScrub(c *config.FileCacheScrubConfig) client.FileCacheScrub {
+	return client.FileCacheScrub{
+		Enabled:     c.Enabled,
+		Interval:    time.Duration(c.IntervalSeconds) * time.Second,
+		Rate:        c.Rate,
+		VerifiedTTL: time.Duration(c.VerifiedTTLSeconds) * time.Second,
+		Quarantine:  c.Quarantine,
+	}
+}
+
+// fileCachePrewarm converts the file cache prewarm config to the client file cache prewarm option
+func fileCachePrewarm(c *config.FileCachePrewarmConfig) client.FileCachePrewarm {
+	return client.FileCachePrewarm{
+		Enabled:      c.Enabled,
+		DelayApply:   c.DelayApply,
+		DelayTimeout: time.Duration(c.DelayTimeoutSeconds) * time.Second,
+	}
+}
+
+// kvSnapshot converts the kv snapshot config to the client kv snapshot option, the encryption key is read from the
+// key file
+func kvSnapshot(c *config.KvSnapshotConfig) (client.KvSnapshot, error) {
+	s := client.KvSnapshot{
+		Enabled: c.Enabled,
+		Dir:     c.Dir,
+		MaxSize: uint64(c.MaxSizeMB * 1024 * 1024),
+	}
+	if !c.Enabled || c.EncryptionKeyFile == "" {
+		return s, nil
+	}
+	data, err := os.ReadFile(c.EncryptionKeyFile)
+	if err != nil {
+		return s, fmt.Errorf("read kv snapshot encryption key file failed, err: %s", err.Error())
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return s, fmt.Errorf("decode kv snapshot encryption key failed, err: %s", err.Error())
+	}
+	s.EncryptionKey = key
+	return s, nil
+}
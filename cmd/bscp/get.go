@@ -15,9 +15,11 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/spf13/cobra"
@@ -244,14 +246,13 @@ func runGetFileList(bscp client.Client, app string, match []string) error {
 	}
 }
 
-// runGetFileContents gets file contents
+// runGetFileContents streams file contents to stdout
 func runGetFileContents(bscp client.Client, app string, match []string) error {
-	output, err := getFileOutput(bscp, app, match)
+	release, err := getFileRelease(bscp, app, match)
 	if err != nil {
 		return err
 	}
-	_, err = fmt.Fprint(os.Stdout, output)
-	return err
+	return writeFileContents(os.Stdout, release.FileItems)
 }
 
 // getFileRelease gets file release
@@ -264,51 +265,29 @@ func getFileRelease(bscp client.Client, app string, match []string) (*client.Rel
 	return bscp.PullFiles(app, opts...)
 }
 
-// getFileOutput gets file output
-func getFileOutput(bscp client.Client, app string, match []string) (string, error) {
-	release, err := getFileRelease(bscp, app, match)
-	if err != nil {
-		return "", err
-	}
-
-	var contents [][]byte
-	contents, err = getfileContents(release.FileItems)
-	if err != nil {
-		return "", err
-	}
-
+// writeFileContents writes the file contents one by one as streams, so that the large files are never loaded into
+// memory, the content is verified while it is written and an error is returned if it does not match
+func writeFileContents(w io.Writer, files []*client.ConfigItemFile) error {
 	// output only content when getting for just one file which is convenient to save it directly in a file
-	if len(release.FileItems) == 1 {
-		return string(contents[0]), nil
-	}
-
-	output := ""
-	for idx, file := range release.FileItems {
-		output += fmt.Sprintf("***start No.%d***\nfile: %s\nconent: \n%s\n***end No.%d***\n\n",
-			idx+1, filepath.Join(file.Path, file.Name), contents[idx], idx+1)
+	if len(files) == 1 {
+		_, err := files[0].WriteTo(w)
+		return err
 	}
-	return output, nil
-}
-
-// getfileContents get file contents concurrently
-func getfileContents(files []*client.ConfigItemFile) ([][]byte, error) {
-	contents := make([][]byte, len(files))
-	g, _ := errgroup.WithContext(context.Background())
-	g.SetLimit(10)
 
-	for i, f := range files {
-		idx, file := i, f
-		g.Go(func() error {
-			content, err := file.GetContent()
-			if err != nil {
-				return err
-			}
-			contents[idx] = content
-			return nil
-		})
+	for idx, file := range files {
+		if _, err := fmt.Fprintf(w, "***start No.%d***\nfile: %s\nconent: \n", idx+1,
+			filepath.Join(file.Path, file.Name)); err != nil {
+			return err
+		}
+		if _, err := file.WriteTo(w); err != nil {
+			return fmt.Errorf("write the content of file %s failed, err: %s",
+				filepath.Join(file.Path, file.Name), err.Error())
+		}
+		if _, err := fmt.Fprintf(w, "\n***end No.%d***\n\n", idx+1); err != nil {
+			return err
+		}
 	}
-
-	return contents, g.Wait()
+	return nil
 }
 
 // runDownloadFile downloads file
@@ -355,6 +334,11 @@ func runDownloadFile(bscp client.Client, app string, match []string) error {
 			"you can remove the arg --ignore-dir or make your other choices", sameFiles)
 	}
 
+	// show the download progress when attached to a terminal
+	bar := newProgressBar(app)
+	if bar != nil {
+		release.TrackProgress(bar.update)
+	}
 	// save content to dst file
 	g, _ := errgroup.WithContext(context.Background())
 	g.SetLimit(10)
@@ -366,11 +350,15 @@ func runDownloadFile(bscp client.Client, app string, match []string) error {
 			if err != nil {
 				return err
 			}
-			fmt.Printf("saving to file %s\n", dstFiles[idx])
+			if bar == nil {
+				fmt.Printf("saving to file %s\n", dstFiles[idx])
+			}
 			return file.SaveToFile(dstFiles[idx])
 		})
 	}
-	if err := g.Wait(); err != nil {
+	err = g.Wait()
+	bar.finish()
+	if err != nil {
 		return err
 	}
 
@@ -398,10 +386,20 @@ func runGetFile(args []string) error {
 		client.WithBizID(conf.Biz),
 		client.WithToken(conf.Token),
 		client.WithFileCache(client.FileCache{
-			Enabled:     conf.FileCache.Enabled,
-			CacheDir:    conf.FileCache.CacheDir,
-			ThresholdGB: conf.FileCache.ThresholdGB,
+			Enabled:        conf.FileCache.Enabled,
+			CacheDir:       conf.FileCache.CacheDir,
+			ThresholdGB:    conf.FileCache.ThresholdGB,
+			EvictionPolicy: conf.FileCache.EvictionPolicy,
+			Scrub:          fileCacheScrub(conf.FileCache.Scrub),
+		}),
+		client.WithSources(contentSources(conf.Sources)...),
+		client.WithSharedStore(client.SharedStore{
+			Enabled: conf.SharedStore.Enabled,
+			Dir:     conf.SharedStore.Dir,
 		}),
+		client.WithHTTPTransport(httpTransport(conf.HTTPTransport)),
+		client.WithFileDownloadTimeout(time.Duration(conf.Download.FileTimeoutSeconds)*time.Second),
+		client.WithRangePartSize(conf.Download.RangePartSize),
 	)
 
 	if err != nil {
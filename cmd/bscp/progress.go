@@ -0,0 +1,84 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/TencentBlueKing/bscp-go/client"
+)
+
+const (
+	// progressBarWidth the width of the bar in characters
+	progressBarWidth = 30
+)
+
+// progressBar shows the download progress of a release in a single line of the terminal
+type progressBar struct {
+	out    *os.File
+	prefix string
+	drawn  bool
+}
+
+// newProgressBar creates a progress bar on stderr, it returns nil if stderr is not attached to a terminal,
+// so that the logs and the redirected output are not messed up.
+func newProgressBar(prefix string) *progressBar {
+	if !isTerminal(os.Stderr) {
+		return nil
+	}
+	return &progressBar{out: os.Stderr, prefix: prefix}
+}
+
+// isTerminal returns whether the file is a terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// update redraws the bar by the release progress
+func (b *progressBar) update(p client.ReleaseProgress) {
+	if b == nil {
+		return
+	}
+	percent := 100.0
+	if p.TotalBytes > 0 {
+		percent = float64(p.DoneBytes) * 100 / float64(p.TotalBytes)
+	}
+	filled := int(percent / 100 * progressBarWidth)
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", progressBarWidth-filled)
+	eta := "-"
+	if p.ETA > 0 {
+		eta = p.ETA.Round(time.Second).String()
+	}
+	// \033[K clears the rest of the line which may be longer last time
+	fmt.Fprintf(b.out, "\r%s [%s] %5.1f%% %d/%d files %s/%s %s/s ETA %s\033[K", b.prefix, bar, percent,
+		p.DoneFiles, p.TotalFiles, humanize.IBytes(p.DoneBytes), humanize.IBytes(p.TotalBytes),
+		humanize.IBytes(uint64(p.Throughput)), eta)
+	b.drawn = true
+}
+
+// finish ends the line of the bar
+func (b *progressBar) finish() {
+	if b == nil || !b.drawn {
+		return
+	}
+	fmt.Fprintln(b.out)
+}
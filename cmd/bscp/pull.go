@@ -24,6 +24,7 @@ import (
 
 	sfs "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/sf-share"
 	"github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/version"
+	"github.com/dustin/go-humanize"
 	"github.com/spf13/cobra"
 	"golang.org/x/exp/slog"
 
@@ -44,16 +45,22 @@ var (
 	}
 )
 
+var (
+	dryRun bool
+)
+
 // Pull executes the pull command.
 func Pull(cmd *cobra.Command, args []string) {
-	// print bscp banner
-	fmt.Println(strings.TrimSpace(version.GetStartInfo()))
+	// print bscp banner, the output of dry run is kept clean for parsing
+	if !dryRun {
+		fmt.Println(strings.TrimSpace(version.GetStartInfo()))
+	}
 
 	if err := initConf(pullViper); err != nil {
 		logger.Error("init conf failed", logger.ErrAttr(err))
 		os.Exit(1)
 	}
-	if conf.ConfigFile != "" {
+	if conf.ConfigFile != "" && !dryRun {
 		fmt.Println("use config file:", conf.ConfigFile)
 	}
 	if err := conf.Validate(); err != nil {
@@ -61,29 +68,71 @@ func Pull(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 
-	bscp, err := client.New(
+	opts := []client.Option{
 		client.WithFeedAddrs(conf.FeedAddrs),
 		client.WithBizID(conf.Biz),
 		client.WithToken(conf.Token),
 		client.WithLabels(conf.Labels),
 		client.WithUID(conf.UID),
 		client.WithP2PDownload(conf.EnableP2PDownload),
+		client.WithP2PDownloadSettings(client.P2PDownloadSettings{
+			Threshold:    conf.P2PDownload.Threshold,
+			PollInterval: time.Duration(conf.P2PDownload.PollIntervalSeconds) * time.Second,
+			Timeout:      time.Duration(conf.P2PDownload.TimeoutSeconds) * time.Second,
+			StagingDir:   conf.P2PDownload.StagingDir,
+		}),
 		client.WithBkAgentID(conf.BkAgentID),
 		client.WithClusterID(conf.ClusterID),
 		client.WithPodID(conf.PodID),
 		client.WithContainerName(conf.ContainerName),
 		client.WithFileCache(client.FileCache{
-			Enabled:     conf.FileCache.Enabled,
-			CacheDir:    conf.FileCache.CacheDir,
-			ThresholdGB: conf.FileCache.ThresholdGB,
+			Enabled:        conf.FileCache.Enabled,
+			CacheDir:       conf.FileCache.CacheDir,
+			ThresholdGB:    conf.FileCache.ThresholdGB,
+			EvictionPolicy: conf.FileCache.EvictionPolicy,
+			Scrub:          fileCacheScrub(conf.FileCache.Scrub),
 		}),
 		client.WithTextLineBreak(conf.TextLineBreak),
-	)
+		client.WithVersionedDir(client.VersionedDir{
+			Enabled:        conf.VersionedDir.Enabled,
+			RetainReleases: conf.VersionedDir.RetainReleases,
+		}),
+		client.WithFileDeletion(client.FileDeletion{
+			NeverDelete: conf.FileDeletion.NeverDelete,
+			Ignore:      conf.FileDeletion.Ignore,
+		}),
+		client.WithAutoRollback(conf.AutoRollback),
+		client.WithBandwidthLimit(conf.Download.BandwidthLimit),
+		client.WithDownloadPriority(client.DownloadPriority{
+			Enabled:       conf.Download.PriorityEnabled,
+			SmallFileSize: conf.Download.SmallFileSize,
+		}),
+		client.WithSources(contentSources(conf.Sources)...),
+		client.WithSharedStore(client.SharedStore{
+			Enabled: conf.SharedStore.Enabled,
+			Dir:     conf.SharedStore.Dir,
+		}),
+		client.WithHTTPTransport(httpTransport(conf.HTTPTransport)),
+		client.WithFileDownloadTimeout(time.Duration(conf.Download.FileTimeoutSeconds) * time.Second),
+		client.WithRangePartSize(conf.Download.RangePartSize),
+	}
+	if dryRun {
+		opts = append(opts, dryRunOptions()...)
+	}
+	bscp, err := client.New(opts...)
 	if err != nil {
 		logger.Error("init client", logger.ErrAttr(err))
 		os.Exit(1)
 	}
 
+	if dryRun {
+		if err = planAppsFiles(bscp); err != nil {
+			logger.Error("plan files failed", logger.ErrAttr(err))
+			os.Exit(1)
+		}
+		return
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	// 是否采集/监控资源使用率
 	if conf.EnableMonitorResourceUsage {
@@ -100,6 +149,15 @@ func Pull(cmd *cobra.Command, args []string) {
 		opts = append(opts, client.WithAppConfigMatch(app.ConfigMatches))
 		opts = append(opts, client.WithAppLabels(app.Labels))
 		opts = append(opts, client.WithAppUID(app.UID))
+		if app.AutoRollback != nil {
+			opts = append(opts, client.WithAppAutoRollback(*app.AutoRollback))
+		}
+		if len(app.PathMappings) > 0 {
+			opts = append(opts, client.WithAppPathMappings(pathMappings(app.PathMappings)))
+		}
+		if app.BandwidthLimit > 0 {
+			opts = append(opts, client.WithAppBandwidthLimit(app.BandwidthLimit))
+		}
 		if err = pullAppFiles(ctx, bscp, conf.TempDir, conf.Biz, app.Name, opts); err != nil {
 			cancel()
 			logger.Error("pull files failed", logger.ErrAttr(err))
@@ -142,6 +200,11 @@ func pullAppFiles(ctx context.Context, bscp client.Client, tempDir string, biz u
 			}
 		}
 	}()
+	// show the download progress when attached to a terminal
+	bar := newProgressBar(app)
+	if bar != nil {
+		release.TrackProgress(bar.update)
+	}
 
 	// 1.执行前置脚本
 	// 2.更新文件
@@ -149,12 +212,88 @@ func pullAppFiles(ctx context.Context, bscp client.Client, tempDir string, biz u
 	// 4.更新Metadata
 	if err = release.Execute(release.ExecuteHook(&client.PreScriptStrategy{}), release.UpdateFiles(),
 		release.ExecuteHook(&client.PostScriptStrategy{}), release.UpdateMetadata()); err != nil {
+		bar.finish()
 		return err
 	}
+	bar.finish()
 	logger.Info("pull files success", slog.Any("releaseID", release.ReleaseID))
 	return nil
 }
 
+// planAppsFiles prints what would change for all the apps, nothing is written to disk or reported
+func planAppsFiles(bscp client.Client) error {
+	plans := make([]*client.ReleasePlan, 0, len(conf.Apps))
+	for _, app := range conf.Apps {
+		opts := []client.AppOption{}
+		opts = append(opts, client.WithAppConfigMatch(app.ConfigMatches))
+		opts = append(opts, client.WithAppLabels(app.Labels))
+		opts = append(opts, client.WithAppUID(app.UID))
+		if len(app.PathMappings) > 0 {
+			opts = append(opts, client.WithAppPathMappings(pathMappings(app.PathMappings)))
+		}
+		if app.BandwidthLimit > 0 {
+			opts = append(opts, client.WithAppBandwidthLimit(app.BandwidthLimit))
+		}
+		release, err := bscp.PullFiles(app.Name, opts...)
+		if err != nil {
+			return err
+		}
+		release.AppDir = filepath.Join(conf.TempDir, strconv.Itoa(int(conf.Biz)), app.Name)
+		release.TempDir = conf.TempDir
+		release.BizID = conf.Biz
+		release.ClientMode = sfs.Pull
+		plan, err := release.Plan()
+		if err != nil {
+			return err
+		}
+		plans = append(plans, plan)
+	}
+
+	return printPlans(plans)
+}
+
+// dryRunOptions returns the client options which overwrite the ones writing to disk on init, the file cache, kv cache
+// and shared store are disabled for dry run
+func dryRunOptions() []client.Option {
+	return []client.Option{
+		client.WithFileCache(client.FileCache{}),
+		client.WithKvCache(client.KvCache{}),
+		client.WithSharedStore(client.SharedStore{}),
+	}
+}
+
+// printPlans prints the release plans in the output format
+func printPlans(plans []*client.ReleasePlan) error {
+	switch outputFormat {
+	case outputFormatJson:
+		return jsonOutput(plans)
+	case outputFormatTable:
+		for _, plan := range plans {
+			fmt.Printf("app: %s, release: %s(%d), unchanged files: %d\n",
+				plan.App, plan.ReleaseName, plan.ReleaseID, plan.Unchanged)
+			table := newTable()
+			table.SetHeader([]string{"Action", "Path", "Size", "Permission"})
+			for _, f := range plan.Files {
+				var size, permission string
+				if f.Action != client.PlanActionDelete {
+					size = humanize.IBytes(f.ByteSize)
+					permission = fmt.Sprintf("%s %s:%s", f.Privilege, f.User, f.UserGroup)
+				}
+				table.Append([]string{string(f.Action), f.Path, size, permission})
+			}
+			for _, h := range plan.Hooks {
+				table.Append([]string{"exec " + string(h.Type), h.Name, "", h.ScriptType})
+			}
+			table.Render()
+			fmt.Println()
+		}
+		return nil
+	default:
+		return fmt.Errorf(
+			`unable to match a printer suitable for the output format "%s", allowed formats are: json`, outputFormat)
+	}
+}
+
 func init() {
 	// !important: promise of compatibility
 	PullCmd.Flags().SortFlags = false
@@ -196,6 +335,9 @@ func init() {
 	mustBindPFlag(pullViper, "enable_resource", PullCmd.Flags().Lookup("enable-resource"))
 	PullCmd.Flags().StringP("text-line-break", "", "", "text file line break, default as LF")
 	mustBindPFlag(pullViper, "text_line_break", PullCmd.Flags().Lookup("text-line-break"))
+	PullCmd.Flags().BoolVarP(&dryRun, "dry-run", "", false,
+		"only print what would change, nothing is written to disk or reported")
+	PullCmd.Flags().StringVarP(&outputFormat, "output", "o", "", "output format of dry run, One of: json")
 
 	for key, envName := range commonEnvs {
 		// bind env variable with viper
@@ -0,0 +1,152 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	sfs "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/sf-share"
+	"github.com/spf13/cobra"
+	"golang.org/x/exp/slog"
+
+	"github.com/TencentBlueKing/bscp-go/client"
+	"github.com/TencentBlueKing/bscp-go/internal/constant"
+	"github.com/TencentBlueKing/bscp-go/internal/util"
+	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+)
+
+var (
+	// RollbackCmd command to rollback app files to a previously applied release locally
+	RollbackCmd = &cobra.Command{
+		Use:   "rollback",
+		Short: "rollback app files to a previously applied release locally",
+		Long: `rollback app files to a previously applied release locally, the files are restored from the retained
+release dir or the file cache, and the post hook of the release is executed again`,
+		Run: Rollback,
+	}
+)
+
+var (
+	toReleaseID uint32
+)
+
+// Rollback executes the rollback command.
+func Rollback(cmd *cobra.Command, args []string) {
+	if err := initConf(rollbackViper); err != nil {
+		logger.Error("init conf failed", logger.ErrAttr(err))
+		os.Exit(1)
+	}
+	if err := conf.Validate(); err != nil {
+		logger.Error("validate config failed", logger.ErrAttr(err))
+		os.Exit(1)
+	}
+	if len(conf.Apps) != 1 {
+		logger.Error("rollback only supports one app, please specify the app by --app")
+		os.Exit(1)
+	}
+
+	bscp, err := client.New(
+		client.WithFeedAddrs(conf.FeedAddrs),
+		client.WithBizID(conf.Biz),
+		client.WithToken(conf.Token),
+		client.WithLabels(conf.Labels),
+		client.WithUID(conf.UID),
+		client.WithFileCache(client.FileCache{
+			Enabled:        conf.FileCache.Enabled,
+			CacheDir:       conf.FileCache.CacheDir,
+			ThresholdGB:    conf.FileCache.ThresholdGB,
+			EvictionPolicy: conf.FileCache.EvictionPolicy,
+			Scrub:          fileCacheScrub(conf.FileCache.Scrub),
+		}),
+		client.WithVersionedDir(client.VersionedDir{
+			Enabled:        conf.VersionedDir.Enabled,
+			RetainReleases: conf.VersionedDir.RetainReleases,
+		}),
+		client.WithFileDeletion(client.FileDeletion{
+			NeverDelete: conf.FileDeletion.NeverDelete,
+			Ignore:      conf.FileDeletion.Ignore,
+		}),
+	)
+	if err != nil {
+		logger.Error("init client", logger.ErrAttr(err))
+		os.Exit(1)
+	}
+
+	app := conf.Apps[0]
+	appDir := filepath.Join(conf.TempDir, strconv.Itoa(int(conf.Biz)), app.Name)
+	// nothing is changed or reported if the files can not be restored locally
+	if _, err = checkRollback(appDir); err != nil {
+		logger.Error("can not rollback", slog.String("app", app.Name), logger.ErrAttr(err))
+		os.Exit(1)
+	}
+	release := bscp.NewRelease(app.Name, client.WithAppConfigMatch(app.ConfigMatches),
+		client.WithAppLabels(app.Labels), client.WithAppUID(app.UID))
+	release.AppDir = appDir
+	release.TempDir = conf.TempDir
+	release.BizID = conf.Biz
+	release.ClientMode = sfs.Pull
+	release.CursorID = util.GenerateCursorID(conf.Biz)
+
+	if err = release.Rollback(toReleaseID); err != nil {
+		logger.Error("rollback failed", slog.String("app", app.Name), logger.ErrAttr(err))
+		os.Exit(1)
+	}
+	fmt.Printf("rollback app %s to release %d success\n", app.Name, release.ReleaseID)
+}
+
+// checkRollback checks the files of the app dir can be restored to the release to rollback to, the file cache is
+// initialized by the client before
+func checkRollback(appDir string) (uint32, error) {
+	return client.CheckRollback(appDir, toReleaseID, client.VersionedDir{
+		Enabled:        conf.VersionedDir.Enabled,
+		RetainReleases: conf.VersionedDir.RetainReleases,
+	})
+}
+
+func init() {
+	// !important: promise of compatibility
+	RollbackCmd.Flags().SortFlags = false
+	RollbackCmd.Flags().StringP("feed-addrs", "f", "", "feed server address, eg: 'bscp-feed.example.com:9510'")
+	mustBindPFlag(rollbackViper, "feed_addrs", RollbackCmd.Flags().Lookup("feed-addrs"))
+	RollbackCmd.Flags().IntP("biz", "b", 0, "biz id")
+	mustBindPFlag(rollbackViper, "biz", RollbackCmd.Flags().Lookup("biz"))
+	RollbackCmd.Flags().StringP("app", "a", "", "app name")
+	mustBindPFlag(rollbackViper, "app", RollbackCmd.Flags().Lookup("app"))
+	RollbackCmd.Flags().StringP("token", "t", "", "sdk token")
+	mustBindPFlag(rollbackViper, "token", RollbackCmd.Flags().Lookup("token"))
+	RollbackCmd.Flags().StringP("labels", "l", "", "labels")
+	mustBindPFlag(rollbackViper, "labels_str", RollbackCmd.Flags().Lookup("labels"))
+	RollbackCmd.Flags().StringP("temp-dir", "d", constant.DefaultTempDir, "bscp temp dir")
+	mustBindPFlag(rollbackViper, "temp_dir", RollbackCmd.Flags().Lookup("temp-dir"))
+	RollbackCmd.Flags().BoolP("file-cache-enabled", "", constant.DefaultFileCacheEnabled, "enable file cache or not")
+	mustBindPFlag(rollbackViper, "file_cache.enabled", RollbackCmd.Flags().Lookup("file-cache-enabled"))
+	RollbackCmd.Flags().StringP("file-cache-dir", "", constant.DefaultFileCacheDir, "bscp file cache dir")
+	mustBindPFlag(rollbackViper, "file_cache.cache_dir", RollbackCmd.Flags().Lookup("file-cache-dir"))
+	RollbackCmd.Flags().Uint32VarP(&toReleaseID, "to", "", 0,
+		"the release id to rollback to, default as the previous successfully applied release")
+
+	for key, envName := range commonEnvs {
+		// bind env variable with viper
+		if err := rollbackViper.BindEnv(key, envName); err != nil {
+			panic(err)
+		}
+		// add env info for cmdline flags
+		if f := RollbackCmd.Flags().Lookup(strings.ReplaceAll(key, "_", "-")); f != nil {
+			f.Usage = fmt.Sprintf("%v [env %v]", f.Usage, envName)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pbci "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/core/config-item"
+	pbcontent "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/core/content"
+	sfs "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/sf-share"
+
+	"github.com/TencentBlueKing/bscp-go/internal/cache"
+	"github.com/TencentBlueKing/bscp-go/internal/config"
+	"github.com/TencentBlueKing/bscp-go/internal/util/eventmeta"
+)
+
+// signature returns the SHA256 of the content
+func signature(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// writeFile writes the content to the file, the parent dirs are created
+func writeFile(t *testing.T, filePath, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(filePath), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filePath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// rollbackAppDir prepares the app dir which release 1 (app.conf=v1) and then release 2 (app.conf=v2) are applied
+// with the versioned layout, the release dir of release 1 is pruned if not retained.
+func rollbackAppDir(t *testing.T, retained bool) string {
+	t.Helper()
+	appDir := filepath.Join(t.TempDir(), "1", "app")
+	manifest := &eventmeta.ReleaseManifest{ReleaseID: 1, Files: []*eventmeta.ManifestFile{{
+		Name: "app.conf",
+		Path: "/",
+		FileMeta: &sfs.ConfigItemMetaV1{
+			ContentSpec:    &pbcontent.ContentSpec{Signature: signature("v1"), ByteSize: 2},
+			ConfigItemSpec: &pbci.ConfigItemSpec{Name: "app.conf", Path: "/", FileType: "binary"},
+		},
+	}}}
+	if err := eventmeta.WriteReleaseManifest(appDir, manifest); err != nil {
+		t.Fatal(err)
+	}
+	if retained {
+		writeFile(t, filepath.Join(appDir, "releases", "1", "app.conf"), "v1")
+	}
+	writeFile(t, filepath.Join(appDir, "releases", "2", "app.conf"), "v2")
+	for _, link := range []struct{ name, target string }{{"current", "releases/2"}, {"files", "current"}} {
+		if err := os.Symlink(link.target, filepath.Join(appDir, link.name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, id := range []uint32{1, 2} {
+		if err := eventmeta.AppendMetadataToFile(appDir, &eventmeta.EventMeta{ReleaseID: id,
+			Status: eventmeta.EventStatusSuccess}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return appDir
+}
+
+func TestCheckRollback(t *testing.T) {
+	conf = &config.ClientConfig{VersionedDir: &config.VersionedDirConfig{Enabled: true, RetainReleases: 3}}
+	t.Cleanup(func() { conf = new(config.ClientConfig) })
+
+	tests := []struct {
+		name    string
+		appDir  func(t *testing.T) string
+		cached  bool
+		wantErr bool
+	}{
+		{
+			name: "no previous release",
+			appDir: func(t *testing.T) string {
+				appDir := t.TempDir()
+				if err := eventmeta.AppendMetadataToFile(appDir, &eventmeta.EventMeta{ReleaseID: 2,
+					Status: eventmeta.EventStatusSuccess}); err != nil {
+					t.Fatal(err)
+				}
+				return appDir
+			},
+			wantErr: true,
+		},
+		{
+			name:   "release dir retained",
+			appDir: func(t *testing.T) string { return rollbackAppDir(t, true) },
+		},
+		{
+			name:   "release dir pruned but content in cache",
+			appDir: func(t *testing.T) string { return rollbackAppDir(t, false) },
+			cached: true,
+		},
+		{
+			name:    "neither release dir nor content in cache",
+			appDir:  func(t *testing.T) string { return rollbackAppDir(t, false) },
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			appDir := tt.appDir(t)
+			if tt.cached {
+				cacheDir := t.TempDir()
+				if err := cache.Init(cacheDir, 1, cache.EvictionPolicyLRU, cache.ScrubOptions{}); err != nil {
+					t.Fatal(err)
+				}
+				t.Cleanup(func() { cache.Enable = false })
+				writeFile(t, filepath.Join(cacheDir, signature("v1")), "v1")
+			}
+
+			got, err := checkRollback(appDir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkRollback() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && got != 1 {
+				t.Errorf("checkRollback() = %d, want 1", got)
+			}
+		})
+	}
+}
@@ -56,6 +56,13 @@ func init() {
 
 	rootCmd.AddCommand(PullCmd)
 	rootCmd.AddCommand(WatchCmd)
+	rootCmd.AddCommand(RollbackCmd)
+	cacheCmd.AddCommand(cacheLsCmd)
+	cacheCmd.AddCommand(cacheStatsCmd)
+	cacheCmd.AddCommand(cachePruneCmd)
+	cacheCmd.AddCommand(cacheVerifyCmd)
+	cacheCmd.AddCommand(cacheWarmCmd)
+	rootCmd.AddCommand(cacheCmd)
 	rootCmd.AddCommand(VersionCmd)
 	rootCmd.PersistentFlags().StringP(
 		"log-level", "", "", "log filtering level, One of: debug|info|warn|error. (default info)")
@@ -31,6 +31,7 @@ import (
 	"golang.org/x/exp/slog"
 
 	"github.com/TencentBlueKing/bscp-go/client"
+	"github.com/TencentBlueKing/bscp-go/internal/config"
 	"github.com/TencentBlueKing/bscp-go/internal/constant"
 	"github.com/TencentBlueKing/bscp-go/internal/util"
 	"github.com/TencentBlueKing/bscp-go/pkg/logger"
@@ -49,14 +50,16 @@ var (
 
 // Watch run as a daemon to watch the config changes.
 func Watch(cmd *cobra.Command, args []string) {
-	// print bscp banner
-	fmt.Println(strings.TrimSpace(version.GetStartInfo()))
+	// print bscp banner, the output of dry run is kept clean for parsing
+	if !dryRun {
+		fmt.Println(strings.TrimSpace(version.GetStartInfo()))
+	}
 
 	if err := initConf(watchViper); err != nil {
 		logger.Error("init conf failed", logger.ErrAttr(err))
 		os.Exit(1)
 	}
-	if conf.ConfigFile != "" {
+	if conf.ConfigFile != "" && !dryRun {
 		fmt.Println("use config file:", conf.ConfigFile)
 	}
 	if err := conf.Validate(); err != nil {
@@ -88,15 +91,18 @@ func Watch(cmd *cobra.Command, args []string) {
 
 	for _, subscriber := range conf.Apps {
 		handler := &WatchHandler{
-			Biz:           conf.Biz,
-			App:           subscriber.Name,
-			Labels:        subscriber.Labels,
-			UID:           subscriber.UID,
-			ConfigMatches: subscriber.ConfigMatches,
-			Lock:          sync.Mutex{},
-			TempDir:       conf.TempDir,
-			AppTempDir:    filepath.Join(conf.TempDir, strconv.Itoa(int(conf.Biz)), subscriber.Name),
-			bscp:          bscp,
+			Biz:            conf.Biz,
+			App:            subscriber.Name,
+			Labels:         subscriber.Labels,
+			UID:            subscriber.UID,
+			ConfigMatches:  subscriber.ConfigMatches,
+			AutoRollback:   subscriber.AutoRollback,
+			PathMappings:   subscriber.PathMappings,
+			BandwidthLimit: subscriber.BandwidthLimit,
+			Lock:           sync.Mutex{},
+			TempDir:        conf.TempDir,
+			AppTempDir:     filepath.Join(conf.TempDir, strconv.Itoa(int(conf.Biz)), subscriber.Name),
+			bscp:           bscp,
 		}
 		if err := bscp.AddWatcher(handler.watchCallback, handler.App, handler.getSubscribeOptions()...); err != nil {
 			logger.Error("add watch", logger.ErrAttr(err))
@@ -133,29 +139,69 @@ func Watch(cmd *cobra.Command, args []string) {
 }
 
 func newWatchClient(labels map[string]string) (client.Client, error) {
-	return client.New(
+	snapshot, err := kvSnapshot(conf.KvCache.Snapshot)
+	if err != nil {
+		return nil, err
+	}
+	opts := []client.Option{
 		client.WithFeedAddrs(conf.FeedAddrs),
 		client.WithBizID(conf.Biz),
 		client.WithToken(conf.Token),
 		client.WithLabels(labels),
 		client.WithUID(conf.UID),
 		client.WithP2PDownload(conf.EnableP2PDownload),
+		client.WithP2PDownloadSettings(client.P2PDownloadSettings{
+			Threshold:    conf.P2PDownload.Threshold,
+			PollInterval: time.Duration(conf.P2PDownload.PollIntervalSeconds) * time.Second,
+			Timeout:      time.Duration(conf.P2PDownload.TimeoutSeconds) * time.Second,
+			StagingDir:   conf.P2PDownload.StagingDir,
+		}),
 		client.WithBkAgentID(conf.BkAgentID),
 		client.WithClusterID(conf.ClusterID),
 		client.WithPodID(conf.PodID),
 		client.WithContainerName(conf.ContainerName),
 		client.WithFileCache(client.FileCache{
-			Enabled:     conf.FileCache.Enabled,
-			CacheDir:    conf.FileCache.CacheDir,
-			ThresholdGB: conf.FileCache.ThresholdGB,
+			Enabled:        conf.FileCache.Enabled,
+			CacheDir:       conf.FileCache.CacheDir,
+			ThresholdGB:    conf.FileCache.ThresholdGB,
+			EvictionPolicy: conf.FileCache.EvictionPolicy,
+			Scrub:          fileCacheScrub(conf.FileCache.Scrub),
+			Prewarm:        fileCachePrewarm(conf.FileCache.Prewarm),
 		}),
 		client.WithKvCache(client.KvCache{
 			Enabled:     conf.KvCache.Enabled,
 			ThresholdMB: conf.KvCache.ThresholdMB,
+			Snapshot:    snapshot,
 		}),
 		client.WithEnableMonitorResourceUsage(conf.EnableMonitorResourceUsage),
 		client.WithTextLineBreak(conf.TextLineBreak),
-	)
+		client.WithVersionedDir(client.VersionedDir{
+			Enabled:        conf.VersionedDir.Enabled,
+			RetainReleases: conf.VersionedDir.RetainReleases,
+		}),
+		client.WithFileDeletion(client.FileDeletion{
+			NeverDelete: conf.FileDeletion.NeverDelete,
+			Ignore:      conf.FileDeletion.Ignore,
+		}),
+		client.WithAutoRollback(conf.AutoRollback),
+		client.WithBandwidthLimit(conf.Download.BandwidthLimit),
+		client.WithDownloadPriority(client.DownloadPriority{
+			Enabled:       conf.Download.PriorityEnabled,
+			SmallFileSize: conf.Download.SmallFileSize,
+		}),
+		client.WithSources(contentSources(conf.Sources)...),
+		client.WithSharedStore(client.SharedStore{
+			Enabled: conf.SharedStore.Enabled,
+			Dir:     conf.SharedStore.Dir,
+		}),
+		client.WithHTTPTransport(httpTransport(conf.HTTPTransport)),
+		client.WithFileDownloadTimeout(time.Duration(conf.Download.FileTimeoutSeconds) * time.Second),
+		client.WithRangePartSize(conf.Download.RangePartSize),
+	}
+	if dryRun {
+		opts = append(opts, dryRunOptions()...)
+	}
+	return client.New(opts...)
 }
 
 func serveHttp() {
@@ -180,6 +226,12 @@ type WatchHandler struct {
 	UID string
 	// ConfigMatches app config item's match conditions
 	ConfigMatches []string
+	// AutoRollback overwrites the global auto rollback config for the app if set
+	AutoRollback *bool
+	// PathMappings rules to map the config items to the target paths on the host
+	PathMappings []*config.PathMappingConfig
+	// BandwidthLimit download bandwidth limit of the app in bytes per second
+	BandwidthLimit int64
 	// TempDir bscp temporary directory
 	TempDir string
 	// AppTempDir app temporary directory
@@ -230,6 +282,18 @@ func (w *WatchHandler) watchCallback(release *client.Release) error {
 	release.BizID = w.Biz
 	release.ClientMode = sfs.Watch
 
+	if dryRun {
+		plan, err := release.Plan()
+		if err != nil {
+			return err
+		}
+		if err = printPlans([]*client.ReleasePlan{plan}); err != nil {
+			return err
+		}
+		// the release is not applied, so it is not reported as a version change
+		return client.ErrDryRun
+	}
+
 	if err := release.Execute(release.ExecuteHook(&client.PreScriptStrategy{}), release.UpdateFiles(),
 		release.ExecuteHook(&client.PostScriptStrategy{}), release.UpdateMetadata()); err != nil {
 		return err
@@ -243,6 +307,15 @@ func (w *WatchHandler) getSubscribeOptions() []client.AppOption {
 	options = append(options, client.WithAppLabels(w.Labels))
 	options = append(options, client.WithAppUID(w.UID))
 	options = append(options, client.WithAppConfigMatch(w.ConfigMatches))
+	if w.AutoRollback != nil {
+		options = append(options, client.WithAppAutoRollback(*w.AutoRollback))
+	}
+	if len(w.PathMappings) > 0 {
+		options = append(options, client.WithAppPathMappings(pathMappings(w.PathMappings)))
+	}
+	if w.BandwidthLimit > 0 {
+		options = append(options, client.WithAppBandwidthLimit(w.BandwidthLimit))
+	}
 	return options
 }
 
@@ -295,6 +368,9 @@ func init() {
 	mustBindPFlag(watchViper, "enable_resource", WatchCmd.Flags().Lookup("enable-resource"))
 	WatchCmd.Flags().StringP("text-line-break", "", "", "text line break, default as LF")
 	mustBindPFlag(watchViper, "text_line_break", WatchCmd.Flags().Lookup("text-line-break"))
+	WatchCmd.Flags().BoolVarP(&dryRun, "dry-run", "", false,
+		"only print what would change for the received releases, nothing is written to disk")
+	WatchCmd.Flags().StringVarP(&outputFormat, "output", "o", "", "output format of dry run, One of: json")
 
 	envs := map[string]string{}
 	for key, envName := range commonEnvs {
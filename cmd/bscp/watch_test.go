@@ -0,0 +1,103 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	pbci "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/core/config-item"
+	pbcontent "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/core/content"
+	sfs "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/sf-share"
+
+	"github.com/TencentBlueKing/bscp-go/client"
+)
+
+// captureStdout returns what is written to stdout by the fn
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	fn()
+	_ = w.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b)
+}
+
+func TestWatchCallbackDryRun(t *testing.T) {
+	dryRun, outputFormat = true, outputFormatJson
+	t.Cleanup(func() { dryRun, outputFormat = false, "" })
+
+	tempDir := t.TempDir()
+	appDir := filepath.Join(tempDir, "1", "app")
+	writeFile(t, filepath.Join(appDir, "files", "unchanged.conf"), "v1")
+	handler := &WatchHandler{Biz: 1, App: "app", TempDir: tempDir, AppTempDir: appDir}
+	release := &client.Release{
+		ReleaseID:   2,
+		ReleaseName: "v2",
+		AppMate:     &sfs.SideAppMeta{App: "app"},
+	}
+	for name, content := range map[string]string{"unchanged.conf": "v1", "created.conf": "v2"} {
+		release.FileItems = append(release.FileItems, &client.ConfigItemFile{
+			Name: name,
+			Path: "/",
+			FileMeta: &sfs.ConfigItemMetaV1{
+				ContentSpec: &pbcontent.ContentSpec{Signature: signature(content),
+					ByteSize: uint64(len(content))},
+				ConfigItemSpec: &pbci.ConfigItemSpec{Name: name, Path: "/", FileType: "binary"},
+			},
+		})
+	}
+
+	var err error
+	out := captureStdout(t, func() { err = handler.watchCallback(release) })
+	// the watcher does not report the planned release as a version change
+	if !errors.Is(err, client.ErrDryRun) {
+		t.Fatalf("expected the dry run error, got %v", err)
+	}
+	var plans []*client.ReleasePlan
+	if err = json.Unmarshal([]byte(out), &plans); err != nil {
+		t.Fatalf("decode the output %q failed, err: %v", out, err)
+	}
+	if len(plans) != 1 || plans[0].ReleaseID != 2 || plans[0].Unchanged != 1 {
+		t.Fatalf("unexpected plans: %s", out)
+	}
+	if files := plans[0].Files; len(files) != 1 || files[0].Action != client.PlanActionCreate ||
+		files[0].Path != filepath.Join(appDir, "files", "created.conf") {
+		t.Errorf("unexpected plan files: %s", out)
+	}
+
+	// the release is not applied
+	if _, err = os.Stat(filepath.Join(appDir, "files", "created.conf")); !os.IsNotExist(err) {
+		t.Errorf("the file is written by the dry run, err: %v", err)
+	}
+	entries, err := os.ReadDir(appDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("the app dir is written by the dry run, entries: %v", entries)
+	}
+}
@@ -36,6 +36,10 @@ func main() {
 	// 在线服务, 可设置 metrics
 	// metrics.RegisterMetrics()
 	// http.Handle("/metrics", promhttp.Handler())
+	// 或注册到自定义的 Registerer
+	// registry := prometheus.NewRegistry()
+	// metrics.MustRegister(registry)
+	// http.Handle("/metrics", promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
 
 	// 初始化配置信息, 按需修改
 	bizStr := os.Getenv("BSCP_BIZ")
@@ -58,6 +62,10 @@ func main() {
 		}))
 	}
 
+	// 可设置 OpenTelemetry tracing, 如输出到标准输出
+	// exporter, _ := stdouttrace.New(stdouttrace.WithPrettyPrint())
+	// clientOpts = append(clientOpts, client.WithTraceExporter(exporter))
+
 	bscp, err := client.New(clientOpts...)
 	if err != nil {
 		slog.Error("init client", logger.ErrAttr(err))
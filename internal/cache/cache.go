@@ -14,14 +14,12 @@
 package cache
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"io/fs"
 	"math"
 	"os"
 	"path/filepath"
-	"sort"
 	"time"
 
 	sfs "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/sf-share"
@@ -30,7 +28,9 @@ import (
 	"golang.org/x/exp/slog"
 
 	"github.com/TencentBlueKing/bscp-go/internal/downloader"
+	"github.com/TencentBlueKing/bscp-go/internal/util"
 	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+	"github.com/TencentBlueKing/bscp-go/pkg/metrics"
 )
 
 const (
@@ -51,18 +51,43 @@ var Enable bool
 type Cache struct {
 	path       string
 	thrsholdGB float64
+	// index the cache index of the cached contents
+	index *index
+	// scrub options of verifying the cached contents
+	scrub ScrubOptions
+	// locks serializes the filling of the same content
+	locks signatureLocks
 }
 
-// Init return a bscp sdk cache instance
-func Init(path string, thresholdGB float64) error {
-	Enable = true
-	instance = &Cache{
-		path:       path,
-		thrsholdGB: thresholdGB,
+// Init return a bscp sdk cache instance, the cached contents are evicted by the policy, which is lru or lfu
+func Init(path string, thresholdGB float64, policy string, scrub ScrubOptions) error {
+	c, err := New(path, thresholdGB, policy, scrub)
+	if err != nil {
+		return err
 	}
+	Enable = true
+	instance = c
+	metrics.FileCacheEntries.Set(func() float64 { return float64(c.index.count()) })
+	metrics.FileCacheBytes.Set(func() float64 { return float64(c.index.totalSize()) })
+	return nil
+}
 
+// New creates a cache of the cache dir without enabling it for the sdk, e.g. for managing the cache by the cli
+func New(path string, thresholdGB float64, policy string, scrub ScrubOptions) (*Cache, error) {
 	// prepare cache dir
-	return os.MkdirAll(path, os.ModePerm)
+	if err := os.MkdirAll(path, os.ModePerm); err != nil {
+		return nil, err
+	}
+	idx, err := loadIndex(path, policy)
+	if err != nil {
+		return nil, fmt.Errorf("load file cache index failed, err: %s", err.Error())
+	}
+	return &Cache{
+		path:       path,
+		thrsholdGB: thresholdGB,
+		index:      idx,
+		scrub:      scrub.withDefaults(),
+	}, nil
 }
 
 // GetCache return the cache instance
@@ -70,45 +95,32 @@ func GetCache() *Cache {
 	return instance
 }
 
-// OnReleaseChange is the callback to refresh cache when release change event was received.
-func (c *Cache) OnReleaseChange(event *sfs.ReleaseChangeEvent) {
-	pl := new(sfs.ReleaseChangePayload)
-	if err := json.Unmarshal(event.Payload, pl); err != nil {
-		logger.Error("decode release change event payload failed, skip the event",
-			logger.ErrAttr(err), slog.String("rid", event.Rid))
-		return
+// lookup returns whether the config content is cached and its SHA256 is match, the hit is recorded in the index
+func (c *Cache) lookup(ci *sfs.ConfigItemMetaV1) (bool, error) {
+	exists, err := c.checkFileCacheExists(ci)
+	if err != nil {
+		return false, err
 	}
+	c.recordLookup(ci, exists)
+	return exists, nil
+}
 
-	if err := os.MkdirAll(c.path, os.ModePerm); err != nil {
-		logger.Error("mkdir cache path failed", slog.String("path", c.path), logger.ErrAttr(err))
+// recordLookup records the hit or the miss of the config content
+func (c *Cache) recordLookup(ci *sfs.ConfigItemMetaV1, hit bool) {
+	if !hit {
+		metrics.FileCacheMissCounter.Inc()
 		return
 	}
-
-	for _, ci := range pl.ReleaseMeta.CIMetas {
-		exists, err := c.checkFileCacheExists(ci)
-		if err != nil {
-			logger.Error("check config item exists failed", logger.ErrAttr(err), slog.String("rid", event.Rid))
-			continue
-		}
-		if exists {
-			continue
-		}
-		filePath := filepath.Join(c.path, ci.ContentSpec.Signature)
-		// TODO: gse 现在分发文件时，target 的目录必须一致，因此这里 Cache 和 SDK 的下载目录会被视为同一个目录，并发下载时会有问题
-		// 两个并发下载任务下载到同一个文件中，但是 Downloader 中并发移动这个文件时会导致其中一个任务失败
-		// 在 GSE 解决这个问题（支持根据 target 设置目录）之前，先不启用 Cahce.OnReleaseChange 回调
-		if err := downloader.GetDownloader().Download(ci.PbFileMeta(), ci.RepositoryPath, ci.ContentSpec.ByteSize,
-			downloader.DownloadToFile, nil, filePath); err != nil {
-			logger.Error("download file failed", logger.ErrAttr(err), slog.String("rid", event.Rid))
-			return
-		}
-	}
+	metrics.FileCacheHitCounter.Inc()
+	c.index.touch(ci.ContentSpec.Signature, ci.ContentSpec.ByteSize)
 }
 
-// checkFileCacheExists verify the config content is exist or not in the local.
+// checkFileCacheExists verify the config content is exist or not in the local, the content verified recently is not
+// hashed again, and the corrupt content is quarantined or deleted.
 func (c *Cache) checkFileCacheExists(ci *sfs.ConfigItemMetaV1) (bool, error) {
-	filePath := filepath.Join(c.path, ci.ContentSpec.Signature)
-	_, err := os.Stat(filePath)
+	signature := ci.ContentSpec.Signature
+	filePath := filepath.Join(c.path, signature)
+	info, err := os.Stat(filePath)
 	if err != nil {
 		if os.IsNotExist(err) {
 			// content is not exist
@@ -118,21 +130,42 @@ func (c *Cache) checkFileCacheExists(ci *sfs.ConfigItemMetaV1) (bool, error) {
 		return false, err
 	}
 
+	if uint64(info.Size()) != ci.ContentSpec.ByteSize {
+		c.handleCorrupt(signature, fmt.Errorf("file size %d not matched, expected size: %d", info.Size(),
+			ci.ContentSpec.ByteSize))
+		return false, nil
+	}
+	if c.index.verifiedWithin(signature, ci.ContentSpec.ByteSize, c.scrub.VerifiedTTL) {
+		return true, nil
+	}
+
 	sha, err := tools.FileSHA256(filePath)
 	if err != nil {
 		return false, fmt.Errorf("check configuration item's SHA256 failed, err: %s", err.Error())
 	}
 
-	if sha != ci.ContentSpec.Signature {
+	if sha != signature {
+		c.handleCorrupt(signature, fmt.Errorf("file SHA256 %s not matched", sha))
 		return false, nil
 	}
+	c.index.verified(signature)
 
 	return true, nil
 }
 
+// Exists returns whether the config content is cached and its SHA256 is match.
+func (c *Cache) Exists(ci *sfs.ConfigItemMetaV1) bool {
+	exists, err := c.checkFileCacheExists(ci)
+	if err != nil {
+		logger.Error("check config item exists failed", logger.ErrAttr(err))
+		return false
+	}
+	return exists
+}
+
 // GetFileContent return the config content bytes.
 func (c *Cache) GetFileContent(ci *sfs.ConfigItemMetaV1) (bool, []byte) {
-	exists, err := c.checkFileCacheExists(ci)
+	exists, err := c.lookup(ci)
 	if err != nil {
 		logger.Error("check config item cache exists failed",
 			slog.String("item", ci.ContentSpec.Signature), logger.ErrAttr(err))
@@ -151,33 +184,139 @@ func (c *Cache) GetFileContent(ci *sfs.ConfigItemMetaV1) (bool, []byte) {
 	return true, bytes
 }
 
-// CopyToFile copy the config content to the specified file.
-// get from cache first, if not exist, then get from remote repo and add it to cache
-func (c *Cache) CopyToFile(ci *sfs.ConfigItemMetaV1, filePath string) bool {
-	if ci.ContentSpec.ByteSize > uint64(MaxSingleFileCacheSizeRate*c.thrsholdGB*GByte) {
-		logger.Warn("config item size is too large, skip cache",
-			slog.String("item", filepath.Join(ci.ConfigItemSpec.Path, ci.ConfigItemSpec.Name)),
-			slog.Int64("size", int64(ci.ContentSpec.ByteSize)))
-		return false
+// Open opens the cached config content as a stream, which is verified by the SHA256 while it is read instead of
+// before, so that the large content is read only once. It returns false if the content is not cached or its size
+// does not match, and the content is quarantined or deleted if it is found corrupt while read.
+func (c *Cache) Open(ci *sfs.ConfigItemMetaV1) (io.ReadCloser, bool) {
+	signature := ci.ContentSpec.Signature
+	filePath := filepath.Join(c.path, signature)
+	// the content is held until the stream is closed, so that it is not evicted while it is read
+	release := c.locks.hold(signature)
+	file, err := os.Open(filePath)
+	if err != nil {
+		release()
+		if !os.IsNotExist(err) {
+			logger.Error("open config item cache file failed", slog.String("file", filePath), logger.ErrAttr(err))
+		}
+		c.recordLookup(ci, false)
+		return nil, false
 	}
-	exists, err := c.checkFileCacheExists(ci)
+	info, err := file.Stat()
 	if err != nil {
-		logger.Error("check config item cache exists failed",
-			slog.String("item", ci.ContentSpec.Signature), logger.ErrAttr(err))
-		return false
+		logger.Error("stat config item cache file failed", slog.String("file", filePath), logger.ErrAttr(err))
+		_ = file.Close()
+		release()
+		c.recordLookup(ci, false)
+		return nil, false
+	}
+	if uint64(info.Size()) != ci.ContentSpec.ByteSize {
+		_ = file.Close()
+		release()
+		c.handleCorrupt(signature, fmt.Errorf("file size %d not matched, expected size: %d", info.Size(),
+			ci.ContentSpec.ByteSize))
+		c.recordLookup(ci, false)
+		return nil, false
 	}
+	c.recordLookup(ci, true)
+	return &cacheStream{
+		ReadCloser: util.NewVerifyReader(file, ci.ContentSpec.ByteSize, signature),
+		cache:      c,
+		signature:  signature,
+		info:       info,
+		release:    release,
+	}, true
+}
 
-	cacheFilePath := filepath.Join(c.path, ci.ContentSpec.Signature)
-	if !exists {
-		// get from remote repo and add it to cache
-		if err = downloader.GetDownloader().Download(ci.PbFileMeta(), ci.RepositoryPath, ci.ContentSpec.ByteSize,
-			downloader.DownloadToFile, nil, cacheFilePath); err != nil {
-			logger.Error("download file failed", logger.ErrAttr(err))
-			return false
+// cacheStream is the stream of the cached content, the content is recorded as verified if it is read completely,
+// or quarantined on close if it does not match
+type cacheStream struct {
+	io.ReadCloser
+	cache     *Cache
+	signature string
+	info      os.FileInfo
+	release   func()
+	verified  bool
+	corrupt   error
+}
+
+// Read reads the cached content
+func (s *cacheStream) Read(p []byte) (int, error) {
+	n, err := s.ReadCloser.Read(p)
+	switch {
+	case err == io.EOF:
+		s.verified = true
+	case errors.Is(err, util.ErrVerifyFailed):
+		s.corrupt = err
+	}
+	return n, err
+}
+
+// Close closes the cached content, the corrupt content is handled after the file is closed, so that it can be
+// renamed or deleted on all the platforms
+func (s *cacheStream) Close() error {
+	err := s.ReadCloser.Close()
+	s.release()
+	switch {
+	case s.verified:
+		s.cache.index.verified(s.signature)
+	case s.corrupt != nil:
+		unlock := s.cache.locks.lock(s.signature)
+		defer unlock()
+		// the content may be replaced by a new download after it is opened
+		if info, e := os.Stat(filepath.Join(s.cache.path, s.signature)); e == nil && os.SameFile(info, s.info) {
+			s.cache.handleCorrupt(s.signature, s.corrupt)
 		}
 	}
+	return err
+}
+
+// Warm adds the config content to the cache if it is not cached, it is downloaded from remote repo with the
+// download options. The content larger than the single file limit is not cached. The concurrent calls of the same
+// content wait for the first one and use the content it cached.
+func (c *Cache) Warm(ci *sfs.ConfigItemMetaV1, opts ...downloader.DownloadOption) error {
+	_, err := c.warm(ci, opts...)
+	return err
+}
+
+// warm is the same as Warm, and returns whether the config content is cached already
+func (c *Cache) warm(ci *sfs.ConfigItemMetaV1, opts ...downloader.DownloadOption) (bool, error) {
+	if ci.ContentSpec.ByteSize > uint64(MaxSingleFileCacheSizeRate*c.thrsholdGB*GByte) {
+		return false, fmt.Errorf("config item size %d is too large to cache", ci.ContentSpec.ByteSize)
+	}
+	unlock := c.locks.lock(ci.ContentSpec.Signature)
+	defer unlock()
+	exists, err := c.lookup(ci)
+	if err != nil {
+		return false, fmt.Errorf("check config item cache exists failed, err: %s", err.Error())
+	}
+	if exists {
+		return true, nil
+	}
+
+	// get from remote repo and add it to cache
+	if err = downloader.GetDownloader().Download(ci.PbFileMeta(), ci.RepositoryPath, ci.ContentSpec.ByteSize,
+		downloader.DownloadToFile, nil, filepath.Join(c.path, ci.ContentSpec.Signature), opts...); err != nil {
+		return false, err
+	}
+	c.index.add(ci.ContentSpec.Signature, ci.ContentSpec.ByteSize)
+	return false, nil
+}
 
-	var src, dst *os.File
+// CopyToFile copy the config content to the specified file.
+// get from cache first, if not exist, then get from remote repo with the download options and add it to cache
+func (c *Cache) CopyToFile(ci *sfs.ConfigItemMetaV1, filePath string, opts ...downloader.DownloadOption) bool {
+	start := time.Now()
+	hit, err := c.warm(ci, opts...)
+	if err != nil {
+		logger.Warn("add config item to cache failed, skip cache",
+			slog.String("item", filepath.Join(ci.ConfigItemSpec.Path, ci.ConfigItemSpec.Name)),
+			slog.Int64("size", int64(ci.ContentSpec.ByteSize)), logger.ErrAttr(err))
+		return false
+	}
+
+	cacheFilePath := filepath.Join(c.path, ci.ContentSpec.Signature)
+	var src *os.File
+	var dst *util.AtomicFile
 	src, err = os.Open(cacheFilePath)
 	if err != nil {
 		logger.Error("open config item cache file failed", slog.String("file", cacheFilePath), logger.ErrAttr(err))
@@ -185,98 +324,66 @@ func (c *Cache) CopyToFile(ci *sfs.ConfigItemMetaV1, filePath string) bool {
 	}
 	defer src.Close()
 
-	dst, err = os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	// copy to a temp file beside the destination file and rename it, so that the destination file is never
+	// partially written
+	dst, err = util.CreateAtomicFile(filePath, 0644)
 	if err != nil {
 		logger.Error("open destination file failed", slog.String("file", filePath), logger.ErrAttr(err))
 		return false
 	}
-	defer dst.Close()
+	defer dst.Abort()
 
 	if _, err := io.Copy(dst, src); err != nil {
 		logger.Error("copy config item cache file to destination file failed",
 			slog.String("cache_file", cacheFilePath), slog.String("file", filePath), logger.ErrAttr(err))
 		return false
 	}
+	if err := dst.Commit(); err != nil {
+		logger.Error("rename destination file failed", slog.String("file", filePath), logger.ErrAttr(err))
+		return false
+	}
+	// the content missed is counted by the source downloaded from
+	if hit {
+		metrics.DownloadBytesCounter.WithLabelValues("cache").Add(float64(ci.ContentSpec.ByteSize))
+		metrics.DownloadDurationSeconds.WithLabelValues("cache").Observe(time.Since(start).Seconds())
+	}
 	return true
 }
 
-// AutoCleanupFileCache auto cleanup file cache
+// Pin pins the contents of the currently applied release of the app, so that they are never evicted, the contents
+// of the release applied before are unpinned.
+func (c *Cache) Pin(bizID uint32, app string, releaseID uint32, signatures []string) {
+	c.index.pin(fmt.Sprintf("%d/%s", bizID, app), releaseID, signatures)
+	if err := c.index.save(); err != nil {
+		logger.Warn("save file cache index failed", logger.ErrAttr(err))
+	}
+}
+
+// AutoCleanupFileCache auto cleanup file cache, the size is accounted by the cache index, and the contents are
+// evicted by the eviction policy until the size is under the retention rate of the threshold.
 func AutoCleanupFileCache(cacheDir string, cleanupIntervalSeconds int64, thresholdGB, retentionRate float64) {
 	logger.Info("start auto cleanup file cache ",
 		slog.String("cacheDir", cacheDir),
 		slog.String("cleanupIntervalSeconds", fmt.Sprintf("%ds", cleanupIntervalSeconds)),
 		slog.String("thresholdGB", fmt.Sprintf("%sGB", humanize.Ftoa(thresholdGB))),
-		slog.String("retentionRate", fmt.Sprintf("%s%%", humanize.Ftoa(retentionRate*100))))
+		slog.String("retentionRate", fmt.Sprintf("%s%%", humanize.Ftoa(retentionRate*100))),
+		slog.String("policy", instance.index.policy))
 
 	for {
-		currentSize, err := calculateDirSize(cacheDir)
-		if err != nil {
-			logger.Error("calculate current cache directory size failed", logger.ErrAttr(err))
-			time.Sleep(time.Duration(cleanupIntervalSeconds) * time.Second)
-			continue
-		}
-		logger.Debug("calculate current cache directory size", slog.String("currentSize",
-			humanize.IBytes(uint64(currentSize))))
+		downloader.CleanupPartFiles(cacheDir, downloader.DefaultPartFileExpiration)
+		idx := instance.index
+		currentSize := idx.totalSize()
+		logger.Debug("current cache directory size", slog.String("currentSize", humanize.IBytes(currentSize)))
 
-		if currentSize > int64(thresholdGB*GByte) {
+		if currentSize > uint64(thresholdGB*GByte) {
 			logger.Info("cleaning up directory...")
-			cleanupOldestFiles(cacheDir, currentSize-int64(math.Floor(thresholdGB*GByte*retentionRate)))
+			count, freed := idx.evict(uint64(math.Floor(thresholdGB*GByte*retentionRate)), &instance.locks)
+			logger.Info("cleanup file cache done", slog.Int("evicted", count),
+				slog.String("freed", humanize.IBytes(freed)))
 		}
-		time.Sleep(time.Duration(cleanupIntervalSeconds) * time.Second)
-	}
-}
-
-func calculateDirSize(dir string) (int64, error) {
-	var size int64
-	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		size += info.Size()
-		return nil
-	})
-	return size, err
-}
-
-func cleanupOldestFiles(dir string, spaceToFree int64) {
-	files, err := listFilesByModTime(dir)
-	if err != nil {
-		logger.Error("list files by mod time failed", logger.ErrAttr(err))
-	}
-
-	for _, file := range files {
-		filePath := filepath.Join(dir, file.Name())
-		err = os.Remove(filePath)
-		if err != nil {
-			logger.Error("deleting file failed", slog.String("file", filePath), logger.ErrAttr(err))
-		} else {
-			logger.Info("deleted file", slog.String("file", filePath))
-			spaceToFree -= file.Size()
+		if err := idx.save(); err != nil {
+			logger.Warn("save file cache index failed", logger.ErrAttr(err))
 		}
-
-		if spaceToFree <= 0 {
-			break
-		}
-	}
-}
-
-func listFilesByModTime(dir string) ([]os.FileInfo, error) {
-	entries, err := os.ReadDir(dir)
-	if err != nil {
-		return nil, err
-	}
-	files := make([]fs.FileInfo, 0, len(entries))
-	for _, entry := range entries {
-		info, err := entry.Info()
-		if err != nil {
-			return nil, err
-		}
-		files = append(files, info)
+		time.Sleep(time.Duration(cleanupIntervalSeconds) * time.Second)
 	}
-
-	sort.Slice(files, func(i, j int) bool {
-		return files[i].ModTime().Before(files[j].ModTime())
-	})
-
-	return files, nil
 }
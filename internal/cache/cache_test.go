@@ -0,0 +1,187 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	pbcontent "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/core/content"
+	sfs "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/sf-share"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/TencentBlueKing/bscp-go/internal/util"
+	"github.com/TencentBlueKing/bscp-go/pkg/metrics"
+)
+
+// newTestRegistry returns the registry which all the metrics of bscp-go are registered on
+func newTestRegistry(t *testing.T) *prometheus.Registry {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	if err := metrics.Register(reg); err != nil {
+		t.Fatal(err)
+	}
+	return reg
+}
+
+// gatherValue returns the value of the metric with the label value gathered from the registry, the metric must be
+// registered and collected
+func gatherValue(t *testing.T, reg *prometheus.Registry, name string, labelValue ...string) float64 {
+	t.Helper()
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if f.GetName() != name {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			if len(labelValue) > 0 && (len(m.GetLabel()) == 0 || m.GetLabel()[0].GetValue() != labelValue[0]) {
+				continue
+			}
+			switch {
+			case m.GetCounter() != nil:
+				return m.GetCounter().GetValue()
+			case m.GetGauge() != nil:
+				return m.GetGauge().GetValue()
+			}
+		}
+	}
+	t.Fatalf("metric %s%v is not gathered", name, labelValue)
+	return 0
+}
+
+func TestOpen(t *testing.T) {
+	tests := []struct {
+		name        string
+		content     string
+		cached      string
+		wantHit     bool
+		wantErr     bool
+		wantCorrupt bool
+	}{
+		{name: "good", content: "good", cached: "good", wantHit: true},
+		{name: "not cached", content: "missing"},
+		{name: "size not match", content: "good", cached: "truncated", wantCorrupt: true},
+		{name: "SHA256 not match", content: "good", cached: "evil", wantHit: true, wantErr: true, wantCorrupt: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			signature := writeContent(t, dir, tt.content)
+			if tt.cached == "" {
+				if err := os.Remove(filepath.Join(dir, signature)); err != nil {
+					t.Fatal(err)
+				}
+			} else if err := os.WriteFile(filepath.Join(dir, signature), []byte(tt.cached), 0644); err != nil {
+				t.Fatal(err)
+			}
+			c, err := New(dir, 1, EvictionPolicyLRU, ScrubOptions{Quarantine: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ci := &sfs.ConfigItemMetaV1{ContentSpec: &pbcontent.ContentSpec{Signature: signature,
+				ByteSize: uint64(len(tt.content))}}
+
+			r, hit := c.Open(ci)
+			if hit != tt.wantHit {
+				t.Fatalf("Open() hit = %v, want %v", hit, tt.wantHit)
+			}
+			if hit {
+				b, err := io.ReadAll(r)
+				if tt.wantErr != (err != nil) || (err != nil && !errors.Is(err, util.ErrVerifyFailed)) {
+					t.Errorf("read the cached content, err: %v, want err: %v", err, tt.wantErr)
+				}
+				if err == nil && string(b) != tt.content {
+					t.Errorf("the cached content = %q, want %q", b, tt.content)
+				}
+				if err = r.Close(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, err = os.Stat(filepath.Join(dir, quarantineDirName, signature))
+			if quarantined := err == nil; quarantined != tt.wantCorrupt {
+				t.Errorf("the cached content is quarantined: %v, want %v", quarantined, tt.wantCorrupt)
+			}
+			if tt.wantCorrupt && c.Exists(ci) {
+				t.Errorf("the corrupt content is still cached")
+			}
+			if verified := c.index.verifiedWithin(signature, ci.ContentSpec.ByteSize, time.Minute); verified !=
+				(tt.wantHit && !tt.wantErr) {
+				t.Errorf("the content is recorded as verified: %v", verified)
+			}
+		})
+	}
+}
+
+func TestFileCacheMetrics(t *testing.T) {
+	dir := t.TempDir()
+	good := writeContent(t, dir, "good")
+	other := writeContent(t, dir, "other")
+	if err := Init(dir, 1, EvictionPolicyLRU, ScrubOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { Enable, instance = false, nil })
+	c := GetCache()
+	reg := newTestRegistry(t)
+	hits := gatherValue(t, reg, "bscp_go_total_file_cache_hit_count")
+	misses := gatherValue(t, reg, "bscp_go_total_file_cache_miss_count")
+	evictions := gatherValue(t, reg, "bscp_go_total_file_cache_eviction_count")
+
+	// the hit and the miss of the lookups are counted
+	for _, ci := range []*sfs.ConfigItemMetaV1{
+		{ContentSpec: &pbcontent.ContentSpec{Signature: good, ByteSize: 4}},
+		{ContentSpec: &pbcontent.ContentSpec{Signature: "missing", ByteSize: 7}},
+	} {
+		if r, hit := c.Open(ci); hit {
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if got := gatherValue(t, reg, "bscp_go_total_file_cache_hit_count") - hits; got != 1 {
+		t.Errorf("file cache hits = %v, want 1", got)
+	}
+	if got := gatherValue(t, reg, "bscp_go_total_file_cache_miss_count") - misses; got != 1 {
+		t.Errorf("file cache misses = %v, want 1", got)
+	}
+	if got := gatherValue(t, reg, "bscp_go_file_cache_entries"); got != 2 {
+		t.Errorf("file cache entries = %v, want 2", got)
+	}
+	if got := gatherValue(t, reg, "bscp_go_file_cache_bytes"); got != 9 {
+		t.Errorf("file cache bytes = %v, want 9", got)
+	}
+
+	// the least recently used content is evicted
+	if n, _ := c.Prune(4, 0); n != 1 {
+		t.Fatalf("expected one content is evicted, got %d", n)
+	}
+	if c.Exists(&sfs.ConfigItemMetaV1{ContentSpec: &pbcontent.ContentSpec{Signature: other, ByteSize: 5}}) {
+		t.Errorf("the least recently used content is not evicted")
+	}
+	if got := gatherValue(t, reg, "bscp_go_total_file_cache_eviction_count") - evictions; got != 1 {
+		t.Errorf("file cache evictions = %v, want 1", got)
+	}
+	if got := gatherValue(t, reg, "bscp_go_file_cache_entries"); got != 1 {
+		t.Errorf("file cache entries = %v, want 1", got)
+	}
+	if got := gatherValue(t, reg, "bscp_go_file_cache_bytes"); got != 4 {
+		t.Errorf("file cache bytes = %v, want 4", got)
+	}
+}
@@ -0,0 +1,445 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+
+	"github.com/TencentBlueKing/bscp-go/internal/util"
+	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+	"github.com/TencentBlueKing/bscp-go/pkg/metrics"
+)
+
+const (
+	// indexFileName is the file name of the persisted cache index in the cache dir
+	indexFileName = ".index.json"
+	// indexLockFileName is the file name of the lock which serializes the saves of the index by the processes
+	// sharing the cache dir
+	indexLockFileName = ".index.lock"
+
+	// EvictionPolicyLRU evicts the least recently used content first
+	EvictionPolicyLRU = "lru"
+	// EvictionPolicyLFU evicts the least frequently used content first, the least recently used one is evicted
+	// first if they are used equally
+	EvictionPolicyLFU = "lfu"
+)
+
+// Entry is a cached content in the cache index, the content is stored in the file named by its signature
+type Entry struct {
+	// Signature the SHA256 signature of the content
+	Signature string `json:"-"`
+	// Size the byte size of the content
+	Size uint64 `json:"size"`
+	// LastAccess the last time the content is used
+	LastAccess time.Time `json:"last_access"`
+	// Hits the times the content is used
+	Hits uint64 `json:"hits"`
+	// VerifiedAt the last time the content is verified by the SHA256 signature
+	VerifiedAt time.Time `json:"verified_at"`
+}
+
+// Pin is the contents referenced by the currently applied release of an app, which are never evicted
+type Pin struct {
+	// ReleaseID the currently applied release id
+	ReleaseID uint32 `json:"release_id"`
+	// Signatures the signatures of the release files
+	Signatures []string `json:"signatures"`
+}
+
+// indexFile is the persisted cache index
+type indexFile struct {
+	Entries map[string]*Entry `json:"entries"`
+	Pins    map[string]*Pin   `json:"pins"`
+}
+
+// index is the cache index which accounts the size and the usage of the cached contents without walking the
+// cache dir, it is persisted in the cache dir and reconciled with the dir when it is loaded.
+type index struct {
+	lock    sync.Mutex
+	dir     string
+	policy  string
+	entries map[string]*Entry
+	pins    map[string]*Pin
+	size    uint64
+	dirty   bool
+	// pinnedApps the apps pinned since the last save, whose pins are not overwritten by the persisted ones
+	pinnedApps map[string]bool
+}
+
+// loadIndex loads the index persisted in the cache dir, the contents added or removed by others when the index
+// is not loaded are reconciled by scanning the dir once.
+func loadIndex(dir, policy string) (*index, error) {
+	idx := &index{
+		dir:        dir,
+		policy:     policy,
+		entries:    make(map[string]*Entry),
+		pins:       make(map[string]*Pin),
+		pinnedApps: make(map[string]bool),
+	}
+	if data, err := os.ReadFile(filepath.Join(dir, indexFileName)); err == nil {
+		f := new(indexFile)
+		if err := json.Unmarshal(data, f); err != nil {
+			logger.Warn("the file cache index is broken, rebuild it", slog.String("dir", dir), logger.ErrAttr(err))
+		} else {
+			if f.Entries != nil {
+				idx.entries = f.Entries
+			}
+			if f.Pins != nil {
+				idx.pins = f.Pins
+			}
+		}
+	}
+	if err := idx.reconcile(); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// reconcile makes the index consistent with the contents in the cache dir
+func (idx *index) reconcile() error {
+	dirEntries, err := os.ReadDir(idx.dir)
+	if err != nil {
+		return err
+	}
+	onDisk := make(map[string]bool, len(dirEntries))
+	for _, de := range dirEntries {
+		if !de.Type().IsRegular() || !isSignature(de.Name()) {
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		sig := de.Name()
+		onDisk[sig] = true
+		e, ok := idx.entries[sig]
+		if !ok {
+			e = &Entry{LastAccess: info.ModTime()}
+			idx.entries[sig] = e
+			idx.dirty = true
+		}
+		e.Signature = sig
+		e.Size = uint64(info.Size())
+	}
+	idx.size = 0
+	for sig, e := range idx.entries {
+		if !onDisk[sig] {
+			delete(idx.entries, sig)
+			idx.dirty = true
+			continue
+		}
+		idx.size += e.Size
+	}
+	return nil
+}
+
+// touch records a use of the cached content
+func (idx *index) touch(signature string, size uint64) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	e, ok := idx.entries[signature]
+	if !ok {
+		e = idx.addLocked(signature, size)
+	}
+	e.LastAccess = time.Now()
+	e.Hits++
+	idx.dirty = true
+}
+
+// add adds the content to the index after it is cached, the content is verified by the downloader
+func (idx *index) add(signature string, size uint64) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	e := idx.addLocked(signature, size)
+	e.LastAccess = time.Now()
+	e.VerifiedAt = e.LastAccess
+}
+
+// verified records the verification of the content
+func (idx *index) verified(signature string) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if e, ok := idx.entries[signature]; ok {
+		e.VerifiedAt = time.Now()
+		idx.dirty = true
+	}
+}
+
+// verifiedWithin returns whether the content of the size is verified within the ttl
+func (idx *index) verifiedWithin(signature string, size uint64, ttl time.Duration) bool {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	e, ok := idx.entries[signature]
+	return ok && e.Size == size && time.Since(e.VerifiedAt) < ttl
+}
+
+// unverifiedSince returns the copies of the contents not verified since the time, the oldest verified first
+func (idx *index) unverifiedSince(since time.Time) []Entry {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	entries := make([]Entry, 0)
+	for _, e := range idx.entries {
+		if e.VerifiedAt.Before(since) {
+			entries = append(entries, *e)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].VerifiedAt.Before(entries[j].VerifiedAt)
+	})
+	return entries
+}
+
+// addLocked adds the content or updates its size, the lock should be held
+func (idx *index) addLocked(signature string, size uint64) *Entry {
+	e, ok := idx.entries[signature]
+	if ok {
+		idx.size -= e.Size
+		e.Size = size
+	} else {
+		e = &Entry{Signature: signature, Size: size}
+		idx.entries[signature] = e
+	}
+	idx.size += size
+	idx.dirty = true
+	return e
+}
+
+// remove removes the content from the index
+func (idx *index) remove(signature string) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	idx.removeLocked(signature)
+}
+
+// removeLocked removes the content from the index, the lock should be held
+func (idx *index) removeLocked(signature string) {
+	e, ok := idx.entries[signature]
+	if !ok {
+		return
+	}
+	idx.size -= e.Size
+	delete(idx.entries, signature)
+	idx.dirty = true
+}
+
+// pin pins the contents of the currently applied release of the app, the contents of the release applied before
+// are unpinned
+func (idx *index) pin(app string, releaseID uint32, signatures []string) {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	idx.pins[app] = &Pin{ReleaseID: releaseID, Signatures: signatures}
+	idx.pinnedApps[app] = true
+	idx.dirty = true
+}
+
+// pinned returns the signatures of the pinned contents, the lock should be held
+func (idx *index) pinned() map[string]bool {
+	pinned := make(map[string]bool)
+	for _, p := range idx.pins {
+		for _, sig := range p.Signatures {
+			pinned[sig] = true
+		}
+	}
+	return pinned
+}
+
+// totalSize returns the byte size of the cached contents
+func (idx *index) totalSize() uint64 {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	return idx.size
+}
+
+// count returns the count of the cached contents
+func (idx *index) count() int {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	return len(idx.entries)
+}
+
+// evict evicts the contents by the eviction policy until the size is not larger than the target size, the pinned
+// contents and the contents in use are never evicted. It returns the count and the byte size of the evicted contents.
+func (idx *index) evict(targetSize uint64, locks *signatureLocks) (int, uint64) {
+	idx.lock.Lock()
+	if idx.size <= targetSize {
+		idx.lock.Unlock()
+		return 0, 0
+	}
+	pinned := idx.pinned()
+	candidates := make([]Entry, 0, len(idx.entries))
+	for _, e := range idx.entries {
+		if !pinned[e.Signature] {
+			candidates = append(candidates, *e)
+		}
+	}
+	idx.lock.Unlock()
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if idx.policy == EvictionPolicyLFU && a.Hits != b.Hits {
+			return a.Hits < b.Hits
+		}
+		return a.LastAccess.Before(b.LastAccess)
+	})
+
+	var count int
+	var freed uint64
+	for _, e := range candidates {
+		if idx.totalSize() <= targetSize {
+			break
+		}
+		removed, ok := idx.removeUnused(e, locks)
+		if !ok {
+			continue
+		}
+		logger.Info("deleted file", slog.String("file", filepath.Join(idx.dir, e.Signature)),
+			slog.Uint64("size", removed.Size), slog.Time("last_access", removed.LastAccess),
+			slog.Uint64("hits", removed.Hits))
+		count++
+		freed += removed.Size
+		metrics.FileCacheEvictionCounter.Inc()
+	}
+	if size := idx.totalSize(); size > targetSize {
+		logger.Warn("the file cache is still over the target size, the rest contents are pinned by the applied "+
+			"releases or in use", slog.Uint64("size", size), slog.Uint64("target_size", targetSize))
+	}
+	return count, freed
+}
+
+// removeUnused removes the content chosen to be removed from the cache dir and the index, unless it is in use,
+// pinned or used since it is chosen. It returns the removed entry and whether it is removed.
+func (idx *index) removeUnused(chosen Entry, locks *signatureLocks) (Entry, bool) {
+	// the content being filled, checked or read by others is skipped instead of waited
+	unlock, ok := locks.tryLock(chosen.Signature)
+	if !ok {
+		return Entry{}, false
+	}
+	defer unlock()
+
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	e, ok := idx.entries[chosen.Signature]
+	if !ok || e.LastAccess.After(chosen.LastAccess) || idx.pinned()[chosen.Signature] {
+		return Entry{}, false
+	}
+	filePath := filepath.Join(idx.dir, e.Signature)
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		logger.Error("deleting file failed", slog.String("file", filePath), logger.ErrAttr(err))
+		return Entry{}, false
+	}
+	removed := *e
+	idx.removeLocked(e.Signature)
+	return removed, true
+}
+
+// save persists the index if it is changed since the last save, it is merged with the index persisted by the other
+// processes sharing the cache dir under the file lock, so that their changes are not overwritten.
+func (idx *index) save() error {
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+	if !idx.dirty {
+		return nil
+	}
+	f, err := os.OpenFile(filepath.Join(idx.dir, indexLockFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("open file cache index lock failed, err: %s", err.Error())
+	}
+	defer f.Close()
+	if err = util.LockFile(f); err != nil {
+		return fmt.Errorf("lock file cache index failed, err: %s", err.Error())
+	}
+	defer func() {
+		_ = util.UnlockFile(f)
+	}()
+
+	idx.mergeLocked()
+	data, err := json.Marshal(&indexFile{Entries: idx.entries, Pins: idx.pins})
+	if err != nil {
+		return fmt.Errorf("encode file cache index failed, err: %s", err.Error())
+	}
+	if err := util.WriteFileAtomic(filepath.Join(idx.dir, indexFileName), data, 0644); err != nil {
+		return fmt.Errorf("write file cache index failed, err: %s", err.Error())
+	}
+	idx.dirty = false
+	idx.pinnedApps = make(map[string]bool)
+	return nil
+}
+
+// mergeLocked merges the persisted index into the index, the contents added or removed by the other processes are
+// accounted by the cache dir, and the pins of the apps not pinned since the last save are taken from the persisted
+// index. The lock should be held.
+func (idx *index) mergeLocked() {
+	data, err := os.ReadFile(filepath.Join(idx.dir, indexFileName))
+	if err != nil {
+		return
+	}
+	f := new(indexFile)
+	if err = json.Unmarshal(data, f); err != nil {
+		return
+	}
+	for sig, saved := range f.Entries {
+		e, ok := idx.entries[sig]
+		if !ok {
+			// the content cached by others, the one removed by this process is not added back
+			info, err := os.Stat(filepath.Join(idx.dir, sig))
+			if err != nil || uint64(info.Size()) != saved.Size {
+				continue
+			}
+			saved.Signature = sig
+			idx.entries[sig] = saved
+			idx.size += saved.Size
+			continue
+		}
+		if saved.LastAccess.After(e.LastAccess) {
+			e.LastAccess = saved.LastAccess
+		}
+		if saved.VerifiedAt.After(e.VerifiedAt) {
+			e.VerifiedAt = saved.VerifiedAt
+		}
+		if saved.Hits > e.Hits {
+			e.Hits = saved.Hits
+		}
+	}
+	for sig := range idx.entries {
+		if _, ok := f.Entries[sig]; ok {
+			continue
+		}
+		// the content removed by others
+		if _, err := os.Stat(filepath.Join(idx.dir, sig)); os.IsNotExist(err) {
+			idx.removeLocked(sig)
+		}
+	}
+	for app, p := range f.Pins {
+		if !idx.pinnedApps[app] {
+			idx.pins[app] = p
+		}
+	}
+}
+
+// isSignature returns whether the file name is a SHA256 signature, the other files in the cache dir such as the
+// partial downloaded files and the index are not cached contents
+func isSignature(name string) bool {
+	if len(name) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
@@ -0,0 +1,184 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeContent writes the content into the cache dir and returns its signature
+func writeContent(t *testing.T, dir, content string) string {
+	sum := sha256.Sum256([]byte(content))
+	sig := hex.EncodeToString(sum[:])
+	if err := os.WriteFile(filepath.Join(dir, sig), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func TestIndexEvictLRU(t *testing.T) {
+	dir := t.TempDir()
+	a := writeContent(t, dir, "aaaa")
+	b := writeContent(t, dir, "bbbb")
+	c := writeContent(t, dir, "cccc")
+	// the partial downloaded files are not cached contents
+	if err := os.WriteFile(filepath.Join(dir, a+".part"), []byte("aa"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := loadIndex(dir, EvictionPolicyLRU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := idx.totalSize(); size != 12 {
+		t.Fatalf("expected size 12, got %d", size)
+	}
+
+	// a is the least recently used one but pinned, b is used recently
+	for _, sig := range []string{a, c, b} {
+		idx.touch(sig, 4)
+		time.Sleep(time.Millisecond)
+	}
+	idx.pin("1/app", 1, []string{a})
+	if count, freed := idx.evict(4, new(signatureLocks)); count != 2 || freed != 8 {
+		t.Fatalf("expected 2 contents evicted, got %d, freed %d", count, freed)
+	}
+	for sig, expected := range map[string]bool{a: true, b: false, c: false} {
+		if _, err := os.Stat(filepath.Join(dir, sig)); (err == nil) != expected {
+			t.Errorf("expected content %s exists %v", sig, expected)
+		}
+	}
+
+	if err := idx.save(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadIndex(dir, EvictionPolicyLRU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.entries) != 1 || loaded.entries[a].Hits != 1 || loaded.pins["1/app"] == nil {
+		t.Errorf("expected the index is persisted, got %+v", loaded.entries)
+	}
+}
+
+func TestIndexEvictLFU(t *testing.T) {
+	dir := t.TempDir()
+	a := writeContent(t, dir, "aaaa")
+	b := writeContent(t, dir, "bbbb")
+
+	idx, err := loadIndex(dir, EvictionPolicyLFU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx.touch(a, 4)
+	idx.touch(a, 4)
+	idx.touch(b, 4)
+	if count, _ := idx.evict(4, new(signatureLocks)); count != 1 {
+		t.Fatalf("expected 1 content evicted, got %d", count)
+	}
+	if _, ok := idx.entries[a]; !ok {
+		t.Errorf("expected the frequently used content is kept")
+	}
+}
+
+func TestIndexSaveMerge(t *testing.T) {
+	dir := t.TempDir()
+	a := writeContent(t, dir, "aaaa")
+	b := writeContent(t, dir, "bbbb")
+
+	// two processes share the cache dir
+	idx1, err := loadIndex(dir, EvictionPolicyLRU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx2, err := loadIndex(dir, EvictionPolicyLRU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := writeContent(t, dir, "cccc")
+	idx1.add(c, 4)
+	idx1.touch(a, 4)
+	idx1.pin("1/app1", 1, []string{a})
+	if err = os.Remove(filepath.Join(dir, b)); err != nil {
+		t.Fatal(err)
+	}
+	idx1.remove(b)
+	if err = idx1.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	idx2.touch(a, 4)
+	idx2.touch(a, 4)
+	idx2.pin("1/app2", 2, []string{b})
+	if err = idx2.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadIndex(dir, EvictionPolicyLRU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := loaded.entries[b]; ok {
+		t.Errorf("the content removed by the other process is added back")
+	}
+	if _, ok := loaded.entries[c]; !ok {
+		t.Errorf("the content added by the other process is lost")
+	}
+	if e := loaded.entries[a]; e == nil || e.Hits != 2 {
+		t.Errorf("expected the hits of the content are merged, got %+v", e)
+	}
+	if loaded.pins["1/app1"] == nil || loaded.pins["1/app2"] == nil {
+		t.Errorf("expected the pins of both processes are kept, got %+v", loaded.pins)
+	}
+	if idx2.totalSize() != 8 {
+		t.Errorf("expected the size is merged, got %d", idx2.totalSize())
+	}
+}
+
+func TestIndexEvictInUse(t *testing.T) {
+	dir := t.TempDir()
+	a := writeContent(t, dir, "aaaa")
+	b := writeContent(t, dir, "bbbb")
+	c := writeContent(t, dir, "cccc")
+
+	idx, err := loadIndex(dir, EvictionPolicyLRU)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sig := range []string{a, b, c} {
+		idx.touch(sig, 4)
+		time.Sleep(time.Millisecond)
+	}
+	// a is being filled, b is being read
+	locks := new(signatureLocks)
+	unlock := locks.lock(a)
+	defer unlock()
+	release := locks.hold(b)
+	defer release()
+	if count, freed := idx.evict(0, locks); count != 1 || freed != 4 {
+		t.Fatalf("expected 1 content evicted, got %d, freed %d", count, freed)
+	}
+	if count, _ := idx.removeUnusedSince(time.Now(), locks); count != 0 {
+		t.Fatalf("expected the contents in use are not removed, got %d removed", count)
+	}
+	for sig, expected := range map[string]bool{a: true, b: true, c: false} {
+		if _, err := os.Stat(filepath.Join(dir, sig)); (err == nil) != expected {
+			t.Errorf("expected content %s exists %v", sig, expected)
+		}
+	}
+}
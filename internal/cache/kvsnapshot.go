@@ -0,0 +1,376 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	sfs "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/sf-share"
+	"golang.org/x/exp/slog"
+
+	"github.com/TencentBlueKing/bscp-go/internal/util"
+	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+)
+
+const (
+	// DefaultKvSnapshotMaxSize is the default max byte size of the kv snapshot of each app, which is 10MB
+	DefaultKvSnapshotMaxSize = 10 * 1024 * 1024
+	// kvSnapshotFlushInterval the interval of persisting the changed kv snapshots
+	kvSnapshotFlushInterval = 10 * time.Second
+	// kvTypeSecret is the kv type of the secret values, which are encrypted at rest if the encryption key is set
+	kvTypeSecret = "secret"
+)
+
+var kvSnapshot *KvSnapshot
+
+// EnableKvSnapshot define whether to enable the on-disk kv snapshot
+var EnableKvSnapshot bool
+
+// KvSnapshotOptions options of the on-disk kv snapshot
+type KvSnapshotOptions struct {
+	// Dir the dir of the snapshots, the snapshot of each app is stored in <dir>/<biz>/<app>.json
+	Dir string
+	// MaxSize the max byte size of the snapshot of each app, the largest values are dropped if it is exceeded
+	MaxSize uint64
+	// EncryptionKey the AES key of 16, 24 or 32 bytes, the secret values are encrypted by AES-GCM if it is set,
+	// otherwise they are stored in plain text like the others
+	EncryptionKey []byte
+}
+
+// KvSnapshot is the last known good kv values of the apps persisted on disk, so that the values can be read after
+// a restart while the feed server is unavailable
+type KvSnapshot struct {
+	opts KvSnapshotOptions
+	gcm  cipher.AEAD
+	lock sync.Mutex
+	// apps the snapshots keyed by biz/app
+	apps map[string]*appKvSnapshot
+}
+
+// appKvSnapshot is the kv snapshot of an app
+type appKvSnapshot struct {
+	bizID uint32
+	app   string
+	kvs   map[string]*kvSnapshotEntry
+	dirty bool
+}
+
+// kvSnapshotEntry is a kv in the snapshot, the value of the secret kv is stored in Encrypted if the encryption key
+// is set
+type kvSnapshotEntry struct {
+	KvEntry
+	KvType    string `json:"kv_type,omitempty"`
+	Encrypted []byte `json:"encrypted,omitempty"`
+}
+
+// InitKvSnapshot loads the kv snapshots in the dir and enables the kv snapshot
+func InitKvSnapshot(opts KvSnapshotOptions) error {
+	s, err := newKvSnapshot(opts)
+	if err != nil {
+		return err
+	}
+	EnableKvSnapshot = true
+	kvSnapshot = s
+	return nil
+}
+
+// GetKvSnapshot return the kv snapshot instance
+func GetKvSnapshot() *KvSnapshot {
+	return kvSnapshot
+}
+
+// newKvSnapshot creates the kv snapshot and loads the snapshots in the dir
+func newKvSnapshot(opts KvSnapshotOptions) (*KvSnapshot, error) {
+	if opts.MaxSize == 0 {
+		opts.MaxSize = DefaultKvSnapshotMaxSize
+	}
+	s := &KvSnapshot{opts: opts, apps: make(map[string]*appKvSnapshot)}
+	if len(opts.EncryptionKey) > 0 {
+		block, err := aes.NewCipher(opts.EncryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid kv snapshot encryption key, err: %s", err.Error())
+		}
+		if s.gcm, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(opts.Dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+	if err := s.load(); err != nil {
+		return nil, fmt.Errorf("load kv snapshot failed, err: %s", err.Error())
+	}
+	return s, nil
+}
+
+// load loads the snapshots of all the apps in the dir, the broken snapshot is skipped
+func (s *KvSnapshot) load() error {
+	bizDirs, err := os.ReadDir(s.opts.Dir)
+	if err != nil {
+		return err
+	}
+	for _, bd := range bizDirs {
+		bizID, err := strconv.ParseUint(bd.Name(), 10, 32)
+		if !bd.IsDir() || err != nil {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(s.opts.Dir, bd.Name()))
+		if err != nil {
+			return err
+		}
+		for _, f := range files {
+			if f.IsDir() || filepath.Ext(f.Name()) != ".json" {
+				continue
+			}
+			app := strings.TrimSuffix(f.Name(), ".json")
+			as, err := s.loadApp(uint32(bizID), app)
+			if err != nil {
+				logger.Warn("load kv snapshot failed, skip it", slog.Uint64("biz", bizID), slog.String("app", app),
+					logger.ErrAttr(err))
+				continue
+			}
+			s.apps[snapshotKey(as.bizID, as.app)] = as
+		}
+	}
+	return nil
+}
+
+// loadApp loads the snapshot of the app, the secret values which can not be decrypted are skipped
+func (s *KvSnapshot) loadApp(bizID uint32, app string) (*appKvSnapshot, error) {
+	data, err := os.ReadFile(s.appFile(bizID, app))
+	if err != nil {
+		return nil, err
+	}
+	kvs := make(map[string]*kvSnapshotEntry)
+	if err := json.Unmarshal(data, &kvs); err != nil {
+		return nil, err
+	}
+	for key, e := range kvs {
+		if e.Encrypted == nil {
+			continue
+		}
+		value, err := s.decrypt(e.Encrypted)
+		if err != nil {
+			logger.Warn("decrypt kv snapshot value failed, skip it", slog.String("app", app), slog.String("key", key),
+				logger.ErrAttr(err))
+			delete(kvs, key)
+			continue
+		}
+		e.Value, e.Encrypted = value, nil
+	}
+	for _, e := range kvs {
+		e.FromSnapshot = true
+	}
+	return &appKvSnapshot{bizID: bizID, app: app, kvs: kvs}, nil
+}
+
+// Range calls fn with each kv in the snapshots, e.g. to fill the in-memory cache on start
+func (s *KvSnapshot) Range(fn func(bizID uint32, app, key string, e KvEntry)) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, as := range s.apps {
+		for key, e := range as.kvs {
+			fn(as.bizID, as.app, key, e.KvEntry)
+		}
+	}
+}
+
+// Set records the value and the type of the kv got from the feed server, it is persisted by the next flush, the
+// secret value is encrypted when persisted
+func (s *KvSnapshot) Set(bizID uint32, app, key, kvType string, e KvEntry) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	as := s.appLocked(bizID, app)
+	old, ok := as.kvs[key]
+	if !ok {
+		old = new(kvSnapshotEntry)
+		as.kvs[key] = old
+	}
+	e.FromSnapshot = false
+	old.KvEntry = e
+	old.KvType = kvType
+	as.dirty = true
+}
+
+// Sync makes the snapshot of the app consistent with the kvs of the release pulled or received by watch, the
+// deleted kvs are removed and the kv types are updated, the snapshot is persisted by the next flush. The values of
+// the changed kvs are kept as the last known good values until they are got again.
+func (s *KvSnapshot) Sync(bizID uint32, app string, kvs []*sfs.KvMetaV1) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	as := s.appLocked(bizID, app)
+	released := make(map[string]string, len(kvs))
+	for _, kv := range kvs {
+		released[kv.Key] = kv.KvType
+	}
+	for key, e := range as.kvs {
+		kvType, ok := released[key]
+		if !ok {
+			delete(as.kvs, key)
+			as.dirty = true
+			continue
+		}
+		if e.KvType != kvType {
+			e.KvType = kvType
+			as.dirty = true
+		}
+	}
+}
+
+// Flush persists the changed snapshots
+func (s *KvSnapshot) Flush() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var errs []error
+	for _, as := range s.apps {
+		if !as.dirty {
+			continue
+		}
+		if err := s.saveLocked(as); err != nil {
+			errs = append(errs, fmt.Errorf("save kv snapshot of app %s failed, err: %s", as.app, err.Error()))
+			continue
+		}
+		as.dirty = false
+	}
+	return errors.Join(errs...)
+}
+
+// AutoFlushKvSnapshot persists the changed snapshots periodically
+func AutoFlushKvSnapshot() {
+	for {
+		time.Sleep(kvSnapshotFlushInterval)
+		if err := kvSnapshot.Flush(); err != nil {
+			logger.Warn("flush kv snapshot failed", logger.ErrAttr(err))
+		}
+	}
+}
+
+// saveLocked persists the snapshot of the app, the secret values are encrypted if the encryption key is set and the
+// largest values are dropped if the max size is exceeded. The lock should be held.
+func (s *KvSnapshot) saveLocked(as *appKvSnapshot) error {
+	kvs := make(map[string]*kvSnapshotEntry, len(as.kvs))
+	for key, e := range as.kvs {
+		out := &kvSnapshotEntry{KvEntry: e.KvEntry, KvType: e.KvType}
+		out.FromSnapshot = false
+		if e.KvType == kvTypeSecret && s.gcm != nil {
+			encrypted, err := s.encrypt(e.Value)
+			if err != nil {
+				return err
+			}
+			out.Value, out.Encrypted = "", encrypted
+		}
+		kvs[key] = out
+	}
+
+	data, err := json.Marshal(kvs)
+	if err != nil {
+		return err
+	}
+	if uint64(len(data)) > s.opts.MaxSize {
+		if data, err = s.shrink(as.app, kvs, uint64(len(data))); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.appFile(as.bizID, as.app)), os.ModePerm); err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(s.appFile(as.bizID, as.app), data, 0600)
+}
+
+// shrink drops the largest values until the encoded snapshot is not larger than the max size
+func (s *KvSnapshot) shrink(app string, kvs map[string]*kvSnapshotEntry, size uint64) ([]byte, error) {
+	keys := make([]string, 0, len(kvs))
+	for key := range kvs {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return entrySize(kvs[keys[i]]) > entrySize(kvs[keys[j]])
+	})
+	var dropped []string
+	for _, key := range keys {
+		if size <= s.opts.MaxSize {
+			break
+		}
+		size -= uint64(len(key)) + entrySize(kvs[key])
+		delete(kvs, key)
+		dropped = append(dropped, key)
+	}
+	logger.Warn("the kv snapshot exceeds the max size, drop the largest values", slog.String("app", app),
+		slog.Uint64("max_size", s.opts.MaxSize), slog.Any("dropped", dropped))
+	return json.Marshal(kvs)
+}
+
+// entrySize returns the approximate encoded byte size of the kv
+func entrySize(e *kvSnapshotEntry) uint64 {
+	// the encrypted value is base64 encoded
+	return uint64(len(e.Md5) + len(e.KvType) + len(e.Value) + len(e.Encrypted)*4/3)
+}
+
+// encrypt encrypts the value by AES-GCM, the random nonce is prepended to the cipher text
+func (s *KvSnapshot) encrypt(value string) ([]byte, error) {
+	nonce := make([]byte, s.gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return s.gcm.Seal(nonce, nonce, []byte(value), nil), nil
+}
+
+// decrypt decrypts the value encrypted by encrypt
+func (s *KvSnapshot) decrypt(data []byte) (string, error) {
+	if s.gcm == nil {
+		return "", errors.New("the encryption key is not set")
+	}
+	if len(data) < s.gcm.NonceSize() {
+		return "", errors.New("the encrypted value is too short")
+	}
+	nonce, cipherText := data[:s.gcm.NonceSize()], data[s.gcm.NonceSize():]
+	plain, err := s.gcm.Open(nil, nonce, cipherText, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plain), nil
+}
+
+// appLocked returns the snapshot of the app, it is created if not exists. The lock should be held.
+func (s *KvSnapshot) appLocked(bizID uint32, app string) *appKvSnapshot {
+	key := snapshotKey(bizID, app)
+	as, ok := s.apps[key]
+	if !ok {
+		as = &appKvSnapshot{bizID: bizID, app: app, kvs: make(map[string]*kvSnapshotEntry)}
+		s.apps[key] = as
+	}
+	return as
+}
+
+// appFile returns the snapshot file path of the app
+func (s *KvSnapshot) appFile(bizID uint32, app string) string {
+	return filepath.Join(s.opts.Dir, strconv.FormatUint(uint64(bizID), 10), app+".json")
+}
+
+// snapshotKey returns the key of the app snapshot, which is biz/app
+func snapshotKey(bizID uint32, app string) string {
+	return fmt.Sprintf("%d/%s", bizID, app)
+}
@@ -0,0 +1,114 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	sfs "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/sf-share"
+)
+
+func TestKvSnapshotRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	key := bytes.Repeat([]byte{1}, 32)
+	s, err := newKvSnapshot(KvSnapshotOptions{Dir: dir, EncryptionKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Set(1, "app", "plain", "", KvEntry{Md5: "md5-plain", Value: "plain-value"})
+	s.Set(1, "app", "secret", "", KvEntry{Md5: "md5-secret", Value: "secret-value"})
+	s.Set(1, "app", "deleted", "", KvEntry{Md5: "md5-deleted", Value: "deleted-value"})
+	s.Sync(1, "app", []*sfs.KvMetaV1{{Key: "plain", KvType: "string"}, {Key: "secret", KvType: kvTypeSecret}})
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(s.appFile(1, "app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "secret-value") {
+		t.Error("the secret value is stored in plain text")
+	}
+	if strings.Contains(string(data), "deleted") {
+		t.Error("the deleted kv is not removed")
+	}
+
+	loaded, err := newKvSnapshot(KvSnapshotOptions{Dir: dir, EncryptionKey: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	loaded.Range(func(bizID uint32, app, key string, e KvEntry) {
+		if !e.FromSnapshot {
+			t.Errorf("the kv %s is not marked as loaded from snapshot", key)
+		}
+		got[key] = e.Md5 + ":" + e.Value
+	})
+	want := map[string]string{"plain": "md5-plain:plain-value", "secret": "md5-secret:secret-value"}
+	if len(got) != len(want) || got["plain"] != want["plain"] || got["secret"] != want["secret"] {
+		t.Errorf("loaded kvs %v, want %v", got, want)
+	}
+
+	// the secret value can not be loaded without the key
+	noKey, err := newKvSnapshot(KvSnapshotOptions{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	noKey.Range(func(bizID uint32, app, key string, e KvEntry) {
+		if key == "secret" {
+			t.Error("the secret value is loaded without the encryption key")
+		}
+	})
+}
+
+func TestKvSnapshotSetSecret(t *testing.T) {
+	s, err := newKvSnapshot(KvSnapshotOptions{Dir: t.TempDir(), EncryptionKey: bytes.Repeat([]byte{1}, 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the secret got for the first time is not synced yet
+	s.Set(1, "app", "secret", kvTypeSecret, KvEntry{Md5: "md5-secret", Value: "secret-value"})
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(s.appFile(1, "app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "secret-value") || !strings.Contains(string(data), `"encrypted"`) {
+		t.Errorf("the secret value is not encrypted, got %s", data)
+	}
+}
+
+func TestKvSnapshotMaxSize(t *testing.T) {
+	s, err := newKvSnapshot(KvSnapshotOptions{Dir: t.TempDir(), MaxSize: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Set(1, "app", "small", "string", KvEntry{Md5: "md5", Value: "v"})
+	s.Set(1, "app", "large", "string", KvEntry{Md5: "md5", Value: strings.Repeat("v", 500)})
+	if err := s.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(s.appFile(1, "app"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) > 200 || !strings.Contains(string(data), "small") || strings.Contains(string(data), "large") {
+		t.Errorf("the largest value is not dropped, got %s", data)
+	}
+}
@@ -0,0 +1,153 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+)
+
+// Reference is an applied release which references a cached content
+type Reference struct {
+	// App the app of the release, which is in the format of biz/app
+	App string
+	// ReleaseID the release id
+	ReleaseID uint32
+}
+
+// EntryInfo is a cached content with the applied releases which reference it
+type EntryInfo struct {
+	Entry
+	// References the applied releases which reference the content, the referenced content is never evicted
+	References []Reference
+}
+
+// Stats is the statistics of the file cache
+type Stats struct {
+	// Entries the count of the cached contents
+	Entries int
+	// Size the byte size of the cached contents
+	Size uint64
+	// ThresholdSize the byte size which triggers the cleanup
+	ThresholdSize uint64
+	// PinnedEntries the count of the contents referenced by the applied releases
+	PinnedEntries int
+	// PinnedSize the byte size of the contents referenced by the applied releases
+	PinnedSize uint64
+	// Hits the total uses of the cached contents
+	Hits uint64
+	// Quarantined the count of the corrupt contents in the quarantine dir
+	Quarantined int
+	// Policy the eviction policy
+	Policy string
+}
+
+// Entries returns the cached contents, the least recently used first
+func (c *Cache) Entries() []EntryInfo {
+	idx := c.index
+	idx.lock.Lock()
+	defer idx.lock.Unlock()
+
+	refs := make(map[string][]Reference)
+	for app, p := range idx.pins {
+		for _, sig := range p.Signatures {
+			refs[sig] = append(refs[sig], Reference{App: app, ReleaseID: p.ReleaseID})
+		}
+	}
+	infos := make([]EntryInfo, 0, len(idx.entries))
+	for sig, e := range idx.entries {
+		r := refs[sig]
+		sort.Slice(r, func(i, j int) bool { return r[i].App < r[j].App })
+		infos = append(infos, EntryInfo{Entry: *e, References: r})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].LastAccess.Before(infos[j].LastAccess)
+	})
+	return infos
+}
+
+// Stats returns the statistics of the file cache
+func (c *Cache) Stats() Stats {
+	idx := c.index
+	idx.lock.Lock()
+	stats := Stats{
+		Entries:       len(idx.entries),
+		Size:          idx.size,
+		ThresholdSize: uint64(c.thrsholdGB * GByte),
+		Policy:        idx.policy,
+	}
+	pinned := idx.pinned()
+	for sig, e := range idx.entries {
+		stats.Hits += e.Hits
+		if pinned[sig] {
+			stats.PinnedEntries++
+			stats.PinnedSize += e.Size
+		}
+	}
+	idx.lock.Unlock()
+
+	if entries, err := os.ReadDir(filepath.Join(c.path, quarantineDirName)); err == nil {
+		stats.Quarantined = len(entries)
+	}
+	return stats
+}
+
+// Prune removes the contents not used within olderThan, then evicts the contents by the eviction policy until the
+// size is not larger than maxSize, the zero values mean no limit. The contents referenced by the applied releases
+// are never removed. It returns the count and the byte size of the removed contents.
+func (c *Cache) Prune(maxSize uint64, olderThan time.Duration) (int, uint64) {
+	var count int
+	var freed uint64
+	if olderThan > 0 {
+		count, freed = c.index.removeUnusedSince(time.Now().Add(-olderThan), &c.locks)
+	}
+	if maxSize > 0 {
+		n, size := c.index.evict(maxSize, &c.locks)
+		count += n
+		freed += size
+	}
+	if err := c.index.save(); err != nil {
+		logger.Warn("save file cache index failed", logger.ErrAttr(err))
+	}
+	return count, freed
+}
+
+// removeUnusedSince removes the contents not used since the time, the pinned contents and the contents in use are
+// never removed
+func (idx *index) removeUnusedSince(since time.Time, locks *signatureLocks) (int, uint64) {
+	idx.lock.Lock()
+	pinned := idx.pinned()
+	candidates := make([]Entry, 0)
+	for sig, e := range idx.entries {
+		if !pinned[sig] && e.LastAccess.Before(since) {
+			candidates = append(candidates, *e)
+		}
+	}
+	idx.lock.Unlock()
+
+	var count int
+	var freed uint64
+	for _, e := range candidates {
+		removed, ok := idx.removeUnused(e, locks)
+		if !ok {
+			continue
+		}
+		count++
+		freed += removed.Size
+	}
+	return count, freed
+}
@@ -14,9 +14,13 @@ package cache
 
 import (
 	"context"
+	"encoding/json"
 	"time"
 
+	pbbase "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/core/base"
 	"github.com/allegro/bigcache/v3"
+
+	"github.com/TencentBlueKing/bscp-go/pkg/metrics"
 )
 
 var mc *bigcache.BigCache
@@ -43,6 +47,16 @@ func InitMemCache(thresholdMb float64) error {
 		// if value is reached then the oldest entries can be overridden for the new ones
 		// 0 value means no size limit
 		HardMaxCacheSize: int(thresholdMb),
+
+		// count the evicted entries, the deleted ones are not evictions
+		OnRemoveWithReason: func(key string, entry []byte, reason bigcache.RemoveReason) {
+			switch reason {
+			case bigcache.NoSpace:
+				metrics.KvCacheEvictionCounter.WithLabelValues("no_space").Inc()
+			case bigcache.Expired:
+				metrics.KvCacheEvictionCounter.WithLabelValues("expired").Inc()
+			}
+		},
 	}
 
 	var err error
@@ -50,6 +64,11 @@ func InitMemCache(thresholdMb float64) error {
 	if err != nil {
 		return err
 	}
+	c := mc
+	metrics.KvCacheHits.Set(func() float64 { return float64(c.Stats().Hits) })
+	metrics.KvCacheMisses.Set(func() float64 { return float64(c.Stats().Misses) })
+	metrics.KvCacheEntries.Set(func() float64 { return float64(c.Len()) })
+	metrics.KvCacheCapacityBytes.Set(func() float64 { return float64(c.Capacity()) })
 	return nil
 }
 
@@ -57,3 +76,41 @@ func InitMemCache(thresholdMb float64) error {
 func GetMemCache() *bigcache.BigCache {
 	return mc
 }
+
+// KvEntry is a kv value in the in-memory cache and the kv snapshot with the metadata of the fetch
+type KvEntry struct {
+	// Md5 the md5 of the value
+	Md5 string `json:"md5"`
+	// Value the kv value
+	Value string `json:"value,omitempty"`
+	// ReleaseID the release id which the value is fetched from, 0 if unknown
+	ReleaseID uint32 `json:"release_id,omitempty"`
+	// Revision the revision of the kv, nil if unknown
+	Revision *pbbase.Revision `json:"revision,omitempty"`
+	// FetchedAt the time the value is fetched from the feed server
+	FetchedAt time.Time `json:"fetched_at"`
+	// FromSnapshot whether the value is loaded from the kv snapshot on start rather than fetched by this process
+	FromSnapshot bool `json:"from_snapshot,omitempty"`
+}
+
+// SetKvEntry sets the kv entry into the in-memory cache
+func SetKvEntry(key string, e *KvEntry) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return mc.Set(key, data)
+}
+
+// GetKvEntry gets the kv entry from the in-memory cache, bigcache.ErrEntryNotFound is returned if not found
+func GetKvEntry(key string) (*KvEntry, error) {
+	data, err := mc.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	e := new(KvEntry)
+	if err := json.Unmarshal(data, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
@@ -0,0 +1,74 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/allegro/bigcache/v3"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/TencentBlueKing/bscp-go/pkg/metrics"
+)
+
+func TestKvCacheMetrics(t *testing.T) {
+	if err := InitMemCache(1); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { EnableMemCache = false })
+	reg := newTestRegistry(t)
+	// the counter of the label is not gathered until it is counted
+	evictions := testutil.ToFloat64(metrics.KvCacheEvictionCounter.WithLabelValues("no_space"))
+
+	// the hit and the miss of the lookups are counted
+	if err := SetKvEntry("key", &KvEntry{Md5: "md5", Value: "value", ReleaseID: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetKvEntry("key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := GetKvEntry("missing"); !errors.Is(err, bigcache.ErrEntryNotFound) {
+		t.Fatalf("expected the missing key is not found, err: %v", err)
+	}
+	if got := gatherValue(t, reg, "bscp_go_total_kv_cache_hit_count"); got != 1 {
+		t.Errorf("kv cache hits = %v, want 1", got)
+	}
+	if got := gatherValue(t, reg, "bscp_go_total_kv_cache_miss_count"); got != 1 {
+		t.Errorf("kv cache misses = %v, want 1", got)
+	}
+	if got := gatherValue(t, reg, "bscp_go_kv_cache_entries"); got != 1 {
+		t.Errorf("kv cache entries = %v, want 1", got)
+	}
+	// the capacity is the memory allocated by the shards rather than the size of the kvs
+	capacity := gatherValue(t, reg, "bscp_go_kv_cache_capacity_bytes")
+	if capacity < float64(len("value")) {
+		t.Errorf("kv cache capacity bytes = %v, want the allocated memory", capacity)
+	}
+
+	// the oldest kvs are evicted once the cache is full
+	value := strings.Repeat("v", 400)
+	for i := 0; i < 10000; i++ {
+		if err := SetKvEntry(fmt.Sprintf("key-%d", i), &KvEntry{Value: value}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := gatherValue(t, reg, "bscp_go_total_kv_cache_eviction_count", "no_space") - evictions; got <= 0 {
+		t.Errorf("kv cache evictions = %v, want the kvs evicted for no space", got)
+	}
+	if got := gatherValue(t, reg, "bscp_go_kv_cache_entries"); got >= 10000 {
+		t.Errorf("kv cache entries = %v, want less than the kvs set", got)
+	}
+}
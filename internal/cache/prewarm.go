@@ -0,0 +1,147 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"encoding/json"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	sfs "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/sf-share"
+	"github.com/dustin/go-humanize"
+	"golang.org/x/exp/slog"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/TencentBlueKing/bscp-go/internal/downloader"
+	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+)
+
+// prewarmConcurrency the max count of the contents downloaded concurrently by a pre-warm
+const prewarmConcurrency = 5
+
+// signatureLocks serializes the filling of the same content, so that the pre-warm and the apply of a release never
+// download the same content twice or check it while it is being filled. The content in use is never evicted.
+type signatureLocks struct {
+	mu    sync.Mutex
+	locks map[string]*signatureLock
+}
+
+// signatureLock is the lock of a content with the count of its holders, waiters and readers
+type signatureLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock locks the content of the signature and returns the unlock func
+func (l *signatureLocks) lock(signature string) func() {
+	sl := l.ref(signature)
+	sl.Lock()
+	return func() {
+		sl.Unlock()
+		l.unref(signature, sl)
+	}
+}
+
+// tryLock locks the content of the signature if it is not in use, it returns false if it is locked, waited or read
+func (l *signatureLocks) tryLock(signature string) (func(), bool) {
+	l.mu.Lock()
+	if _, ok := l.locks[signature]; ok {
+		l.mu.Unlock()
+		return nil, false
+	}
+	l.mu.Unlock()
+	return l.lock(signature), true
+}
+
+// hold marks the content of the signature in use without locking it, e.g. it is read by a stream, so that it is not
+// evicted. It returns the release func.
+func (l *signatureLocks) hold(signature string) func() {
+	sl := l.ref(signature)
+	return func() {
+		l.unref(signature, sl)
+	}
+}
+
+// ref returns the lock of the signature with its refs increased
+func (l *signatureLocks) ref(signature string) *signatureLock {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.locks == nil {
+		l.locks = make(map[string]*signatureLock)
+	}
+	sl, ok := l.locks[signature]
+	if !ok {
+		sl = new(signatureLock)
+		l.locks[signature] = sl
+	}
+	sl.refs++
+	return sl
+}
+
+// unref decreases the refs of the lock, the lock is deleted if it is not used
+func (l *signatureLocks) unref(signature string, sl *signatureLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	sl.refs--
+	if sl.refs == 0 {
+		delete(l.locks, signature)
+	}
+}
+
+// OnReleaseChange pre-warms the cache when the release change event is received, the missing contents of the
+// release are downloaded into the cache in background with the low priority, so that applying the release is a local
+// copy. The contents larger than the single file limit are skipped. The returned chan is closed once it is done.
+func (c *Cache) OnReleaseChange(event *sfs.ReleaseChangeEvent, opts ...downloader.DownloadOption) <-chan struct{} {
+	done := make(chan struct{})
+	pl := new(sfs.ReleaseChangePayload)
+	if err := json.Unmarshal(event.Payload, pl); err != nil {
+		logger.Error("decode release change event payload failed, skip pre-warming the cache",
+			logger.ErrAttr(err), slog.String("rid", event.Rid))
+		close(done)
+		return done
+	}
+
+	opts = append(opts, downloader.WithPriority(downloader.PriorityLow))
+	go func() {
+		defer close(done)
+		start := time.Now()
+		var warmed, failed int32
+		var size uint64
+		g := new(errgroup.Group)
+		g.SetLimit(prewarmConcurrency)
+		for _, ci := range pl.ReleaseMeta.CIMetas {
+			ci := ci
+			if ci.ContentSpec.ByteSize > uint64(MaxSingleFileCacheSizeRate*c.thrsholdGB*GByte) {
+				continue
+			}
+			g.Go(func() error {
+				if err := c.Warm(ci, opts...); err != nil {
+					atomic.AddInt32(&failed, 1)
+					logger.Warn("pre-warm config item cache failed", slog.String("rid", event.Rid),
+						slog.String("signature", ci.ContentSpec.Signature), logger.ErrAttr(err))
+					return nil
+				}
+				atomic.AddInt32(&warmed, 1)
+				atomic.AddUint64(&size, ci.ContentSpec.ByteSize)
+				return nil
+			})
+		}
+		_ = g.Wait()
+		logger.Info("pre-warm file cache done", slog.String("rid", event.Rid),
+			slog.Any("releaseID", pl.ReleaseMeta.ReleaseID), slog.Int("warmed", int(warmed)),
+			slog.Int("failed", int(failed)), slog.String("size", humanize.IBytes(size)),
+			slog.String("cost", time.Since(start).String()))
+	}()
+	return done
+}
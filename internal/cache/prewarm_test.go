@@ -0,0 +1,54 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSignatureLocks(t *testing.T) {
+	var locks signatureLocks
+	var holders, maxHolders int32
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock := locks.lock("sig")
+			defer unlock()
+			n := atomic.AddInt32(&holders, 1)
+			if n > atomic.LoadInt32(&maxHolders) {
+				atomic.StoreInt32(&maxHolders, n)
+			}
+			time.Sleep(time.Millisecond)
+			atomic.AddInt32(&holders, -1)
+		}()
+	}
+	wg.Wait()
+
+	if maxHolders != 1 {
+		t.Errorf("the lock of the same signature is held by %d holders at the same time", maxHolders)
+	}
+	if len(locks.locks) != 0 {
+		t.Errorf("the unused locks are not released, got %d", len(locks.locks))
+	}
+
+	// the locks of different signatures do not block each other
+	unlockA := locks.lock("a")
+	unlockB := locks.lock("b")
+	unlockB()
+	unlockA()
+}
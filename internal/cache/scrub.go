@@ -0,0 +1,185 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"golang.org/x/exp/slog"
+
+	"github.com/TencentBlueKing/bscp-go/internal/downloader"
+	"github.com/TencentBlueKing/bscp-go/internal/util"
+	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+	"github.com/TencentBlueKing/bscp-go/pkg/metrics"
+)
+
+const (
+	// quarantineDirName is the dir name in the cache dir which the corrupt contents are moved into
+	quarantineDirName = ".quarantine"
+
+	// DefaultScrubInterval is the default interval of the scrub rounds
+	DefaultScrubInterval = time.Hour
+	// DefaultVerifiedTTL is the default duration in which a verified content is not hashed again on lookup
+	DefaultVerifiedTTL = 24 * time.Hour
+)
+
+// ScrubOptions options of verifying the cached contents, the zero values are replaced by the defaults
+type ScrubOptions struct {
+	// Interval the interval of the scrub rounds, each round verifies the contents not verified within the interval
+	Interval time.Duration
+	// Rate the bytes hashed per second by the scrubber, 0 means no limit
+	Rate int64
+	// VerifiedTTL the lookups skip hashing the content verified within the ttl
+	VerifiedTTL time.Duration
+	// Quarantine is whether move the corrupt contents into the quarantine dir instead of deleting them
+	Quarantine bool
+}
+
+// withDefaults returns the options with the zero values replaced by the defaults
+func (o ScrubOptions) withDefaults() ScrubOptions {
+	if o.Interval <= 0 {
+		o.Interval = DefaultScrubInterval
+	}
+	if o.VerifiedTTL <= 0 {
+		o.VerifiedTTL = DefaultVerifiedTTL
+	}
+	return o
+}
+
+// VerifyResult is the result of verifying the cached contents
+type VerifyResult struct {
+	// Checked the count of the verified contents
+	Checked int
+	// CheckedBytes the byte size of the verified contents
+	CheckedBytes uint64
+	// Corrupt the signatures of the corrupt contents, which are quarantined or deleted
+	Corrupt []string
+}
+
+// Verify verifies all the cached contents by hashing them, the corrupt contents are quarantined or deleted.
+func (c *Cache) Verify(ctx context.Context) (*VerifyResult, error) {
+	return c.verify(ctx, time.Now(), nil)
+}
+
+// verify verifies the contents not verified since the time, the hashing rate is limited by the limiter
+func (c *Cache) verify(ctx context.Context, since time.Time, limiter *downloader.Limiter) (*VerifyResult, error) {
+	result := new(VerifyResult)
+	for _, e := range c.index.unverifiedSince(since) {
+		if err := ctx.Err(); err != nil {
+			return result, err
+		}
+		err := verifyFile(ctx, filepath.Join(c.path, e.Signature), e.Size, e.Signature, limiter)
+		if os.IsNotExist(err) {
+			c.index.remove(e.Signature)
+			continue
+		}
+		result.Checked++
+		result.CheckedBytes += e.Size
+		if err != nil {
+			if ctx.Err() != nil {
+				return result, ctx.Err()
+			}
+			c.handleCorrupt(e.Signature, err)
+			result.Corrupt = append(result.Corrupt, e.Signature)
+			continue
+		}
+		c.index.verified(e.Signature)
+	}
+	if err := c.index.save(); err != nil {
+		logger.Warn("save file cache index failed", logger.ErrAttr(err))
+	}
+	return result, nil
+}
+
+// AutoScrubFileCache verifies the cached contents periodically at the limited rate, so that the corrupt contents
+// are found before they are used, and the lookups of the verified contents skip hashing.
+func AutoScrubFileCache() {
+	c := instance
+	logger.Info("start auto scrub file cache", slog.String("cacheDir", c.path),
+		slog.String("interval", c.scrub.Interval.String()), slog.String("rate", humanize.IBytes(uint64(c.scrub.Rate))),
+		slog.Bool("quarantine", c.scrub.Quarantine))
+
+	limiter := downloader.NewLimiter(c.scrub.Rate)
+	for {
+		start := time.Now()
+		result, err := c.verify(context.Background(), start.Add(-c.scrub.Interval), limiter)
+		if err != nil {
+			logger.Error("scrub file cache failed", logger.ErrAttr(err))
+		} else if result.Checked > 0 {
+			logger.Info("scrub file cache done", slog.Int("checked", result.Checked),
+				slog.String("checkedBytes", humanize.IBytes(result.CheckedBytes)),
+				slog.Int("corrupt", len(result.Corrupt)), slog.String("cost", time.Since(start).String()))
+		}
+		time.Sleep(c.scrub.Interval)
+	}
+}
+
+// handleCorrupt removes the corrupt content from the cache, it is moved into the quarantine dir for troubleshooting
+// if quarantine is enabled, otherwise it is deleted
+func (c *Cache) handleCorrupt(signature string, reason error) {
+	c.index.remove(signature)
+	metrics.FileCacheCorruptCounter.Inc()
+	filePath := filepath.Join(c.path, signature)
+	if c.scrub.Quarantine {
+		dir := filepath.Join(c.path, quarantineDirName)
+		if err := os.MkdirAll(dir, os.ModePerm); err == nil {
+			if err = os.Rename(filePath, filepath.Join(dir, signature)); err == nil {
+				logger.Warn("the cached content is corrupt, quarantine it", slog.String("file", filePath),
+					slog.String("quarantine_dir", dir), logger.ErrAttr(reason))
+				return
+			}
+		}
+	}
+	if err := os.Remove(filePath); err != nil && !os.IsNotExist(err) {
+		logger.Error("delete the corrupt cached content failed", slog.String("file", filePath), logger.ErrAttr(err))
+		return
+	}
+	logger.Warn("the cached content is corrupt, delete it", slog.String("file", filePath), logger.ErrAttr(reason))
+}
+
+// verifyFile verifies the byte size and the SHA256 signature of the file, the hashing rate is limited by the limiter
+func verifyFile(ctx context.Context, filePath string, size uint64, signature string,
+	limiter *downloader.Limiter) error {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	r := util.NewVerifyReader(file, size, signature)
+	defer r.Close()
+	_, err = io.Copy(io.Discard, &limitedReader{ctx: ctx, r: r, limiter: limiter})
+	return err
+}
+
+// limitedReader is a reader whose rate is limited by the limiter
+type limitedReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *downloader.Limiter
+}
+
+// Read reads the content and waits for the limiter
+func (l *limitedReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if n > 0 {
+		if e := l.limiter.WaitN(l.ctx, n); e != nil {
+			return n, fmt.Errorf("wait for the scrub rate limit failed, err: %s", e.Error())
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,51 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package cache
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestVerifyQuarantine(t *testing.T) {
+	dir := t.TempDir()
+	good := writeContent(t, dir, "good")
+	bad := writeContent(t, dir, "bad")
+	if err := os.WriteFile(filepath.Join(dir, bad), []byte("broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := New(dir, 1, EvictionPolicyLRU, ScrubOptions{Quarantine: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := c.Verify(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Checked != 2 || len(result.Corrupt) != 1 || result.Corrupt[0] != bad {
+		t.Fatalf("expected 1 corrupt content of 2, got %+v", result)
+	}
+	if _, err := os.Stat(filepath.Join(dir, quarantineDirName, bad)); err != nil {
+		t.Errorf("expected the corrupt content is quarantined, err: %v", err)
+	}
+	if !c.index.verifiedWithin(good, 4, time.Minute) {
+		t.Errorf("expected the verification time of the good content is recorded")
+	}
+	if _, ok := c.index.entries[bad]; ok {
+		t.Errorf("expected the corrupt content is removed from the index")
+	}
+}
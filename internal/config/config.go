@@ -17,7 +17,12 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strconv"
 	"strings"
 
 	"github.com/spf13/viper"
@@ -76,6 +81,22 @@ type ClientConfig struct {
 	EnableMonitorResourceUsage bool `json:"enable_resource" mapstructure:"enable_resource"`
 	// TextLineBreak 文本文件换行符
 	TextLineBreak string `json:"text_line_break" mapstructure:"text_line_break"`
+	// VersionedDir versioned release directory layout config
+	VersionedDir *VersionedDirConfig `json:"versioned_dir" mapstructure:"versioned_dir"`
+	// AutoRollback 后置脚本执行失败时是否自动回滚到上一个版本
+	AutoRollback bool `json:"auto_rollback" mapstructure:"auto_rollback"`
+	// FileDeletion config for deleting the files which are not in the release
+	FileDeletion *FileDeletionConfig `json:"file_deletion" mapstructure:"file_deletion"`
+	// Download download bandwidth and priority config
+	Download *DownloadConfig `json:"download" mapstructure:"download"`
+	// Sources content sources tried in order before the feed server
+	Sources []*SourceConfig `json:"sources" mapstructure:"sources"`
+	// SharedStore node local shared store config
+	SharedStore *SharedStoreConfig `json:"shared_store" mapstructure:"shared_store"`
+	// HTTPTransport http transport config for downloading from the repository
+	HTTPTransport *HTTPTransportConfig `json:"http_transport" mapstructure:"http_transport"`
+	// P2PDownload p2p download threshold, polling and staging dir config
+	P2PDownload *P2PDownloadConfig `json:"p2p_download" mapstructure:"p2p_download"`
 }
 
 // String get config string
@@ -254,6 +275,47 @@ func (c *ClientConfig) ValidateBase() error {
 	if err := c.KvCache.Validate(); err != nil {
 		return err
 	}
+	if c.FileDeletion == nil {
+		c.FileDeletion = new(FileDeletionConfig)
+	}
+	if err := c.FileDeletion.Validate(); err != nil {
+		return err
+	}
+	if c.VersionedDir == nil {
+		c.VersionedDir = new(VersionedDirConfig)
+	}
+	if err := c.VersionedDir.Validate(); err != nil {
+		return err
+	}
+	if c.Download == nil {
+		c.Download = new(DownloadConfig)
+	}
+	if err := c.Download.Validate(); err != nil {
+		return err
+	}
+	for _, s := range c.Sources {
+		if err := s.Validate(); err != nil {
+			return err
+		}
+	}
+	if c.SharedStore == nil {
+		c.SharedStore = new(SharedStoreConfig)
+	}
+	if err := c.SharedStore.Validate(); err != nil {
+		return err
+	}
+	if c.HTTPTransport == nil {
+		c.HTTPTransport = new(HTTPTransportConfig)
+	}
+	if err := c.HTTPTransport.Validate(); err != nil {
+		return err
+	}
+	if c.P2PDownload == nil {
+		c.P2PDownload = new(P2PDownloadConfig)
+	}
+	if err := c.P2PDownload.Validate(); err != nil {
+		return err
+	}
 
 	return nil
 }
@@ -289,6 +351,12 @@ type AppConfig struct {
 	UID string `json:"uid" mapstructure:"uid"`
 	// ConfigMatches app config item's match conditions
 	ConfigMatches []string `json:"config_matches" mapstructure:"config_matches"`
+	// AutoRollback overwrites the global auto rollback config for the app if set
+	AutoRollback *bool `json:"auto_rollback" mapstructure:"auto_rollback"`
+	// PathMappings rules to map the config items to the target paths on the host
+	PathMappings []*PathMappingConfig `json:"path_mappings" mapstructure:"path_mappings"`
+	// BandwidthLimit download bandwidth limit of the app in bytes per second, 0 means no limit
+	BandwidthLimit int64 `json:"bandwidth_limit" mapstructure:"bandwidth_limit"`
 }
 
 // Validate validate the app watch config
@@ -296,6 +364,47 @@ func (c *AppConfig) Validate() error {
 	if c.Name == "" {
 		return fmt.Errorf("app is empty")
 	}
+	if c.BandwidthLimit < 0 {
+		return fmt.Errorf("app %s: bandwidth limit should not be negative", c.Name)
+	}
+	for _, m := range c.PathMappings {
+		if err := m.Validate(); err != nil {
+			return fmt.Errorf("app %s: %s", c.Name, err.Error())
+		}
+	}
+	return nil
+}
+
+// PathMappingConfig config for mapping the config items to the target path on the host
+type PathMappingConfig struct {
+	// Match is the config item path prefix or glob pattern matched against the full config item path
+	Match string `json:"match" mapstructure:"match"`
+	// Target is the absolute destination root on the host
+	Target string `json:"target" mapstructure:"target"`
+	// User overwrites the owner of the target file if set
+	User string `json:"user" mapstructure:"user"`
+	// UserGroup overwrites the owner group of the target file if set
+	UserGroup string `json:"user_group" mapstructure:"user_group"`
+	// Privilege overwrites the mode of the target file if set, eg: 644
+	Privilege string `json:"privilege" mapstructure:"privilege"`
+}
+
+// Validate validates the path mapping config
+func (c *PathMappingConfig) Validate() error {
+	if c.Match == "" {
+		return errors.New("path mapping match is empty")
+	}
+	if _, err := path.Match(c.Match, ""); err != nil {
+		return fmt.Errorf("invalid path mapping match %s, err: %s", c.Match, err.Error())
+	}
+	if c.Target == "" || !filepath.IsAbs(c.Target) {
+		return fmt.Errorf("path mapping target %s must be an absolute path", c.Target)
+	}
+	if c.Privilege != "" {
+		if _, err := strconv.ParseUint(c.Privilege, 8, 32); err != nil {
+			return fmt.Errorf("invalid path mapping privilege %s, it should be octal, eg: 644", c.Privilege)
+		}
+	}
 	return nil
 }
 
@@ -309,6 +418,12 @@ type FileCacheConfig struct {
 	CleanupIntervalSeconds int64 `json:"-" mapstructure:"-"`
 	// ThresholdGB is threshold gigabyte of cleanup
 	ThresholdGB float64 `json:"threshold_gb" mapstructure:"threshold_gb"`
+	// EvictionPolicy is the policy of evicting the cached contents on cleanup, lru or lfu
+	EvictionPolicy string `json:"eviction_policy" mapstructure:"eviction_policy"`
+	// Scrub is the config of verifying the cached contents in background
+	Scrub *FileCacheScrubConfig `json:"scrub" mapstructure:"scrub"`
+	// Prewarm is the config of pre-warming the cache when a release is announced by watch
+	Prewarm *FileCachePrewarmConfig `json:"prewarm" mapstructure:"prewarm"`
 	// retentionRate is retention rate of cleanup, not exposed for configuration now, use default value
 	RetentionRate float64 `json:"-" mapstructure:"-"`
 }
@@ -327,6 +442,62 @@ func (c *FileCacheConfig) Validate() error {
 	if c.RetentionRate <= 0 || c.RetentionRate > 1 {
 		c.RetentionRate = constant.DefaultCacheRetentionRate
 	}
+	switch c.EvictionPolicy {
+	case "":
+		c.EvictionPolicy = constant.DefaultCacheEvictionPolicy
+	case constant.CacheEvictionPolicyLRU, constant.CacheEvictionPolicyLFU:
+	default:
+		return fmt.Errorf("invalid file cache eviction policy %s, allowed policies are: lru,lfu", c.EvictionPolicy)
+	}
+	if c.Scrub == nil {
+		c.Scrub = new(FileCacheScrubConfig)
+	}
+	if c.Prewarm == nil {
+		c.Prewarm = new(FileCachePrewarmConfig)
+	}
+	if err := c.Prewarm.Validate(); err != nil {
+		return err
+	}
+	return c.Scrub.Validate()
+}
+
+// FileCacheScrubConfig config for verifying the cached contents in background
+type FileCacheScrubConfig struct {
+	// Enabled is whether verify the cached contents in background
+	Enabled bool `json:"enabled" mapstructure:"enabled"`
+	// IntervalSeconds is the interval of the scrub rounds
+	IntervalSeconds int `json:"interval_seconds" mapstructure:"interval_seconds"`
+	// Rate is the bytes hashed per second, 0 means no limit
+	Rate int64 `json:"rate" mapstructure:"rate"`
+	// VerifiedTTLSeconds is the duration in which a verified content is not hashed again on lookup
+	VerifiedTTLSeconds int `json:"verified_ttl_seconds" mapstructure:"verified_ttl_seconds"`
+	// Quarantine is whether move the corrupt contents into the quarantine dir instead of deleting them
+	Quarantine bool `json:"quarantine" mapstructure:"quarantine"`
+}
+
+// Validate validates the file cache scrub config
+func (c *FileCacheScrubConfig) Validate() error {
+	if c.IntervalSeconds < 0 || c.VerifiedTTLSeconds < 0 || c.Rate < 0 {
+		return errors.New("file cache scrub interval, rate and verified ttl should not be negative")
+	}
+	return nil
+}
+
+// FileCachePrewarmConfig config for pre-warming the cache when a release is announced by watch
+type FileCachePrewarmConfig struct {
+	// Enabled is whether pre-warm the cache when a release is announced
+	Enabled bool `json:"enabled" mapstructure:"enabled"`
+	// DelayApply is whether delay applying the release until the pre-warm completes
+	DelayApply bool `json:"delay_apply" mapstructure:"delay_apply"`
+	// DelayTimeoutSeconds is the max duration of delaying the apply
+	DelayTimeoutSeconds int `json:"delay_timeout_seconds" mapstructure:"delay_timeout_seconds"`
+}
+
+// Validate validates the file cache prewarm config
+func (c *FileCachePrewarmConfig) Validate() error {
+	if c.DelayTimeoutSeconds < 0 {
+		return errors.New("file cache prewarm delay timeout should not be negative")
+	}
 	return nil
 }
 
@@ -336,6 +507,8 @@ type KvCacheConfig struct {
 	Enabled bool `json:"enabled" mapstructure:"enabled"`
 	// ThresholdMB is threshold megabyte of kv cache
 	ThresholdMB float64 `json:"threshold_mb" mapstructure:"threshold_mb"`
+	// Snapshot is the config of persisting the kv cache on disk
+	Snapshot *KvSnapshotConfig `json:"snapshot" mapstructure:"snapshot"`
 }
 
 // Validate validates the kv cache config
@@ -343,5 +516,221 @@ func (c *KvCacheConfig) Validate() error {
 	if c.ThresholdMB <= 0 {
 		c.ThresholdMB = constant.DefaultKvCacheThresholdMB
 	}
+	if c.Snapshot == nil {
+		c.Snapshot = new(KvSnapshotConfig)
+	}
+	return c.Snapshot.Validate()
+}
+
+// KvSnapshotConfig config for persisting the last known good kv values on disk
+type KvSnapshotConfig struct {
+	// Enabled is whether persist the kv values on disk
+	Enabled bool `json:"enabled" mapstructure:"enabled"`
+	// Dir is the dir of the kv snapshots
+	Dir string `json:"dir" mapstructure:"dir"`
+	// MaxSizeMB is the max megabyte size of the snapshot of each app
+	MaxSizeMB float64 `json:"max_size_mb" mapstructure:"max_size_mb"`
+	// EncryptionKeyFile is the file of the hex encoded AES key to encrypt the secret values at rest
+	EncryptionKeyFile string `json:"encryption_key_file" mapstructure:"encryption_key_file"`
+}
+
+// Validate validates the kv snapshot config
+func (c *KvSnapshotConfig) Validate() error {
+	if c.Dir == "" {
+		c.Dir = constant.DefaultKvSnapshotDir
+	}
+	if c.MaxSizeMB < 0 {
+		return errors.New("kv snapshot max size should not be negative")
+	}
+	if c.MaxSizeMB == 0 {
+		c.MaxSizeMB = constant.DefaultKvSnapshotMaxSizeMB
+	}
+	return nil
+}
+
+// VersionedDirConfig config for versioned release directory layout
+type VersionedDirConfig struct {
+	// Enabled is whether download files into releases/<releaseID> and switch the current symlink atomically
+	Enabled bool `json:"enabled" mapstructure:"enabled"`
+	// RetainReleases is the count of release dirs to retain, including the current one
+	RetainReleases int `json:"retain_releases" mapstructure:"retain_releases"`
+}
+
+// Validate validates the versioned dir config
+func (c *VersionedDirConfig) Validate() error {
+	if c.Enabled && runtime.GOOS == "windows" {
+		return errors.New("versioned dir layout is not supported on windows")
+	}
+	if c.RetainReleases <= 0 {
+		c.RetainReleases = constant.DefaultRetainReleases
+	}
+	return nil
+}
+
+// FileDeletionConfig config for deleting the files which are not in the release
+type FileDeletionConfig struct {
+	// NeverDelete is whether never delete any file which is not in the release
+	NeverDelete bool `json:"never_delete" mapstructure:"never_delete"`
+	// Ignore is the glob patterns of the files which are never deleted, relative to the files dir
+	Ignore []string `json:"ignore" mapstructure:"ignore"`
+}
+
+// Validate validates the file deletion config
+func (c *FileDeletionConfig) Validate() error {
+	for _, pattern := range c.Ignore {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid file deletion ignore pattern %s, err: %s", pattern, err.Error())
+		}
+	}
+	return nil
+}
+
+// DownloadConfig config for download bandwidth and priority
+type DownloadConfig struct {
+	// BandwidthLimit is the global download bandwidth limit in bytes per second, 0 means no limit
+	BandwidthLimit int64 `json:"bandwidth_limit" mapstructure:"bandwidth_limit"`
+	// PriorityEnabled is whether download the small text files first and the large files last
+	PriorityEnabled bool `json:"priority_enabled" mapstructure:"priority_enabled"`
+	// SmallFileSize is the max byte size of the small files for download priority
+	SmallFileSize uint64 `json:"small_file_size" mapstructure:"small_file_size"`
+	// FileTimeoutSeconds is the total timeout of downloading a file, 0 means no limit
+	FileTimeoutSeconds int `json:"file_timeout_seconds" mapstructure:"file_timeout_seconds"`
+	// RangePartSize is the byte size of each part of the range download, 0 means the default size
+	RangePartSize uint64 `json:"range_part_size" mapstructure:"range_part_size"`
+}
+
+// Validate validates the download config
+func (c *DownloadConfig) Validate() error {
+	if c.BandwidthLimit < 0 {
+		return errors.New("download bandwidth limit should not be negative")
+	}
+	if c.SmallFileSize == 0 {
+		c.SmallFileSize = constant.DefaultSmallFileSize
+	}
+	if c.FileTimeoutSeconds < 0 {
+		return errors.New("download file timeout seconds should not be negative")
+	}
+	return nil
+}
+
+const (
+	// SourceTypeLocal is the source type of a local mirror directory
+	SourceTypeLocal = "local"
+	// SourceTypeHTTP is the source type of a http server which serves the content by signature
+	SourceTypeHTTP = "http"
+)
+
+// SourceConfig config for a content source
+type SourceConfig struct {
+	// Type the source type, local or http
+	Type string `json:"type" mapstructure:"type"`
+	// Path the mirror directory of the local source
+	Path string `json:"path" mapstructure:"path"`
+	// URL the base url of the http source, the content is requested at <url>/<signature>
+	URL string `json:"url" mapstructure:"url"`
+	// TimeoutSeconds the request timeout of the http source, default is 30
+	TimeoutSeconds int `json:"timeout_seconds" mapstructure:"timeout_seconds"`
+}
+
+// Validate validates the source config
+func (c *SourceConfig) Validate() error {
+	switch c.Type {
+	case SourceTypeLocal:
+		if !filepath.IsAbs(c.Path) {
+			return fmt.Errorf("local source path %s should be an absolute path", c.Path)
+		}
+	case SourceTypeHTTP:
+		u, err := url.Parse(c.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("invalid http source url %s", c.URL)
+		}
+		if c.TimeoutSeconds < 0 {
+			return fmt.Errorf("http source timeout should not be negative")
+		}
+		if c.TimeoutSeconds == 0 {
+			c.TimeoutSeconds = constant.DefaultSourceTimeoutSeconds
+		}
+	default:
+		return fmt.Errorf("invalid source type %s, allowed types are: local,http", c.Type)
+	}
+	return nil
+}
+
+// SharedStoreConfig config for the node local content store shared by the clients on the same node
+type SharedStoreConfig struct {
+	// Enabled is whether enable the shared store
+	Enabled bool `json:"enabled" mapstructure:"enabled"`
+	// Dir is the shared store dir, e.g. a hostPath dir mounted by all the sidecars on the node
+	Dir string `json:"dir" mapstructure:"dir"`
+}
+
+// Validate validates the shared store config
+func (c *SharedStoreConfig) Validate() error {
+	if c.Enabled && !filepath.IsAbs(c.Dir) {
+		return fmt.Errorf("shared store dir %s should be an absolute path", c.Dir)
+	}
+	return nil
+}
+
+// HTTPTransportConfig config for the http transport of downloading from the repository, the zero values mean the
+// default settings
+type HTTPTransportConfig struct {
+	// DialTimeoutSeconds is the timeout of dialing the repository
+	DialTimeoutSeconds int `json:"dial_timeout_seconds" mapstructure:"dial_timeout_seconds"`
+	// TLSHandshakeTimeoutSeconds is the timeout of the tls handshake
+	TLSHandshakeTimeoutSeconds int `json:"tls_handshake_timeout_seconds" mapstructure:"tls_handshake_timeout_seconds"`
+	// ResponseHeaderTimeoutSeconds is the timeout of waiting for the response header
+	ResponseHeaderTimeoutSeconds int `json:"response_header_timeout_seconds" mapstructure:"response_header_timeout_seconds"`
+	// IdleConnTimeoutSeconds is the timeout of the idle connections kept in the pool
+	IdleConnTimeoutSeconds int `json:"idle_conn_timeout_seconds" mapstructure:"idle_conn_timeout_seconds"`
+	// MaxIdleConns is the max idle connections of all the hosts
+	MaxIdleConns int `json:"max_idle_conns" mapstructure:"max_idle_conns"`
+	// MaxIdleConnsPerHost is the max idle connections of each host
+	MaxIdleConnsPerHost int `json:"max_idle_conns_per_host" mapstructure:"max_idle_conns_per_host"`
+	// ProxyURL is the proxy of the requests, the proxy from the environment is used if it is empty
+	ProxyURL string `json:"proxy_url" mapstructure:"proxy_url"`
+	// EnableHTTP2 is whether try http/2 with the repository
+	EnableHTTP2 bool `json:"enable_http2" mapstructure:"enable_http2"`
+	// CAFile is the ca file trusted besides the system ca
+	CAFile string `json:"ca_file" mapstructure:"ca_file"`
+}
+
+// Validate validates the http transport config
+func (c *HTTPTransportConfig) Validate() error {
+	if c.DialTimeoutSeconds < 0 || c.TLSHandshakeTimeoutSeconds < 0 || c.ResponseHeaderTimeoutSeconds < 0 ||
+		c.IdleConnTimeoutSeconds < 0 {
+		return errors.New("http transport timeout seconds should not be negative")
+	}
+	if c.MaxIdleConns < 0 || c.MaxIdleConnsPerHost < 0 {
+		return errors.New("http transport max idle conns should not be negative")
+	}
+	if c.ProxyURL != "" {
+		if _, err := url.Parse(c.ProxyURL); err != nil {
+			return fmt.Errorf("invalid http transport proxy url %s, err: %s", c.ProxyURL, err.Error())
+		}
+	}
+	return nil
+}
+
+// P2PDownloadConfig config for the p2p download, the zero values mean the default settings
+type P2PDownloadConfig struct {
+	// Threshold is the min byte size of the file downloaded by p2p
+	Threshold uint64 `json:"threshold" mapstructure:"threshold"`
+	// PollIntervalSeconds is the interval of polling the p2p download task status
+	PollIntervalSeconds int `json:"poll_interval_seconds" mapstructure:"poll_interval_seconds"`
+	// TimeoutSeconds is the timeout of waiting for the p2p download task
+	TimeoutSeconds int `json:"timeout_seconds" mapstructure:"timeout_seconds"`
+	// StagingDir is the dir which gse downloads the files into
+	StagingDir string `json:"staging_dir" mapstructure:"staging_dir"`
+}
+
+// Validate validates the p2p download config
+func (c *P2PDownloadConfig) Validate() error {
+	if c.PollIntervalSeconds < 0 || c.TimeoutSeconds < 0 {
+		return errors.New("p2p download poll interval seconds and timeout seconds should not be negative")
+	}
+	if c.StagingDir != "" && !filepath.IsAbs(c.StagingDir) {
+		return fmt.Errorf("p2p download staging dir %s should be an absolute path", c.StagingDir)
+	}
 	return nil
 }
@@ -36,6 +36,12 @@ const (
 	// DefaultCacheRetentionRate is the bscp cli default file cache retention rate, which is 90%
 	// !important: promise of compatibility
 	DefaultCacheRetentionRate = 0.9
+	// CacheEvictionPolicyLRU evicts the least recently used cached contents first
+	CacheEvictionPolicyLRU = "lru"
+	// CacheEvictionPolicyLFU evicts the least frequently used cached contents first
+	CacheEvictionPolicyLFU = "lfu"
+	// DefaultCacheEvictionPolicy is the bscp cli default file cache eviction policy
+	DefaultCacheEvictionPolicy = CacheEvictionPolicyLRU
 
 	// DefaultKvCacheEnabled is the bscp cli default kv cache switch.
 	// !important: promise of compatibility
@@ -43,6 +49,22 @@ const (
 	// DefaultKvCacheThresholdMB is the bscp cli default file cache threshold, which is 500MB
 	// !important: promise of compatibility
 	DefaultKvCacheThresholdMB = 500
+	// DefaultKvSnapshotDir is the bscp cli default dir of the kv snapshots.
+	DefaultKvSnapshotDir = "/data/bscp/kv_snapshot"
+	// DefaultKvSnapshotMaxSizeMB is the bscp cli default max megabyte size of the kv snapshot of each app
+	DefaultKvSnapshotMaxSizeMB = 10
+
+	// DefaultRetainReleases is the bscp cli default count of release dirs to retain in versioned layout.
+	// !important: promise of compatibility
+	DefaultRetainReleases = 3
+
+	// DefaultSmallFileSize is the bscp cli default max byte size of the small files for download priority, which is 1MB
+	// !important: promise of compatibility
+	DefaultSmallFileSize = 1024 * 1024
+
+	// DefaultSourceTimeoutSeconds is the bscp cli default request timeout of the http content source
+	// !important: promise of compatibility
+	DefaultSourceTimeoutSeconds = 30
 
 	// DefaultHttpPort is the bscp sidecar default http port.
 	// !important: promise of compatibility
@@ -15,6 +15,7 @@ package downloader
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -28,14 +29,93 @@ import (
 	"golang.org/x/exp/slog"
 
 	"github.com/TencentBlueKing/bscp-go/internal/upstream"
+	"github.com/TencentBlueKing/bscp-go/internal/util"
 	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+	"github.com/TencentBlueKing/bscp-go/pkg/metrics"
 )
 
 const (
-	defaultAsyncDownloadByteSize             = 2 * 1024 * 1024
-	defaultAsyncDownloadPollingStateInterval = 5 * time.Second
+	// DefaultAsyncDownloadByteSize is the default min byte size of the file downloaded by p2p
+	DefaultAsyncDownloadByteSize = 2 * 1024 * 1024
+	// DefaultAsyncDownloadPollInterval is the default interval of polling the p2p download task status
+	DefaultAsyncDownloadPollInterval = 5 * time.Second
+	// DefaultAsyncDownloadTimeout is the default timeout of waiting for the p2p download task
+	DefaultAsyncDownloadTimeout = 10 * time.Minute
 )
 
+// the reasons of falling back to http download, which are the label values of the fallback metrics
+const (
+	asyncFallbackCreateTask = "create_task_failed"
+	asyncFallbackStatus     = "query_status_failed"
+	asyncFallbackFailed     = "task_failed"
+	asyncFallbackTimeout    = "timeout"
+	asyncFallbackVerify     = "verify_failed"
+)
+
+// AsyncOptions options of the p2p async download, the zero values are replaced by the defaults
+type AsyncOptions struct {
+	// Threshold the min byte size of the file downloaded by p2p, the smaller files are downloaded by http
+	Threshold uint64
+	// PollInterval the interval of polling the task status
+	PollInterval time.Duration
+	// Timeout the timeout of waiting for the task
+	Timeout time.Duration
+	// StagingDir the dir in which each task creates a unique dir for gse to download the file into, the os temp dir
+	// is used if it is empty
+	StagingDir string
+}
+
+var (
+	// asyncOptions the p2p async download options applied on downloader init
+	asyncOptions = AsyncOptions{}
+)
+
+// SetAsyncOptions sets the p2p async download options, which should be called before Init
+func SetAsyncOptions(o AsyncOptions) {
+	asyncOptions = o
+}
+
+// withDefaults returns the options with the zero values replaced by the defaults
+func (o AsyncOptions) withDefaults() AsyncOptions {
+	if o.Threshold == 0 {
+		o.Threshold = DefaultAsyncDownloadByteSize
+	}
+	if o.PollInterval <= 0 {
+		o.PollInterval = DefaultAsyncDownloadPollInterval
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = DefaultAsyncDownloadTimeout
+	}
+	if o.StagingDir == "" {
+		o.StagingDir = os.TempDir()
+	}
+	return o
+}
+
+// AsyncResult is the result of downloading a file by p2p
+type AsyncResult struct {
+	// TaskID the p2p download task id, empty if the task is not created
+	TaskID string
+	// Fallback is whether the file is downloaded by http since the p2p download failed
+	Fallback bool
+	// FallbackReason the error of the p2p download which causes the fallback
+	FallbackReason string
+}
+
+// AsyncReportFunc receives the result of downloading a file by p2p
+type AsyncReportFunc func(AsyncResult)
+
+// asyncError is the error of the p2p download with the reason of falling back to http download
+type asyncError struct {
+	reason string
+	err    error
+}
+
+// Error returns the error message
+func (e *asyncError) Error() string {
+	return e.err.Error()
+}
+
 type asyncDownloader struct {
 	vas *kit.Vas
 	// bkAgentID blueking gse agent id
@@ -49,16 +129,29 @@ type asyncDownloader struct {
 	upstream      upstream.Upstream
 	bizID         uint32
 	token         string
+	opts          AsyncOptions
 }
 
-// Download the configuration items from p2p async download.
-func (dl *asyncDownloader) Download(fileMeta *pbfs.FileMeta, downloadUri string, fileSize uint64,
-	to DownloadTo, bytes []byte, toFile string) error {
-	// create asynchronous download task
-
+// Download the configuration items from p2p async download, the bandwidth of p2p download is controlled by gse,
+// so the download options are not applied. It returns the task id, which is empty if the task is not created.
+// Each task downloads into a unique staging dir, so that the concurrent tasks of the same content, e.g. the cache
+// pre-warming and the download of the app, never move the file downloaded by each other.
+func (dl *asyncDownloader) Download(fileMeta *pbfs.FileMeta, toFile string) (string, error) {
 	start := time.Now()
+	signature := fileMeta.CommitSpec.GetContent().GetSignature()
+	stagingDir, err := os.MkdirTemp(dl.opts.StagingDir, "bscp-"+signature+"-")
+	if err != nil {
+		return "", &asyncError{reason: asyncFallbackCreateTask,
+			err: fmt.Errorf("create staging dir failed, err: %s", err.Error())}
+	}
+	defer os.RemoveAll(stagingDir)
+	// the dir is written by the gse agent, which may not run as the same user
+	if err := os.Chmod(stagingDir, 0755); err != nil {
+		return "", &asyncError{reason: asyncFallbackCreateTask,
+			err: fmt.Errorf("chmod staging dir failed, err: %s", err.Error())}
+	}
 
-	tempDir := os.TempDir()
+	// create asynchronous download task
 	resp, err := dl.upstream.AsyncDownload(dl.vas, &pbfs.AsyncDownloadReq{
 		BizId:         fileMeta.ConfigItemAttachment.BizId,
 		BkAgentId:     dl.bkAgentID,
@@ -66,10 +159,10 @@ func (dl *asyncDownloader) Download(fileMeta *pbfs.FileMeta, downloadUri string,
 		PodId:         dl.podID,
 		ContainerName: dl.containerName,
 		FileMeta:      fileMeta,
-		FileDir:       tempDir,
+		FileDir:       stagingDir,
 	})
 	if err != nil {
-		return err
+		return "", &asyncError{reason: asyncFallbackCreateTask, err: err}
 	}
 
 	logger.Info("start async download file",
@@ -78,36 +171,68 @@ func (dl *asyncDownloader) Download(fileMeta *pbfs.FileMeta, downloadUri string,
 
 	// Check the status of the download asynchronously with timeout
 	if err := dl.awaitDownloadCompletion(fileMeta.ConfigItemAttachment.BizId, resp.TaskId, toFile); err != nil {
-		return err
+		// the file may have been downloaded completely by gse even if the task is failed or timed out
+		if e := dl.moveDownloaded(stagingDir, signature, toFile); e != nil {
+			return resp.TaskId, err
+		}
+	} else if err := dl.moveDownloaded(stagingDir, signature, toFile); err != nil {
+		return resp.TaskId, &asyncError{reason: asyncFallbackVerify, err: err}
 	}
 
-	// move the downloaded file from temp dir to the target path
-	if err := MoveFile(filepath.Join(tempDir, fileMeta.CommitSpec.Content.Signature), toFile); err != nil {
-		return fmt.Errorf("move file from %s to %s failed, err: %s",
-			filepath.Join(tempDir, fileMeta.CommitSpec.Content.Signature), toFile, err)
-	}
+	logger.Info("async download file success", "file", toFile, "taskID", resp.TaskId,
+		"cost", time.Since(start).String())
+	return resp.TaskId, nil
+}
 
-	// Verify the checksum of the downloaded file
-	if err := dl.verifyChecksum(toFile, fileMeta.CommitSpec.Content.Signature); err != nil {
-		return err
+// asyncDownload downloads the file by p2p, and falls back to http download if it fails, the result is reported to
+// the metrics and the async report of the download options
+func (d *downloader) asyncDownload(fileMeta *pbfs.FileMeta, downloadUri string, fileSize uint64, filePath string,
+	opts ...DownloadOption) error {
+	o := newDownloadOptions(opts...)
+	metrics.P2PDownloadAttemptCounter.Inc()
+	start := time.Now()
+	taskID, err := d.asyncDownloader.Download(fileMeta, filePath)
+	if err == nil {
+		metrics.P2PDownloadSuccessCounter.Inc()
+		reportDownloadMetrics("p2p", fileSize, time.Since(start))
+		if saved := d.httpDownloader.throughput.estimate(fileSize) - time.Since(start); saved > 0 {
+			metrics.P2PDownloadSavedSecondsCounter.Add(saved.Seconds())
+		}
+		if o.asyncReport != nil {
+			o.asyncReport(AsyncResult{TaskID: taskID})
+		}
+		return nil
 	}
 
-	logger.Info("async download file success", "file", toFile, "cost", time.Since(start).String())
-	return nil
+	reason := asyncFallbackCreateTask
+	var e *asyncError
+	if errors.As(err, &e) {
+		reason = e.reason
+	}
+	metrics.P2PDownloadFallbackCounter.WithLabelValues(reason).Inc()
+	if o.asyncReport != nil {
+		o.asyncReport(AsyncResult{TaskID: taskID, Fallback: true, FallbackReason: err.Error()})
+	}
+	logger.Warn("async download file failed, fallback to http download", "file",
+		filepath.Join(fileMeta.ConfigItemSpec.Path, fileMeta.ConfigItemSpec.Name), "taskID", taskID,
+		"reason", reason, "err", err.Error())
+	// if async download failed, fallback to http download, which resumes from the partial file if exists
+	return d.httpDownloader.Download(fileMeta, downloadUri, fileSize, DownloadToFile, nil, filePath, opts...)
 }
 
 // awaitDownloadCompletion waits for the download task to complete with a timeout.
 func (dl *asyncDownloader) awaitDownloadCompletion(bizID uint32, taskID, toFile string) error {
-	ctx, cancel := context.WithTimeout(dl.vas.Ctx, 10*time.Minute)
+	ctx, cancel := context.WithTimeout(dl.vas.Ctx, dl.opts.Timeout)
 	defer cancel()
 
-	ticker := time.NewTicker(defaultAsyncDownloadPollingStateInterval)
+	ticker := time.NewTicker(dl.opts.PollInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-ctx.Done():
-			return fmt.Errorf("async download file %s timed out", toFile)
+			return &asyncError{reason: asyncFallbackTimeout,
+				err: fmt.Errorf("async download file %s timed out after %s", toFile, dl.opts.Timeout)}
 		case <-ticker.C:
 
 			resp, err := dl.upstream.AsyncDownloadStatus(dl.vas, &pbfs.AsyncDownloadStatusReq{
@@ -115,11 +240,11 @@ func (dl *asyncDownloader) awaitDownloadCompletion(bizID uint32, taskID, toFile
 				TaskId: taskID,
 			})
 			if err != nil {
-				return err
+				return &asyncError{reason: asyncFallbackStatus, err: err}
 			}
 			switch resp.Status {
 			case pbfs.AsyncDownloadStatus_FAILED:
-				return fmt.Errorf("async download file %s failed", toFile)
+				return &asyncError{reason: asyncFallbackFailed, err: fmt.Errorf("async download file %s failed", toFile)}
 			case pbfs.AsyncDownloadStatus_DOWNLOADING:
 				continue
 			case pbfs.AsyncDownloadStatus_SUCCESS:
@@ -129,6 +254,23 @@ func (dl *asyncDownloader) awaitDownloadCompletion(bizID uint32, taskID, toFile
 	}
 }
 
+// moveDownloaded verifies the file downloaded by gse in the staging dir and moves it to the target path, the checksum
+// is verified before moving, so that a broken file never replaces the target.
+func (dl *asyncDownloader) moveDownloaded(stagingDir, signature, toFile string) error {
+	downloadedFile := filepath.Join(stagingDir, signature)
+	if _, err := os.Stat(downloadedFile); err != nil {
+		return err
+	}
+	if err := dl.verifyChecksum(downloadedFile, signature); err != nil {
+		return err
+	}
+	// move the downloaded file from temp dir to the target path
+	if err := MoveFile(downloadedFile, toFile); err != nil {
+		return fmt.Errorf("move file from %s to %s failed, err: %s", downloadedFile, toFile, err)
+	}
+	return nil
+}
+
 // verifyChecksum verifies the checksum of the downloaded file.
 func (dl *asyncDownloader) verifyChecksum(filePath, expectedChecksum string) error {
 	signature, err := tools.FileSHA256(filePath)
@@ -165,18 +307,19 @@ func crossDeviceMoveFile(srcPath, dstPath string) error {
 	}
 	defer srcFile.Close()
 
-	dstFile, err := os.Create(dstPath)
+	// copy to a temp file beside the target file and rename it, so that the target file is never partially written
+	dstFile, err := util.CreateAtomicFile(dstPath, 0644)
 	if err != nil {
 		return err
 	}
-	defer dstFile.Close()
+	defer dstFile.Abort()
 
 	_, err = io.Copy(dstFile, srcFile)
 	if err != nil {
 		return err
 	}
 
-	if err := dstFile.Sync(); err != nil {
+	if err := dstFile.Commit(); err != nil {
 		return err
 	}
 
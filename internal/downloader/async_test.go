@@ -0,0 +1,295 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/kit"
+	pbcommit "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/core/commit"
+	pbci "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/core/config-item"
+	pbcontent "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/core/content"
+	pbfs "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/feed-server"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/TencentBlueKing/bscp-go/internal/upstream"
+	"github.com/TencentBlueKing/bscp-go/pkg/metrics"
+)
+
+// asyncUpstream is the upstream which serves the p2p download tasks and the http download url, the file is
+// written into the staging dir of the task as gse does when the task status is queried
+type asyncUpstream struct {
+	upstream.Upstream
+	url string
+	// content written into the staging dir as the file of the signature, nothing is written if it is nil
+	content   []byte
+	signature string
+	// createErr fails the task creation
+	createErr error
+	// statusErr fails the task status query
+	statusErr error
+	// status of the task
+	status pbfs.AsyncDownloadStatus
+
+	lock       sync.Mutex
+	fileDirs   []string
+	statusReqs int
+	urlReqs    int
+}
+
+// AsyncDownload creates the p2p download task
+func (u *asyncUpstream) AsyncDownload(vas *kit.Vas, req *pbfs.AsyncDownloadReq) (*pbfs.AsyncDownloadResp, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if u.createErr != nil {
+		return nil, u.createErr
+	}
+	u.fileDirs = append(u.fileDirs, req.FileDir)
+	return &pbfs.AsyncDownloadResp{TaskId: "task"}, nil
+}
+
+// AsyncDownloadStatus returns the status of the task, and writes the content into the staging dir
+func (u *asyncUpstream) AsyncDownloadStatus(vas *kit.Vas, req *pbfs.AsyncDownloadStatusReq) (
+	*pbfs.AsyncDownloadStatusResp, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.statusReqs++
+	if u.statusErr != nil {
+		return nil, u.statusErr
+	}
+	if u.content != nil {
+		fileDir := u.fileDirs[len(u.fileDirs)-1]
+		if err := os.WriteFile(filepath.Join(fileDir, u.signature), u.content, 0644); err != nil {
+			return nil, err
+		}
+	}
+	return &pbfs.AsyncDownloadStatusResp{Status: u.status}, nil
+}
+
+// GetDownloadURL returns the url of the http download
+func (u *asyncUpstream) GetDownloadURL(vas *kit.Vas, req *pbfs.GetDownloadURLReq) (*pbfs.GetDownloadURLResp,
+	error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	u.urlReqs++
+	return &pbfs.GetDownloadURLResp{Urls: []string{u.url}}, nil
+}
+
+// newTestAsyncDownloader returns the downloader with p2p download enabled, the http downloads are served with content
+func newTestAsyncDownloader(t *testing.T, u *asyncUpstream, content []byte, opts AsyncOptions) *downloader {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(content)
+	}))
+	t.Cleanup(srv.Close)
+	u.url = srv.URL
+	sum := sha256.Sum256(content)
+	u.signature = hex.EncodeToString(sum[:])
+	vas := &kit.Vas{Rid: "rid", Ctx: context.Background()}
+	return &downloader{
+		enableAsyncDownload: true,
+		asyncDownloader:     &asyncDownloader{vas: vas, upstream: u, opts: opts},
+		httpDownloader: &httpDownloader{
+			vas:                     vas,
+			upstream:                u,
+			sem:                     newPrioritySemaphore(1),
+			client:                  srv.Client(),
+			fileTimeout:             time.Minute,
+			balanceDownloadByteSize: 1024 * 1024,
+		},
+	}
+}
+
+// newTestFileMeta returns the file meta of the content
+func newTestFileMeta(content []byte) *pbfs.FileMeta {
+	sum := sha256.Sum256(content)
+	signature := hex.EncodeToString(sum[:])
+	return &pbfs.FileMeta{
+		CommitSpec:           &pbcommit.CommitSpec{Content: &pbcontent.ContentSpec{Signature: signature}},
+		ConfigItemSpec:       &pbci.ConfigItemSpec{Path: "/etc", Name: "app.conf"},
+		ConfigItemAttachment: &pbci.ConfigItemAttachment{BizId: 1},
+	}
+}
+
+func TestAsyncOptionsWithDefaults(t *testing.T) {
+	tests := []struct {
+		name string
+		opts AsyncOptions
+		want AsyncOptions
+	}{
+		{name: "defaults", opts: AsyncOptions{}, want: AsyncOptions{Threshold: DefaultAsyncDownloadByteSize,
+			PollInterval: DefaultAsyncDownloadPollInterval, Timeout: DefaultAsyncDownloadTimeout,
+			StagingDir: os.TempDir()}},
+		{name: "negative durations", opts: AsyncOptions{PollInterval: -time.Second, Timeout: -time.Second},
+			want: AsyncOptions{Threshold: DefaultAsyncDownloadByteSize, PollInterval: DefaultAsyncDownloadPollInterval,
+				Timeout: DefaultAsyncDownloadTimeout, StagingDir: os.TempDir()}},
+		{name: "set", opts: AsyncOptions{Threshold: 1, PollInterval: time.Second, Timeout: time.Minute,
+			StagingDir: "/data/staging"}, want: AsyncOptions{Threshold: 1, PollInterval: time.Second,
+			Timeout: time.Minute, StagingDir: "/data/staging"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.opts.withDefaults(); got != tt.want {
+				t.Errorf("withDefaults() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAsyncDownloadThreshold(t *testing.T) {
+	content := []byte("p2p content")
+	tests := []struct {
+		name      string
+		disabled  bool
+		to        DownloadTo
+		threshold uint64
+		wantP2P   bool
+	}{
+		{name: "not smaller than the threshold", to: DownloadToFile, threshold: uint64(len(content)), wantP2P: true},
+		{name: "smaller than the threshold", to: DownloadToFile, threshold: uint64(len(content)) + 1},
+		{name: "download to bytes", to: DownloadToBytes, threshold: 1},
+		{name: "p2p disabled", disabled: true, to: DownloadToFile, threshold: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := &asyncUpstream{content: content}
+			d := newTestAsyncDownloader(t, u, content, AsyncOptions{Threshold: tt.threshold,
+				PollInterval: time.Millisecond, Timeout: time.Minute, StagingDir: t.TempDir()})
+			d.enableAsyncDownload = !tt.disabled
+			var b []byte
+			toFile := ""
+			if tt.to == DownloadToBytes {
+				b = make([]byte, len(content))
+			} else {
+				toFile = filepath.Join(t.TempDir(), "app.conf")
+			}
+
+			if err := d.fetch(newTestFileMeta(content), "", uint64(len(content)), tt.to, b, toFile); err != nil {
+				t.Fatal(err)
+			}
+			if p2p := len(u.fileDirs) > 0; p2p != tt.wantP2P || (u.urlReqs > 0) == tt.wantP2P {
+				t.Errorf("downloaded by p2p: %v, http: %v, want p2p: %v", p2p, u.urlReqs > 0, tt.wantP2P)
+			}
+			if tt.to == DownloadToBytes {
+				if string(b) != string(content) {
+					t.Errorf("downloaded content = %q, want %q", b, content)
+				}
+				return
+			}
+			if got, err := os.ReadFile(toFile); err != nil || string(got) != string(content) {
+				t.Errorf("downloaded file = %q, err: %v, want %q", got, err, content)
+			}
+		})
+	}
+}
+
+func TestAsyncDownloadFallback(t *testing.T) {
+	content := []byte("p2p content")
+	tests := []struct {
+		name       string
+		upstream   *asyncUpstream
+		timeout    time.Duration
+		wantReason string
+	}{
+		{name: "success", upstream: &asyncUpstream{content: content}},
+		{name: "create task failed", upstream: &asyncUpstream{createErr: errors.New("gse is down")},
+			wantReason: asyncFallbackCreateTask},
+		{name: "query status failed", upstream: &asyncUpstream{statusErr: errors.New("gse is down")},
+			wantReason: asyncFallbackStatus},
+		{name: "task failed", upstream: &asyncUpstream{status: pbfs.AsyncDownloadStatus_FAILED},
+			wantReason: asyncFallbackFailed},
+		{name: "timeout", upstream: &asyncUpstream{status: pbfs.AsyncDownloadStatus_DOWNLOADING},
+			timeout: 50 * time.Millisecond, wantReason: asyncFallbackTimeout},
+		{name: "verify failed", upstream: &asyncUpstream{content: []byte("broken")},
+			wantReason: asyncFallbackVerify},
+		// the file is kept even if the task is reported failed, since gse has downloaded it completely
+		{name: "downloaded by the failed task", upstream: &asyncUpstream{content: content,
+			status: pbfs.AsyncDownloadStatus_FAILED}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			timeout := tt.timeout
+			if timeout == 0 {
+				timeout = time.Minute
+			}
+			stagingDir := t.TempDir()
+			d := newTestAsyncDownloader(t, tt.upstream, content, AsyncOptions{Threshold: 1,
+				PollInterval: time.Millisecond, Timeout: timeout, StagingDir: stagingDir})
+			fileMeta := newTestFileMeta(content)
+			attempts := testutil.ToFloat64(metrics.P2PDownloadAttemptCounter)
+			successes := testutil.ToFloat64(metrics.P2PDownloadSuccessCounter)
+			fallbacks := testutil.ToFloat64(metrics.P2PDownloadFallbackCounter.WithLabelValues(tt.wantReason))
+			var results []AsyncResult
+			toFile := filepath.Join(t.TempDir(), "app.conf")
+
+			err := d.fetch(fileMeta, "", uint64(len(content)), DownloadToFile, nil, toFile,
+				WithAsyncReport(func(r AsyncResult) { results = append(results, r) }))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, err := os.ReadFile(toFile); err != nil || string(got) != string(content) {
+				t.Errorf("downloaded file = %q, err: %v, want %q", got, err, content)
+			}
+			// each task downloads into its own staging dir, which is removed after the download
+			if entries, err := os.ReadDir(stagingDir); err != nil || len(entries) != 0 {
+				t.Errorf("the staging dir is not cleaned up, entries: %v, err: %v", entries, err)
+			}
+			for _, dir := range tt.upstream.fileDirs {
+				if filepath.Dir(dir) != stagingDir {
+					t.Errorf("the task downloads into %s, which is not in the staging dir %s", dir, stagingDir)
+				}
+			}
+
+			if got := testutil.ToFloat64(metrics.P2PDownloadAttemptCounter) - attempts; got != 1 {
+				t.Errorf("p2p download attempts = %v, want 1", got)
+			}
+			if len(results) != 1 {
+				t.Fatalf("expected one async report, got %+v", results)
+			}
+			if tt.wantReason == "" {
+				if got := testutil.ToFloat64(metrics.P2PDownloadSuccessCounter) - successes; got != 1 {
+					t.Errorf("p2p download successes = %v, want 1", got)
+				}
+				if results[0].Fallback || results[0].TaskID != "task" || tt.upstream.urlReqs != 0 {
+					t.Errorf("unexpected result of the p2p download: %+v, http downloads: %d", results[0],
+						tt.upstream.urlReqs)
+				}
+				return
+			}
+			if got := testutil.ToFloat64(metrics.P2PDownloadFallbackCounter.WithLabelValues(tt.wantReason)) -
+				fallbacks; got != 1 {
+				t.Errorf("p2p download fallbacks of %s = %v, want 1", tt.wantReason, got)
+			}
+			if got := testutil.ToFloat64(metrics.P2PDownloadSuccessCounter) - successes; got != 0 {
+				t.Errorf("the fallback is counted as the p2p download success")
+			}
+			if !results[0].Fallback || results[0].FallbackReason == "" || tt.upstream.urlReqs != 1 {
+				t.Errorf("unexpected result of the fallback: %+v, http downloads: %d", results[0],
+					tt.upstream.urlReqs)
+			}
+			if tt.wantReason == asyncFallbackTimeout && tt.upstream.statusReqs < 2 {
+				t.Errorf("the task status is polled %d times within the timeout", tt.upstream.statusReqs)
+			}
+		})
+	}
+}
@@ -14,20 +14,25 @@
 package downloader
 
 import (
+	"context"
 	"fmt"
-	"path/filepath"
+	"io"
+	"time"
 
 	"github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/kit"
 	pbfs "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/feed-server"
 	sfs "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/sf-share"
-	"golang.org/x/sync/semaphore"
+	"golang.org/x/sync/singleflight"
 
 	"github.com/TencentBlueKing/bscp-go/internal/upstream"
 	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+	"github.com/TencentBlueKing/bscp-go/pkg/metrics"
 )
 
 var (
 	instance *downloader
+	// flight merges the concurrent downloads of the same content
+	flight singleflight.Group
 
 	// DownloadToBytes download file content to bytes.
 	DownloadToBytes DownloadTo = "bytes"
@@ -38,12 +43,78 @@ var (
 // DownloadTo defines the download target.
 type DownloadTo string
 
+// downloadOptions options for downloading a file
+type downloadOptions struct {
+	limiter  *Limiter
+	priority Priority
+	progress ProgressFunc
+	// asyncReport receives the result of the p2p download, nil if not needed
+	asyncReport AsyncReportFunc
+	// traceCtx carries the span which the spans of the download are started as the children of, nil if not traced
+	traceCtx context.Context
+}
+
+// ProgressFunc is called with the byte size of each chunk written, it is called concurrently by the ranged parts.
+type ProgressFunc func(n uint64)
+
+// DownloadOption setter for download options
+type DownloadOption func(*downloadOptions)
+
+// WithLimiter limits the bandwidth of the download by the limiter, besides the global bandwidth limit,
+// which is usually shared by all the downloads of an app.
+func WithLimiter(l *Limiter) DownloadOption {
+	return func(o *downloadOptions) {
+		o.limiter = l
+	}
+}
+
+// WithPriority sets the download priority of the file
+func WithPriority(p Priority) DownloadOption {
+	return func(o *downloadOptions) {
+		o.priority = p
+	}
+}
+
+// WithProgress reports the downloaded bytes to the progress func, the bytes of a failed and retried download
+// are reported again, so the receiver should cap the total by the file size.
+func WithProgress(fn ProgressFunc) DownloadOption {
+	return func(o *downloadOptions) {
+		o.progress = fn
+	}
+}
+
+// WithAsyncReport reports the result of the p2p download to fn, it is not called if the file is not downloaded by p2p
+func WithAsyncReport(fn AsyncReportFunc) DownloadOption {
+	return func(o *downloadOptions) {
+		o.asyncReport = fn
+	}
+}
+
+// WithTraceContext starts the spans of the download as the children of the span in ctx
+func WithTraceContext(ctx context.Context) DownloadOption {
+	return func(o *downloadOptions) {
+		o.traceCtx = ctx
+	}
+}
+
+// newDownloadOptions returns the download options with the default priority
+func newDownloadOptions(opts ...DownloadOption) *downloadOptions {
+	o := &downloadOptions{priority: PriorityNormal}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
 // Downloader implements all the supported operations which used to download files from provider.
 // default max memory usage: defaultDownloadGroutines(default 10) * swapSize(default 2MB) = 20MB
 type Downloader interface {
 	// Download the configuration items from provider.
 	// path is the full path of the file to be downloaded.
-	Download(fileMeta *pbfs.FileMeta, downloadUri string, fileSize uint64, to DownloadTo, b []byte, path string) error
+	Download(fileMeta *pbfs.FileMeta, downloadUri string, fileSize uint64, to DownloadTo, b []byte, path string,
+		opts ...DownloadOption) error
+	// Open the configuration item's content as a verified stream, the caller must close it.
+	Open(fileMeta *pbfs.FileMeta, downloadUri string, fileSize uint64, opts ...DownloadOption) (io.ReadCloser, error)
 }
 
 // Init init the downloader instance.
@@ -55,15 +126,24 @@ func Init(vas *kit.Vas, bizID uint32, token string, upstream upstream.Upstream,
 		return fmt.Errorf("build tls config failed, err: %s", err.Error())
 	}
 
+	o := httpOptions.withDefaults()
+	client, err := newHTTPClient(tlsC, o)
+	if err != nil {
+		return fmt.Errorf("build http client failed, err: %s", err.Error())
+	}
+
 	instance = &downloader{
 		httpDownloader: &httpDownloader{
-			vas:                     vas,
-			token:                   token,
-			bizID:                   bizID,
-			upstream:                upstream,
-			tls:                     tlsC,
-			sem:                     semaphore.NewWeighted(setupMaxHttpDownloadGoroutines()),
-			balanceDownloadByteSize: defaultRangeDownloadByteSize,
+			vas:           vas,
+			token:         token,
+			bizID:         bizID,
+			upstream:      upstream,
+			sem:           newPrioritySemaphore(setupMaxHttpDownloadGoroutines()),
+			client:        client,
+			fileTimeout:   o.FileTimeout,
+			headerTimeout: o.ResponseHeaderTimeout,
+			// the file larger than half of the range part size is downloaded with range policy
+			balanceDownloadByteSize: o.RangePartSize / 2,
 		},
 	}
 
@@ -86,6 +166,7 @@ func Init(vas *kit.Vas, bizID uint32, token string, upstream upstream.Upstream,
 		clusterID:     clusterID,
 		podID:         podID,
 		containerName: containerName,
+		opts:          asyncOptions.withDefaults(),
 	}
 
 	return nil
@@ -97,25 +178,75 @@ type downloader struct {
 	httpDownloader      *httpDownloader
 }
 
+// Download the file, the concurrent downloads of the same content to the same file are merged into one, e.g. the
+// cache filling of the same signature. The downloads to bytes are not merged, since each one is written into the
+// bytes of its caller with its own options.
 func (d *downloader) Download(fileMeta *pbfs.FileMeta, downloadUri string, fileSize uint64, to DownloadTo, b []byte,
-	filePath string) error {
+	filePath string, opts ...DownloadOption) error {
+	signature := fileMeta.CommitSpec.GetContent().GetSignature()
+	if signature == "" || to != DownloadToFile {
+		return d.download(fileMeta, downloadUri, fileSize, to, b, filePath, opts...)
+	}
+
+	// the file downloaded by the first call is verified by the signature, so the others can use it directly
+	key := string(to) + ":" + signature + ":" + filePath
+	downloaded := false
+	_, err, _ := flight.Do(key, func() (interface{}, error) {
+		downloaded = true
+		return nil, d.download(fileMeta, downloadUri, fileSize, to, b, filePath, opts...)
+	})
+	if err != nil {
+		return err
+	}
+	if !downloaded {
+		logger.Debug("the same content is downloading concurrently, share the result", "signature", signature)
+		metrics.DedupSavedBytesCounter.WithLabelValues("concurrent").Add(float64(fileSize))
+		// the bytes are reported to the progress of the first call, report the shared file as a whole
+		if o := newDownloadOptions(opts...); o.progress != nil {
+			o.progress(fileSize)
+		}
+	}
+	return nil
+}
+
+// reportDownloadMetrics reports the bytes and the duration of a file downloaded from the source
+func reportDownloadMetrics(source string, fileSize uint64, cost time.Duration) {
+	metrics.DownloadBytesCounter.WithLabelValues(source).Add(float64(fileSize))
+	metrics.DownloadDurationSeconds.WithLabelValues(source).Observe(cost.Seconds())
+}
+
+// download the file from the node local shared store, or fetch it and add it to the store
+func (d *downloader) download(fileMeta *pbfs.FileMeta, downloadUri string, fileSize uint64, to DownloadTo, b []byte,
+	filePath string, opts ...DownloadOption) error {
+	fetch := func() error {
+		return d.fetch(fileMeta, downloadUri, fileSize, to, b, filePath, opts...)
+	}
+	if store == nil {
+		return fetch()
+	}
+	return store.download(fileMeta, fileSize, to, b, filePath, newDownloadOptions(opts...), fetch)
+}
+
+// fetch the file from the sources, or by the async downloader or the http downloader
+func (d *downloader) fetch(fileMeta *pbfs.FileMeta, downloadUri string, fileSize uint64, to DownloadTo, b []byte,
+	filePath string, opts ...DownloadOption) error {
+	// the sources are requested within the file timeout, same as the http download
+	ctx, cancel := d.httpDownloader.fileContext()
+	ok := downloadFromSources(ctx, fileMeta, fileSize, to, b, filePath, newDownloadOptions(opts...))
+	cancel()
+	if ok {
+		return nil
+	}
 	if !d.enableAsyncDownload {
-		return d.httpDownloader.Download(fileMeta, downloadUri, fileSize, to, b, filePath)
+		return d.httpDownloader.Download(fileMeta, downloadUri, fileSize, to, b, filePath, opts...)
 	}
 	// if download to bytes, use http download
 	if to == DownloadToBytes {
-		return d.httpDownloader.Download(fileMeta, downloadUri, fileSize, to, b, filePath)
+		return d.httpDownloader.Download(fileMeta, downloadUri, fileSize, to, b, filePath, opts...)
 	}
-	// if file size is less than 1MB, use http download
-	if fileSize < defaultAsyncDownloadByteSize {
-		return d.httpDownloader.Download(fileMeta, downloadUri, fileSize, to, b, filePath)
+	// if file size is less than the threshold, use http download
+	if fileSize < d.asyncDownloader.opts.Threshold {
+		return d.httpDownloader.Download(fileMeta, downloadUri, fileSize, to, b, filePath, opts...)
 	}
-	// if file size is larger than 1MB, try async download
-	if err := d.asyncDownloader.Download(fileMeta, downloadUri, fileSize, to, b, filePath); err != nil {
-		logger.Warn("async download file failed, fallback to http download", "file",
-			filepath.Join(fileMeta.ConfigItemSpec.Path, fileMeta.ConfigItemSpec.Name), "err", err.Error())
-		// if async download failed, fallback to http download
-		return d.httpDownloader.Download(fileMeta, downloadUri, fileSize, to, b, filePath)
-	}
-	return nil
+	return d.asyncDownload(fileMeta, downloadUri, fileSize, filePath, opts...)
 }
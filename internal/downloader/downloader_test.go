@@ -0,0 +1,104 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDownloadConcurrent(t *testing.T) {
+	content := []byte("concurrent content")
+	fileMeta := newTestFileMeta(content)
+	tests := []struct {
+		name         string
+		to           DownloadTo
+		wantRequests int32
+	}{
+		// the concurrent downloads to the same file are merged
+		{name: "to file", to: DownloadToFile, wantRequests: 1},
+		// each download to bytes is written into the bytes of its caller
+		{name: "to bytes", to: DownloadToBytes, wantRequests: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the first request is blocked until the second download is started
+			var requests int32
+			requested, release := make(chan struct{}, 2), make(chan struct{})
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				atomic.AddInt32(&requests, 1)
+				requested <- struct{}{}
+				<-release
+				_, _ = w.Write(content)
+			}))
+			t.Cleanup(srv.Close)
+			u := &asyncUpstream{}
+			d := newTestAsyncDownloader(t, u, content, AsyncOptions{})
+			d.enableAsyncDownload = false
+			d.httpDownloader.client = srv.Client()
+			d.httpDownloader.sem = newPrioritySemaphore(2)
+			u.url = srv.URL
+			toFile := filepath.Join(t.TempDir(), "app.conf")
+
+			wg := sync.WaitGroup{}
+			bufs := [][]byte{make([]byte, len(content)), make([]byte, len(content))}
+			progress := make([]uint64, 2)
+			download := func(i int) {
+				defer wg.Done()
+				if err := d.Download(fileMeta, "", uint64(len(content)), tt.to, bufs[i], toFile,
+					WithProgress(func(n uint64) { progress[i] += n })); err != nil {
+					t.Error(err)
+				}
+			}
+			wg.Add(2)
+			go download(0)
+			<-requested
+			go download(1)
+			if tt.wantRequests > 1 {
+				<-requested
+			} else {
+				// wait for the second download to join the first one
+				time.Sleep(50 * time.Millisecond)
+			}
+			close(release)
+			wg.Wait()
+
+			if requests != tt.wantRequests {
+				t.Errorf("requests = %d, want %d", requests, tt.wantRequests)
+			}
+			// the progress is reported to each caller
+			for i, p := range progress {
+				if p != uint64(len(content)) {
+					t.Errorf("progress of download %d = %d, want %d", i, p, len(content))
+				}
+			}
+			if tt.to == DownloadToFile {
+				if got, err := os.ReadFile(toFile); err != nil || string(got) != string(content) {
+					t.Errorf("downloaded file = %q, err: %v, want %q", got, err, content)
+				}
+				return
+			}
+			for i, b := range bufs {
+				if string(b) != string(content) {
+					t.Errorf("bytes of download %d = %q, want %q", i, b, content)
+				}
+			}
+		})
+	}
+}
@@ -20,7 +20,6 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"net"
 	"net/http"
 	"os"
 	"path"
@@ -34,21 +33,25 @@ import (
 	pbfs "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/feed-server"
 	sfs "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/sf-share"
 	"github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/tools"
+	"go.opentelemetry.io/otel/attribute"
 	"golang.org/x/exp/slog"
-	"golang.org/x/sync/semaphore"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 
+	"github.com/TencentBlueKing/bscp-go/internal/tracing"
 	"github.com/TencentBlueKing/bscp-go/internal/upstream"
+	"github.com/TencentBlueKing/bscp-go/internal/util"
 	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+	"github.com/TencentBlueKing/bscp-go/pkg/metrics"
 )
 
 const (
-	// TODO: consider config these options.
-	defaultSwapBufferSize              = 2 * 1024 * 1024
-	defaultRangeDownloadByteSize       = 5 * defaultSwapBufferSize
-	requestAwaitResponseTimeoutSeconds = 10
-	defaultDownloadGroutines           = 10
+	// defaultSwapBufferSize is the buffer size of copying the response body to the file or bytes
+	defaultSwapBufferSize = 2 * 1024 * 1024
+	// defaultRangeDownloadByteSize is the half of the default range part size
+	defaultRangeDownloadByteSize = 5 * defaultSwapBufferSize
+	// defaultDownloadGroutines is the default max goroutines to download file via http
+	defaultDownloadGroutines = 10
 
 	// EnvMaxHTTPDownloadGoroutines is the env name of max goroutines to download file via http.
 	EnvMaxHTTPDownloadGoroutines = "BK_BSCP_MAX_HTTP_DOWNLOAD_GOROUTINES"
@@ -104,8 +107,15 @@ type httpDownloader struct {
 	upstream upstream.Upstream
 	bizID    uint32
 	token    string
-	tls      *tls.Config
-	sem      *semaphore.Weighted
+	sem      *prioritySemaphore
+	// client the http client shared by all the downloads
+	client *http.Client
+	// fileTimeout the total timeout of downloading a file, 0 means no limit
+	fileTimeout time.Duration
+	// headerTimeout the timeout of waiting for the response header
+	headerTimeout time.Duration
+	// throughput the throughput of the http downloads, which estimates the time saved by p2p download
+	throughput throughputMeter
 	// balanceDownloadByteSize determines when to download the file with range policy
 	// if the configuration item's content size is larger than this, then it
 	// will be downloaded with range policy, otherwise, it will be downloaded directly
@@ -115,19 +125,27 @@ type httpDownloader struct {
 
 // Download the configuration items from provider.
 func (dl *httpDownloader) Download(fileMeta *pbfs.FileMeta, downloadUri string, fileSize uint64,
-	to DownloadTo, bytes []byte, toFile string) error {
+	to DownloadTo, bytes []byte, toFile string, opts ...DownloadOption) error {
 
 	start := time.Now()
+	o := newDownloadOptions(opts...)
+	ctx, cancel := dl.fileContext()
+	defer cancel()
 	exec := &execDownload{
-		ctx:          context.Background(),
+		limiter:      o.limiter,
+		priority:     o.priority,
+		progress:     o.progress,
+		ctx:          ctx,
+		traceCtx:     o.traceCtx,
 		dl:           dl,
 		fileMeta:     fileMeta,
 		to:           to,
-		client:       dl.initClient(),
+		client:       dl.client,
 		header:       http.Header{},
 		downloadUris: []string{downloadUri},
 		fileSize:     fileSize,
 	}
+	var atomicFile *util.AtomicFile
 	switch to {
 	case DownloadToFile:
 		if len(toFile) == 0 {
@@ -135,15 +153,33 @@ func (dl *httpDownloader) Download(fileMeta *pbfs.FileMeta, downloadUri string,
 				sfs.SecondaryError{SpecificFailedReason: sfs.FilePathNotFound,
 					Err: fmt.Errorf("target file path is empty")})
 		}
-		file, err := os.OpenFile(toFile, os.O_RDWR|os.O_CREATE|os.O_TRUNC, os.ModePerm)
+		signature := fileMeta.CommitSpec.GetContent().GetSignature()
+		if fileSize > dl.balanceDownloadByteSize && signature != "" {
+			// the big file is downloaded to a partial file with range policy, which can be resumed after
+			// a failure or a process restart
+			part, err := openPartFile(toFile, signature, fileSize, 2*dl.balanceDownloadByteSize)
+			if err != nil {
+				return sfs.WrapPrimaryError(sfs.DownloadFailed,
+					sfs.SecondaryError{SpecificFailedReason: sfs.OpenFileFailed,
+						Err: fmt.Errorf("open the partial file failed, err: %s", err.Error())})
+			}
+			defer part.close()
+			exec.part = part
+			exec.file = part.file
+			break
+		}
+		// download to a temp file beside the target file and rename it after downloaded,
+		// so that the target file is never truncated or partially written
+		var err error
+		atomicFile, err = util.CreateAtomicFile(toFile, 0644)
 		if err != nil {
 			return sfs.WrapPrimaryError(sfs.DownloadFailed,
 				sfs.SecondaryError{SpecificFailedReason: sfs.OpenFileFailed,
 					Err: fmt.Errorf("open the target file failed, err: %s", err.Error())})
 		}
 		logger.Info("open file success", "file", toFile)
-		defer file.Close()
-		exec.file = file
+		defer atomicFile.Abort()
+		exec.file = atomicFile.File
 	case DownloadToBytes:
 		if len(bytes) != int(fileSize) {
 			return sfs.WrapPrimaryError(sfs.DownloadFailed,
@@ -155,56 +191,112 @@ func (dl *httpDownloader) Download(fileMeta *pbfs.FileMeta, downloadUri string,
 	if err := exec.do(); err != nil {
 		return err
 	}
+	if exec.part != nil {
+		if err := exec.part.commit(toFile); err != nil {
+			return sfs.WrapPrimaryError(sfs.DownloadFailed,
+				sfs.SecondaryError{SpecificFailedReason: sfs.ValidateDownloadFailed,
+					Err: fmt.Errorf("commit the downloaded file to %s failed, err: %s", toFile, err.Error())})
+		}
+	}
+	if atomicFile != nil {
+		if err := atomicFile.Commit(); err != nil {
+			return sfs.WrapPrimaryError(sfs.DownloadFailed,
+				sfs.SecondaryError{SpecificFailedReason: sfs.WriteFileFailed,
+					Err: fmt.Errorf("rename the downloaded file to %s failed, err: %s", toFile, err.Error())})
+		}
+	}
 
-	logger.Info("http download file success", "file", toFile, "cost", time.Since(start).String())
+	cost := time.Since(start)
+	dl.throughput.record(fileSize, cost)
+	reportDownloadMetrics("http", fileSize, cost)
+	logger.Info("http download file success", "file", toFile, "cost", cost.String())
 	return nil
 }
 
-func (dl *httpDownloader) initClient() *http.Client {
-	// TODO: find a way to manage these configuration options.
-	transport := &http.Transport{
-		Proxy:               http.ProxyFromEnvironment,
-		TLSHandshakeTimeout: 5 * time.Second,
-		TLSClientConfig:     dl.tls,
-		Dial: (&net.Dialer{
-			Timeout:   5 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).Dial,
-		MaxIdleConnsPerHost: 10,
-		// TODO: confirm this
-		ResponseHeaderTimeout: 15 * time.Minute,
-	}
-
-	return &http.Client{
-		Transport: transport,
-		Timeout:   0,
+// throughputMeter measures the throughput of the http downloads
+type throughputMeter struct {
+	lock  sync.Mutex
+	bytes uint64
+	cost  time.Duration
+}
+
+// record records a download of the file size in the cost
+func (m *throughputMeter) record(fileSize uint64, cost time.Duration) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.bytes += fileSize
+	m.cost += cost
+}
+
+// estimate estimates the time of downloading the file size by http, it returns 0 if nothing is downloaded by http
+func (m *throughputMeter) estimate(fileSize uint64) time.Duration {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.bytes == 0 {
+		return 0
 	}
+	return time.Duration(float64(m.cost) * float64(fileSize) / float64(m.bytes))
 }
 
 type execDownload struct {
-	fileMeta     *pbfs.FileMeta
-	ctx          context.Context
+	fileMeta *pbfs.FileMeta
+	ctx      context.Context
+	// traceCtx carries the parent span of the download, nil if not traced
+	traceCtx     context.Context
 	dl           *httpDownloader
 	to           DownloadTo
 	bytes        []byte
 	file         *os.File
+	part         *partFile
 	client       *http.Client
 	header       http.Header
 	downloadUri  string   // used for every request
 	downloadUris []string // returned by feed server
 	fileSize     uint64
 	waitTimeMil  int64
+	// limiter limits the bandwidth of the download besides the global limiter
+	limiter  *Limiter
+	priority Priority
+	// progress reports the written bytes, nil if not needed
+	progress ProgressFunc
+	// cancel cancels the ctx, only set for the stream which outlives the Open call
+	cancel context.CancelFunc
 }
 
 func (exec *execDownload) do() error {
-	// get file temporary download url from upstream
+	if err := exec.getDownloadURLs(); err != nil {
+		return err
+	}
+
+	var errs []error
+	for _, uri := range exec.downloadUris {
+		exec.downloadUri = uri
+		e := exec.download()
+		if e == nil {
+			return nil
+		}
+		errs = append(errs, e)
+	}
+
+	if len(errs) == 1 {
+		return errs[0]
+	}
+	return fmt.Errorf("master repo err: %v, slave repo err: %v", errs[0], errs[1])
+}
+
+// getDownloadURLs gets the file temporary download urls from upstream
+func (exec *execDownload) getDownloadURLs() error {
 	getUrlReq := &pbfs.GetDownloadURLReq{
 		ApiVersion: sfs.CurrentAPIVersion,
 		BizId:      exec.dl.bizID,
 		FileMeta:   exec.fileMeta,
 		Token:      exec.dl.token,
 	}
-	resp, err := exec.dl.upstream.GetDownloadURL(exec.dl.vas, getUrlReq)
+	ctx, span := tracing.Start(exec.traceCtx, "GetDownloadURL")
+	// the trace context is propagated to upstream server by the grpc metadata
+	vas := &kit.Vas{Rid: exec.dl.vas.Rid, Ctx: tracing.Propagate(exec.dl.vas.Ctx, ctx)}
+	resp, err := exec.dl.upstream.GetDownloadURL(vas, getUrlReq)
+	tracing.End(span, err)
 	if err != nil {
 		if st, ok := status.FromError(err); ok {
 			if st.Code() == codes.PermissionDenied || st.Code() == codes.Unauthenticated {
@@ -238,21 +330,7 @@ func (exec *execDownload) do() error {
 	if len(resp.Urls) == 0 {
 		exec.downloadUris = []string{resp.Url}
 	}
-
-	var errs []error
-	for _, uri := range exec.downloadUris {
-		exec.downloadUri = uri
-		e := exec.download()
-		if e == nil {
-			return nil
-		}
-		errs = append(errs, e)
-	}
-
-	if len(errs) == 1 {
-		return errs[0]
-	}
-	return fmt.Errorf("master repo err: %v, slave repo err: %v", errs[0], errs[1])
+	return nil
 }
 
 func (exec *execDownload) download() error {
@@ -301,7 +379,13 @@ func (exec *execDownload) download() error {
 
 // isProviderSupportRangeDownload return the configuration item's content size if
 // it supports range download.
-func (exec *execDownload) isProviderSupportRangeDownload() (uint64, bool, error) {
+func (exec *execDownload) isProviderSupportRangeDownload() (size uint64, yes bool, err error) {
+	_, span := tracing.Start(exec.traceCtx, "HEAD")
+	defer func() {
+		span.SetAttributes(attribute.Bool("range_supported", yes))
+		tracing.End(span, err)
+	}()
+
 	req, err := http.NewRequest(http.MethodHead, exec.downloadUri, nil)
 	if err != nil {
 		return 0, false, fmt.Errorf("new request failed, err: %s", err.Error())
@@ -309,7 +393,9 @@ func (exec *execDownload) isProviderSupportRangeDownload() (uint64, bool, error)
 
 	req = req.WithContext(exec.ctx)
 	req.Header = exec.header
-	req.Header.Set("Request-Timeout", strconv.Itoa(15))
+	if timeout := exec.dl.headTimeoutSeconds(); timeout > 0 {
+		req.Header.Set("Request-Timeout", strconv.Itoa(timeout))
+	}
 
 	resp, err := exec.client.Do(req)
 	if err != nil {
@@ -343,7 +429,7 @@ func (exec *execDownload) isProviderSupportRangeDownload() (uint64, bool, error)
 		return 0, false, errors.New("can not get the content length form header")
 	}
 
-	size, err := strconv.ParseUint(length[0], 10, 64)
+	size, err = strconv.ParseUint(length[0], 10, 64)
 	if err != nil {
 		return 0, false, fmt.Errorf("parse content length failed, err: %s", err.Error())
 	}
@@ -369,8 +455,9 @@ func (exec *execDownload) downloadDirectlyWithRetry() error {
 		if retry.RetryCount() >= uint32(maxRetryCount) {
 			return fmt.Errorf("exec do download failed, retry count: %d", maxRetryCount)
 		}
-		if err := exec.downloadDirectly(requestAwaitResponseTimeoutSeconds); err != nil {
+		if err := exec.downloadDirectly(); err != nil {
 			logger.Error("exec do download failed", logger.ErrAttr(err), slog.Any("retry_count", retry.RetryCount()))
+			metrics.DownloadRetryCounter.WithLabelValues("http").Inc()
 			retry.Sleep()
 			continue
 		}
@@ -380,19 +467,22 @@ func (exec *execDownload) downloadDirectlyWithRetry() error {
 }
 
 // downloadDirectly download file without range.
-func (exec *execDownload) downloadDirectly(timeoutSeconds int) error {
-	if err := exec.dl.sem.Acquire(exec.ctx, 1); err != nil {
+func (exec *execDownload) downloadDirectly() (err error) {
+	_, span := tracing.Start(exec.traceCtx, "GET")
+	defer func() { tracing.End(span, err) }()
+
+	if err := exec.dl.sem.Acquire(exec.ctx, exec.priority); err != nil {
 		return fmt.Errorf("acquire semaphore failed, err: %s", err.Error())
 	}
 
 	logger.Info("start download file directly",
 		slog.String("file", filepath.Join(exec.fileMeta.ConfigItemSpec.Path, exec.fileMeta.ConfigItemSpec.Name)))
 
-	defer exec.dl.sem.Release(1)
+	defer exec.dl.sem.Release()
 
 	start := time.Now()
 	header := exec.header
-	body, err := exec.doRequest(http.MethodGet, header, timeoutSeconds)
+	body, err := exec.doRequest(http.MethodGet, header)
 	if err != nil {
 		return err
 	}
@@ -431,6 +521,11 @@ func (exec *execDownload) downloadWithRange() error {
 	wg := sync.WaitGroup{}
 
 	for part := 0; part < totalParts; part++ {
+		// the range has been downloaded before the failure or restart
+		if exec.part != nil && exec.part.isCompleted(part) {
+			exec.reportProgress(exec.partSize(part, totalParts, batchSize))
+			continue
+		}
 		start = uint64(part) * batchSize
 
 		if part == totalParts-1 {
@@ -456,6 +551,12 @@ func (exec *execDownload) downloadWithRange() error {
 					logger.ErrAttr(err))
 				return
 			}
+			if exec.part != nil {
+				if err := exec.part.markCompleted(pos); err != nil {
+					logger.Warn("record download file part failed, it will be downloaded again if resumed",
+						slog.Int("part", pos), logger.ErrAttr(err))
+				}
+			}
 
 			logger.Debug("download file range part success",
 				slog.String("file", filepath.Join(exec.fileMeta.ConfigItemSpec.Path, exec.fileMeta.ConfigItemSpec.Name)),
@@ -489,6 +590,7 @@ func (exec *execDownload) downloadOneRangedPartWithRetry(start uint64, end uint6
 		}
 		if err := exec.downloadOneRangedPart(start, end); err != nil {
 			logger.Error("download file part failed", logger.ErrAttr(err), slog.Any("retry_count", retry.RetryCount()))
+			metrics.DownloadRetryCounter.WithLabelValues("http").Inc()
 			retry.Sleep()
 			continue
 		}
@@ -497,15 +599,19 @@ func (exec *execDownload) downloadOneRangedPartWithRetry(start uint64, end uint6
 	return nil
 }
 
-func (exec *execDownload) downloadOneRangedPart(start uint64, end uint64) error {
+func (exec *execDownload) downloadOneRangedPart(start uint64, end uint64) (err error) {
+	_, span := tracing.Start(exec.traceCtx, "range part",
+		attribute.Int64("range_start", int64(start)), attribute.Int64("range_end", int64(end)))
+	defer func() { tracing.End(span, err) }()
+
 	if start > end {
 		return errors.New("invalid start or end to do range download")
 	}
 
-	if err := exec.dl.sem.Acquire(exec.ctx, 1); err != nil {
+	if err := exec.dl.sem.Acquire(exec.ctx, exec.priority); err != nil {
 		return fmt.Errorf("acquire semaphore failed, err: %s", err.Error())
 	}
-	defer exec.dl.sem.Release(1)
+	defer exec.dl.sem.Release()
 
 	header := exec.header.Clone()
 	// set ranged part.
@@ -515,7 +621,7 @@ func (exec *execDownload) downloadOneRangedPart(start uint64, end uint64) error
 		header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
 	}
 
-	body, err := exec.doRequest(http.MethodGet, header, 6*requestAwaitResponseTimeoutSeconds)
+	body, err := exec.doRequest(http.MethodGet, header)
 	if err != nil {
 		return err
 	}
@@ -529,7 +635,7 @@ func (exec *execDownload) downloadOneRangedPart(start uint64, end uint64) error
 	return nil
 }
 
-func (exec *execDownload) doRequest(method string, header http.Header, timeoutSeconds int) (io.ReadCloser, error) {
+func (exec *execDownload) doRequest(method string, header http.Header) (io.ReadCloser, error) {
 	req, err := http.NewRequest(method, exec.downloadUri, nil)
 	if err != nil {
 		return nil, fmt.Errorf("new request failed, err: %s", err.Error())
@@ -538,8 +644,8 @@ func (exec *execDownload) doRequest(method string, header http.Header, timeoutSe
 	req.Header = header
 	// Note: do not use request context to control timeout, the context is
 	// managed by the upper scheduler.
-	if timeoutSeconds > 0 {
-		req.Header.Set("Request-Timeout", strconv.Itoa(timeoutSeconds))
+	if timeout := exec.dl.getTimeoutSeconds(); timeout > 0 {
+		req.Header.Set("Request-Timeout", strconv.Itoa(timeout))
 	}
 
 	req = req.WithContext(exec.ctx)
@@ -578,6 +684,10 @@ func (exec *execDownload) write(body io.ReadCloser, expectSize uint64, start uin
 		// that happen after reading some bytes and also both of the
 		// allowed EOF behaviors.
 		if picked > 0 {
+			// limit the bandwidth by the global and the app limiter, the ranged parts share the limiters
+			if e := exec.waitBandwidth(picked); e != nil {
+				return fmt.Errorf("wait for bandwidth limit failed, err: %s", e.Error())
+			}
 			var cnt int
 			switch exec.to {
 			case DownloadToBytes:
@@ -595,6 +705,7 @@ func (exec *execDownload) write(body io.ReadCloser, expectSize uint64, start uin
 			}
 
 			totalSize += uint64(picked)
+			exec.reportProgress(uint64(picked))
 		}
 
 		if err == nil {
@@ -616,6 +727,29 @@ func (exec *execDownload) write(body io.ReadCloser, expectSize uint64, start uin
 	return nil
 }
 
+// reportProgress reports the written bytes to the progress func
+func (exec *execDownload) reportProgress(n uint64) {
+	if exec.progress != nil && n > 0 {
+		exec.progress(n)
+	}
+}
+
+// partSize returns the byte size of the ranged part
+func (exec *execDownload) partSize(part, totalParts int, batchSize uint64) uint64 {
+	if part == totalParts-1 {
+		return exec.fileSize - uint64(part)*batchSize
+	}
+	return batchSize
+}
+
+// waitBandwidth blocks until n bytes are allowed by the global and the download limiter
+func (exec *execDownload) waitBandwidth(n int) error {
+	if err := globalLimiter.WaitN(exec.ctx, n); err != nil {
+		return err
+	}
+	return exec.limiter.WaitN(exec.ctx, n)
+}
+
 func tlsConfigFromTLSBytes(tlsBytes *sfs.TLSBytes) (*tls.Config, error) {
 	if tlsBytes == nil {
 		return new(tls.Config), nil
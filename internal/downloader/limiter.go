@@ -0,0 +1,196 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"container/list"
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	// globalLimiter limits the bandwidth of all the downloads of the process, nil means no limit
+	globalLimiter *Limiter
+)
+
+// SetBandwidthLimit sets the global bandwidth limit of all the downloads in bytes per second,
+// no limit if bytesPerSecond <= 0.
+func SetBandwidthLimit(bytesPerSecond int64) {
+	globalLimiter = NewLimiter(bytesPerSecond)
+}
+
+// Limiter is a token bucket which limits the download bandwidth in bytes per second, a nil Limiter means no limit.
+type Limiter struct {
+	lock sync.Mutex
+	// rate bytes per second
+	rate float64
+	// burst the max tokens, which allows one second burst
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter creates a limiter with the bandwidth limit in bytes per second, it returns nil if bytesPerSecond <= 0.
+func NewLimiter(bytesPerSecond int64) *Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &Limiter{
+		rate:   float64(bytesPerSecond),
+		burst:  float64(bytesPerSecond),
+		tokens: float64(bytesPerSecond),
+		last:   time.Now(),
+	}
+}
+
+// WaitN blocks until n bytes are allowed to be transferred. The tokens can be borrowed, so that a read larger than
+// the burst just waits longer instead of failing.
+func (l *Limiter) WaitN(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+	l.lock.Lock()
+	now := time.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.lock.Unlock()
+	if wait == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Priority is the download priority of the file, the file with higher priority acquires the download goroutine first
+type Priority int
+
+const (
+	// PriorityNormal is the default priority
+	PriorityNormal Priority = iota
+	// PriorityHigh is for the small text files, which are usually the configs the app needs first
+	PriorityHigh
+	// PriorityLow is for the large files
+	PriorityLow
+
+	priorityCount = 3
+)
+
+// priorityOrder is the order to wake up the waiters
+var priorityOrder = [priorityCount]Priority{PriorityHigh, PriorityNormal, PriorityLow}
+
+// Higher returns whether the priority p is higher than q
+func (p Priority) Higher(q Priority) bool {
+	return p.order() < q.order()
+}
+
+// order returns the index of the priority in the wake up order
+func (p Priority) order() int {
+	for i, o := range priorityOrder {
+		if p == o {
+			return i
+		}
+	}
+	// the invalid priority is treated as normal
+	return PriorityNormal.order()
+}
+
+// prioritySemaphore limits the concurrent downloads, the waiters with higher priority are woken up first,
+// and the waiters with the same priority are woken up in FIFO order.
+type prioritySemaphore struct {
+	lock    sync.Mutex
+	size    int64
+	cur     int64
+	waiters [priorityCount]list.List
+}
+
+// newPrioritySemaphore creates a priority semaphore with the max concurrency
+func newPrioritySemaphore(size int64) *prioritySemaphore {
+	return &prioritySemaphore{size: size}
+}
+
+// Acquire acquires the semaphore with the priority, blocks until acquired or the ctx is done
+func (s *prioritySemaphore) Acquire(ctx context.Context, p Priority) error {
+	if p < 0 || p >= priorityCount {
+		p = PriorityNormal
+	}
+	s.lock.Lock()
+	if s.cur < s.size && s.noWaiters() {
+		s.cur++
+		s.lock.Unlock()
+		return nil
+	}
+	ready := make(chan struct{})
+	elem := s.waiters[p].PushBack(ready)
+	s.lock.Unlock()
+
+	select {
+	case <-ctx.Done():
+		s.lock.Lock()
+		select {
+		case <-ready:
+			// acquired just after the ctx is done, give it back
+			s.cur--
+			s.notifyWaiters()
+		default:
+			s.waiters[p].Remove(elem)
+		}
+		s.lock.Unlock()
+		return ctx.Err()
+	case <-ready:
+		return nil
+	}
+}
+
+// Release releases the semaphore
+func (s *prioritySemaphore) Release() {
+	s.lock.Lock()
+	s.cur--
+	s.notifyWaiters()
+	s.lock.Unlock()
+}
+
+// noWaiters returns whether there is no waiter, must be called with lock held
+func (s *prioritySemaphore) noWaiters() bool {
+	for i := range s.waiters {
+		if s.waiters[i].Len() > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// notifyWaiters wakes up the waiters by priority while the semaphore is available, must be called with lock held
+func (s *prioritySemaphore) notifyWaiters() {
+	for _, p := range priorityOrder {
+		for s.cur < s.size && s.waiters[p].Len() > 0 {
+			elem := s.waiters[p].Front()
+			s.waiters[p].Remove(elem)
+			s.cur++
+			close(elem.Value.(chan struct{}))
+		}
+	}
+}
@@ -0,0 +1,68 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLimiterWaitN(t *testing.T) {
+	var nilLimiter *Limiter
+	if err := nilLimiter.WaitN(context.Background(), 1<<30); err != nil {
+		t.Fatalf("expected no limit for nil limiter, got %v", err)
+	}
+
+	l := NewLimiter(1000)
+	start := time.Now()
+	// the burst is consumed at once, the next 500 bytes wait about 0.5s
+	if err := l.WaitN(context.Background(), 1500); err != nil {
+		t.Fatal(err)
+	}
+	if cost := time.Since(start); cost < 400*time.Millisecond {
+		t.Errorf("expected the bandwidth is limited, cost %s", cost)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.WaitN(ctx, 1000); err == nil {
+		t.Errorf("expected error when the ctx is done")
+	}
+}
+
+func TestPrioritySemaphore(t *testing.T) {
+	sem := newPrioritySemaphore(1)
+	if err := sem.Acquire(context.Background(), PriorityNormal); err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan Priority, 2)
+	for _, p := range []Priority{PriorityLow, PriorityHigh} {
+		p := p
+		go func() {
+			if err := sem.Acquire(context.Background(), p); err == nil {
+				acquired <- p
+				sem.Release()
+			}
+		}()
+		// make sure the low priority waiter is queued first
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	sem.Release()
+	if p := <-acquired; p != PriorityHigh {
+		t.Errorf("expected the high priority waiter acquires first, got %d", p)
+	}
+	<-acquired
+}
@@ -0,0 +1,261 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/tools"
+	"golang.org/x/exp/slog"
+
+	"github.com/TencentBlueKing/bscp-go/internal/util"
+	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+)
+
+const (
+	// partFileSuffix is the suffix of the partial downloaded file, it is treated as a temp file by util.IsTempFile
+	partFileSuffix = ".bscp-tmp-part"
+	// partStateSuffix is the suffix of the sidecar state file of the partial downloaded file
+	partStateSuffix = ".json"
+	// DefaultPartFileExpiration is the expiration of the partial downloaded files which are not resumed
+	DefaultPartFileExpiration = 24 * time.Hour
+)
+
+var (
+	// partLocks makes the same partial file downloaded by only one goroutine at a time
+	partLocks = &pathLocks{locks: make(map[string]*pathLock)}
+)
+
+// pathLocks are the locks of the partial file paths, the lock of a path is deleted once it is not used
+type pathLocks struct {
+	mu    sync.Mutex
+	locks map[string]*pathLock
+}
+
+// pathLock is the lock of a partial file path with the count of its holder and waiters
+type pathLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock locks the path and returns the unlock func
+func (l *pathLocks) lock(path string) func() {
+	l.mu.Lock()
+	pl, ok := l.locks[path]
+	if !ok {
+		pl = new(pathLock)
+		l.locks[path] = pl
+	}
+	pl.refs++
+	l.mu.Unlock()
+
+	pl.Lock()
+	return func() {
+		pl.Unlock()
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		pl.refs--
+		if pl.refs == 0 {
+			delete(l.locks, path)
+		}
+	}
+}
+
+// partState is the sidecar state of the partial downloaded file, it records the completed ranges of the content,
+// and is only valid for the same content and range size.
+type partState struct {
+	// Signature the SHA256 of the content
+	Signature string `json:"signature"`
+	// ByteSize the size of the content
+	ByteSize uint64 `json:"byteSize"`
+	// RangeSize the size of each range
+	RangeSize uint64 `json:"rangeSize"`
+	// Completed the index of the completed ranges
+	Completed []int `json:"completed"`
+}
+
+// partFile is the partial downloaded file which can be resumed after a failure or a process restart
+type partFile struct {
+	path      string
+	statePath string
+	file      *os.File
+	lock      sync.Mutex
+	state     *partState
+	completed map[int]bool
+	// unlock unlocks the partial file path, which is locked until the partial file is closed
+	unlock func()
+	closed bool
+}
+
+// partFilePath returns the partial file path of the content, which is beside the target file and keyed by the
+// signature, so that it can be found again even if the target file name is random.
+func partFilePath(toFile, signature string) string {
+	return filepath.Join(filepath.Dir(toFile), "."+signature+partFileSuffix)
+}
+
+// openPartFile opens the partial downloaded file of the content, the completed ranges are loaded from the state
+// file if it matches the content, otherwise the download starts from zero.
+func openPartFile(toFile, signature string, byteSize, rangeSize uint64) (*partFile, error) {
+	p := &partFile{
+		path:      partFilePath(toFile, signature),
+		statePath: partFilePath(toFile, signature) + partStateSuffix,
+		state: &partState{
+			Signature: signature,
+			ByteSize:  byteSize,
+			RangeSize: rangeSize,
+			Completed: []int{},
+		},
+		completed: make(map[int]bool),
+	}
+	p.unlock = partLocks.lock(p.path)
+
+	if state, ok := p.loadState(); ok {
+		p.state = state
+		for _, part := range state.Completed {
+			p.completed[part] = true
+		}
+		logger.Info("resume partial downloaded file", slog.String("file", p.path),
+			slog.Int("completed_ranges", len(state.Completed)))
+	} else {
+		// the partial file can not be trusted without the matched state, start from zero
+		_ = os.Remove(p.path)
+		_ = os.Remove(p.statePath)
+	}
+
+	file, err := os.OpenFile(p.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		p.unlock()
+		return nil, err
+	}
+	p.file = file
+	return p, nil
+}
+
+// loadState loads the state file, it returns false if the state does not match the content
+func (p *partFile) loadState() (*partState, bool) {
+	b, err := os.ReadFile(p.statePath)
+	if err != nil {
+		return nil, false
+	}
+	state := &partState{}
+	if err := json.Unmarshal(b, state); err != nil {
+		logger.Warn("invalid partial download state, discard it", slog.String("file", p.statePath),
+			logger.ErrAttr(err))
+		return nil, false
+	}
+	if state.Signature != p.state.Signature || state.ByteSize != p.state.ByteSize ||
+		state.RangeSize != p.state.RangeSize {
+		return nil, false
+	}
+	if _, err := os.Stat(p.path); err != nil {
+		return nil, false
+	}
+	return state, true
+}
+
+// isCompleted returns whether the range has been downloaded
+func (p *partFile) isCompleted(part int) bool {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.completed[part]
+}
+
+// markCompleted records the range as downloaded, the content is flushed to disk before the state is written,
+// so that a completed range in the state is always on disk.
+func (p *partFile) markCompleted(part int) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if err := p.file.Sync(); err != nil {
+		return err
+	}
+	p.completed[part] = true
+	p.state.Completed = append(p.state.Completed, part)
+	sort.Ints(p.state.Completed)
+	b, err := json.Marshal(p.state)
+	if err != nil {
+		return err
+	}
+	return util.WriteFileAtomic(p.statePath, b, 0644)
+}
+
+// commit verifies the downloaded content and renames it to the target file
+func (p *partFile) commit(toFile string) error {
+	// the path lock is held until the partial file is renamed
+	defer p.close()
+	if err := p.file.Truncate(int64(p.state.ByteSize)); err != nil {
+		return err
+	}
+	if err := p.file.Sync(); err != nil {
+		return err
+	}
+	if err := p.file.Close(); err != nil {
+		return err
+	}
+	sha, err := tools.FileSHA256(p.path)
+	if err != nil {
+		return err
+	}
+	if sha != p.state.Signature {
+		// the partial file is broken, discard it so that the next download starts from zero
+		_ = os.Remove(p.path)
+		_ = os.Remove(p.statePath)
+		return fmt.Errorf("downloaded file SHA256 %s is not match the expected %s", sha, p.state.Signature)
+	}
+	if err := os.Rename(p.path, toFile); err != nil {
+		return err
+	}
+	_ = os.Remove(p.statePath)
+	return nil
+}
+
+// close closes the partial file, the partial file and its state are kept to resume later
+func (p *partFile) close() {
+	if p.closed {
+		return
+	}
+	p.closed = true
+	_ = p.file.Close()
+	p.unlock()
+}
+
+// CleanupPartFiles removes the partial downloaded files and their states in the dir which are not resumed
+// within the expiration.
+func CleanupPartFiles(dir string, expiration time.Duration) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !(strings.HasSuffix(name, partFileSuffix) ||
+			strings.HasSuffix(name, partFileSuffix+partStateSuffix)) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < expiration {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			logger.Warn("remove stale partial downloaded file failed", slog.String("file", name), logger.ErrAttr(err))
+			continue
+		}
+		logger.Info("remove stale partial downloaded file", slog.String("file", filepath.Join(dir, name)))
+	}
+}
@@ -0,0 +1,157 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPartFileResume(t *testing.T) {
+	dir := t.TempDir()
+	toFile := filepath.Join(dir, "model.bin")
+	content := []byte("0123456789abcdef")
+	sum := sha256.Sum256(content)
+	signature := hex.EncodeToString(sum[:])
+
+	// download the first range and exit
+	part, err := openPartFile(toFile, signature, uint64(len(content)), 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = part.file.WriteAt(content[:8], 0); err != nil {
+		t.Fatal(err)
+	}
+	if err = part.markCompleted(0); err != nil {
+		t.Fatal(err)
+	}
+	part.close()
+
+	// the completed range is resumed
+	part, err = openPartFile(toFile, signature, uint64(len(content)), 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !part.isCompleted(0) || part.isCompleted(1) {
+		t.Fatalf("expected only the first range is completed, got %v", part.state.Completed)
+	}
+	if _, err = part.file.WriteAt(content[8:], 8); err != nil {
+		t.Fatal(err)
+	}
+	if err = part.commit(toFile); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(toFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != string(content) {
+		t.Errorf("expected content %q, got %q", content, b)
+	}
+	if _, err = os.Stat(partFilePath(toFile, signature) + partStateSuffix); !os.IsNotExist(err) {
+		t.Errorf("expected the state file is removed after commit")
+	}
+}
+
+func TestPartFileStateMismatch(t *testing.T) {
+	dir := t.TempDir()
+	toFile := filepath.Join(dir, "model.bin")
+
+	part, err := openPartFile(toFile, "sig", 16, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = part.markCompleted(0); err != nil {
+		t.Fatal(err)
+	}
+	part.close()
+
+	// the range size is changed, the state can not be trusted
+	part, err = openPartFile(toFile, "sig", 16, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer part.close()
+	if part.isCompleted(0) {
+		t.Errorf("expected the download starts from zero when the state does not match")
+	}
+}
+
+func TestPartFileLock(t *testing.T) {
+	dir := t.TempDir()
+	toFile := filepath.Join(dir, "model.bin")
+	part, err := openPartFile(toFile, "sig", 16, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the same partial file is opened by only one goroutine at a time
+	opened := make(chan *partFile)
+	go func() {
+		p, e := openPartFile(toFile, "sig", 16, 8)
+		if e != nil {
+			t.Error(e)
+		}
+		opened <- p
+	}()
+	select {
+	case <-opened:
+		t.Fatal("the partial file is opened while it is locked")
+	case <-time.After(50 * time.Millisecond):
+	}
+	part.close()
+	if p := <-opened; p != nil {
+		p.close()
+	}
+
+	// the lock is deleted once the partial file is closed
+	partLocks.mu.Lock()
+	defer partLocks.mu.Unlock()
+	if _, ok := partLocks.locks[partFilePath(toFile, "sig")]; ok {
+		t.Errorf("the lock of the closed partial file is kept")
+	}
+}
+
+func TestCleanupPartFiles(t *testing.T) {
+	dir := t.TempDir()
+	stale := filepath.Join(dir, ".old"+partFileSuffix)
+	fresh := filepath.Join(dir, ".new"+partFileSuffix)
+	other := filepath.Join(dir, "app.conf")
+	for _, f := range []string{stale, fresh, other} {
+		if err := os.WriteFile(f, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-2 * DefaultPartFileExpiration)
+	if err := os.Chtimes(stale, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(other, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	CleanupPartFiles(dir, DefaultPartFileExpiration)
+
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("expected the stale partial file is removed")
+	}
+	for _, f := range []string{fresh, other} {
+		if _, err := os.Stat(f); err != nil {
+			t.Errorf("expected %s is kept, err: %v", f, err)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+
+	pbfs "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/feed-server"
+	"golang.org/x/exp/slog"
+
+	"github.com/TencentBlueKing/bscp-go/internal/util"
+	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+	"github.com/TencentBlueKing/bscp-go/pkg/source"
+)
+
+var (
+	// sources the content sources tried in order before the feed server, which is set before the downloads start
+	sources []source.Source
+)
+
+// SetSources sets the content sources which are tried in order before downloading from the feed server,
+// the content from any source is verified by the SHA256 signature, and the next source is tried on a miss.
+func SetSources(s []source.Source) {
+	sources = s
+}
+
+// openFromSources opens the verified content from the first source which has it, it returns false on a miss of
+// all the sources. The content is read within the ctx, which should be canceled after the content is closed.
+func openFromSources(ctx context.Context, fileMeta *pbfs.FileMeta, fileSize uint64,
+	o *downloadOptions) (*sourceReader, bool) {
+	signature := fileMeta.CommitSpec.GetContent().GetSignature()
+	if signature == "" {
+		return nil, false
+	}
+	content := sourceContent(fileMeta, fileSize)
+	for _, s := range sources {
+		if r, ok := openSource(ctx, s, content, o); ok {
+			return r, true
+		}
+	}
+	return nil, false
+}
+
+// downloadFromSources downloads the content from the sources in order, a source is skipped if it misses or the
+// content is broken. It returns false if all the sources fail, then the content should be downloaded from the
+// feed server. The sources are requested within the ctx.
+func downloadFromSources(ctx context.Context, fileMeta *pbfs.FileMeta, fileSize uint64, to DownloadTo, b []byte,
+	toFile string, o *downloadOptions) bool {
+	signature := fileMeta.CommitSpec.GetContent().GetSignature()
+	if signature == "" {
+		return false
+	}
+	content := sourceContent(fileMeta, fileSize)
+	for _, s := range sources {
+		r, ok := openSource(ctx, s, content, o)
+		if !ok {
+			continue
+		}
+		err := readTo(r, to, b, toFile)
+		r.Close()
+		if err != nil {
+			logger.Warn("download file from source failed, try the next one", slog.String("source", s.Name()),
+				slog.String("file", content.Path), logger.ErrAttr(err))
+			continue
+		}
+		logger.Info("download file from source success", slog.String("source", s.Name()),
+			slog.String("file", content.Path))
+		return true
+	}
+	return false
+}
+
+// sourceContent returns the content to be opened from the sources
+func sourceContent(fileMeta *pbfs.FileMeta, fileSize uint64) source.Content {
+	return source.Content{
+		Signature: fileMeta.CommitSpec.GetContent().GetSignature(),
+		ByteSize:  fileSize,
+		Path:      path.Join(fileMeta.ConfigItemSpec.Path, fileMeta.ConfigItemSpec.Name),
+	}
+}
+
+// openSource opens the content from the source, the content is verified while it is read
+func openSource(ctx context.Context, s source.Source, content source.Content, o *downloadOptions) (*sourceReader,
+	bool) {
+	r, err := s.Open(ctx, content)
+	if err != nil {
+		if !errors.Is(err, source.ErrNotFound) {
+			logger.Warn("open content from source failed, try the next one", slog.String("source", s.Name()),
+				slog.String("file", content.Path), logger.ErrAttr(err))
+		}
+		return nil, false
+	}
+	logger.Debug("open content from source", slog.String("source", s.Name()), slog.String("file", content.Path))
+	return &sourceReader{ReadCloser: util.NewVerifyReader(r, content.ByteSize, content.Signature), o: o}, true
+}
+
+// readTo reads the verified content to the bytes or to the file
+func readTo(r io.Reader, to DownloadTo, b []byte, toFile string) error {
+	switch to {
+	case DownloadToBytes:
+		if _, err := io.ReadFull(r, b); err != nil {
+			return err
+		}
+		// read to the end, so that the content is verified
+		_, err := io.Copy(io.Discard, r)
+		return err
+	case DownloadToFile:
+		file, err := util.CreateAtomicFile(toFile, 0644)
+		if err != nil {
+			return err
+		}
+		defer file.Abort()
+		if _, err = io.Copy(file, r); err != nil {
+			return err
+		}
+		return file.Commit()
+	default:
+		return fmt.Errorf("unsupported download target %s", to)
+	}
+}
+
+// sourceReader is the verified content of a source, which reports the progress
+type sourceReader struct {
+	io.ReadCloser
+	o *downloadOptions
+	// cancel cancels the context which the content is read within on close, nil if the context is not owned
+	cancel context.CancelFunc
+}
+
+// Read reads the content
+func (r *sourceReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 && r.o.progress != nil {
+		r.o.progress(uint64(n))
+	}
+	return n, err
+}
+
+// Close closes the content and cancels the context which it is read within
+func (r *sourceReader) Close() error {
+	err := r.ReadCloser.Close()
+	if r.cancel != nil {
+		r.cancel()
+	}
+	return err
+}
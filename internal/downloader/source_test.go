@@ -0,0 +1,97 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"testing"
+	"time"
+
+	pbcommit "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/core/commit"
+	pbci "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/core/config-item"
+	pbcontent "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/core/content"
+	pbfs "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/feed-server"
+
+	"github.com/TencentBlueKing/bscp-go/pkg/source"
+)
+
+// ctxSource is the source which serves the content and records the context it is opened within
+type ctxSource struct {
+	content []byte
+	ctx     context.Context
+}
+
+// Name returns the name of the source
+func (s *ctxSource) Name() string {
+	return "ctx"
+}
+
+// Open returns the content
+func (s *ctxSource) Open(ctx context.Context, content source.Content) (io.ReadCloser, error) {
+	s.ctx = ctx
+	return io.NopCloser(bytes.NewReader(s.content)), nil
+}
+
+func TestSourcesFileTimeout(t *testing.T) {
+	content := []byte("source content")
+	sum := sha256.Sum256(content)
+	fileMeta := &pbfs.FileMeta{
+		CommitSpec:     &pbcommit.CommitSpec{Content: &pbcontent.ContentSpec{Signature: hex.EncodeToString(sum[:])}},
+		ConfigItemSpec: &pbci.ConfigItemSpec{Path: "/etc", Name: "app.conf"},
+	}
+	s := &ctxSource{content: content}
+	SetSources([]source.Source{s})
+	t.Cleanup(func() { SetSources(nil) })
+	d := &downloader{httpDownloader: &httpDownloader{fileTimeout: time.Minute}}
+
+	// the download from the sources is limited by the file timeout
+	b := make([]byte, len(content))
+	if err := d.fetch(fileMeta, "", uint64(len(content)), DownloadToBytes, b, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, content) {
+		t.Errorf("downloaded content = %q, want %q", b, content)
+	}
+	if _, ok := s.ctx.Deadline(); !ok {
+		t.Error("the source is opened without the file timeout")
+	}
+	if s.ctx.Err() == nil {
+		t.Error("the context is not canceled after the download")
+	}
+
+	// the stream from the sources is limited by the file timeout until it is closed
+	r, err := d.Open(fileMeta, "", uint64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.ctx.Deadline(); !ok {
+		t.Error("the source is opened without the file timeout")
+	}
+	got, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(got, content) {
+		t.Errorf("streamed content = %q, err: %v", got, err)
+	}
+	if s.ctx.Err() != nil {
+		t.Error("the context is canceled before the stream is closed")
+	}
+	if err = r.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s.ctx.Err() == nil {
+		t.Error("the context is not canceled after the stream is closed")
+	}
+}
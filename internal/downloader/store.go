@@ -0,0 +1,223 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	pbfs "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/feed-server"
+	"golang.org/x/exp/slog"
+
+	"github.com/TencentBlueKing/bscp-go/internal/util"
+	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+	"github.com/TencentBlueKing/bscp-go/pkg/metrics"
+)
+
+const (
+	// storeLockSuffix is the suffix of the lock file of the content in the shared store
+	storeLockSuffix = ".lock"
+	// DefaultSharedStoreExpiration is the expiration of the content in the shared store which is not used
+	DefaultSharedStoreExpiration = 7 * 24 * time.Hour
+)
+
+var (
+	// store the node local shared store, nil if not enabled
+	store *sharedStore
+)
+
+// sharedStore is a content addressed store shared by the clients on the same node, e.g. a hostPath dir mounted by
+// all the sidecars. The content is stored in the file named by its signature, and the download of the same content
+// is serialized by a file lock, so that the first client downloads it and the others reuse the verified content.
+type sharedStore struct {
+	dir string
+}
+
+// SetSharedStore enables the node local shared store in the dir, it is disabled if the dir is empty.
+func SetSharedStore(dir string) error {
+	if dir == "" {
+		store = nil
+		return nil
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	store = &sharedStore{dir: dir}
+	return nil
+}
+
+// download downloads the content by the fetch func only if it is not in the store, the content fetched is added
+// to the store for the other clients.
+func (s *sharedStore) download(fileMeta *pbfs.FileMeta, fileSize uint64, to DownloadTo, b []byte, toFile string,
+	o *downloadOptions, fetch func() error) error {
+	signature := fileMeta.CommitSpec.GetContent().GetSignature()
+	if signature == "" {
+		return fetch()
+	}
+	file := path.Join(fileMeta.ConfigItemSpec.Path, fileMeta.ConfigItemSpec.Name)
+
+	unlock, err := s.lock(signature)
+	if err != nil {
+		logger.Warn("lock the content in shared store failed, download it directly", slog.String("file", file),
+			logger.ErrAttr(err))
+		return fetch()
+	}
+	defer unlock()
+
+	if s.reuse(signature, fileSize, to, b, toFile, o) {
+		logger.Info("reuse the content in shared store", slog.String("file", file), slog.String("dir", s.dir))
+		metrics.DedupSavedBytesCounter.WithLabelValues("node").Add(float64(fileSize))
+		return nil
+	}
+
+	if err := fetch(); err != nil {
+		return err
+	}
+	if err := s.publish(signature, to, b, toFile); err != nil {
+		logger.Warn("add the content to shared store failed", slog.String("file", file), logger.ErrAttr(err))
+	}
+	return nil
+}
+
+// open opens the verified content in the store, it returns false if the content is not in the store
+func (s *sharedStore) open(signature string, fileSize uint64, o *downloadOptions) (io.ReadCloser, bool) {
+	f, err := os.Open(s.blobPath(signature))
+	if err != nil {
+		return nil, false
+	}
+	return &sourceReader{ReadCloser: util.NewVerifyReader(f, fileSize, signature), o: o}, true
+}
+
+// reuse reads the content in the store to the target, a broken content is removed from the store
+func (s *sharedStore) reuse(signature string, fileSize uint64, to DownloadTo, b []byte, toFile string,
+	o *downloadOptions) bool {
+	r, ok := s.open(signature, fileSize, o)
+	if !ok {
+		return false
+	}
+	err := readTo(r, to, b, toFile)
+	r.Close()
+	if err != nil {
+		logger.Warn("the content in shared store is broken, remove it", slog.String("signature", signature),
+			logger.ErrAttr(err))
+		_ = os.Remove(s.blobPath(signature))
+		return false
+	}
+	// refresh the modification time, so that the content in use is not expired
+	now := time.Now()
+	_ = os.Chtimes(s.blobPath(signature), now, now)
+	return true
+}
+
+// publish adds the downloaded content to the store atomically
+func (s *sharedStore) publish(signature string, to DownloadTo, b []byte, toFile string) error {
+	var src io.Reader
+	switch to {
+	case DownloadToBytes:
+		src = bytes.NewReader(b)
+	case DownloadToFile:
+		f, err := os.Open(toFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		src = f
+	}
+	blob, err := util.CreateAtomicFile(s.blobPath(signature), 0644)
+	if err != nil {
+		return err
+	}
+	defer blob.Abort()
+	if _, err = io.Copy(blob, src); err != nil {
+		return err
+	}
+	return blob.Commit()
+}
+
+// lock locks the content exclusively among the clients on the node, it blocks until the lock is acquired
+func (s *sharedStore) lock(signature string) (func(), error) {
+	f, err := os.OpenFile(s.blobPath(signature)+storeLockSuffix, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = util.LockFile(f); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return func() {
+		_ = util.UnlockFile(f)
+		f.Close()
+	}, nil
+}
+
+// blobPath returns the path of the content in the store
+func (s *sharedStore) blobPath(signature string) string {
+	return filepath.Join(s.dir, signature)
+}
+
+// CleanupSharedStore removes the content in the shared store which is not used within the expiration, the content
+// being downloaded or reused by other clients is skipped.
+func CleanupSharedStore(expiration time.Duration) {
+	if store == nil {
+		return
+	}
+	entries, err := os.ReadDir(store.dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || util.IsTempFile(name) {
+			continue
+		}
+		signature := strings.TrimSuffix(name, storeLockSuffix)
+		if signature != name {
+			// the lock file of the content which failed to download
+			if _, err := os.Stat(store.blobPath(signature)); err == nil {
+				continue
+			}
+		}
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < expiration {
+			continue
+		}
+		store.remove(signature)
+	}
+}
+
+// remove removes the content and its lock file if it is not locked by others. A client waiting on the removed lock
+// file may download the content at the same time with another one, which is harmless since the content is added
+// to the store atomically.
+func (s *sharedStore) remove(signature string) {
+	f, err := os.OpenFile(s.blobPath(signature)+storeLockSuffix, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if !util.TryLockFile(f) {
+		return
+	}
+	defer func() { _ = util.UnlockFile(f) }()
+	if err := os.Remove(s.blobPath(signature)); err != nil && !os.IsNotExist(err) {
+		logger.Warn("remove expired content in shared store failed", slog.String("signature", signature),
+			logger.ErrAttr(err))
+		return
+	}
+	_ = os.Remove(f.Name())
+	logger.Info("remove expired content in shared store", slog.String("signature", signature))
+}
@@ -0,0 +1,122 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	pbcommit "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/core/commit"
+	pbci "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/core/config-item"
+	pbcontent "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/core/content"
+	pbfs "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/feed-server"
+)
+
+func TestSharedStoreDownloadOnce(t *testing.T) {
+	dir := t.TempDir()
+	content := []byte("shared content")
+	sum := sha256.Sum256(content)
+	fileMeta := &pbfs.FileMeta{
+		CommitSpec:     &pbcommit.CommitSpec{Content: &pbcontent.ContentSpec{Signature: hex.EncodeToString(sum[:])}},
+		ConfigItemSpec: &pbci.ConfigItemSpec{Path: "/etc", Name: "app.conf"},
+	}
+
+	// the clients on the node share the store dir, each one has its own store and target file
+	var fetched int32
+	clients := 10
+	wg := sync.WaitGroup{}
+	errs := make(chan error, clients)
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s := &sharedStore{dir: filepath.Join(dir, "store")}
+			if err := os.MkdirAll(s.dir, os.ModePerm); err != nil {
+				errs <- err
+				return
+			}
+			toFile := filepath.Join(dir, "client", string(rune('a'+i)), "app.conf")
+			if err := os.MkdirAll(filepath.Dir(toFile), os.ModePerm); err != nil {
+				errs <- err
+				return
+			}
+			errs <- s.download(fileMeta, uint64(len(content)), DownloadToFile, nil, toFile, newDownloadOptions(),
+				func() error {
+					atomic.AddInt32(&fetched, 1)
+					return os.WriteFile(toFile, content, 0644)
+				})
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if fetched != 1 {
+		t.Errorf("expected the content is fetched once, got %d", fetched)
+	}
+	for i := 0; i < clients; i++ {
+		b, err := os.ReadFile(filepath.Join(dir, "client", string(rune('a'+i)), "app.conf"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != string(content) {
+			t.Errorf("expected content %q, got %q", content, b)
+		}
+	}
+}
+
+func TestSharedStoreBrokenContent(t *testing.T) {
+	dir := t.TempDir()
+	content := []byte("shared content")
+	sum := sha256.Sum256(content)
+	signature := hex.EncodeToString(sum[:])
+	fileMeta := &pbfs.FileMeta{
+		CommitSpec:     &pbcommit.CommitSpec{Content: &pbcontent.ContentSpec{Signature: signature}},
+		ConfigItemSpec: &pbci.ConfigItemSpec{Path: "/etc", Name: "app.conf"},
+	}
+	s := &sharedStore{dir: dir}
+	if err := os.WriteFile(s.blobPath(signature), []byte("broken content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the broken content is never reused, it is fetched and replaced
+	b := make([]byte, len(content))
+	fetched := false
+	err := s.download(fileMeta, uint64(len(content)), DownloadToBytes, b, "", newDownloadOptions(), func() error {
+		fetched = true
+		copy(b, content)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fetched {
+		t.Errorf("expected the broken content is fetched again")
+	}
+	stored, err := os.ReadFile(s.blobPath(signature))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stored) != string(content) {
+		t.Errorf("expected the store is repaired, got %q", stored)
+	}
+}
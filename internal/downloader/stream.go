@@ -0,0 +1,134 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sync"
+
+	pbfs "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/feed-server"
+	sfs "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/sf-share"
+	"golang.org/x/exp/slog"
+
+	"github.com/TencentBlueKing/bscp-go/internal/util"
+	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+)
+
+// Open opens the file content as a stream from the shared store or the sources, or by http since the async download
+// can not be streamed. The content is verified by the byte size and the SHA256 signature while it is read, and the
+// last Read returns an error instead of io.EOF if it does not match.
+func (d *downloader) Open(fileMeta *pbfs.FileMeta, downloadUri string, fileSize uint64,
+	opts ...DownloadOption) (io.ReadCloser, error) {
+	o := newDownloadOptions(opts...)
+	if signature := fileMeta.CommitSpec.GetContent().GetSignature(); store != nil && signature != "" {
+		if r, ok := store.open(signature, fileSize, o); ok {
+			return r, nil
+		}
+	}
+	// the file timeout limits the whole stream, the context is canceled when the stream is closed
+	ctx, cancel := d.httpDownloader.fileContext()
+	if r, ok := openFromSources(ctx, fileMeta, fileSize, o); ok {
+		r.cancel = cancel
+		return r, nil
+	}
+	cancel()
+	return d.httpDownloader.Open(fileMeta, downloadUri, fileSize, opts...)
+}
+
+// Open opens the file content as a stream, a download goroutine is held until the stream is closed.
+func (dl *httpDownloader) Open(fileMeta *pbfs.FileMeta, downloadUri string, fileSize uint64,
+	opts ...DownloadOption) (io.ReadCloser, error) {
+	o := newDownloadOptions(opts...)
+	// the file timeout limits the whole stream, the context is canceled when the stream is closed
+	ctx, cancel := dl.fileContext()
+	exec := &execDownload{
+		limiter:      o.limiter,
+		priority:     o.priority,
+		progress:     o.progress,
+		ctx:          ctx,
+		traceCtx:     o.traceCtx,
+		cancel:       cancel,
+		dl:           dl,
+		fileMeta:     fileMeta,
+		client:       dl.client,
+		header:       http.Header{},
+		downloadUris: []string{downloadUri},
+		fileSize:     fileSize,
+	}
+	if err := exec.getDownloadURLs(); err != nil {
+		cancel()
+		return nil, err
+	}
+
+	var errs []error
+	for _, uri := range exec.downloadUris {
+		exec.downloadUri = uri
+		body, err := exec.open()
+		if err == nil {
+			return util.NewVerifyReader(body, fileSize, fileMeta.CommitSpec.GetContent().GetSignature()), nil
+		}
+		errs = append(errs, err)
+	}
+	cancel()
+	return nil, sfs.WrapPrimaryError(sfs.DownloadFailed,
+		sfs.SecondaryError{SpecificFailedReason: sfs.RetryDownloadFailed,
+			Err: fmt.Errorf("open the download stream failed, err: %v", errs)})
+}
+
+// open requests the download uri and returns the response body as a stream
+func (exec *execDownload) open() (io.ReadCloser, error) {
+	if err := exec.dl.sem.Acquire(exec.ctx, exec.priority); err != nil {
+		return nil, fmt.Errorf("acquire semaphore failed, err: %s", err.Error())
+	}
+	body, err := exec.doRequest(http.MethodGet, exec.header)
+	if err != nil {
+		exec.dl.sem.Release()
+		return nil, err
+	}
+	logger.Debug("open download stream success",
+		slog.String("file", path.Join(exec.fileMeta.ConfigItemSpec.Path, exec.fileMeta.ConfigItemSpec.Name)))
+	return &streamBody{ReadCloser: body, exec: exec}, nil
+}
+
+// streamBody is the response body of the download stream, which limits the bandwidth, reports the progress and
+// releases the download goroutine on close
+type streamBody struct {
+	io.ReadCloser
+	exec      *execDownload
+	closeOnce sync.Once
+}
+
+// Read reads the content of the stream
+func (b *streamBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if e := b.exec.waitBandwidth(n); e != nil {
+			return n, fmt.Errorf("wait for bandwidth limit failed, err: %s", e.Error())
+		}
+		b.exec.reportProgress(uint64(n))
+	}
+	return n, err
+}
+
+// Close closes the stream and releases the download goroutine
+func (b *streamBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.closeOnce.Do(func() {
+		b.exec.dl.sem.Release()
+		b.exec.cancel()
+	})
+	return err
+}
@@ -0,0 +1,190 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+const (
+	// DefaultDialTimeout is the default timeout of dialing the repository
+	DefaultDialTimeout = 5 * time.Second
+	// DefaultTLSHandshakeTimeout is the default timeout of the tls handshake with the repository
+	DefaultTLSHandshakeTimeout = 5 * time.Second
+	// DefaultResponseHeaderTimeout is the default timeout of waiting for the response header of the repository
+	DefaultResponseHeaderTimeout = 15 * time.Minute
+	// DefaultIdleConnTimeout is the default timeout of the idle connections kept in the pool
+	DefaultIdleConnTimeout = 90 * time.Second
+	// DefaultMaxIdleConns is the default max idle connections of all the hosts
+	DefaultMaxIdleConns = 100
+	// DefaultMaxIdleConnsPerHost is the default max idle connections of each host
+	DefaultMaxIdleConnsPerHost = 10
+	// DefaultRangePartSize is the default byte size of each part of the range download
+	DefaultRangePartSize = 2 * defaultRangeDownloadByteSize
+)
+
+// HTTPOptions options of downloading from the repository by http, the zero values are replaced by the defaults
+type HTTPOptions struct {
+	// DialTimeout timeout of dialing the repository
+	DialTimeout time.Duration
+	// TLSHandshakeTimeout timeout of the tls handshake
+	TLSHandshakeTimeout time.Duration
+	// ResponseHeaderTimeout timeout of waiting for the response header
+	ResponseHeaderTimeout time.Duration
+	// IdleConnTimeout timeout of the idle connections kept in the pool
+	IdleConnTimeout time.Duration
+	// MaxIdleConns max idle connections of all the hosts
+	MaxIdleConns int
+	// MaxIdleConnsPerHost max idle connections of each host
+	MaxIdleConnsPerHost int
+	// ProxyURL the proxy of the requests, the proxy from the environment is used if it is empty
+	ProxyURL string
+	// EnableHTTP2 is whether try http/2 with the repository
+	EnableHTTP2 bool
+	// CAFile the ca file trusted besides the system ca, used to verify the repository
+	CAFile string
+	// FileTimeout the total timeout of downloading a file, 0 means no limit
+	FileTimeout time.Duration
+	// RangePartSize the byte size of each part of the range download, the file larger than half of it is
+	// downloaded with range policy
+	RangePartSize uint64
+}
+
+var (
+	// httpOptions the http options applied on downloader init
+	httpOptions = HTTPOptions{}
+)
+
+// SetHTTPOptions sets the http options, which should be called before Init
+func SetHTTPOptions(o HTTPOptions) {
+	httpOptions = o
+}
+
+// withDefaults returns the options with the zero values replaced by the defaults
+func (o HTTPOptions) withDefaults() HTTPOptions {
+	if o.DialTimeout <= 0 {
+		o.DialTimeout = DefaultDialTimeout
+	}
+	if o.TLSHandshakeTimeout <= 0 {
+		o.TLSHandshakeTimeout = DefaultTLSHandshakeTimeout
+	}
+	if o.ResponseHeaderTimeout <= 0 {
+		o.ResponseHeaderTimeout = DefaultResponseHeaderTimeout
+	}
+	if o.IdleConnTimeout <= 0 {
+		o.IdleConnTimeout = DefaultIdleConnTimeout
+	}
+	if o.MaxIdleConns <= 0 {
+		o.MaxIdleConns = DefaultMaxIdleConns
+	}
+	if o.MaxIdleConnsPerHost <= 0 {
+		o.MaxIdleConnsPerHost = DefaultMaxIdleConnsPerHost
+	}
+	if o.RangePartSize == 0 {
+		o.RangePartSize = DefaultRangePartSize
+	}
+	return o
+}
+
+// newHTTPClient creates the http client shared by all the downloads, so that the connections are reused
+func newHTTPClient(tlsC *tls.Config, o HTTPOptions) (*http.Client, error) {
+	proxy := http.ProxyFromEnvironment
+	if o.ProxyURL != "" {
+		u, err := url.Parse(o.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy url %s, err: %s", o.ProxyURL, err.Error())
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	if o.CAFile != "" {
+		tlsC = tlsC.Clone()
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		ca, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read ca file %s failed, err: %s", o.CAFile, err.Error())
+		}
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("append ca cert in %s failed", o.CAFile)
+		}
+		tlsC.RootCAs = pool
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   o.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		Proxy:                 proxy,
+		TLSHandshakeTimeout:   o.TLSHandshakeTimeout,
+		TLSClientConfig:       tlsC,
+		DialContext:           dialer.DialContext,
+		MaxIdleConns:          o.MaxIdleConns,
+		MaxIdleConnsPerHost:   o.MaxIdleConnsPerHost,
+		IdleConnTimeout:       o.IdleConnTimeout,
+		ResponseHeaderTimeout: o.ResponseHeaderTimeout,
+		// http/2 is not attempted with the custom tls config and dialer unless it is forced
+		ForceAttemptHTTP2: o.EnableHTTP2,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   0,
+	}, nil
+}
+
+// fileContext returns the context of downloading a file, which is done after the file timeout
+func (dl *httpDownloader) fileContext() (context.Context, context.CancelFunc) {
+	if dl.fileTimeout <= 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), dl.fileTimeout)
+}
+
+// headTimeoutSeconds returns the Request-Timeout of the HEAD request, which waits for the response header within
+// the response header timeout, and is capped by the file timeout
+func (dl *httpDownloader) headTimeoutSeconds() int {
+	timeout := dl.headerTimeout
+	if dl.fileTimeout > 0 && (timeout <= 0 || dl.fileTimeout < timeout) {
+		timeout = dl.fileTimeout
+	}
+	return timeoutSeconds(timeout)
+}
+
+// getTimeoutSeconds returns the Request-Timeout of the GET request, which downloads the content within the file
+// timeout, or the response header timeout if the file timeout is not limited
+func (dl *httpDownloader) getTimeoutSeconds() int {
+	if dl.fileTimeout > 0 {
+		return timeoutSeconds(dl.fileTimeout)
+	}
+	return timeoutSeconds(dl.headerTimeout)
+}
+
+// timeoutSeconds returns the timeout in seconds, rounded up so that a timeout under a second is not dropped
+func timeoutSeconds(d time.Duration) int {
+	if d <= 0 {
+		return 0
+	}
+	return int((d + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,86 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package downloader
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRequestTimeoutSeconds(t *testing.T) {
+	tests := []struct {
+		name          string
+		headerTimeout time.Duration
+		fileTimeout   time.Duration
+		wantHead      int
+		wantGet       int
+	}{
+		{name: "default", headerTimeout: DefaultResponseHeaderTimeout, wantHead: 900, wantGet: 900},
+		{name: "file timeout", headerTimeout: time.Minute, fileTimeout: 10 * time.Minute, wantHead: 60, wantGet: 600},
+		{name: "capped by file timeout", headerTimeout: time.Minute, fileTimeout: 30 * time.Second, wantHead: 30,
+			wantGet: 30},
+		{name: "rounded up", headerTimeout: 1500 * time.Millisecond, wantHead: 2, wantGet: 2},
+		{name: "not limited"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dl := &httpDownloader{headerTimeout: tt.headerTimeout, fileTimeout: tt.fileTimeout}
+			if got := dl.headTimeoutSeconds(); got != tt.wantHead {
+				t.Errorf("headTimeoutSeconds() = %d, want %d", got, tt.wantHead)
+			}
+			if got := dl.getTimeoutSeconds(); got != tt.wantGet {
+				t.Errorf("getTimeoutSeconds() = %d, want %d", got, tt.wantGet)
+			}
+		})
+	}
+}
+
+func TestRequestTimeoutHeader(t *testing.T) {
+	var mu sync.Mutex
+	got := make(map[string]string)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		got[r.Method] = r.Header.Get("Request-Timeout")
+		mu.Unlock()
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Length", "4")
+		_, _ = w.Write([]byte("data"))
+	}))
+	defer srv.Close()
+
+	exec := &execDownload{
+		ctx:         context.Background(),
+		traceCtx:    context.Background(),
+		dl:          &httpDownloader{headerTimeout: time.Minute, fileTimeout: 5 * time.Minute},
+		client:      srv.Client(),
+		header:      http.Header{},
+		downloadUri: srv.URL,
+	}
+	if _, _, err := exec.isProviderSupportRangeDownload(); err != nil {
+		t.Fatal(err)
+	}
+	body, err := exec.doRequest(http.MethodGet, exec.header.Clone())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = body.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	if got[http.MethodHead] != "60" || got[http.MethodGet] != "300" {
+		t.Errorf("Request-Timeout of the requests = %v, want HEAD: 60, GET: 300", got)
+	}
+}
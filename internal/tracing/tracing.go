@@ -0,0 +1,141 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package tracing traces the release applications with OpenTelemetry, it is disabled unless a tracer provider or
+// an exporter is set.
+package tracing
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+)
+
+const (
+	// instrumentationName is the name of the tracer
+	instrumentationName = "github.com/TencentBlueKing/bscp-go"
+	// flushTimeout is the timeout of exporting the spans ended
+	flushTimeout = 5 * time.Second
+)
+
+var (
+	tracer     trace.Tracer = noop.NewTracerProvider().Tracer(instrumentationName)
+	flusher    *sdktrace.TracerProvider
+	propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+)
+
+// SetTracerProvider sets the tracer provider which the spans are created by, it should be called before the
+// release applications.
+func SetTracerProvider(tp trace.TracerProvider) {
+	if tp == nil {
+		return
+	}
+	tracer = tp.Tracer(instrumentationName)
+	flusher = nil
+}
+
+// SetExporter sets a tracer provider which exports the spans to the exporter in batches, the spans are flushed
+// when a release application is done, so the in-memory or the stdout exporter can be used in tests.
+func SetExporter(exporter sdktrace.SpanExporter) {
+	if exporter == nil {
+		return
+	}
+	tp := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter))
+	tracer = tp.Tracer(instrumentationName)
+	flusher = tp
+}
+
+// Start starts a span as the child of the span in ctx, a root span is started if there is none, ctx can be nil.
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return tracer.Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End ends the span, and records the error on it if the err is not nil.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Flush exports the spans ended if the spans are exported by the exporter set, it is a no-op for the tracer
+// provider set, which is flushed by the caller.
+func Flush() {
+	if flusher == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), flushTimeout)
+	defer cancel()
+	if err := flusher.ForceFlush(ctx); err != nil {
+		logger.Warn("flush the trace spans failed", logger.ErrAttr(err))
+	}
+}
+
+// Propagate returns a copy of dst which carries the span of src, the trace context is also injected into the grpc
+// outgoing metadata of dst, so that it is propagated to upstream server.
+func Propagate(dst, src context.Context) context.Context {
+	if src == nil {
+		return dst
+	}
+	span := trace.SpanFromContext(src)
+	if !span.SpanContext().IsValid() {
+		return dst
+	}
+	ctx := trace.ContextWithSpan(dst, span)
+	md, ok := metadata.FromOutgoingContext(ctx)
+	if ok {
+		md = md.Copy()
+	} else {
+		md = metadata.MD{}
+	}
+	propagator.Inject(ctx, metadataCarrier(md))
+	return metadata.NewOutgoingContext(ctx, md)
+}
+
+// metadataCarrier adapts the grpc metadata to the carrier of the propagator
+type metadataCarrier metadata.MD
+
+// Get returns the value of the key
+func (c metadataCarrier) Get(key string) string {
+	values := metadata.MD(c).Get(key)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// Set sets the value of the key
+func (c metadataCarrier) Set(key, value string) {
+	metadata.MD(c).Set(key, value)
+}
+
+// Keys returns all the keys
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
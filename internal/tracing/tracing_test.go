@@ -0,0 +1,70 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package tracing
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestExporter(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	SetExporter(exporter)
+	t.Cleanup(func() { SetTracerProvider(noop.NewTracerProvider()) })
+
+	ctx, root := Start(context.Background(), "release change")
+	_, child := Start(ctx, "download file")
+	End(child, errors.New("download failed"))
+	End(root, nil)
+	Flush()
+
+	spans := exporter.GetSpans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 spans exported after flushed, got %d", len(spans))
+	}
+	if spans[0].Name != "download file" || spans[0].Parent.SpanID() != spans[1].SpanContext.SpanID() {
+		t.Errorf("expected the download span is the child of the release span, got %+v", spans)
+	}
+	if spans[0].Status.Code != codes.Error || len(spans[0].Events) != 1 {
+		t.Errorf("expected the error is recorded on the span, got status %+v", spans[0].Status)
+	}
+}
+
+func TestPropagate(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	SetExporter(exporter)
+	t.Cleanup(func() { SetTracerProvider(noop.NewTracerProvider()) })
+
+	dst := metadata.NewOutgoingContext(context.Background(), metadata.Pairs("sidecar-meta", "meta"))
+	if got := Propagate(dst, context.Background()); got != dst {
+		t.Errorf("expected nothing is propagated without a span")
+	}
+
+	ctx, span := Start(context.Background(), "release change")
+	defer span.End()
+	md, _ := metadata.FromOutgoingContext(Propagate(dst, ctx))
+	if len(md.Get("sidecar-meta")) != 1 {
+		t.Errorf("expected the metadata of dst is kept, got %v", md)
+	}
+	parent := md.Get("traceparent")
+	if len(parent) != 1 || !strings.Contains(parent[0], span.SpanContext().TraceID().String()) {
+		t.Errorf("expected the trace context is injected into the metadata, got %v", md)
+	}
+}
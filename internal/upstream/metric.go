@@ -11,3 +11,43 @@
  */
 
 package upstream
+
+import (
+	"context"
+	"path"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+
+	"github.com/TencentBlueKing/bscp-go/pkg/metrics"
+)
+
+// unaryMetricsInterceptor reports the duration and the error of the unary rpc to upstream server.
+func unaryMetricsInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn,
+	invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	reportRPCMetrics(method, start, err)
+	return err
+}
+
+// streamMetricsInterceptor reports the duration and the error of establishing the stream to upstream server, the
+// messages received on the stream later are not counted.
+func streamMetricsInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string,
+	streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	start := time.Now()
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	reportRPCMetrics(method, start, err)
+	return stream, err
+}
+
+func reportRPCMetrics(method string, start time.Time, err error) {
+	// method is like /pbfs.Upstream/Handshake, only the rpc name is used as the label
+	name := path.Base(method)
+	code := status.Code(err).String()
+	metrics.UpstreamRPCDurationSeconds.WithLabelValues(name, code).Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.UpstreamRPCErrorCounter.WithLabelValues(name, code).Inc()
+	}
+}
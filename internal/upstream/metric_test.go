@@ -0,0 +1,45 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package upstream
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/TencentBlueKing/bscp-go/pkg/metrics"
+)
+
+func TestUnaryMetricsInterceptor(t *testing.T) {
+	method := "/pbfs.Upstream/PullKvMeta"
+	invoker := func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn,
+		opts ...grpc.CallOption) error {
+		return status.Error(codes.Unavailable, "unavailable")
+	}
+	if err := unaryMetricsInterceptor(context.Background(), method, nil, nil, nil, invoker); err == nil {
+		t.Fatalf("expected the error of the invoker is returned")
+	}
+
+	failed := testutil.ToFloat64(metrics.UpstreamRPCErrorCounter.WithLabelValues("PullKvMeta", "Unavailable"))
+	if failed != 1 {
+		t.Errorf("expected 1 error counted by the rpc name and the code, got %v", failed)
+	}
+	calls := testutil.CollectAndCount(metrics.UpstreamRPCDurationSeconds)
+	if calls != 1 {
+		t.Errorf("expected the duration is observed, got %d series", calls)
+	}
+}
@@ -76,6 +76,9 @@ func New(opts ...Option) (Upstream, error) {
 	dialOpts = append(dialOpts, grpc.WithUserAgent("bscp-sdk-golang"))
 	// dial without ssl
 	dialOpts = append(dialOpts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	// report the rpc metrics
+	dialOpts = append(dialOpts, grpc.WithChainUnaryInterceptor(unaryMetricsInterceptor),
+		grpc.WithChainStreamInterceptor(streamMetricsInterceptor))
 
 	uc := &upstreamClient{
 		options: option,
@@ -0,0 +1,127 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// tempFileMark is the mark in the name of the temp files which are renamed to the target files later
+const tempFileMark = ".bscp-tmp-"
+
+// AtomicFile is a temp file created beside the target file, the content is written to the temp file and renamed
+// to the target file on commit, so that the readers never see a truncated or partially written target file.
+type AtomicFile struct {
+	*os.File
+	target string
+	closed bool
+}
+
+// CreateAtomicFile creates a temp file beside the target file with the perm.
+func CreateAtomicFile(target string, perm os.FileMode) (*AtomicFile, error) {
+	file, err := os.CreateTemp(filepath.Dir(target), "."+filepath.Base(target)+tempFileMark+"*")
+	if err != nil {
+		return nil, err
+	}
+	if err = file.Chmod(perm); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return &AtomicFile{File: file, target: target}, nil
+}
+
+// Commit flushes the content to disk and renames the temp file to the target file, the mode and owner should
+// be set on the temp file by the caller before commit, so that they are applied together with the content.
+func (f *AtomicFile) Commit() error {
+	if err := f.Sync(); err != nil {
+		f.Abort()
+		return err
+	}
+	f.closed = true
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), f.target); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	syncDir(filepath.Dir(f.target))
+	return nil
+}
+
+// Abort closes and removes the temp file, the target file is untouched. It does nothing after commit.
+func (f *AtomicFile) Abort() {
+	if f.closed {
+		return
+	}
+	f.closed = true
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// WriteFileAtomic writes the data to the file through a temp file and rename, the mode and owner of the existing
+// file are kept, otherwise the perm is used.
+func WriteFileAtomic(filePath string, data []byte, perm os.FileMode) error {
+	info, err := os.Stat(filePath)
+	if err == nil {
+		perm = info.Mode().Perm()
+	}
+	file, err := CreateAtomicFile(filePath, perm)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err != nil {
+		file.Abort()
+		return err
+	}
+	if info != nil {
+		if uid, gid, ok := fileOwner(info); ok {
+			// the owner can only be kept if we have the privilege, otherwise the file is owned by the current user
+			_ = file.Chown(uid, gid)
+		}
+	}
+	return file.Commit()
+}
+
+// TempFilePath returns a unique temp file path beside the target file, which can be renamed to the target file
+// after the content, mode and owner are all ready.
+func TempFilePath(target string) string {
+	return filepath.Join(filepath.Dir(target),
+		"."+filepath.Base(target)+tempFileMark+strconv.FormatUint(rand.Uint64(), 36))
+}
+
+// IsTempFile returns whether the file name is a temp file created by CreateAtomicFile or TempFilePath,
+// which is left over if the process exits before rename.
+func IsTempFile(name string) bool {
+	return strings.HasPrefix(name, ".") && strings.Contains(name, tempFileMark)
+}
+
+// syncDir flushes the dir entry changes to disk, so that the rename survives a crash
+func syncDir(dir string) {
+	if runtime.GOOS == "windows" {
+		return
+	}
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	_ = d.Sync()
+}
@@ -0,0 +1,121 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestAtomicFile(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "app.conf")
+	if err := os.WriteFile(target, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the target is untouched until commit, and after abort
+	file, err := CreateAtomicFile(target, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = file.WriteString("new"); err != nil {
+		t.Fatal(err)
+	}
+	assertContent(t, target, "old")
+	file.Abort()
+	assertContent(t, target, "old")
+	assertNoTempFiles(t, dir)
+
+	file, err = CreateAtomicFile(target, 0640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = file.WriteString("new"); err != nil {
+		t.Fatal(err)
+	}
+	if err = file.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	// abort after commit does nothing
+	file.Abort()
+	assertContent(t, target, "new")
+	assertNoTempFiles(t, dir)
+	if runtime.GOOS != "windows" {
+		info, err := os.Stat(target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0640 {
+			t.Errorf("expected mode 0640, got %o", info.Mode().Perm())
+		}
+	}
+}
+
+func TestWriteFileAtomicKeepsMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file mode is not supported on windows")
+	}
+	dir := t.TempDir()
+	target := filepath.Join(dir, "app.conf")
+	if err := os.WriteFile(target, []byte("old"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteFileAtomic(target, []byte("new"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	assertContent(t, target, "new")
+	info, err := os.Stat(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected the mode 0600 of the existing file is kept, got %o", info.Mode().Perm())
+	}
+}
+
+func TestIsTempFile(t *testing.T) {
+	tmp := filepath.Base(TempFilePath("/etc/app.conf"))
+	if !IsTempFile(tmp) {
+		t.Errorf("expected %s is a temp file", tmp)
+	}
+	if IsTempFile("app.conf") || IsTempFile(".app.conf") {
+		t.Errorf("expected the normal files are not temp files")
+	}
+}
+
+func assertContent(t *testing.T, filePath, expected string) {
+	t.Helper()
+	b, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != expected {
+		t.Errorf("expected content %q, got %q", expected, string(b))
+	}
+}
+
+func assertNoTempFiles(t *testing.T, dir string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if IsTempFile(entry.Name()) {
+			t.Errorf("unexpected temp file %s", entry.Name())
+		}
+	}
+}
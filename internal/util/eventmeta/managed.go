@@ -0,0 +1,86 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package eventmeta
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	sfs "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/sf-share"
+
+	"github.com/TencentBlueKing/bscp-go/internal/util"
+)
+
+// managedFileName is the file name of the managed files manifest
+const managedFileName = "managed.json"
+
+// ManagedFiles defines the files created by bscp, only these files can be deleted by bscp
+type ManagedFiles struct {
+	// Files the slash separated paths relative to the files dir
+	Files []string `json:"files"`
+	// Targets the absolute paths of the files written to the mapped target paths
+	Targets []string `json:"targets,omitempty"`
+}
+
+// WriteManagedFiles write the managed files manifest to <appDir>/managed.json.
+func WriteManagedFiles(appDir string, managed *ManagedFiles) error {
+	if appDir == "" {
+		return sfs.WrapPrimaryError(sfs.UpdateMetadataFailed,
+			sfs.SecondaryError{SpecificFailedReason: sfs.FilePathNotFound,
+				Err: errors.New("managed files manifest path can not be empty")})
+	}
+	if err := os.MkdirAll(appDir, os.ModePerm); err != nil {
+		return sfs.WrapPrimaryError(sfs.UpdateMetadataFailed,
+			sfs.SecondaryError{SpecificFailedReason: sfs.NewFolderFailed, Err: err})
+	}
+
+	sort.Strings(managed.Files)
+	sort.Strings(managed.Targets)
+	b, err := json.Marshal(managed)
+	if err != nil {
+		return sfs.WrapPrimaryError(sfs.UpdateMetadataFailed,
+			sfs.SecondaryError{SpecificFailedReason: sfs.SerializationFailed,
+				Err: fmt.Errorf("marshal managed files failed, err: %s", err.Error())})
+	}
+	// the manifest is always complete, and never clobbered by another writer's temp file
+	if err := util.WriteFileAtomic(filepath.Join(appDir, managedFileName), b, 0644); err != nil {
+		return sfs.WrapPrimaryError(sfs.UpdateMetadataFailed,
+			sfs.SecondaryError{SpecificFailedReason: sfs.WriteFileFailed,
+				Err: fmt.Errorf("write managed files failed, err: %s", err.Error())})
+	}
+	return nil
+}
+
+// GetManagedFiles get the managed files from <appDir>/managed.json.
+// Return managed files, exists, error
+func GetManagedFiles(appDir string) (*ManagedFiles, bool, error) {
+	b, err := os.ReadFile(filepath.Join(appDir, managedFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, false, sfs.WrapPrimaryError(sfs.UpdateMetadataFailed,
+			sfs.SecondaryError{SpecificFailedReason: sfs.ReadFileFailed, Err: err})
+	}
+	managed := &ManagedFiles{}
+	if err := json.Unmarshal(b, managed); err != nil {
+		return nil, false, sfs.WrapPrimaryError(sfs.UpdateMetadataFailed,
+			sfs.SecondaryError{SpecificFailedReason: sfs.SerializationFailed,
+				Err: fmt.Errorf("unmarshal managed files failed, err: %s", err.Error())})
+	}
+	return managed, true, nil
+}
@@ -0,0 +1,165 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package eventmeta
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	pbci "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/core/config-item"
+	pbhook "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/core/hook"
+	sfs "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/sf-share"
+	"golang.org/x/exp/slog"
+
+	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+)
+
+const (
+	// manifestsDirName is the dir name which holds the manifests of the applied releases
+	manifestsDirName = "manifests"
+	// maxRetainManifests is the max count of release manifests to retain
+	maxRetainManifests = 20
+)
+
+// ReleaseManifest defines the file set of an applied release, which is used to restore the release locally.
+type ReleaseManifest struct {
+	// ReleaseID release id
+	ReleaseID uint32 `json:"releaseID"`
+	// ReleaseName release name
+	ReleaseName string `json:"releaseName"`
+	// Files config item files of the release
+	Files []*ManifestFile `json:"files"`
+	// PostHook post hook of the release
+	PostHook *pbhook.HookSpec `json:"postHook,omitempty"`
+}
+
+// ManifestFile defines a config item file of the release manifest
+type ManifestFile struct {
+	// Name config file name
+	Name string `json:"name"`
+	// Path path of config file
+	Path string `json:"path"`
+	// TextLineBreak text file line break
+	TextLineBreak string `json:"textLineBreak"`
+	// FileMeta config item meta, includes the signature and permission of the file
+	FileMeta *sfs.ConfigItemMetaV1 `json:"fileMeta"`
+	// TargetPath the mapped target path of the file
+	TargetPath string `json:"targetPath,omitempty"`
+	// TargetPermission the permission of the mapped target file
+	TargetPermission *pbci.FilePermission `json:"targetPermission,omitempty"`
+}
+
+// WriteReleaseManifest write the release manifest to <appDir>/manifests/<releaseID>.json,
+// the oldest manifests would be deleted when the count exceeds the limit.
+func WriteReleaseManifest(appDir string, manifest *ReleaseManifest) error {
+	if appDir == "" {
+		return sfs.WrapPrimaryError(sfs.UpdateMetadataFailed,
+			sfs.SecondaryError{SpecificFailedReason: sfs.FilePathNotFound,
+				Err: errors.New("manifest file path can not be empty")})
+	}
+	if manifest == nil {
+		return sfs.WrapPrimaryError(sfs.UpdateMetadataFailed,
+			sfs.SecondaryError{SpecificFailedReason: sfs.DataEmpty,
+				Err: errors.New("manifest is nil")})
+	}
+	dir := filepath.Join(appDir, manifestsDirName)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return sfs.WrapPrimaryError(sfs.UpdateMetadataFailed,
+			sfs.SecondaryError{SpecificFailedReason: sfs.NewFolderFailed, Err: err})
+	}
+
+	b, err := json.Marshal(manifest)
+	if err != nil {
+		return sfs.WrapPrimaryError(sfs.UpdateMetadataFailed,
+			sfs.SecondaryError{SpecificFailedReason: sfs.SerializationFailed,
+				Err: fmt.Errorf("marshal manifest failed, err: %s", err.Error())})
+	}
+	// write to temp file and rename, so that the manifest is always complete
+	manifestPath := manifestFilePath(appDir, manifest.ReleaseID)
+	tmpPath := manifestPath + ".tmp"
+	if err := os.WriteFile(tmpPath, b, 0644); err != nil {
+		return sfs.WrapPrimaryError(sfs.UpdateMetadataFailed,
+			sfs.SecondaryError{SpecificFailedReason: sfs.WriteFileFailed,
+				Err: fmt.Errorf("write manifest failed, err: %s", err.Error())})
+	}
+	if err := os.Rename(tmpPath, manifestPath); err != nil {
+		return sfs.WrapPrimaryError(sfs.UpdateMetadataFailed,
+			sfs.SecondaryError{SpecificFailedReason: sfs.WriteFileFailed,
+				Err: fmt.Errorf("rename manifest failed, err: %s", err.Error())})
+	}
+	logger.Info("write release manifest success", slog.String("file", manifestPath))
+
+	pruneManifests(dir)
+	return nil
+}
+
+// GetReleaseManifest get the release manifest of the release.
+// Return manifest, exists, error
+func GetReleaseManifest(appDir string, releaseID uint32) (*ReleaseManifest, bool, error) {
+	b, err := os.ReadFile(manifestFilePath(appDir, releaseID))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, false, nil
+		}
+		return nil, false, sfs.WrapPrimaryError(sfs.UpdateMetadataFailed,
+			sfs.SecondaryError{SpecificFailedReason: sfs.ReadFileFailed, Err: err})
+	}
+	manifest := &ReleaseManifest{}
+	if err := json.Unmarshal(b, manifest); err != nil {
+		return nil, false, sfs.WrapPrimaryError(sfs.UpdateMetadataFailed,
+			sfs.SecondaryError{SpecificFailedReason: sfs.SerializationFailed,
+				Err: fmt.Errorf("unmarshal manifest failed, err: %s", err.Error())})
+	}
+	return manifest, true, nil
+}
+
+func manifestFilePath(appDir string, releaseID uint32) string {
+	return filepath.Join(appDir, manifestsDirName, strconv.FormatUint(uint64(releaseID), 10)+".json")
+}
+
+// pruneManifests deletes the oldest manifests which exceed the limit
+func pruneManifests(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		logger.Warn("read manifests dir failed", slog.String("dir", dir), logger.ErrAttr(err))
+		return
+	}
+	manifests := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		manifests = append(manifests, info)
+	}
+	if len(manifests) <= maxRetainManifests {
+		return
+	}
+	// the newest manifest first
+	sort.Slice(manifests, func(i, j int) bool {
+		return manifests[i].ModTime().After(manifests[j].ModTime())
+	})
+	for _, info := range manifests[maxRetainManifests:] {
+		if err := os.Remove(filepath.Join(dir, info.Name())); err != nil {
+			logger.Warn("delete old manifest failed", slog.String("file", info.Name()), logger.ErrAttr(err))
+		}
+	}
+}
@@ -40,6 +40,10 @@ type EventMeta struct {
 	ConfigMatches []string `json:"configMatches"`
 	// EventTime event time
 	EventTime string `json:"eventTime"`
+	// ReleaseDir the release dir name under releases dir, only set in versioned layout
+	ReleaseDir string `json:"releaseDir,omitempty"`
+	// RollbackFrom the release id which is rolled back from, only set when the event is a local rollback
+	RollbackFrom uint32 `json:"rollbackFrom,omitempty"`
 }
 
 // EventStatus defines event status
@@ -50,6 +54,9 @@ const (
 	EventStatusSuccess EventStatus = "SUCCESS"
 	// EventStatusFailed event failed
 	EventStatusFailed EventStatus = "FAILED"
+	// EventStatusRolledBack the post hook of the release failed and the previous release is restored, the release
+	// is not applied again until a newer release arrives
+	EventStatusRolledBack EventStatus = "ROLLED_BACK"
 )
 
 // AppendMetadataToFile append metadata to file.
@@ -143,6 +150,48 @@ func GetLatestMetadataFromFile(tempDir string) (*EventMeta, bool, error) {
 	return metadata, true, nil
 }
 
+// GetMetadataHistoryFromFile get all the metadata from file, the oldest first.
+func GetMetadataHistoryFromFile(tempDir string) ([]*EventMeta, error) {
+	if tempDir == "" {
+		return nil, sfs.WrapPrimaryError(sfs.UpdateMetadataFailed,
+			sfs.SecondaryError{SpecificFailedReason: sfs.DataEmpty,
+				Err: errors.New("metadata file path can not be empty")})
+	}
+
+	metaFile, err := os.Open(filepath.Join(tempDir, "metadata.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, sfs.WrapPrimaryError(sfs.UpdateMetadataFailed,
+			sfs.SecondaryError{SpecificFailedReason: sfs.OpenFileFailed,
+				Err: err})
+	}
+	defer metaFile.Close()
+
+	history := make([]*EventMeta, 0)
+	scanner := bufio.NewScanner(metaFile)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		metadata := &EventMeta{}
+		if err := json.Unmarshal(scanner.Bytes(), metadata); err != nil {
+			return nil, sfs.WrapPrimaryError(sfs.UpdateMetadataFailed,
+				sfs.SecondaryError{SpecificFailedReason: sfs.SerializationFailed,
+					Err: fmt.Errorf("unmarshal metadata failed, err: %s", err.Error())})
+		}
+		history = append(history, metadata)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, sfs.WrapPrimaryError(sfs.UpdateMetadataFailed,
+			sfs.SecondaryError{SpecificFailedReason: sfs.ReadFileFailed,
+				Err: err})
+	}
+
+	return history, nil
+}
+
 // ChangeEvent 记录变更事件的结构体
 type ChangeEvent struct {
 	// ReleaseID release id
@@ -67,6 +67,36 @@ func SetFilePermission(filePath string, pm *pbci.FilePermission) error {
 	return nil
 }
 
+// CheckFilePermission checks whether the file mode and owner are the same as the permission.
+func CheckFilePermission(filePath string, pm *pbci.FilePermission) (bool, error) {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return false, err
+	}
+
+	mode, err := strconv.ParseInt("0"+pm.Privilege, 8, 64)
+	if err != nil {
+		return false, fmt.Errorf("parse %s privilege to int failed, err: %v", pm.Privilege, err)
+	}
+	if info.Mode().Perm() != os.FileMode(mode).Perm() {
+		return false, nil
+	}
+
+	uid, gid, ok := fileOwner(info)
+	if !ok {
+		return true, nil
+	}
+	ur, err := user.Lookup(pm.User)
+	if err != nil {
+		return false, fmt.Errorf("look up %s user failed, err: %v", pm.User, err)
+	}
+	gp, err := user.LookupGroup(pm.UserGroup)
+	if err != nil {
+		return false, fmt.Errorf("look up %s group failed, err: %v", pm.UserGroup, err)
+	}
+	return ur.Uid == strconv.Itoa(uid) && gp.Gid == strconv.Itoa(gid), nil
+}
+
 // ConvertTextLineBreak converts the text file line break type.
 func ConvertTextLineBreak(filePath string, lineBreak string) error {
 	// 读取文件内容
@@ -75,6 +105,17 @@ func ConvertTextLineBreak(filePath string, lineBreak string) error {
 		return err
 	}
 
+	updatedContent, err := ConvertLineBreak(content, lineBreak)
+	if err != nil {
+		return err
+	}
+
+	// 写回文件，通过临时文件和重命名写入，避免读到写了一半的文件
+	return WriteFileAtomic(filePath, updatedContent, 0644)
+}
+
+// ConvertLineBreak returns the content with all the line breaks converted to the line break type.
+func ConvertLineBreak(content []byte, lineBreak string) ([]byte, error) {
 	// 将所有换行符规范化为 LF，使函数可重入执行
 	normalizedContent := strings.ReplaceAll(string(content), "\r\n", "\n")
 	normalizedContent = strings.ReplaceAll(normalizedContent, "\r", "\n")
@@ -89,12 +130,9 @@ func ConvertTextLineBreak(filePath string, lineBreak string) error {
 	case "CR":
 		targetLineBreak = "\r"
 	default:
-		return fmt.Errorf("invalid line break type: %s", lineBreak)
+		return nil, fmt.Errorf("invalid line break type: %s", lineBreak)
 	}
 
 	// 替换换行符
-	updatedContent := strings.ReplaceAll(normalizedContent, "\n", targetLineBreak)
-
-	// 写回文件
-	return os.WriteFile(filePath, []byte(updatedContent), 0644)
+	return []byte(strings.ReplaceAll(normalizedContent, "\n", targetLineBreak)), nil
 }
@@ -0,0 +1,45 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"os"
+	"sync"
+)
+
+var (
+	// fileLocks the in process locks of the files, since the file lock is not supported on windows, the files are
+	// only locked among the goroutines in the same process
+	fileLocks sync.Map
+)
+
+// LockFile locks the file in process
+func LockFile(f *os.File) error {
+	l, _ := fileLocks.LoadOrStore(f.Name(), &sync.Mutex{})
+	l.(*sync.Mutex).Lock()
+	return nil
+}
+
+// TryLockFile locks the file in process without blocking
+func TryLockFile(f *os.File) bool {
+	l, _ := fileLocks.LoadOrStore(f.Name(), &sync.Mutex{})
+	return l.(*sync.Mutex).TryLock()
+}
+
+// UnlockFile unlocks the file
+func UnlockFile(f *os.File) error {
+	if l, ok := fileLocks.Load(f.Name()); ok {
+		l.(*sync.Mutex).Unlock()
+	}
+	return nil
+}
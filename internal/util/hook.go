@@ -13,6 +13,7 @@
 package util
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
@@ -20,6 +21,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/dal/table"
 	pbhook "github.com/TencentBlueKing/bk-bcs/bcs-services/bcs-bscp/pkg/protocol/core/hook"
@@ -28,6 +30,7 @@ import (
 
 	"github.com/TencentBlueKing/bscp-go/pkg/env"
 	"github.com/TencentBlueKing/bscp-go/pkg/logger"
+	"github.com/TencentBlueKing/bscp-go/pkg/metrics"
 )
 
 const (
@@ -78,7 +81,9 @@ func ExecuteHook(hook *pbhook.HookSpec, hookType table.HookType,
 	cmd := exec.Command(command, args...)
 	cmd.Dir = appTempDir
 	cmd.Env = append(os.Environ(), hookEnvs...)
+	start := time.Now()
 	out, err := cmd.CombinedOutput()
+	reportHookMetrics(hookType, start, err)
 	if err != nil {
 		return sfs.WrapSecondaryError(sfs.ScriptExecutionFailed,
 			fmt.Errorf("exec %s error: %s, output: %s", hookType.String(), err.Error(), string(out)))
@@ -87,6 +92,21 @@ func ExecuteHook(hook *pbhook.HookSpec, hookType table.HookType,
 	return nil
 }
 
+// reportHookMetrics reports the duration and the exit code of the hook execution, the exit code is -1 if the hook
+// is not started or killed by a signal
+func reportHookMetrics(hookType table.HookType, start time.Time, err error) {
+	exitCode := 0
+	if err != nil {
+		exitCode = -1
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			exitCode = exitErr.ExitCode()
+		}
+	}
+	metrics.HookDurationSeconds.WithLabelValues(hookType.String()).Observe(time.Since(start).Seconds())
+	metrics.HookExecutionCounter.WithLabelValues(hookType.String(), strconv.Itoa(exitCode)).Inc()
+}
+
 func saveContentToFile(workspace string, hook *pbhook.HookSpec, hookType table.HookType, hookEnvs []string) (string,
 	error) {
 	hookDir := filepath.Join(workspace, "hooks")
@@ -0,0 +1,70 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+)
+
+// ErrVerifyFailed is wrapped by the error returned when the content does not match the expected byte size or SHA256
+var ErrVerifyFailed = errors.New("verify content failed")
+
+// verifyReader verifies the byte size and the SHA256 of the content while it is read
+type verifyReader struct {
+	io.ReadCloser
+	hash      hash.Hash
+	size      uint64
+	signature string
+	read      uint64
+}
+
+// NewVerifyReader returns a reader which verifies the byte size and the SHA256 signature of the content on the fly,
+// the final Read returns an error instead of io.EOF if the content does not match, so that the caller never treats
+// a broken content as a complete one. The signature is not verified if it is empty.
+func NewVerifyReader(r io.ReadCloser, size uint64, signature string) io.ReadCloser {
+	return &verifyReader{
+		ReadCloser: r,
+		hash:       sha256.New(),
+		size:       size,
+		signature:  signature,
+	}
+}
+
+// Read reads the content and verifies it at the end
+func (r *verifyReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.read += uint64(n)
+		r.hash.Write(p[:n])
+		if r.read > r.size {
+			return n, fmt.Errorf("%w, the content size is larger than the expected %d", ErrVerifyFailed, r.size)
+		}
+	}
+	if err != io.EOF {
+		return n, err
+	}
+	if r.read != r.size {
+		return n, fmt.Errorf("%w, the content size %d is not match the expected %d", ErrVerifyFailed, r.read,
+			r.size)
+	}
+	if sha := hex.EncodeToString(r.hash.Sum(nil)); r.signature != "" && sha != r.signature {
+		return n, fmt.Errorf("%w, the content SHA256 %s is not match the expected %s", ErrVerifyFailed, sha,
+			r.signature)
+	}
+	return n, io.EOF
+}
@@ -0,0 +1,53 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package util
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestVerifyReader(t *testing.T) {
+	content := "key: value\n"
+	sum := sha256.Sum256([]byte(content))
+	signature := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name      string
+		content   string
+		size      uint64
+		signature string
+		wantErr   bool
+	}{
+		{name: "match", content: content, size: uint64(len(content)), signature: signature},
+		{name: "no signature", content: content, size: uint64(len(content))},
+		{name: "signature mismatch", content: "key: other\n", size: uint64(len(content)), signature: signature,
+			wantErr: true},
+		{name: "truncated", content: content[:4], size: uint64(len(content)), signature: signature, wantErr: true},
+		{name: "too large", content: content + content, size: uint64(len(content)), signature: signature,
+			wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewVerifyReader(io.NopCloser(strings.NewReader(tt.content)), tt.size, tt.signature)
+			defer r.Close()
+			_, err := io.ReadAll(r)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("expected error %v, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
@@ -14,6 +14,8 @@
 package metrics
 
 import (
+	"sync/atomic"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -22,12 +24,13 @@ const (
 )
 
 var (
-	// ReleaseChangeCallbackCounter is the counter of release change event callback
+	// ReleaseChangeCallbackCounter is the counter of release change event callback, the release is not a label since
+	// it is unbounded, see CurrentReleaseID for the release of the app
 	ReleaseChangeCallbackCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
 		Namespace: namespace,
 		Name:      "total_release_change_callback_count",
 		Help:      "the total release change count to callback the release change event",
-	}, []string{"app", "status", "release"})
+	}, []string{"app", "status"})
 
 	// ReleaseChangeCallbackHandingSecond is the histogram of release change event callback handing time(seconds)
 	ReleaseChangeCallbackHandingSecond = prometheus.NewHistogramVec(prometheus.HistogramOpts{
@@ -35,11 +38,294 @@ var (
 		Name:      "release_change_callback_handing_second",
 		Help:      "the handing time(seconds) of release change callback",
 		Buckets:   []float64{1, 2, 5, 10, 30, 60, 120, 300, 600, 1800, 3600},
-	}, []string{"app", "status", "release"})
+	}, []string{"app", "status"})
+
+	// CurrentReleaseID is the release id currently applied of the app
+	CurrentReleaseID = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "current_release_id",
+		Help:      "the release id currently applied of the app",
+	}, []string{"app"})
+
+	// ApplyFileChangeCounter is the counter of the files changed by applying the releases, change is "created",
+	// "updated" or "deleted"
+	ApplyFileChangeCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "total_apply_file_change_count",
+		Help:      "the total count of the files changed by applying the releases",
+	}, []string{"app", "change"})
+
+	// UpstreamRPCDurationSeconds is the histogram of the upstream rpc duration by the method and the status code
+	UpstreamRPCDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_rpc_duration_seconds",
+		Help:      "the duration(seconds) of the upstream rpc",
+		Buckets:   []float64{0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30},
+	}, []string{"method", "code"})
+
+	// UpstreamRPCErrorCounter is the counter of the failed upstream rpc by the method and the status code
+	UpstreamRPCErrorCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "total_upstream_rpc_error_count",
+		Help:      "the total count of the failed upstream rpc",
+	}, []string{"method", "code"})
+
+	// StreamReconnectCounter is the counter of the watch stream reconnects by the reason
+	StreamReconnectCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "total_stream_reconnect_count",
+		Help:      "the total count of the watch stream reconnects",
+	}, []string{"reason"})
+
+	// HeartbeatFailureCounter is the counter of the failed heartbeats sent to the upstream server
+	HeartbeatFailureCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "total_heartbeat_failure_count",
+		Help:      "the total count of the failed heartbeats",
+	})
+
+	// BounceCounter is the counter of the bounce requests received from the upstream server
+	BounceCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "total_bounce_count",
+		Help:      "the total count of the bounce requests received from the upstream server",
+	})
+
+	// DownloadBytesCounter is the counter of the downloaded bytes by the source, source is "http", "p2p" or "cache"
+	DownloadBytesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "total_download_bytes",
+		Help:      "the total bytes of the downloaded files",
+	}, []string{"source"})
+
+	// DownloadDurationSeconds is the histogram of the file download duration by the source
+	DownloadDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "download_duration_seconds",
+		Help:      "the duration(seconds) of downloading a file",
+		Buckets:   []float64{0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60, 300, 600, 1800},
+	}, []string{"source"})
+
+	// DownloadRetryCounter is the counter of the download retries by the source
+	DownloadRetryCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "total_download_retry_count",
+		Help:      "the total count of the download retries",
+	}, []string{"source"})
+
+	// HookDurationSeconds is the histogram of the hook execution duration, hook is "pre_hook" or "post_hook"
+	HookDurationSeconds = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "hook_duration_seconds",
+		Help:      "the duration(seconds) of executing the hook",
+		Buckets:   []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 600},
+	}, []string{"hook"})
+
+	// HookExecutionCounter is the counter of the hook executions by the exit code, which is -1 if the hook is not
+	// started or killed by a signal
+	HookExecutionCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "total_hook_execution_count",
+		Help:      "the total count of the hook executions",
+	}, []string{"hook", "exit_code"})
+
+	// DedupSavedBytesCounter is the counter of the bytes not downloaded since the identical content is shared,
+	// source is "release" for the files of a release with the same content, "concurrent" for the concurrent
+	// downloads of the same content
+	DedupSavedBytesCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "total_dedup_saved_bytes",
+		Help:      "the total bytes not downloaded since the identical content is shared",
+	}, []string{"source"})
+
+	// P2PDownloadAttemptCounter is the counter of the files tried to download by p2p
+	P2PDownloadAttemptCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "total_p2p_download_attempt_count",
+		Help:      "the total count of the files tried to download by p2p",
+	})
+
+	// P2PDownloadSuccessCounter is the counter of the files downloaded by p2p successfully
+	P2PDownloadSuccessCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "total_p2p_download_success_count",
+		Help:      "the total count of the files downloaded by p2p successfully",
+	})
+
+	// P2PDownloadFallbackCounter is the counter of the files downloaded by http since the p2p download failed,
+	// reason is one of "create_task_failed", "query_status_failed", "task_failed", "timeout" and "verify_failed"
+	P2PDownloadFallbackCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "total_p2p_download_fallback_count",
+		Help:      "the total count of the files downloaded by http since the p2p download failed",
+	}, []string{"reason"})
+
+	// P2PDownloadSavedSecondsCounter is the counter of the time saved by p2p download, which is estimated by the
+	// http download throughput
+	P2PDownloadSavedSecondsCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "total_p2p_download_saved_seconds",
+		Help:      "the total seconds saved by p2p download, estimated by the http download throughput",
+	})
+
+	// FileCacheHitCounter is the counter of the lookups of the file cache which hit
+	FileCacheHitCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "total_file_cache_hit_count",
+		Help:      "the total count of the file cache lookups which hit",
+	})
+
+	// FileCacheMissCounter is the counter of the lookups of the file cache which miss
+	FileCacheMissCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "total_file_cache_miss_count",
+		Help:      "the total count of the file cache lookups which miss",
+	})
+
+	// FileCacheEvictionCounter is the counter of the contents evicted from the file cache
+	FileCacheEvictionCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "total_file_cache_eviction_count",
+		Help:      "the total count of the contents evicted from the file cache",
+	})
+
+	// FileCacheCorruptCounter is the counter of the corrupt contents found in the file cache
+	FileCacheCorruptCounter = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "total_file_cache_corrupt_count",
+		Help:      "the total count of the corrupt contents found in the file cache",
+	})
+
+	// FileCacheEntries is the count of the contents in the file cache, which is read from the cache index on scrape
+	FileCacheEntries = newFuncCollector("file_cache_entries",
+		"the count of the contents in the file cache", prometheus.GaugeValue)
+
+	// FileCacheBytes is the byte size of the contents in the file cache, which is read from the cache index on scrape
+	FileCacheBytes = newFuncCollector("file_cache_bytes",
+		"the byte size of the contents in the file cache", prometheus.GaugeValue)
+
+	// KvCacheHits is the count of the kv cache lookups which hit, which is read from the kv cache on scrape
+	KvCacheHits = newFuncCollector("total_kv_cache_hit_count",
+		"the total count of the kv cache lookups which hit", prometheus.CounterValue)
+
+	// KvCacheMisses is the count of the kv cache lookups which miss, which is read from the kv cache on scrape
+	KvCacheMisses = newFuncCollector("total_kv_cache_miss_count",
+		"the total count of the kv cache lookups which miss", prometheus.CounterValue)
+
+	// KvCacheEntries is the count of the kvs in the kv cache, which is read from the kv cache on scrape
+	KvCacheEntries = newFuncCollector("kv_cache_entries",
+		"the count of the kvs in the kv cache", prometheus.GaugeValue)
+
+	// KvCacheCapacityBytes is the byte size of the memory allocated by the kv cache rather than the size of the
+	// stored kvs, which is read from the kv cache on scrape
+	KvCacheCapacityBytes = newFuncCollector("kv_cache_capacity_bytes",
+		"the byte size of the memory allocated by the kv cache", prometheus.GaugeValue)
+
+	// KvCacheEvictionCounter is the counter of the kvs evicted from the kv cache, reason is "no_space" or "expired"
+	KvCacheEvictionCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "total_kv_cache_eviction_count",
+		Help:      "the total count of the kvs evicted from the kv cache",
+	}, []string{"reason"})
+
+	// KvCacheFallbackCounter is the counter of the kv reads served from the cache when feed-server is unavailable,
+	// source is "cache" or "snapshot"
+	KvCacheFallbackCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "total_kv_cache_fallback_count",
+		Help:      "the total count of the kv reads served from the cache when feed-server is unavailable",
+	}, []string{"source"})
 )
 
-// RegisterMetrics will register the mtrics
+// FuncCollector collects a metric whose value is read by the func on scrape, e.g. the statistics kept by the cache,
+// nothing is collected until the func is set
+type FuncCollector struct {
+	desc      *prometheus.Desc
+	valueType prometheus.ValueType
+	fn        atomic.Value
+}
+
+// newFuncCollector creates the func collector of the metric
+func newFuncCollector(name, help string, valueType prometheus.ValueType) *FuncCollector {
+	return &FuncCollector{
+		desc:      prometheus.NewDesc(prometheus.BuildFQName(namespace, "", name), help, nil, nil),
+		valueType: valueType,
+	}
+}
+
+// Set sets the func to read the value on scrape
+func (c *FuncCollector) Set(fn func() float64) {
+	c.fn.Store(fn)
+}
+
+// Describe implements prometheus.Collector
+func (c *FuncCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect implements prometheus.Collector
+func (c *FuncCollector) Collect(ch chan<- prometheus.Metric) {
+	fn, ok := c.fn.Load().(func() float64)
+	if !ok {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(c.desc, c.valueType, fn())
+}
+
+// collectors returns all the metrics of bscp-go
+func collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		ReleaseChangeCallbackCounter,
+		ReleaseChangeCallbackHandingSecond,
+		CurrentReleaseID,
+		ApplyFileChangeCounter,
+		UpstreamRPCDurationSeconds,
+		UpstreamRPCErrorCounter,
+		StreamReconnectCounter,
+		HeartbeatFailureCounter,
+		BounceCounter,
+		DownloadBytesCounter,
+		DownloadDurationSeconds,
+		DownloadRetryCounter,
+		HookDurationSeconds,
+		HookExecutionCounter,
+		DedupSavedBytesCounter,
+		P2PDownloadAttemptCounter,
+		P2PDownloadSuccessCounter,
+		P2PDownloadFallbackCounter,
+		P2PDownloadSavedSecondsCounter,
+		FileCacheHitCounter,
+		FileCacheMissCounter,
+		FileCacheEvictionCounter,
+		FileCacheCorruptCounter,
+		FileCacheEntries,
+		FileCacheBytes,
+		KvCacheHits,
+		KvCacheMisses,
+		KvCacheEntries,
+		KvCacheCapacityBytes,
+		KvCacheEvictionCounter,
+		KvCacheFallbackCounter,
+	}
+}
+
+// RegisterMetrics register all the metrics of bscp-go on the prometheus default registerer
 func RegisterMetrics() {
-	prometheus.MustRegister(ReleaseChangeCallbackCounter)
-	prometheus.MustRegister(ReleaseChangeCallbackHandingSecond)
+	MustRegister(prometheus.DefaultRegisterer)
+}
+
+// Register registers all the metrics of bscp-go on the registerer, e.g. a custom registry of the app which embeds
+// the sdk, it returns the error of the first metric failed to register
+func Register(r prometheus.Registerer) error {
+	for _, c := range collectors() {
+		if err := r.Register(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MustRegister registers all the metrics of bscp-go on the registerer and panics if any of them fails
+func MustRegister(r prometheus.Registerer) {
+	r.MustRegister(collectors()...)
 }
@@ -0,0 +1,71 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package source
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DefaultHTTPTimeout is the request timeout of the http source created without a client
+const DefaultHTTPTimeout = 30 * time.Second
+
+// httpSource is the source of a http server which serves the content by its signature
+type httpSource struct {
+	baseURL string
+	client  *http.Client
+}
+
+// NewHTTP creates a source of the http server which serves the content at <baseURL>/<signature>, e.g. an on-prem
+// http cache or a peer sidecar on the same node. A 404 response is treated as a miss. A client with the
+// DefaultHTTPTimeout is used if the client is nil.
+func NewHTTP(baseURL string, client *http.Client) Source {
+	if client == nil {
+		client = &http.Client{Timeout: DefaultHTTPTimeout}
+	}
+	return &httpSource{baseURL: strings.TrimSuffix(baseURL, "/"), client: client}
+}
+
+// Name returns the name of the source
+func (s *httpSource) Name() string {
+	return "http:" + s.baseURL
+}
+
+// Open requests the content from the http server
+func (s *httpSource) Open(ctx context.Context, content Content) (io.ReadCloser, error) {
+	if err := validateSignature(content.Signature); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.baseURL+"/"+content.Signature, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, ErrNotFound
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("request %s failed, http code: %d", req.URL.Redacted(), resp.StatusCode)
+	}
+}
@@ -0,0 +1,51 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package source
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// localDir is the source of a local mirror directory, the content is stored in the file named by its signature
+type localDir struct {
+	dir string
+}
+
+// NewLocalDir creates a source of the local mirror directory, in which the content is stored in the file named by
+// its SHA256 signature, e.g. <dir>/<signature>, which is the same layout as the file cache.
+func NewLocalDir(dir string) Source {
+	return &localDir{dir: dir}
+}
+
+// Name returns the name of the source
+func (s *localDir) Name() string {
+	return "local:" + s.dir
+}
+
+// Open opens the content file
+func (s *localDir) Open(_ context.Context, content Content) (io.ReadCloser, error) {
+	if err := validateSignature(content.Signature); err != nil {
+		return nil, err
+	}
+	file, err := os.Open(filepath.Join(s.dir, content.Signature))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return file, nil
+}
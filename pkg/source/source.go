@@ -0,0 +1,63 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+// Package source defines the pluggable content sources of the config items.
+// The sources are tried in order before downloading from the feed server signed urls, and the content from any
+// source is verified by the SHA256 signature, so a source needs not to be trusted.
+package source
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// ErrNotFound is returned by a source which does not have the content, the next source is tried then
+var ErrNotFound = errors.New("content not found in the source")
+
+// ErrInvalidSignature is returned by a source if the signature of the content is not a SHA256 in lowercase hex,
+// which is rejected before it is used in a path or a url
+var ErrInvalidSignature = errors.New("invalid content signature")
+
+// Content is the config item content to be opened from a source
+type Content struct {
+	// Signature the SHA256 of the content, which is the key of the content in the sources
+	Signature string
+	// ByteSize the byte size of the content
+	ByteSize uint64
+	// Path the absolute path of the config item, e.g. /etc/app.conf, which is only for logging
+	Path string
+}
+
+// Source is a content source of the config items, e.g. a local mirror directory, an on-prem http cache or
+// a peer sidecar on the same node.
+type Source interface {
+	// Name returns the name of the source, which is used in logs
+	Name() string
+	// Open opens the content, it returns ErrNotFound if the source does not have the content.
+	// The caller must close the returned reader.
+	Open(ctx context.Context, content Content) (io.ReadCloser, error)
+}
+
+// validateSignature returns ErrInvalidSignature if the signature is not 64 lowercase hex characters
+func validateSignature(signature string) error {
+	if len(signature) != 64 {
+		return fmt.Errorf("%w: %q", ErrInvalidSignature, signature)
+	}
+	for _, c := range signature {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return fmt.Errorf("%w: %q", ErrInvalidSignature, signature)
+		}
+	}
+	return nil
+}
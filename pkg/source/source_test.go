@@ -0,0 +1,115 @@
+/*
+ * Tencent is pleased to support the open source community by making Blueking Container Service available.
+ * Copyright (C) 2019 THL A29 Limited, a Tencent company. All rights reserved.
+ * Licensed under the MIT License (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ * http://opensource.org/licenses/MIT
+ * Unless required by applicable law or agreed to in writing, software distributed under
+ * the License is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND,
+ * either express or implied. See the License for the specific language governing permissions and
+ * limitations under the License.
+ */
+
+package source
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// signature returns the SHA256 of the content
+func signature(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// invalidSignatures are the signatures which are not SHA256 in lowercase hex
+var invalidSignatures = []string{"", "sig", "../" + signature("content")[3:], strings.ToUpper(signature("content")),
+	signature("content") + "0", signature("content")[:63] + "/"}
+
+func TestLocalDir(t *testing.T) {
+	dir := t.TempDir()
+	sig := signature("content")
+	if err := os.WriteFile(filepath.Join(dir, sig), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := NewLocalDir(dir)
+	assertOpen(t, s, sig, "content")
+	if _, err := s.Open(context.Background(), Content{Signature: signature("missing")}); !errors.Is(err,
+		ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	for _, invalid := range invalidSignatures {
+		if _, err := s.Open(context.Background(), Content{Signature: invalid}); !errors.Is(err,
+			ErrInvalidSignature) {
+			t.Errorf("expected the signature %q is rejected, got %v", invalid, err)
+		}
+	}
+}
+
+func TestHTTP(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch r.URL.Path {
+		case "/contents/" + signature("content"):
+			_, _ = w.Write([]byte("content"))
+		case "/contents/" + signature("broken"):
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	s := NewHTTP(server.URL+"/contents/", nil)
+	if timeout := s.(*httpSource).client.Timeout; timeout != DefaultHTTPTimeout {
+		t.Errorf("timeout of the default client = %s, want %s", timeout, DefaultHTTPTimeout)
+	}
+	assertOpen(t, s, signature("content"), "content")
+	if _, err := s.Open(context.Background(), Content{Signature: signature("missing")}); !errors.Is(err,
+		ErrNotFound) {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+	if _, err := s.Open(context.Background(), Content{Signature: signature("broken")}); err == nil ||
+		errors.Is(err, ErrNotFound) {
+		t.Errorf("expected a server error, got %v", err)
+	}
+
+	// the invalid signatures are rejected without requesting the server
+	requested := requests
+	for _, invalid := range invalidSignatures {
+		if _, err := s.Open(context.Background(), Content{Signature: invalid}); !errors.Is(err,
+			ErrInvalidSignature) {
+			t.Errorf("expected the signature %q is rejected, got %v", invalid, err)
+		}
+	}
+	if requests != requested {
+		t.Errorf("the server is requested with the invalid signatures")
+	}
+}
+
+func assertOpen(t *testing.T, s Source, signature, expected string) {
+	t.Helper()
+	r, err := s.Open(context.Background(), Content{Signature: signature})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != expected {
+		t.Errorf("expected content %q, got %q", expected, string(b))
+	}
+}